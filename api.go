@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+// api serves the daemon's HTTP API:
+//
+//	GET    /health                         daemon status
+//	GET    /metrics                        metrics in the Prometheus text format
+//	GET    /devices                        discovered devices
+//	GET    /external-ip                    external IP of the device
+//	GET    /mappings                       managed mappings
+//	POST   /mappings                       add a managed mapping
+//	DELETE /mappings/{protocol}/{port}     remove a managed mapping
+//	POST   /mappings/{protocol}/{port}/renew  renew a managed mapping
+//
+// When a token is set, requests must carry it as "Authorization: Bearer <token>".
+type api struct {
+	token   string
+	clients clients
+	client  *client
+	manager *upnp.Manager
+	metrics *metrics
+}
+
+type apiDevice struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	UUID string `json:"uuid"`
+}
+
+type apiMapping struct {
+	Protocol    string     `json:"protocol"`
+	External    int        `json:"external"`
+	Internal    int        `json:"internal"`
+	Description string     `json:"description"`
+	Lease       int        `json:"lease"`
+	Granted     int        `json:"granted,omitempty"`
+	Renewed     time.Time  `json:"renewed,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Orphaned    bool       `json:"orphaned,omitempty"`
+	AnyPort     bool       `json:"anyPort,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newAPIMapping(m upnp.ManagedMapping) apiMapping {
+	result := apiMapping{
+		Protocol:    strings.ToLower(string(m.Protocol)),
+		External:    m.ExternalPort,
+		Internal:    m.InternalPort,
+		Description: m.Description,
+		Lease:       int(m.Lease.Seconds()),
+		Granted:     int(m.Granted.Seconds()),
+		Renewed:     m.Renewed,
+		Orphaned:    m.Orphaned,
+		AnyPort:     m.AnyPort,
+	}
+	if !m.ExpiresAt.IsZero() {
+		result.ExpiresAt = &m.ExpiresAt
+	}
+	if m.LastError != nil {
+		result.Error = m.LastError.Error()
+	}
+	return result
+}
+
+func (a *api) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(a.token)) == 1
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, apiError{"invalid or missing token"})
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "health" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":   "ok",
+			"device":   a.client.id,
+			"mappings": len(a.manager.Mappings()),
+		})
+	case len(path) == 1 && path[0] == "metrics" && r.Method == "GET":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		a.metrics.write(w, a.manager)
+	case len(path) == 1 && path[0] == "devices" && r.Method == "GET":
+		devices := []apiDevice{}
+		for _, c := range a.clients {
+			devices = append(devices, apiDevice{c.id, c.name, c.ip, c.igd.UUID()})
+		}
+		writeJSON(w, http.StatusOK, devices)
+	case len(path) == 1 && path[0] == "external-ip" && r.Method == "GET":
+		ip, err := a.manager.IGD().GetExternalIPAddress(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"ip": ip.String()})
+	case len(path) == 1 && path[0] == "mappings" && r.Method == "GET":
+		mappings := []apiMapping{}
+		for _, m := range a.manager.Mappings() {
+			mappings = append(mappings, newAPIMapping(m))
+		}
+		writeJSON(w, http.StatusOK, mappings)
+	case len(path) == 1 && path[0] == "mappings" && r.Method == "POST":
+		var body apiMapping
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		m, err := daemonMapping{Protocol: body.Protocol, External: body.External, Internal: body.Internal, Description: body.Description,
+			Lease: time.Duration(body.Lease) * time.Second, AnyPort: body.AnyPort}.managed()
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		added, err := a.manager.Map(m)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, newAPIMapping(added))
+	case len(path) >= 3 && path[0] == "mappings":
+		t := upnp.Protocol(strings.ToUpper(path[1]))
+		port, err := strconv.Atoi(path[2])
+		if err != nil || !valid(port) {
+			writeJSON(w, http.StatusBadRequest, apiError{"invalid port '" + path[2] + "'"})
+			return
+		}
+		var existing *upnp.ManagedMapping
+		for _, m := range a.manager.Mappings() {
+			if m.Protocol == t && m.ExternalPort == port {
+				existing = &m
+				break
+			}
+		}
+		if existing == nil {
+			writeJSON(w, http.StatusNotFound, apiError{"mapping is not managed"})
+			return
+		}
+		switch {
+		case len(path) == 3 && r.Method == "DELETE":
+			if err := a.manager.Remove(t, port); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(path) == 4 && path[3] == "renew" && r.Method == "POST":
+			if err := a.manager.Add(*existing); err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newAPIMapping(*existing))
+		default:
+			writeJSON(w, http.StatusNotFound, apiError{"not found"})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+	}
+}
+
+// Write err with a status code classifying it, like the CLI's exit codes.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	switch exitCode(err) {
+	case exitConflict:
+		status = http.StatusConflict
+	case exitNotAuthorized:
+		status = http.StatusForbidden
+	case exitUnsupported:
+		status = http.StatusNotImplemented
+	}
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
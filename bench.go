@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpBench = `
+	Usage: upnpctl [-v] bench [options]
+
+	measures how long the device takes to be discovered,
+	to serve its description and to answer SOAP actions,
+	printing percentiles for each over a number of runs.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --count, number of runs of each action
+	  (defaults to 20)
+
+	  --discover, number of discovery rounds, each of
+	  which takes several seconds (defaults to 1)
+
+	  --write, also measure adding and removing a
+	  temporary port mapping
+` + helpFooter
+
+type samples struct {
+	name      string
+	durations []time.Duration
+	errors    int
+	lastErr   error
+}
+
+func (s *samples) time(fn func() error) {
+	t0 := time.Now()
+	err := fn()
+	d := time.Since(t0)
+	if err != nil {
+		s.errors++
+		s.lastErr = err
+		return
+	}
+	s.durations = append(s.durations, d)
+}
+
+func (s *samples) percentile(p float64) time.Duration {
+	if len(s.durations) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(s.durations)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return s.durations[i]
+}
+
+func (s *samples) print() {
+	sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+	total := len(s.durations) + s.errors
+	if len(s.durations) == 0 {
+		fmt.Printf("  %-28s %d/%d failed", s.name, s.errors, total)
+	} else {
+		fmt.Printf("  %-28s p50 %-8s p90 %-8s p99 %-8s max %-8s %d/%d failed", s.name,
+			round(s.percentile(50)), round(s.percentile(90)), round(s.percentile(99)),
+			round(s.durations[len(s.durations)-1]), s.errors, total)
+	}
+	if s.lastErr != nil {
+		fmt.Printf(" (%s)", s.lastErr)
+	}
+	fmt.Println()
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
+
+func benchCmd(args []string) {
+	f := flag.NewFlagSet(string(bench), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpBench)
+	}
+	id := f.String("id", "", "")
+	count := f.Int("count", 20, "")
+	discoveries := f.Int("discover", 1, "")
+	write := f.Bool("write", false, "")
+	f.Parse(args)
+
+	ctx := context.Background()
+
+	if *count < 1 {
+		usage("Invalid count")
+	}
+
+	discovery := &samples{name: "discovery"}
+	for i := 0; i < *discoveries; i++ {
+		discovery.time(func() error {
+			if len(upnp.Discover(intranet)) == 0 {
+				return fmt.Errorf("no devices found")
+			}
+			return nil
+		})
+	}
+
+	c := selectClient(*id)
+	fmt.Printf("Benchmarking %s (%s) with %d runs...\n", c.name, c.ip, *count)
+
+	description := &samples{name: "description fetch"}
+	externalIP := &samples{name: "GetExternalIPAddress"}
+	list := &samples{name: "list mappings"}
+	add := &samples{name: "AddPortMapping"}
+	del := &samples{name: "DeletePortMapping"}
+
+	const port = 54321
+	for i := 0; i < *count; i++ {
+		description.time(func() error {
+			_, err := c.igd.Client().LoadIGD(ctx, c.igd.URL().String())
+			return err
+		})
+		externalIP.time(func() error {
+			_, err := c.igd.GetExternalIPAddress(ctx)
+			return err
+		})
+		list.time(func() error {
+			_, err := c.igd.GetPortMappings(ctx)
+			return err
+		})
+		if *write {
+			add.time(func() error {
+				return c.igd.AddPortMapping(ctx, upnp.TCP, port, port, "upnpctl v"+VERSION+" bench", 0)
+			})
+			del.time(func() error {
+				return c.igd.DeletePortMapping(ctx, upnp.TCP, port)
+			})
+		}
+	}
+
+	results := []*samples{discovery, description, externalIP, list}
+	if *write {
+		results = append(results, add, del)
+	}
+	for _, s := range results {
+		s.print()
+	}
+}
@@ -0,0 +1,132 @@
+//go:build integration
+
+// The integration harness: runs the discover, map, list, renew and delete cycle against a
+// real InternetGatewayDevice, by default the miniupnpd run.sh starts in a network namespace.
+// It exits with status 1 at the first step which fails.
+//
+//	sudo contrib/netns/run.sh
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"upnpctl/upnp"
+)
+
+func main() {
+	externalIP := flag.String("external-ip", "", "the external IP address the IGD must report, any when empty")
+	port := flag.Int("port", 40123, "the external port of the test mapping")
+	search := flag.String("search", "", "the address to send search requests to, the SSDP multicast address when empty")
+	verbose := flag.Bool("v", false, "log the SOAP traffic")
+	flag.Parse()
+
+	c := &upnp.Client{
+		DiscoveryTimeout: 2 * time.Second,
+		RequestTimeout:   5 * time.Second,
+		VerifyMappings:   true,
+		SearchAddr:       *search,
+	}
+	if *verbose {
+		c.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	ctx := context.Background()
+
+	var igd upnp.IGD
+	step("discover", func() error {
+		igds := c.Discover()
+		if len(igds) == 0 {
+			return errors.New("no IGD found")
+		}
+		igd = igds[0]
+		fmt.Printf("  found %s at %s\n", igd.FriendlyIdentifier(), igd.URL())
+		return nil
+	})
+
+	step("external IP", func() error {
+		ip, err := igd.GetExternalIPAddress(ctx)
+		if err != nil {
+			return err
+		}
+		if *externalIP != "" && !ip.Equal(net.ParseIP(*externalIP)) {
+			return fmt.Errorf("external IP is %s, want %s", ip, *externalIP)
+		}
+		fmt.Printf("  %s\n", ip)
+		return nil
+	})
+
+	m := upnp.PortMapping{
+		ExternalPort: *port,
+		Protocol:     upnp.TCP,
+		InternalPort: *port,
+		Enabled:      true,
+		Description:  "upnpctl integration",
+		Lease:        10 * time.Minute,
+	}
+	step("map", func() error {
+		return igd.Add(ctx, m)
+	})
+
+	var first upnp.PortMapping
+	step("list", func() error {
+		mappings, err := igd.GetPortMappings(ctx)
+		if err != nil {
+			return err
+		}
+		for _, got := range mappings {
+			if got.ExternalPort == m.ExternalPort && got.Protocol == m.Protocol {
+				if got.InternalPort != m.InternalPort || got.Description != m.Description {
+					return fmt.Errorf("mapping listed as %+v", got)
+				}
+				first = got
+				return nil
+			}
+		}
+		return fmt.Errorf("mapping missing from %d listed", len(mappings))
+	})
+
+	step("renew", func() error {
+		// Let the lease run down a little, so the renewal shows.
+		time.Sleep(2 * time.Second)
+		if err := igd.Add(ctx, m); err != nil {
+			return err
+		}
+		got, err := igd.GetSpecificPortMappingEntry(ctx, m.Protocol, m.ExternalPort)
+		if err != nil {
+			return err
+		}
+		if first.Lease > 0 && got.Lease <= first.Lease-time.Second {
+			return fmt.Errorf("lease %s after renewal, was %s", got.Lease, first.Lease)
+		}
+		return nil
+	})
+
+	step("delete", func() error {
+		if err := igd.Delete(ctx, m); err != nil {
+			return err
+		}
+		_, err := igd.GetSpecificPortMappingEntry(ctx, m.Protocol, m.ExternalPort)
+		if !upnp.IsErrorCode(err, upnp.ErrCodeNoSuchEntry, upnp.ErrCodeNoSuchEntryInArray) {
+			return fmt.Errorf("mapping still there after deleting it (%v)", err)
+		}
+		return nil
+	})
+
+	fmt.Println("PASS")
+}
+
+// Run the step f, exiting when it fails.
+func step(name string, f func() error) {
+	start := time.Now()
+	if err := f(); err != nil {
+		fmt.Printf("FAIL %s: %s\n", name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("ok   %s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+}
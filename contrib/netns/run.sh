@@ -0,0 +1,91 @@
+#!/bin/sh
+# Run the integration harness against miniupnpd, isolated in network namespaces:
+#
+#   upnpctl-lan (192.168.77.2) --- (192.168.77.1) upnpctl-router (203.0.113.2) --- wan0
+#
+# miniupnpd runs in the router namespace with its iptables backend; the harness runs in
+# the LAN namespace, discovering it by multicast like a real host would.
+#
+# Needs root, iproute2, iptables and miniupnpd (e.g. apt-get install miniupnpd-iptables).
+# Extra arguments are passed to the harness, e.g. -v to log the SOAP traffic.
+set -eu
+
+cd "$(dirname "$0")/../.."
+
+LAN=upnpctl-lan
+ROUTER=upnpctl-router
+
+delete_namespaces() {
+	ip netns del "$LAN" 2>/dev/null || true
+	ip netns del "$ROUTER" 2>/dev/null || true
+}
+# Left over by an aborted run.
+delete_namespaces
+
+WORK=$(mktemp -d)
+cleanup() {
+	[ -f "$WORK/miniupnpd.pid" ] && kill "$(cat "$WORK/miniupnpd.pid")" 2>/dev/null || true
+	delete_namespaces
+	rm -rf "$WORK"
+}
+trap cleanup EXIT INT TERM
+
+go build -tags integration -o "$WORK/harness" ./contrib/netns
+
+ip netns add "$LAN"
+ip netns add "$ROUTER"
+
+ip link add lan0 netns "$LAN" type veth peer name rtr0 netns "$ROUTER"
+ip -n "$LAN" addr add 192.168.77.2/24 dev lan0
+ip -n "$LAN" link set lan0 up
+ip -n "$LAN" link set lo up
+ip -n "$LAN" route add default via 192.168.77.1
+ip -n "$LAN" route add 239.0.0.0/8 dev lan0
+
+ip -n "$ROUTER" addr add 192.168.77.1/24 dev rtr0
+ip -n "$ROUTER" link set rtr0 up
+ip -n "$ROUTER" link set lo up
+ip -n "$ROUTER" link add wan0 type dummy
+ip -n "$ROUTER" addr add 203.0.113.2/24 dev wan0
+ip -n "$ROUTER" link set wan0 up
+ip -n "$ROUTER" route add default via 203.0.113.1
+ip -n "$ROUTER" route add 239.0.0.0/8 dev rtr0
+ip netns exec "$ROUTER" sysctl -qw net.ipv4.ip_forward=1
+
+# The chains miniupnpd adds its rules to.
+ip netns exec "$ROUTER" sh -e <<EOF
+iptables -t nat -N MINIUPNPD
+iptables -t nat -A PREROUTING -i wan0 -j MINIUPNPD
+iptables -t nat -N MINIUPNPD-POSTROUTING
+iptables -t nat -A POSTROUTING -o wan0 -j MINIUPNPD-POSTROUTING
+iptables -t filter -N MINIUPNPD
+iptables -t filter -A FORWARD -i wan0 -o rtr0 -j MINIUPNPD
+EOF
+
+cat >"$WORK/miniupnpd.conf" <<EOF
+ext_ifname=wan0
+listening_ip=rtr0
+port=5000
+enable_natpmp=no
+enable_upnp=yes
+secure_mode=yes
+system_uptime=yes
+friendly_name=upnpctl integration
+uuid=7c9a3e51-0a2b-4c6d-8e9f-0123456789ab
+allow 1024-65535 192.168.77.0/24 1024-65535
+deny 0-65535 0.0.0.0/0 0-65535
+EOF
+
+ip netns exec "$ROUTER" miniupnpd -f "$WORK/miniupnpd.conf" -P "$WORK/miniupnpd.pid" -d >"$WORK/miniupnpd.log" 2>&1 &
+
+# Wait for miniupnpd to listen.
+for _ in $(seq 50); do
+	ip netns exec "$ROUTER" sh -c 'ss -ltn | grep -q ":5000 "' && break
+	sleep 0.1
+done
+
+if ! ip netns exec "$LAN" "$WORK/harness" -external-ip 203.0.113.2 "$@"; then
+	echo "--- miniupnpd log"
+	cat "$WORK/miniupnpd.log"
+	exit 1
+fi
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"upnpctl/upnp" //vendored
+	"upnpctl/upnp/upnptest"
+)
+
+// Reloading keeps track of the ports the router mapped any_port mappings on instead.
+func TestReloadAnyPortMappings(t *testing.T) {
+	s := upnptest.NewServer2()
+	defer s.Close()
+	s.AddMapping(upnp.PortMapping{Protocol: upnp.TCP, ExternalPort: 8080, InternalPort: 8080,
+		InternalClient: "192.168.1.30", Enabled: true, Description: "other host"})
+	igd, err := (&upnp.Client{AllowPublicAddresses: true}).LoadIGD(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := upnp.NewManager(igd)
+	defer manager.Stop()
+
+	m, err := daemonMapping{Protocol: "tcp", External: 8080, Internal: 80, Description: "web", AnyPort: true}.managed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := []upnp.ManagedMapping{m}
+	ports := make(map[string]int)
+	reloadMappings(manager, "", nil, config, ports)
+	if ports["TCP/8080"] != 8081 {
+		t.Fatalf("ports %v, want TCP/8080 mapped on 8081", ports)
+	}
+
+	added := s.Requests("AddAnyPortMapping")
+	reloadMappings(manager, "", config, config, ports)
+	if n := s.Requests("AddAnyPortMapping"); n != added {
+		t.Errorf("reloading an unchanged config added the mapping %d more times", n-added)
+	}
+	if mappings := manager.Mappings(); len(mappings) != 1 || mappings[0].ExternalPort != 8081 {
+		t.Errorf("managed mappings %v, want the one on port 8081", mappings)
+	}
+
+	reloadMappings(manager, "", config, nil, ports)
+	if mappings := s.Mappings(); len(mappings) != 1 || mappings[0].Description != "other host" {
+		t.Errorf("router has the port mappings %v, want only the other host's", mappings)
+	}
+	if len(ports) != 0 {
+		t.Errorf("ports %v after removing the mapping, want none", ports)
+	}
+}
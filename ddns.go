@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"upnpctl/dyndns"
+	"upnpctl/upnp" //vendored
+)
+
+// How long to wait before retrying a failed DNS update.
+var dyndnsRetryInterval = time.Minute
+
+// How long a DNS update may take.
+var dyndnsTimeout = 30 * time.Second
+
+// A DNS name to keep pointed at the external IP address, with exactly one provider set.
+type dyndnsConfig struct {
+	HTTP    *httpDNSConfig    `yaml:"http"`
+	RFC2136 *rfc2136DNSConfig `yaml:"rfc2136"`
+}
+
+type httpDNSConfig struct {
+	Method   string            `yaml:"method"`
+	URL      string            `yaml:"url"`
+	Body     string            `yaml:"body"`
+	Headers  map[string]string `yaml:"headers"`
+	Hostname string            `yaml:"hostname"`
+}
+
+type rfc2136DNSConfig struct {
+	Server    string        `yaml:"server"`
+	Zone      string        `yaml:"zone"`
+	Name      string        `yaml:"name"`
+	TTL       time.Duration `yaml:"ttl"`
+	Key       string        `yaml:"key"`
+	Secret    string        `yaml:"secret"`
+	Algorithm string        `yaml:"algorithm"`
+}
+
+func (c dyndnsConfig) provider() (string, dyndns.Provider, error) {
+	switch {
+	case c.HTTP != nil && c.RFC2136 == nil:
+		if c.HTTP.URL == "" {
+			return "", nil, fmt.Errorf("Invalid dyndns provider, http needs a url")
+		}
+		return "http " + c.HTTP.Hostname, &dyndns.HTTP{
+			Method:   c.HTTP.Method,
+			URL:      c.HTTP.URL,
+			Body:     c.HTTP.Body,
+			Headers:  c.HTTP.Headers,
+			Hostname: c.HTTP.Hostname,
+		}, nil
+	case c.RFC2136 != nil && c.HTTP == nil:
+		if c.RFC2136.Server == "" || c.RFC2136.Zone == "" || c.RFC2136.Name == "" {
+			return "", nil, fmt.Errorf("Invalid dyndns provider, rfc2136 needs a server, zone and name")
+		}
+		return "rfc2136 " + c.RFC2136.Name, &dyndns.RFC2136{
+			Server:    c.RFC2136.Server,
+			Zone:      c.RFC2136.Zone,
+			Name:      c.RFC2136.Name,
+			TTL:       c.RFC2136.TTL,
+			KeyName:   c.RFC2136.Key,
+			Secret:    c.RFC2136.Secret,
+			Algorithm: c.RFC2136.Algorithm,
+		}, nil
+	}
+	return "", nil, fmt.Errorf("Invalid dyndns entry, it needs exactly one of http or rfc2136")
+}
+
+// Point the configured names at the external IP address now, and again
+// whenever the manager sees it change. The returned function stops the updates.
+func runDyndns(configs []dyndnsConfig, manager *upnp.Manager) func() {
+	if len(configs) == 0 {
+		return func() {}
+	}
+	var updates []chan net.IP
+	for _, c := range configs {
+		name, p, _ := c.provider()
+		ch := make(chan net.IP, 1)
+		updates = append(updates, ch)
+		go dyndnsLoop(name, p, ch)
+	}
+
+	events, cancel := manager.Subscribe()
+	ip, err := manager.IGD().GetExternalIPAddress(context.Background())
+	if err != nil {
+		log.Printf("Failed to get the external IP for dyndns (%s)", err)
+	}
+	go func() {
+		defer func() {
+			for _, ch := range updates {
+				close(ch)
+			}
+		}()
+		for {
+			if ip != nil {
+				for _, ch := range updates {
+					// Replace a pending update which has not been picked up yet.
+					select {
+					case <-ch:
+					default:
+					}
+					ch <- ip
+				}
+			}
+			e, ok := <-events
+			if !ok {
+				return
+			}
+			ip = nil
+			if e.Type == upnp.EventExternalIPChanged {
+				ip = e.ExternalIP
+			}
+		}
+	}()
+	return cancel
+}
+
+// Update the provider with each IP received, retrying failures until they
+// succeed or are superseded by a newer IP.
+func dyndnsLoop(name string, p dyndns.Provider, updates <-chan net.IP) {
+	var pending net.IP
+	var retry <-chan time.Time
+	for {
+		select {
+		case ip, ok := <-updates:
+			if !ok {
+				return
+			}
+			pending = ip
+		case <-retry:
+		}
+		if pending == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dyndnsTimeout)
+		err := p.Update(ctx, pending)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to update %s to %s, retrying in %s (%s)", name, pending, dyndnsRetryInterval, err)
+			retry = time.After(dyndnsRetryInterval)
+			continue
+		}
+		log.Printf("Updated %s to %s", name, pending)
+		pending, retry = nil, nil
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpDiff = `
+	Usage: upnpctl [-v] diff [options] <file> [file]
+
+	shows how the port mappings of a device changed since
+	they were written to <file> by export, or how those of
+	two exported files differ. mappings are the same when
+	they have the same type, external port and remote host.
+
+	  + tcp 8080 -> 192.168.1.10:80 (web)
+	  - udp 5000 -> 192.168.1.11:5000 (game)
+	  ~ tcp 2222 -> 192.168.1.12:2222 (ssh): internal port 22 -> 2222
+
+	lists mappings only on the device (or in the second
+	file), only in <file>, and changed ones.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --format, json or yaml (defaults to the extension
+	  of each file, or json)
+` + helpFooter
+
+func diffCmd(args []string) {
+	f := flag.NewFlagSet(string(diffMappings), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpDiff)
+	}
+	id := f.String("id", "", "")
+	format := f.String("format", "", "")
+	f.Parse(args)
+
+	if f.NArg() < 1 || f.NArg() > 2 {
+		usage(helpDiff)
+	}
+	old := setMappings(readMappingSet(f.Arg(0), *format))
+
+	var current []upnp.PortMapping
+	if f.NArg() == 2 {
+		current = setMappings(readMappingSet(f.Arg(1), *format))
+	} else {
+		c := selectClient(*id)
+		mappings, err := c.igd.GetPortMappings(context.Background())
+		if err != nil {
+			fail(err, fmt.Sprintf("Failed to list mappings (%s)", err))
+		}
+		current = uniqueMappings(mappings)
+	}
+
+	diff := upnp.DiffMappings(old, current)
+	if diff.Empty() {
+		fmt.Println("No differences")
+		return
+	}
+	for _, m := range diff.Added {
+		fmt.Printf("+ %s\n", describeMapping(m))
+	}
+	for _, m := range diff.Removed {
+		fmt.Printf("- %s\n", describeMapping(m))
+	}
+	for _, change := range diff.Modified {
+		fmt.Printf("~ %s: %s\n", describeMapping(change.New), strings.Join(change.Changes, ", "))
+	}
+}
+
+// The port mappings of an exported set.
+func setMappings(set mappingSet) []upnp.PortMapping {
+	mappings := make([]upnp.PortMapping, 0, len(set.Mappings))
+	for _, r := range set.Mappings {
+		mappings = append(mappings, r.portMapping())
+	}
+	return mappings
+}
+
+// A one-line description of the mapping.
+func describeMapping(m upnp.PortMapping) string {
+	s := fmt.Sprintf("%s %d -> %s:%d (%s)", strings.ToLower(string(m.Protocol)), m.ExternalPort, m.InternalClient, m.InternalPort, m.Description)
+	if m.RemoteHost != "" {
+		s += " from " + m.RemoteHost
+	}
+	return s
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpDoctor = `
+	Usage: upnpctl [-v] doctor [options]
+
+	runs a series of checks against the network and the
+	device and prints a pass/fail report, with hints on
+	how to fix the problems found.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --stun, a STUN server (host:port) to cross-check
+	  the external IP with, e.g. stun.l.google.com:19302.
+	  disabled when empty (the default)
+` + helpFooter
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP"
+)
+
+type checkResult struct {
+	name   string
+	status checkStatus
+	detail string
+	hint   string
+}
+
+// The lease requested when checking whether lease durations are honored.
+const doctorLease = 3600
+
+func doctorCmd(args []string) {
+	f := flag.NewFlagSet(string(doctor), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpDoctor)
+	}
+	id := f.String("id", "", "")
+	stun := f.String("stun", "", "")
+	f.Parse(args)
+
+	ctx := context.Background()
+
+	var results []checkResult
+	report := func(r checkResult) {
+		results = append(results, r)
+		fmt.Printf("  [%s] %s: %s\n", r.status, r.name, r.detail)
+		if r.hint != "" && r.status != checkPass {
+			fmt.Printf("         hint: %s\n", r.hint)
+		}
+	}
+	skip := func(names ...string) {
+		for _, name := range names {
+			report(checkResult{name, checkSkip, "previous check failed", ""})
+		}
+	}
+
+	fmt.Println("Running checks...")
+
+	// multicast
+	n, err := ssdpResponders(2 * time.Second)
+	switch {
+	case err != nil:
+		report(checkResult{"Multicast", checkFail, err.Error(),
+			"make sure this machine has a network interface with a multicast route and no firewall blocks UDP port 1900"})
+	case n == 0:
+		report(checkResult{"Multicast", checkWarn, "no SSDP responses received",
+			"the network may filter multicast traffic (e.g. wifi client isolation or IGMP snooping)"})
+	default:
+		report(checkResult{"Multicast", checkPass, fmt.Sprintf("%d SSDP responses received", n), ""})
+	}
+
+	// gateway
+	cs := discover()
+	var c *client
+	if *id == "" && len(cs) > 0 {
+		// The device other commands use.
+		if c = defaultRouteClient(cs); c == nil {
+			c = cs[0]
+		}
+	}
+	for _, cl := range cs {
+		if cl.id == *id {
+			c = cl
+		}
+	}
+	if c == nil {
+		report(checkResult{"Gateway", checkFail, fmt.Sprintf("no InternetGatewayDevice found (%d discovered)", len(cs)),
+			"enable UPnP IGD on the router, or pass a valid --id"})
+		skip("WAN connection", "External IP")
+		if *stun != "" {
+			skip("STUN")
+		}
+		skip("Add mapping", "Lease duration", "Eventing")
+		printSummary(results)
+		os.Exit(exitNoGateway)
+	}
+	report(checkResult{"Gateway", checkPass, fmt.Sprintf("using %s (%s), %d found", c.name, c.ip, len(cs)), ""})
+
+	// wan connection
+	if svc, err := c.igd.PreferredService(ctx); err != nil {
+		report(checkResult{"WAN connection", checkFail, err.Error(), "the router does not expose a WANIPConnection or WANPPPConnection service"})
+	} else if status, err := svc.GetStatusInfo(ctx); err != nil {
+		report(checkResult{"WAN connection", checkWarn, fmt.Sprintf("%s, status unknown (%s)", svc.URN(), err), ""})
+	} else if !status.Connected() {
+		report(checkResult{"WAN connection", checkWarn, fmt.Sprintf("%s is %s", svc.URN(), status.ConnectionStatus),
+			"the router may not be connected to the internet"})
+	} else {
+		report(checkResult{"WAN connection", checkPass, fmt.Sprintf("%s connected for %s", svc.URN(), status.Uptime), ""})
+	}
+
+	// external ip
+	nat, err := c.igd.CheckDoubleNAT(ctx, true)
+	switch {
+	case err != nil:
+		report(checkResult{"External IP", checkFail, err.Error(), "the router may not be connected to the internet"})
+	case nat.Verdict == upnp.NATCarrierGrade:
+		report(checkResult{"External IP", checkWarn, nat.ExternalIP.String() + " is a carrier-grade NAT address",
+			"mappings will not be reachable from the internet; ask the ISP for a public IP"})
+	case nat.Upstream != nil:
+		report(checkResult{"External IP", checkWarn, fmt.Sprintf("%s is not a public address (double NAT), upstream router %s speaks UPnP",
+			nat.ExternalIP, nat.Upstream.FriendlyIdentifier()),
+			"mappings will not be reachable from the internet unless they are added on the upstream router too; put this router in bridge mode"})
+	case nat.DoubleNAT():
+		report(checkResult{"External IP", checkWarn, nat.ExternalIP.String() + " is not a public address (double NAT)",
+			"mappings will not be reachable from the internet unless the upstream router forwards them too; put this router in bridge mode or ask the ISP for a public IP"})
+	default:
+		report(checkResult{"External IP", checkPass, nat.ExternalIP.String() + " is a public address", ""})
+	}
+
+	// stun
+	if *stun != "" {
+		report(stunCheck(ctx, &c.igd, *stun))
+	}
+
+	// add mapping
+	r, _ := rand.Int(rand.Reader, big.NewInt(40000))
+	port := 20000 + int(r.Int64())
+	desc := "upnpctl v" + VERSION + " doctor"
+	if err := c.igd.AddPortMapping(ctx, upnp.TCP, port, port, desc, doctorLease); err != nil {
+		report(checkResult{"Add mapping", checkFail, err.Error(),
+			"the router may only allow permanent leases, or restrict port mapping in its UPnP settings"})
+		skip("Lease duration")
+	} else {
+		report(checkResult{"Add mapping", checkPass, fmt.Sprintf("mapped port %d", port), ""})
+
+		// lease duration
+		m, err := c.igd.GetSpecificPortMappingEntry(ctx, upnp.TCP, port)
+		switch {
+		case err != nil:
+			report(checkResult{"Lease duration", checkWarn, "could not read back mapping (" + err.Error() + ")", ""})
+		case m.Lease == 0:
+			report(checkResult{"Lease duration", checkWarn, fmt.Sprintf("requested %ds, router created a permanent mapping", doctorLease),
+				"mappings will not expire on their own, remove them with 'upnpctl rem'"})
+		case m.Lease < (doctorLease-60)*time.Second:
+			report(checkResult{"Lease duration", checkWarn, fmt.Sprintf("requested %ds, router granted %s", doctorLease, m.Lease),
+				"renew mappings more frequently than the granted lease"})
+		default:
+			report(checkResult{"Lease duration", checkPass, fmt.Sprintf("router granted %s", m.Lease), ""})
+		}
+
+		if err := c.igd.DeletePortMapping(ctx, upnp.TCP, port); err != nil {
+			fmt.Printf("Failed to remove mapping %d (%s)\n", port, err)
+		}
+	}
+
+	// eventing
+	if c.igd.SupportsEventing() {
+		report(checkResult{"Eventing", checkPass, "router advertises GENA event subscriptions", ""})
+	} else {
+		report(checkResult{"Eventing", checkWarn, "router does not advertise GENA event subscriptions",
+			"changes (e.g. of the external IP) can only be detected by polling"})
+	}
+
+	if printSummary(results) > 0 {
+		os.Exit(exitError)
+	}
+}
+
+// Cross-check the external IP address of igd with the STUN server.
+func stunCheck(ctx context.Context, igd *upnp.IGD, server string) checkResult {
+	r, err := igd.CheckSTUN(ctx, server)
+	switch {
+	case err != nil:
+		return checkResult{"STUN", checkWarn, err.Error(), "the network may block UDP to " + server}
+	case r.Verdict == upnp.STUNUpstreamNAT:
+		return checkResult{"STUN", checkWarn, fmt.Sprintf("router reports %s, STUN server sees %s (upstream NAT)", r.ExternalIP, r.ObservedIP),
+			"mappings will not be reachable from the internet; ask the ISP for a public IP"}
+	case r.Verdict == upnp.STUNMismatch:
+		return checkResult{"STUN", checkWarn, fmt.Sprintf("router reports %s, STUN server sees %s", r.ExternalIP, r.ObservedIP),
+			"the router reports a wrong address, or traffic leaves through another route (e.g. a VPN)"}
+	}
+	return checkResult{"STUN", checkPass, fmt.Sprintf("STUN server sees %s too", r.ObservedIP), ""}
+}
+
+// Print the number of checks per status, returning the number of failed checks.
+func printSummary(results []checkResult) int {
+	counts := map[checkStatus]int{}
+	for _, r := range results {
+		counts[r.status]++
+	}
+	fmt.Printf("%d passed, %d warnings, %d failed, %d skipped\n",
+		counts[checkPass], counts[checkWarn], counts[checkFail], counts[checkSkip])
+	return counts[checkFail]
+}
+
+// Send an ssdp:all search and count the responses received within timeout.
+func ssdpResponders(timeout time.Duration) (int, error) {
+	ssdp := &net.UDPAddr{IP: []byte{239, 255, 255, 250}, Port: 1900}
+	socket, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: ssdp.IP})
+	if err != nil {
+		return 0, err
+	}
+	defer socket.Close()
+
+	search := "M-SEARCH * HTTP/1.1\nHost: 239.255.255.250:1900\nSt: ssdp:all\nMan: \"ssdp:discover\"\nMx: 1\n\n"
+	if _, err := socket.WriteTo([]byte(strings.Replace(search, "\n", "\r\n", -1)), ssdp); err != nil {
+		return 0, err
+	}
+
+	socket.SetDeadline(time.Now().Add(timeout))
+	n := 0
+	buf := make([]byte, 1500)
+	for {
+		_, _, err := socket.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(string(buf), "HTTP/1.1 200") {
+			n++
+		}
+	}
+	return n, nil
+}
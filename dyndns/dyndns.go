@@ -0,0 +1,20 @@
+// Package dyndns updates DNS records when the external IP address of a gateway changes.
+package dyndns
+
+import (
+	"context"
+	"net"
+)
+
+// A Provider points a DNS name at an IP address.
+type Provider interface {
+	Update(ctx context.Context, ip net.IP) error
+}
+
+// The DNS record type holding ip: A for IPv4 and AAAA for IPv6 addresses.
+func recordType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
+}
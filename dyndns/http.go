@@ -0,0 +1,92 @@
+package dyndns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// HTTP updates a record through a provider's HTTP API, such as the dyndns2
+// protocol spoken by most dynamic DNS services. URL, Body and the header values
+// are templates (see text/template) which can refer to {{.IP}}, {{.Type}} and {{.Hostname}}.
+type HTTP struct {
+	Method   string // defaults to GET, or POST with a body
+	URL      string
+	Body     string
+	Headers  map[string]string
+	Hostname string
+
+	// The client to send requests with, defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type templateData struct {
+	IP       string
+	Type     string
+	Hostname string
+}
+
+func expand(name, text string, data templateData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Send the request of the provider for ip, failing on a status code other than 2xx.
+func (p *HTTP) Update(ctx context.Context, ip net.IP) error {
+	data := templateData{IP: ip.String(), Type: recordType(ip), Hostname: p.Hostname}
+
+	url, err := expand("url", p.URL, data)
+	if err != nil {
+		return err
+	}
+	body, err := expand("body", p.Body, data)
+	if err != nil {
+		return err
+	}
+	method := strings.ToUpper(p.Method)
+	if method == "" {
+		method = "GET"
+		if body != "" {
+			method = "POST"
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range p.Headers {
+		v, err := expand(k, v, data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(k, v)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package dyndns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC2136 updates a record with a DNS UPDATE message (RFC 2136), signed with
+// a TSIG key (RFC 8945) when KeyName is set. Existing records of the same name
+// and type are replaced.
+type RFC2136 struct {
+	Server string // host:port of the primary name server, the port defaults to 53
+	Zone   string
+	Name   string
+	TTL    time.Duration // defaults to 5 minutes
+
+	KeyName   string
+	Secret    string // base64
+	Algorithm string // defaults to hmac-sha256
+}
+
+// Replace the records of the name with ip.
+func (p *RFC2136) Update(ctx context.Context, ip net.IP) error {
+	if p.Server == "" || p.Zone == "" || p.Name == "" {
+		return errors.New("rfc2136: server, zone and name are required")
+	}
+	server := p.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = 5 * time.Minute
+	}
+	zone := dns.Fqdn(p.Zone)
+	name := dns.Fqdn(p.Name)
+
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: uint32(ttl.Seconds())}
+	var rr dns.RR
+	if ip.To4() != nil {
+		hdr.Rrtype = dns.TypeA
+		rr = &dns.A{Hdr: hdr, A: ip.To4()}
+	} else {
+		hdr.Rrtype = dns.TypeAAAA
+		rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(zone)
+	msg.RemoveRRset([]dns.RR{rr})
+	msg.Insert([]dns.RR{rr})
+
+	client := &dns.Client{Net: "udp"}
+	if p.KeyName != "" {
+		key := dns.Fqdn(p.KeyName)
+		algo := dns.HmacSHA256
+		if p.Algorithm != "" {
+			algo = dns.Fqdn(strings.ToLower(p.Algorithm))
+		}
+		client.TsigSecret = map[string]string{key: p.Secret}
+		msg.SetTsig(key, algo, 300, time.Now().Unix())
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: update of %s refused: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpExport = `
+	Usage: upnpctl [-v] export [options] [file]
+
+	writes the port mappings of a device to [file] (or
+	stdout), so they can be recreated with import, for
+	example on a replacement router.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --format, json or yaml (defaults to the extension
+	  of [file], or json)
+` + helpFooter
+
+var helpImport = `
+	Usage: upnpctl [-v] import [options] <file>
+
+	recreates the port mappings written by export on a
+	device. note that many routers only allow a host to
+	add mappings to itself.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --format, json or yaml (defaults to the extension
+	  of <file>, or json)
+` + helpFooter
+
+// A set of port mappings, as written by export and read by import.
+type mappingSet struct {
+	Device   string          `json:"device" yaml:"device"`
+	Exported time.Time       `json:"exported" yaml:"exported"`
+	Mappings []mappingRecord `json:"mappings" yaml:"mappings"`
+}
+
+type mappingRecord struct {
+	Protocol    string `json:"protocol" yaml:"protocol"`
+	External    int    `json:"external" yaml:"external"`
+	Internal    int    `json:"internal" yaml:"internal"`
+	Client      string `json:"client" yaml:"client"`
+	Description string `json:"description" yaml:"description"`
+	Lease       int    `json:"lease,omitempty" yaml:"lease,omitempty"`
+	Enabled     bool   `json:"enabled" yaml:"enabled"`
+	RemoteHost  string `json:"remoteHost,omitempty" yaml:"remoteHost,omitempty"`
+}
+
+func formatOf(format, file string) string {
+	if format != "" {
+		return strings.ToLower(format)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+// Read and validate a mapping file written by export, exiting when it is invalid.
+func readMappingSet(file, format string) mappingSet {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		fail(err, err.Error())
+	}
+	var set mappingSet
+	switch formatOf(format, file) {
+	case "json":
+		err = json.Unmarshal(b, &set)
+	case "yaml":
+		err = yaml.Unmarshal(b, &set)
+	default:
+		usage("Invalid format: " + format)
+	}
+	if err != nil {
+		usage(fmt.Sprintf("Invalid mapping file %s (%s)", file, err))
+	}
+
+	for _, r := range set.Mappings {
+		t := upnp.Protocol(strings.ToUpper(r.Protocol))
+		if t != upnp.TCP && t != upnp.UDP {
+			usage(fmt.Sprintf("Invalid type '%s' of mapping %d", r.Protocol, r.External))
+		}
+		if !valid(r.External) || !valid(r.Internal) {
+			usage(fmt.Sprintf("Invalid mapping %d:%d", r.External, r.Internal))
+		}
+	}
+	return set
+}
+
+// The port mapping of the record.
+func (r mappingRecord) portMapping() upnp.PortMapping {
+	return upnp.PortMapping{
+		RemoteHost:     r.RemoteHost,
+		ExternalPort:   r.External,
+		Protocol:       upnp.Protocol(strings.ToUpper(r.Protocol)),
+		InternalPort:   r.Internal,
+		InternalClient: r.Client,
+		Enabled:        r.Enabled,
+		Description:    r.Description,
+		Lease:          time.Duration(r.Lease) * time.Second,
+	}
+}
+
+func exportCmd(args []string) {
+	f := flag.NewFlagSet(string(export), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpExport)
+	}
+	id := f.String("id", "", "")
+	format := f.String("format", "", "")
+	f.Parse(args)
+
+	ctx := context.Background()
+	file := f.Arg(0)
+
+	c := selectClient(*id)
+	mappings, err := c.igd.GetPortMappings(ctx)
+	if err != nil {
+		fail(err, fmt.Sprintf("Failed to list mappings (%s)", err))
+	}
+
+	set := mappingSet{Device: c.name, Exported: time.Now().UTC()}
+	for _, m := range uniqueMappings(mappings) {
+		set.Mappings = append(set.Mappings, mappingRecord{
+			Protocol:    strings.ToLower(string(m.Protocol)),
+			External:    m.ExternalPort,
+			Internal:    m.InternalPort,
+			Client:      m.InternalClient,
+			Description: m.Description,
+			Lease:       int(m.Lease.Seconds()),
+			Enabled:     m.Enabled,
+			RemoteHost:  m.RemoteHost,
+		})
+	}
+
+	var b []byte
+	switch formatOf(*format, file) {
+	case "json":
+		b, err = json.MarshalIndent(set, "", "  ")
+		b = append(b, '\n')
+	case "yaml":
+		b, err = yaml.Marshal(set)
+	default:
+		usage("Invalid format: " + *format)
+	}
+	if err != nil {
+		fail(err, err.Error())
+	}
+
+	if file == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		fail(err, err.Error())
+	}
+	fmt.Printf("Exported %d mappings to %s\n", len(set.Mappings), file)
+}
+
+func importCmd(args []string) {
+	f := flag.NewFlagSet(string(imp), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpImport)
+	}
+	id := f.String("id", "", "")
+	format := f.String("format", "", "")
+	f.Parse(args)
+
+	ctx := context.Background()
+	file := f.Arg(0)
+	if file == "" {
+		usage(helpImport)
+	}
+
+	set := readMappingSet(file, *format)
+
+	c := selectClient(*id)
+	lg := loadLedger()
+	defer lg.save()
+
+	fmt.Printf("Importing %d mappings...\n", len(set.Mappings))
+	for _, r := range set.Mappings {
+		t := upnp.Protocol(strings.ToUpper(r.Protocol))
+		opts := []upnp.MappingOption{
+			upnp.WithDescription(r.Description),
+			upnp.WithLease(time.Duration(r.Lease) * time.Second),
+			upnp.WithRemoteHost(r.RemoteHost),
+			upnp.WithEnabled(r.Enabled),
+		}
+		client := r.Client
+		if client == "" {
+			client = "this machine"
+		} else {
+			opts = append(opts, upnp.WithInternalClient(client))
+		}
+		if err := c.igd.AddMapping(ctx, t, r.External, r.Internal, opts...); err != nil {
+			lg.save()
+			fail(err, fmt.Sprintf("Failed to add mapping %d -> %s:%d (%s)", r.External, client, r.Internal, err))
+		}
+		lg.add(&c.igd, t, r.External)
+		fmt.Printf("  %s %d -> %s:%d (%s)\n", r.Protocol, r.External, client, r.Internal, r.Description)
+	}
+
+	fmt.Println("Done")
+}
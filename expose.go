@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpExpose = `
+	Usage: upnpctl [-v] expose [options]
+
+	maps an external port to this machine and proxies
+	the connections it receives to a target address,
+	so services only listening on loopback can be
+	exposed without reconfiguring them. the mappings
+	are removed when upnpctl is interrupted.
+
+	Options:
+	  --target, the address to proxy to. required.
+	  for example, "127.0.0.1:3000".
+
+	  --external, the external port. required.
+
+	  --internal, the local port to listen on
+	  (defaults to the external port)
+
+	  --udp, also map and proxy UDP datagrams
+
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --timeout, port mapping timeout, renewed while
+	  running (defaults to permanent)
+
+	  --desc, port mapping description
+	  (defaults to 'upnpctl v` + VERSION + `')
+` + helpFooter
+
+// How long an idle UDP flow is kept before its upstream socket is closed.
+const udpFlowTimeout = 2 * time.Minute
+
+func exposeCmd(args []string) {
+	f := flag.NewFlagSet(string(expose), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpExpose)
+	}
+	id := f.String("id", "", "")
+	target := f.String("target", "", "")
+	external := f.Int("external", 0, "")
+	internal := f.Int("internal", 0, "")
+	withUDP := f.Bool("udp", false, "")
+	timeoutf := f.Duration("timeout", 0, "")
+	desc := f.String("desc", "upnpctl v"+VERSION, "")
+	f.Parse(args)
+
+	ctx := context.Background()
+
+	if *target == "" || *external == 0 {
+		usage(helpExpose)
+	}
+	if _, _, err := net.SplitHostPort(*target); err != nil {
+		usage("Invalid target '" + *target + "'")
+	}
+	if !valid(*external) {
+		usage("Invalid external port '" + strconv.Itoa(*external) + "'")
+	}
+	if *internal == 0 {
+		*internal = *external
+	}
+	if !valid(*internal) {
+		usage("Invalid internal port '" + strconv.Itoa(*internal) + "'")
+	}
+	timeout := int(timeoutf.Seconds())
+
+	listenAddr := ":" + strconv.Itoa(*internal)
+	tl, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		fail(err, err.Error())
+	}
+	var ul net.PacketConn
+	if *withUDP {
+		ul, err = net.ListenPacket("udp", listenAddr)
+		if err != nil {
+			fail(err, err.Error())
+		}
+	}
+
+	c := selectClient(*id)
+	protocols := []upnp.Protocol{upnp.TCP}
+	if *withUDP {
+		protocols = append(protocols, upnp.UDP)
+	}
+	mapAll := func() error {
+		for _, t := range protocols {
+			if err := c.igd.AddPortMapping(ctx, t, *external, *internal, *desc, timeout); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	unmapAll := func() {
+		for _, t := range protocols {
+			if err := c.igd.DeletePortMapping(ctx, t, *external); err != nil {
+				fmt.Printf("Failed to remove %s mapping %d (%s)\n", t, *external, err)
+			}
+		}
+	}
+
+	if err := mapAll(); err != nil {
+		fail(err, fmt.Sprintf("Failed to add mapping %d:%d (%s)", *external, *internal, err))
+	}
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		if timeout <= 0 {
+			return
+		}
+		ticker := time.NewTicker(*timeoutf / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := mapAll(); err != nil {
+					fmt.Printf("Failed to renew mapping %d:%d (%s)\n", *external, *internal, err)
+				}
+			}
+		}
+	}()
+
+	go proxyTCP(tl, *target)
+	if ul != nil {
+		go proxyUDP(ul, *target)
+	}
+	fmt.Printf("Exposing %s on external port %d (via local port %d), press Ctrl+C to stop\n", *target, *external, *internal)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	close(stop)
+	<-renewed
+	fmt.Println("Removing mappings...")
+	unmapAll()
+	fmt.Println("Done")
+}
+
+func proxyTCP(l net.Listener, target string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("accept: %s", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				log.Printf("dial %s: %s", target, err)
+				return
+			}
+			defer upstream.Close()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			pipe := func(dst, src net.Conn) {
+				defer wg.Done()
+				io.Copy(dst, src)
+				if tc, ok := dst.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				}
+			}
+			go pipe(upstream, conn)
+			go pipe(conn, upstream)
+			wg.Wait()
+		}()
+	}
+}
+
+// Relay datagrams between each remote peer and the target, using a
+// dedicated upstream socket per peer so replies can be routed back.
+func proxyUDP(l net.PacketConn, target string) {
+	var mut sync.Mutex
+	flows := map[string]net.Conn{}
+	buf := make([]byte, 65535)
+	for {
+		n, peer, err := l.ReadFrom(buf)
+		if err != nil {
+			log.Printf("read: %s", err)
+			return
+		}
+		mut.Lock()
+		upstream, ok := flows[peer.String()]
+		if !ok {
+			upstream, err = net.Dial("udp", target)
+			if err != nil {
+				mut.Unlock()
+				log.Printf("dial %s: %s", target, err)
+				continue
+			}
+			flows[peer.String()] = upstream
+			go func(peer net.Addr, upstream net.Conn) {
+				reply := make([]byte, 65535)
+				for {
+					upstream.SetReadDeadline(time.Now().Add(udpFlowTimeout))
+					n, err := upstream.Read(reply)
+					if err != nil {
+						break
+					}
+					l.WriteTo(reply[:n], peer)
+				}
+				mut.Lock()
+				delete(flows, peer.String())
+				mut.Unlock()
+				upstream.Close()
+			}(peer, upstream)
+		}
+		mut.Unlock()
+		upstream.Write(buf[:n])
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"upnpctl/rpc"
+	"upnpctl/upnp" //vendored
+)
+
+// grpcAPI serves the daemon's gRPC API, defined in rpc/daemon.proto.
+type grpcAPI struct {
+	rpc.UnimplementedDaemonServer
+	*api
+}
+
+func newGRPCServer(a *api) *grpc.Server {
+	g := &grpcAPI{api: a}
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := g.authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := g.authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	rpc.RegisterDaemonServer(s, g)
+	return s
+}
+
+func (g *grpcAPI) authorize(ctx context.Context) error {
+	if g.token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(g.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing token")
+}
+
+// Convert err to a status with a code classifying it, like the CLI's exit codes.
+func grpcError(err error) error {
+	code := codes.Unavailable
+	switch exitCode(err) {
+	case exitConflict:
+		code = codes.AlreadyExists
+	case exitNotAuthorized:
+		code = codes.PermissionDenied
+	case exitUnsupported:
+		code = codes.Unimplemented
+	}
+	return status.Error(code, err.Error())
+}
+
+func toProtocol(p rpc.Protocol) (upnp.Protocol, error) {
+	switch p {
+	case rpc.Protocol_PROTOCOL_TCP, rpc.Protocol_PROTOCOL_UNSPECIFIED:
+		return upnp.TCP, nil
+	case rpc.Protocol_PROTOCOL_UDP:
+		return upnp.UDP, nil
+	}
+	return "", status.Errorf(codes.InvalidArgument, "invalid protocol %d", p)
+}
+
+func fromMapping(m upnp.ManagedMapping) *rpc.Mapping {
+	result := &rpc.Mapping{
+		Protocol:    rpc.Protocol_PROTOCOL_TCP,
+		External:    uint32(m.ExternalPort),
+		Internal:    uint32(m.InternalPort),
+		Description: m.Description,
+		Lease:       uint32(m.Lease.Seconds()),
+		Orphaned:    m.Orphaned,
+		AnyPort:     m.AnyPort,
+	}
+	if m.Protocol == upnp.UDP {
+		result.Protocol = rpc.Protocol_PROTOCOL_UDP
+	}
+	if !m.Renewed.IsZero() {
+		result.Renewed = timestamppb.New(m.Renewed)
+	}
+	if !m.ExpiresAt.IsZero() {
+		result.ExpiresAt = timestamppb.New(m.ExpiresAt)
+	}
+	if m.LastError != nil {
+		result.Error = m.LastError.Error()
+	}
+	return result
+}
+
+func (g *grpcAPI) find(p rpc.Protocol, external uint32) (*upnp.ManagedMapping, error) {
+	t, err := toProtocol(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range g.manager.Mappings() {
+		if m.Protocol == t && m.ExternalPort == int(external) {
+			return &m, nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "mapping is not managed")
+}
+
+func (g *grpcAPI) ListDevices(ctx context.Context, req *rpc.ListDevicesRequest) (*rpc.ListDevicesResponse, error) {
+	resp := &rpc.ListDevicesResponse{}
+	for _, c := range g.clients {
+		resp.Devices = append(resp.Devices, &rpc.Device{Id: c.id, Name: c.name, Ip: c.ip, Uuid: c.igd.UUID()})
+	}
+	return resp, nil
+}
+
+func (g *grpcAPI) GetExternalIP(ctx context.Context, req *rpc.GetExternalIPRequest) (*rpc.GetExternalIPResponse, error) {
+	ip, err := g.manager.IGD().GetExternalIPAddress(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &rpc.GetExternalIPResponse{Ip: ip.String()}, nil
+}
+
+func (g *grpcAPI) ListMappings(ctx context.Context, req *rpc.ListMappingsRequest) (*rpc.ListMappingsResponse, error) {
+	resp := &rpc.ListMappingsResponse{}
+	for _, m := range g.manager.Mappings() {
+		resp.Mappings = append(resp.Mappings, fromMapping(m))
+	}
+	return resp, nil
+}
+
+func (g *grpcAPI) AddMapping(ctx context.Context, req *rpc.AddMappingRequest) (*rpc.Mapping, error) {
+	rm := req.GetMapping()
+	t, err := toProtocol(rm.GetProtocol())
+	if err != nil {
+		return nil, err
+	}
+	m, err := daemonMapping{Protocol: string(t), External: int(rm.GetExternal()), Internal: int(rm.GetInternal()), Description: rm.GetDescription(),
+		Lease: time.Duration(rm.GetLease()) * time.Second, AnyPort: rm.GetAnyPort()}.managed()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	added, err := g.manager.Map(m)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return fromMapping(added), nil
+}
+
+func (g *grpcAPI) DeleteMapping(ctx context.Context, req *rpc.DeleteMappingRequest) (*rpc.DeleteMappingResponse, error) {
+	m, err := g.find(req.GetProtocol(), req.GetExternal())
+	if err != nil {
+		return nil, err
+	}
+	if err := g.manager.Remove(m.Protocol, m.ExternalPort); err != nil {
+		return nil, grpcError(err)
+	}
+	return &rpc.DeleteMappingResponse{}, nil
+}
+
+func (g *grpcAPI) RenewMapping(ctx context.Context, req *rpc.RenewMappingRequest) (*rpc.Mapping, error) {
+	m, err := g.find(req.GetProtocol(), req.GetExternal())
+	if err != nil {
+		return nil, err
+	}
+	if err := g.manager.Add(*m); err != nil {
+		return nil, grpcError(err)
+	}
+	return fromMapping(*m), nil
+}
+
+var eventTypes = map[upnp.EventType]rpc.Event_Type{
+	upnp.EventExternalIPChanged: rpc.Event_TYPE_EXTERNAL_IP_CHANGED,
+	upnp.EventRenewalFailed:     rpc.Event_TYPE_RENEWAL_FAILED,
+	upnp.EventDeviceLost:        rpc.Event_TYPE_DEVICE_LOST,
+	upnp.EventDeviceFound:       rpc.Event_TYPE_DEVICE_FOUND,
+	upnp.EventNetworkChanged:    rpc.Event_TYPE_NETWORK_CHANGED,
+	upnp.EventLeaseTruncated:    rpc.Event_TYPE_LEASE_TRUNCATED,
+	upnp.EventDeviceMoved:       rpc.Event_TYPE_DEVICE_MOVED,
+}
+
+func (g *grpcAPI) Events(req *rpc.EventsRequest, stream grpc.ServerStreamingServer[rpc.Event]) error {
+	events, cancel := g.manager.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return status.Error(codes.Unavailable, "daemon is shutting down")
+			}
+			event := &rpc.Event{Type: eventTypes[e.Type], Time: timestamppb.New(e.Time), Uuid: e.UUID}
+			if e.Mapping != nil {
+				event.Mapping = fromMapping(*e.Mapping)
+			}
+			if e.ExternalIP != nil {
+				event.ExternalIp = e.ExternalIP.String()
+			}
+			if e.Err != nil {
+				event.Error = e.Err.Error()
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
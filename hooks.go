@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+// How long a hook may run when its config sets no timeout.
+var defaultHookTimeout = 30 * time.Second
+
+// The event types hooks can run on.
+var hookEventTypes = []upnp.EventType{
+	upnp.EventExternalIPChanged,
+	upnp.EventRenewalFailed,
+	upnp.EventDeviceLost,
+	upnp.EventDeviceFound,
+	upnp.EventNetworkChanged,
+	upnp.EventLeaseTruncated,
+	upnp.EventDeviceMoved,
+}
+
+// A hook runs a command or calls a webhook when the manager publishes one of its events.
+type hookConfig struct {
+	// The event types the hook runs on, all of them when empty.
+	Events  []string      `yaml:"events"`
+	Webhook string        `yaml:"webhook"`
+	Exec    []string      `yaml:"exec"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (h hookConfig) validate() error {
+	if h.Webhook == "" && len(h.Exec) == 0 {
+		return fmt.Errorf("Hook has neither webhook nor exec")
+	}
+	for _, e := range h.Events {
+		if !slices.Contains(hookEventTypes, upnp.EventType(e)) {
+			return fmt.Errorf("Invalid hook event '%s'", e)
+		}
+	}
+	return nil
+}
+
+func (h hookConfig) matches(t upnp.EventType) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if upnp.EventType(e) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// The JSON sent to webhooks and written to the stdin of commands.
+type hookEvent struct {
+	Type       string      `json:"type"`
+	Time       time.Time   `json:"time"`
+	UUID       string      `json:"uuid"`
+	Mapping    *apiMapping `json:"mapping,omitempty"`
+	ExternalIP string      `json:"external_ip,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func newHookEvent(e upnp.Event) hookEvent {
+	result := hookEvent{Type: string(e.Type), Time: e.Time, UUID: e.UUID}
+	if e.Mapping != nil {
+		m := newAPIMapping(*e.Mapping)
+		result.Mapping = &m
+	}
+	if e.ExternalIP != nil {
+		result.ExternalIP = e.ExternalIP.String()
+	}
+	if e.Err != nil {
+		result.Error = e.Err.Error()
+	}
+	return result
+}
+
+// The environment of commands, describing the event like its JSON does.
+func (e hookEvent) env() []string {
+	env := []string{
+		"UPNPCTL_EVENT=" + e.Type,
+		"UPNPCTL_TIME=" + e.Time.Format(time.RFC3339),
+		"UPNPCTL_UUID=" + e.UUID,
+	}
+	if e.Mapping != nil {
+		env = append(env,
+			"UPNPCTL_PROTOCOL="+e.Mapping.Protocol,
+			"UPNPCTL_EXTERNAL_PORT="+strconv.Itoa(e.Mapping.External),
+			"UPNPCTL_INTERNAL_PORT="+strconv.Itoa(e.Mapping.Internal),
+		)
+	}
+	if e.ExternalIP != "" {
+		env = append(env, "UPNPCTL_EXTERNAL_IP="+e.ExternalIP)
+	}
+	if e.Error != "" {
+		env = append(env, "UPNPCTL_ERROR="+e.Error)
+	}
+	return env
+}
+
+// Run the hooks on the events of the manager, each in its own goroutine so
+// a slow hook does not hold up the others. The returned function stops them.
+func runHooks(hooks []hookConfig, manager *upnp.Manager) func() {
+	if len(hooks) == 0 {
+		return func() {}
+	}
+	events, cancel := manager.Subscribe()
+	go func() {
+		for e := range events {
+			he := newHookEvent(e)
+			for _, h := range hooks {
+				if h.matches(e.Type) {
+					go h.run(he)
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+func (h hookConfig) run(e hookEvent) {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	body, _ := json.Marshal(e)
+	if h.Webhook != "" {
+		if err := postWebhook(ctx, h.Webhook, body); err != nil {
+			log.Printf("Webhook %s for %s failed (%s)", h.Webhook, e.Type, err)
+		}
+	}
+	if len(h.Exec) > 0 {
+		cmd := exec.CommandContext(ctx, h.Exec[0], h.Exec[1:]...)
+		cmd.Env = append(os.Environ(), e.env()...)
+		cmd.Stdin = bytes.NewReader(body)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("Hook %s for %s failed (%s): %s", h.Exec[0], e.Type, err, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "upnpctl/"+VERSION)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+// ledger records when upnpctl created each port mapping, since
+// routers do not report the age of their mappings.
+type ledger struct {
+	path    string
+	Created map[string]time.Time `json:"created"`
+}
+
+func ledgerKey(igd *upnp.IGD, t upnp.Protocol, external int) string {
+	return fmt.Sprintf("%s/%s/%d", igd.UUID(), t, external)
+}
+
+// Load the ledger from the user's config directory. A missing or
+// unreadable ledger is treated as empty.
+func loadLedger() *ledger {
+	l := &ledger{Created: map[string]time.Time{}}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return l
+	}
+	l.path = filepath.Join(dir, "upnpctl", "mappings.json")
+	if b, err := os.ReadFile(l.path); err == nil {
+		json.Unmarshal(b, l)
+	}
+	if l.Created == nil {
+		l.Created = map[string]time.Time{}
+	}
+	return l
+}
+
+func (l *ledger) created(igd *upnp.IGD, t upnp.Protocol, external int) (time.Time, bool) {
+	c, ok := l.Created[ledgerKey(igd, t, external)]
+	return c, ok
+}
+
+func (l *ledger) add(igd *upnp.IGD, t upnp.Protocol, external int) {
+	l.Created[ledgerKey(igd, t, external)] = time.Now()
+}
+
+func (l *ledger) remove(igd *upnp.IGD, t upnp.Protocol, external int) {
+	delete(l.Created, ledgerKey(igd, t, external))
+}
+
+func (l *ledger) save() error {
+	if l.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.path, b, 0600)
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"upnpctl/upnp" //vendored
 )
@@ -17,6 +24,48 @@ var VERSION string = "0.0.0" //set via ldflags
 
 var helpFooter = `
 	  -v, verbose logs
+	  -record <file>, record the HTTP and SOAP traffic with
+	  devices to file, e.g. to attach it to a bug report
+	  -replay <file>, replay traffic recorded with -record
+	  instead of talking to devices, reproducing their
+	  responses offline
+	  -allow-public, talk to devices whose URLs point outside
+	  the private network or the subnet they answered from
+	  -auth [<device>=]<user>:<password>, the credentials of
+	  devices protecting their URLs with HTTP authentication,
+	  those of one device by UUID or host; may be repeated
+	  -audit <file>, append the port mappings and pinholes
+	  added, updated and deleted to file as JSON lines
+	  -capture <file>, write the SSDP and HTTP traffic to
+	  file in pcapng format, for Wireshark
+	  -trace <file>, write the raw SSDP packets and SOAP
+	  payloads sent and received to file as JSON lines,
+	  with passwords and authenticators redacted
+	  -allow <device>, -deny <device>, only operate on the
+	  devices allowed and not denied, by UUID, subnet (e.g.
+	  192.168.1.0/24) or friendly name glob; may be repeated
+	  -local-ip connection|subnet, how the address mappings
+	  point to is found: that of the connection to the
+	  device (the default), or of the interface in the
+	  device's subnet, e.g. when the device is reached
+	  through another VLAN
+	  -retries <n>, search for devices again up to n times,
+	  waiting twice as long each time, when none answer
+	  -mx <seconds>, how long devices may delay their
+	  answers to searches (1 to 5); discovery listens a
+	  second longer, e.g. for slow devices
+	  -strict, reject devices whose descriptions or search
+	  responses violate the UPnP specification instead of
+	  warning about them
+	  -source <interface|address>, send the HTTP traffic to
+	  devices from the interface or local address, e.g. on
+	  multi-WAN or VPN hosts
+
+	Exit codes:
+	  0 ok, 1 error, 2 invalid usage, 3 no device found,
+	  4 mapping conflict, 5 action not authorized,
+	  6 action not supported, 7 other UPnP error,
+	  8 device unreachable
 
 	Read more: https://github.com/jpillora/upnpctl
 `
@@ -30,9 +79,52 @@ var help = `
 	  * list: discovers all available UPnP devices
 	  * add: adds a set of port mappings to a device
 	  * rem: removes a set of port mappings from a device
+	  * enable, disable: resumes or pauses port mappings
+	  * status: shows whether the WAN connection is up
+	  * stats: monitors WAN throughput of a device
+	  * pinhole: manages IPv6 firewall pinholes on a device
+	  * expose: maps a port and proxies it to a local address
+	  * test: checks that port mapping works end-to-end
+	  * doctor: diagnoses common UPnP problems
+	  * validate: checks a device against the IGD specs
+	  * purge: removes all port mappings matching filters
+	  * export: writes the port mappings of a device to a file
+	  * import: recreates exported port mappings on a device
+	  * diff: shows how port mappings changed since an export
+	  * bench: measures discovery and SOAP response times
+	  * daemon: keeps port mappings alive, with an optional HTTP API
 
 ` + helpFooter
 
+var helpList = `
+	Usage: upnpctl [-v] list [options]
+
+	discovers all available UPnP devices and prints their
+	ids, names and IP addresses.
+
+	Options:
+	  --json, print the devices as a JSON array instead.
+	  each element has the fields "id", "name", "ip" and
+	  "device", the device description as cached by the
+	  upnp package (see upnp.IGD.MarshalJSON): "uuid", "usn",
+	  "friendlyName", "manufacturer", "modelName",
+	  "modelNumber", "serialNumber", "presentationURL",
+	  "icons", "url", "localIP", "server" and "services",
+	  "interfaces", "firewalls" and "deviceProtection" with
+	  the "device", "id", "urn", "controlURL", "eventSubURL"
+	  and "scpdURL" of each service.
+	  these fields are stable across releases.
+
+	  --raw, print the device description and service
+	  descriptions (SCPDs) of each device exactly as sent,
+	  e.g. to attach them to a bug report.
+
+	  --watch, discover the devices again at this interval
+	  (e.g. 30s) until interrupted, and print those which
+	  appear (+), disappear (-) or change (~): reboot, move
+	  to another URL or change their services.
+` + helpFooter
+
 var helpAdd = `
 	Usage: upnpctl [-v] add [options] [mapping]...
 
@@ -43,7 +135,8 @@ var helpAdd = `
 
 	Options:
 	  --id, the device id. required	when more than one
-	  device is found.
+	  device is found and none of them owns the default
+	  route.
 
 	  --type, port type: tcp or udp (defaults to 'tcp')
 
@@ -51,7 +144,25 @@ var helpAdd = `
 
 	  --desc, port mapping description; some routers
 	  display this description along-side port mappings
-	  (defaults to 'upnpctl v` + VERSION + `')
+	  (defaults to 'upnpctl v` + VERSION + `'). {app},
+	  {hostname}, {pid}, {protocol}, {external} and
+	  {internal} are replaced, e.g. "{app} on {hostname}
+	  port {internal}"
+
+	  --verify, read each mapping back after adding it and
+	  fail when the router silently ignored it
+
+	  --disabled, add the mappings disabled, so the router
+	  keeps them without forwarding traffic until they are
+	  enabled
+
+	  --any-port, let the router map another external port
+	  when one is taken, on devices with AddAnyPortMapping,
+	  and print the ports mapped
+
+	  --all, add the mappings to all devices found whose
+	  WAN connection is up, e.g. on networks with redundant
+	  uplinks
 ` + helpFooter
 
 var helpRem = `
@@ -63,29 +174,189 @@ var helpRem = `
 
 	Options:
 	  --id, the device id. required	when more than one
-	  device is found.
+	  device is found and none of them owns the default
+	  route.
+
+	  --all, remove the mappings from all devices found
+` + helpFooter
+
+var helpEnable = `
+	Usage: upnpctl [-v] enable|disable [options] [external]...
+
+	a [external] is the external port identifying a port
+	mapping to enable or disable. a disabled mapping stays
+	on the router without forwarding traffic, so it can be
+	paused and resumed without recreating it.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found and none of them owns the default
+	  route.
+
+	  --type, port type: tcp or udp (defaults to 'tcp')
 ` + helpFooter
 
+// Set the credentials of an -auth flag on the DefaultClient.
+func authFlag(s string) error {
+	device, userinfo, ok := strings.Cut(s, "=")
+	if !ok {
+		device, userinfo = "", s
+	}
+	user, password, ok := strings.Cut(userinfo, ":")
+	if !ok || user == "" {
+		return errors.New("want [<device>=]<user>:<password>")
+	}
+	creds := &upnp.Credentials{Username: user, Password: password}
+	if device == "" {
+		upnp.DefaultClient.Auth = creds
+		return nil
+	}
+	if upnp.DefaultClient.DeviceAuth == nil {
+		upnp.DefaultClient.DeviceAuth = make(map[string]*upnp.Credentials)
+	}
+	upnp.DefaultClient.DeviceAuth[device] = creds
+	return nil
+}
+
+// Open the audit log file for appending, creating it if needed.
+func openAuditLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// The device filter of the DefaultClient, set up on first use.
+func deviceFilter() *upnp.DeviceFilter {
+	if upnp.DefaultClient.Devices == nil {
+		upnp.DefaultClient.Devices = &upnp.DeviceFilter{}
+	}
+	return upnp.DefaultClient.Devices
+}
+
 type command string
 
 var list = command("list")
 var add = command("add")
 var rem = command("rem")
-var intranet *string
+var enable = command("enable")
+var disable = command("disable")
+var wanStatus = command("status")
+var stats = command("stats")
+var pinhole = command("pinhole")
+var expose = command("expose")
+var test = command("test")
+var doctor = command("doctor")
+var purge = command("purge")
+var export = command("export")
+var imp = command("import")
+var diffMappings = command("diff")
+var bench = command("bench")
+var validate = command("validate")
+var daemon = command("daemon")
+var intranet = new(string)
 
 func main() {
 	v := flag.Bool("v", false, "")
+	record := flag.String("record", "", "")
+	replay := flag.String("replay", "", "")
+	allowPublic := flag.Bool("allow-public", false, "")
+	audit := flag.String("audit", "", "")
+	trace := flag.String("trace", "", "")
+	capture := flag.String("capture", "", "")
+	strict := flag.Bool("strict", false, "")
+	flag.IntVar(&upnp.DefaultClient.DiscoveryRetries, "retries", 0, "")
+	flag.IntVar(&upnp.DefaultClient.SearchMX, "mx", 0, "")
+	flag.Func("auth", "", authFlag)
+	flag.Func("source", "", func(s string) error {
+		if ip := net.ParseIP(s); ip != nil {
+			upnp.DefaultClient.SourceIP = ip
+			return nil
+		}
+		ifi, err := net.InterfaceByName(s)
+		if err != nil {
+			return err
+		}
+		upnp.DefaultClient.SourceInterface = ifi
+		return nil
+	})
+	flag.Func("local-ip", "", func(s string) error {
+		switch s {
+		case "connection":
+			upnp.DefaultClient.LocalIPStrategy = upnp.LocalIPConnection
+		case "subnet":
+			upnp.DefaultClient.LocalIPStrategy = upnp.LocalIPSubnet
+		default:
+			return errors.New("want connection or subnet")
+		}
+		return nil
+	})
+	flag.Func("allow", "", func(s string) error {
+		deviceFilter().Allow = append(deviceFilter().Allow, s)
+		return nil
+	})
+	flag.Func("deny", "", func(s string) error {
+		deviceFilter().Deny = append(deviceFilter().Deny, s)
+		return nil
+	})
 	flag.Usage = func() {
-		display(help)
+		usage(help)
 	}
 	flag.Parse()
+	upnp.DefaultClient.UserAgent = "upnpctl/" + VERSION + " UPnP/1.1"
+	upnp.DefaultClient.SortResults = true
+	upnp.DefaultClient.AllowPublicAddresses = *allowPublic
+	if *strict {
+		upnp.DefaultClient.ParseMode = upnp.ParseStrict
+	}
+	if mx := upnp.DefaultClient.SearchMX; mx < 0 || mx > 5 {
+		usage("Invalid MX '" + strconv.Itoa(mx) + "'")
+	}
 	if *v {
-		upnp.Debug = true
-		upnp.EnableLog()
+		upnp.DefaultClient.Logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	switch {
+	case *record != "" && *replay != "":
+		usage("Specify either -record or -replay")
+	case *record != "":
+		f, err := os.Create(*record)
+		if err != nil {
+			display(fmt.Sprintf("Failed to create recording (%s)", err))
+		}
+		upnp.DefaultClient.HTTPClient = &http.Client{Transport: upnp.NewRecorder(f, nil)}
+	case *replay != "":
+		f, err := os.Open(*replay)
+		if err != nil {
+			display(fmt.Sprintf("Failed to open recording (%s)", err))
+		}
+		replayer, err = upnp.NewReplayer(f)
+		f.Close()
+		if err != nil {
+			display(fmt.Sprintf("Failed to read recording (%s)", err))
+		}
+		upnp.DefaultClient.HTTPClient = &http.Client{Transport: replayer}
+	}
+	if *capture != "" {
+		f, err := os.Create(*capture)
+		if err != nil {
+			display(fmt.Sprintf("Failed to create capture (%s)", err))
+		}
+		upnp.DefaultClient.Middleware = append(upnp.DefaultClient.Middleware, upnp.NewCapture(f, nil))
+	}
+	if *audit != "" {
+		f, err := openAuditLog(*audit)
+		if err != nil {
+			display(fmt.Sprintf("Failed to open audit log (%s)", err))
+		}
+		upnp.DefaultClient.Audit = upnp.NewAuditLog(f)
+	}
+	if *trace != "" {
+		f, err := os.Create(*trace)
+		if err != nil {
+			display(fmt.Sprintf("Failed to create trace (%s)", err))
+		}
+		upnp.DefaultClient.Trace = upnp.NewTraceLog(f)
 	}
 	args := flag.Args()
 	if len(args) == 0 {
-		display(help)
+		usage(help)
 	}
 
 	cmd := command(args[0])
@@ -93,19 +364,62 @@ func main() {
 
 	switch cmd {
 	case list:
-		listMappings()
+		listCmd(args)
+		os.Exit(0)
+	case wanStatus:
+		statusCmd(args)
+		os.Exit(0)
+	case stats:
+		statsCmd(args)
+		os.Exit(0)
+	case pinhole:
+		pinholeCmd(args)
+		os.Exit(0)
+	case expose:
+		exposeCmd(args)
+		os.Exit(0)
+	case test:
+		testCmd(args)
+		os.Exit(0)
+	case doctor:
+		doctorCmd(args)
+		os.Exit(0)
+	case purge:
+		purgeCmd(args)
+		os.Exit(0)
+	case export:
+		exportCmd(args)
+		os.Exit(0)
+	case imp:
+		importCmd(args)
+		os.Exit(0)
+	case diffMappings:
+		diffCmd(args)
+		os.Exit(0)
+	case bench:
+		benchCmd(args)
+		os.Exit(0)
+	case validate:
+		validateCmd(args)
+		os.Exit(0)
+	case daemon:
+		daemonCmd(args)
 		os.Exit(0)
 	case add:
 		if len(args) == 0 {
-			display(helpAdd)
+			usage(helpAdd)
 		}
 	case rem:
 		if len(args) == 0 {
-			display(helpRem)
+			usage(helpRem)
+		}
+	case enable, disable:
+		if len(args) == 0 {
+			usage(helpEnable)
 		}
 	default:
 		fmt.Println("no match " + cmd)
-		display(help)
+		usage(help)
 	}
 
 	f := flag.NewFlagSet(string(cmd), flag.ExitOnError)
@@ -114,9 +428,17 @@ func main() {
 	intranet = f.String("ip", "", "")
 	timeoutf := f.Duration("timeout", 0, "")
 	desc := f.String("desc", "upnpctl v"+VERSION, "")
+	verify := f.Bool("verify", false, "")
+	disabled := f.Bool("disabled", false, "")
+	anyPort := f.Bool("any-port", false, "")
+	all := f.Bool("all", false, "")
 	//parse and transform args
 	f.Parse(args)
 
+	upnp.DefaultClient.VerifyMappings = *verify
+
+	ctx := context.Background()
+
 	args = f.Args()
 
 	timeout := int((*timeoutf).Seconds())
@@ -125,7 +447,7 @@ func main() {
 	case upnp.TCP:
 	case upnp.UDP:
 	default:
-		display("Invalid type: " + string(t))
+		usage("Invalid type: " + string(t))
 	}
 
 	l := len(args)
@@ -138,83 +460,389 @@ func main() {
 	for i, a := range args {
 		m := &mapping{}
 		if err := m.unmarshal(a); err != nil {
-			display(err.Error())
+			usage(err.Error())
 		}
-		if cmd == rem && m.internal != m.external {
-			display("When removing ports, only specify the external port")
+		if cmd != add && m.internal != m.external {
+			usage("When removing, enabling or disabling ports, only specify the external port")
 		}
 		// fmt.Printf("Mapping %d -> %d (timeout %d, description %s)\n", m.external, m.internal, timeout, *desc)
 		ms[i] = m
 	}
 
-	var c *client = nil
-	fmt.Printf("Discovering UPnP devices...\n")
-	cs := discover()
-	if len(cs) == 0 {
-		display("No UPnP devices found")
-	}
-
-	if *id == "" {
-		if len(cs) == 1 {
-			c = cs[0]
-		} else {
-			fmt.Printf("The --id option is required as there is more than one UPnP device:\n")
-			for _, c := range cs {
-				fmt.Printf("  --id %s => %s (%s)\n", c.id, c.name, c.ip)
-			}
-			os.Exit(1)
+	if *all {
+		if cmd != add && cmd != rem {
+			usage("The --all option only applies to add and rem")
 		}
-	} else {
-		for _, cl := range cs {
-			if cl.id == *id {
-				c = cl
-				break
-			}
+		if *id != "" {
+			usage("Specify either --id or --all")
 		}
-		if c == nil {
-			display("No UPnP devices found matching id: " + *id)
+		if *anyPort {
+			usage("Specify either --any-port or --all")
 		}
+		allCmd(ctx, cmd, t, ms, *desc, timeout)
+		return
 	}
 
+	c := selectClient(*id)
+
+	lg := loadLedger()
+	defer lg.save()
+
 	if cmd == add {
 		fmt.Printf("Adding #%d mapping%s...\n", l, plural)
 		for _, m := range ms {
-			err := c.igd.AddPortMapping(t, m.external, m.internal, *desc, timeout)
+			opts := []upnp.MappingOption{upnp.WithDescriptionTemplate(*desc),
+				upnp.WithLease(time.Duration(timeout) * time.Second), upnp.WithEnabled(!*disabled)}
+			port := m.external
+			var err error
+			if *anyPort {
+				port, err = c.igd.AddAnyMapping(ctx, t, m.external, m.internal, opts...)
+			} else {
+				err = c.igd.AddMapping(ctx, t, m.external, m.internal, opts...)
+			}
 			if err != nil {
-				display(fmt.Sprintf("Failed to add mapping %d:%d (%s)", m.external, m.internal, err))
+				lg.save()
+				fail(err, fmt.Sprintf("Failed to add mapping %d:%d (%s)", m.external, m.internal, err))
 			}
+			if *anyPort {
+				fmt.Printf("Mapped %d:%d\n", port, m.internal)
+			}
+			lg.add(&c.igd, t, port)
 		}
 	}
 
 	if cmd == rem {
 		fmt.Printf("Removing #%d mapping%s...\n", l, plural)
 		for _, m := range ms {
-			err := c.igd.DeletePortMapping(t, m.external)
+			err := c.igd.DeletePortMapping(ctx, t, m.external)
 			if err != nil {
-				display(fmt.Sprintf("Failed to remove mapping %d (%s)", m.external, err))
+				lg.save()
+				fail(err, fmt.Sprintf("Failed to remove mapping %d (%s)", m.external, err))
+			}
+			lg.remove(&c.igd, t, m.external)
+		}
+	}
+
+	if cmd == enable || cmd == disable {
+		verb := "Enabling"
+		if cmd == disable {
+			verb = "Disabling"
+		}
+		fmt.Printf("%s #%d mapping%s...\n", verb, l, plural)
+		for _, m := range ms {
+			var err error
+			if cmd == enable {
+				err = c.igd.EnableMapping(ctx, t, m.external)
+			} else {
+				err = c.igd.DisableMapping(ctx, t, m.external)
+			}
+			if err != nil {
+				fail(err, fmt.Sprintf("Failed to %s mapping %d (%s)", cmd, m.external, err))
+			}
+		}
+	}
+
+	fmt.Println("Done")
+}
+
+// Add or remove the mappings on all devices, e.g. on LANs with redundant uplinks.
+func allCmd(ctx context.Context, cmd command, t upnp.Protocol, ms []*mapping, desc string, timeout int) {
+	fmt.Printf("Discovering UPnP devices...\n")
+	cs := discover()
+	if len(cs) == 0 {
+		exit(exitNoGateway, "No UPnP devices found")
+	}
+	gateways := make(upnp.Gateways, len(cs))
+	for i, c := range cs {
+		gateways[i] = &c.igd
+	}
+	if cmd == add {
+		// Skip dead uplinks rather than fail on them.
+		connected := gateways.Connected(ctx)
+		up := make(clients, 0, len(connected))
+		for _, c := range cs {
+			if slices.Contains(connected, &c.igd) {
+				up = append(up, c)
+			} else {
+				fmt.Printf("  %s: skipped, not connected\n", c.name)
 			}
 		}
+		if len(up) == 0 {
+			exit(exitNoGateway, "No connected UPnP devices found")
+		}
+		cs, gateways = up, connected
 	}
 
+	lg := loadLedger()
+	defer lg.save()
+
+	var failed error
+	for _, m := range ms {
+		pm := upnp.PortMapping{
+			Protocol:     t,
+			ExternalPort: m.external,
+			InternalPort: m.internal,
+			Enabled:      true,
+			Lease:        time.Duration(timeout) * time.Second,
+		}
+		pm.Description = upnp.ExpandDescription(desc, pm)
+		var err error
+		if cmd == add {
+			err = gateways.Add(ctx, pm)
+		} else {
+			err = gateways.Delete(ctx, pm)
+		}
+		var gerr upnp.GatewaysError
+		errors.As(err, &gerr)
+		for _, c := range cs {
+			if e := gerr.ErrorOf(&c.igd); e != nil {
+				fmt.Printf("  %s: failed on %d (%s)\n", c.name, m.external, e)
+				failed = e
+				continue
+			}
+			if cmd == add {
+				lg.add(&c.igd, t, m.external)
+			} else {
+				lg.remove(&c.igd, t, m.external)
+			}
+		}
+	}
+	if failed != nil {
+		lg.save()
+		fail(failed, "Failed on some devices")
+	}
 	fmt.Println("Done")
 }
 
-func listMappings() {
+// Discover UPnP devices and pick the one identified by id,
+// exiting when there is no unambiguous choice.
+func selectClient(id string) *client {
+	fmt.Printf("Discovering UPnP devices...\n")
+	return pickClient(discover(), id)
+}
+
+// Pick the device identified by id from cs, exiting when there is no unambiguous choice.
+func pickClient(cs clients, id string) *client {
+	if len(cs) == 0 {
+		exit(exitNoGateway, "No UPnP devices found")
+	}
+
+	if id == "" {
+		if len(cs) == 1 {
+			return cs[0]
+		}
+		if c := defaultRouteClient(cs); c != nil {
+			fmt.Fprintf(os.Stderr, "Using %s (%s), which owns the default route\n", c.name, c.ip)
+			return c
+		}
+		fmt.Printf("The --id option is required as there is more than one UPnP device:\n")
+		for _, c := range cs {
+			fmt.Printf("  --id %s => %s (%s)\n", c.id, c.name, c.ip)
+		}
+		os.Exit(exitUsage)
+	}
+
+	for _, c := range cs {
+		if c.id == id {
+			return c
+		}
+	}
+	exit(exitNoGateway, "No UPnP devices found matching id: "+id)
+	return nil
+}
+
+// The client of the device owning the host's default route, nil when none does
+// or it cannot be determined.
+func defaultRouteClient(cs clients) *client {
+	igds := make([]upnp.IGD, len(cs))
+	for i, c := range cs {
+		igds[i] = c.igd
+	}
+	igd, ok := upnp.SelectDefaultGateway(igds)
+	if !ok {
+		return nil
+	}
+	for _, c := range cs {
+		if c.igd.UUID() == igd.UUID() {
+			return c
+		}
+	}
+	return nil
+}
+
+type listedDevice struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	IP     string    `json:"ip"`
+	Device *upnp.IGD `json:"device"`
+}
+
+func listCmd(args []string) {
+	f := flag.NewFlagSet(string(list), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpList)
+	}
+	asJSON := f.Bool("json", false, "")
+	raw := f.Bool("raw", false, "")
+	watch := f.Duration("watch", 0, "")
+	f.Parse(args)
+
+	if *raw {
+		ctx := context.Background()
+		for _, c := range discover() {
+			fmt.Printf("<!-- #%s: %s -->\n%s\n", c.id, c.igd.URL(), c.igd.RawDescription())
+			for _, s := range c.igd.Services() {
+				if s.SCPDURL() == "" {
+					continue
+				}
+				scpd, err := s.RawSCPD(ctx)
+				if err != nil {
+					fmt.Printf("<!-- %s: %s -->\n", s.SCPDURL(), err)
+					continue
+				}
+				fmt.Printf("<!-- %s -->\n%s\n", s.SCPDURL(), scpd)
+			}
+		}
+		return
+	}
+
+	if *asJSON {
+		devices := []listedDevice{}
+		for _, c := range discover() {
+			devices = append(devices, listedDevice{c.id, c.name, c.ip, &c.igd})
+		}
+		b, err := json.MarshalIndent(devices, "", "  ")
+		if err != nil {
+			display(err.Error())
+		}
+		fmt.Println(string(b))
+		return
+	}
+
 	fmt.Printf("Discovering UPnP devices...\n")
 	cs := discover()
 	for _, c := range cs {
-		fmt.Printf("  #%s: %s (%s)\n", c.id, c.name, c.ip)
+		model := strings.TrimSpace(c.igd.Manufacturer() + " " + c.igd.ModelName())
+		if model != "" {
+			model = " - " + model
+		}
+		fmt.Printf("  #%s: %s (%s)%s\n", c.id, c.name, c.ip, model)
+	}
+	if *watch > 0 {
+		watchDevices(cs, *watch)
+	}
+}
+
+// Discover the devices every interval, printing the changes from the previous discovery.
+func watchDevices(cs clients, interval time.Duration) {
+	previous := make([]upnp.IGD, len(cs))
+	for i, c := range cs {
+		previous[i] = c.igd
+	}
+	describe := func(igd upnp.IGD) string {
+		host := igd.URL().Host
+		ip, _, _ := net.SplitHostPort(host)
+		return fmt.Sprintf("%s (%s)", igd.FriendlyName(), ip)
+	}
+	for {
+		time.Sleep(interval)
+		var current []upnp.IGD
+		for _, c := range discover() {
+			current = append(current, c.igd)
+		}
+		diff := upnp.DiffSnapshots(previous, current)
+		now := time.Now().Format(time.TimeOnly)
+		for _, igd := range diff.Added {
+			fmt.Printf("%s + %s\n", now, describe(igd))
+		}
+		for _, igd := range diff.Removed {
+			fmt.Printf("%s - %s\n", now, describe(igd))
+		}
+		for _, change := range diff.Changed {
+			var what []string
+			if change.Rebooted {
+				what = append(what, "rebooted")
+			}
+			if change.Moved {
+				what = append(what, "moved to "+change.New.URL().String())
+			}
+			if change.ServicesChanged {
+				what = append(what, "services changed")
+			}
+			fmt.Printf("%s ~ %s: %s\n", now, describe(change.New), strings.Join(what, ", "))
+		}
+		previous = current
 	}
 }
 
+// Exit codes, so scripts can tell the causes of failures apart.
+const (
+	exitOK            = 0
+	exitError         = 1 // unclassified failure
+	exitUsage         = 2 // invalid command line
+	exitNoGateway     = 3 // no (matching) UPnP device found
+	exitConflict      = 4 // mapping conflicts with an existing one (UPnP error 718, 729)
+	exitNotAuthorized = 5 // device refused the action (UPnP error 606)
+	exitUnsupported   = 6 // device lacks the action or service (UPnP error 401, 602)
+	exitUPnPError     = 7 // any other UPnP error returned by the device
+	exitNetwork       = 8 // device could not be reached
+)
+
 func display(msg string) {
+	exit(exitError, msg)
+}
+
+func usage(msg string) {
+	exit(exitUsage, msg)
+}
+
+// Print msg and exit with the code classifying err.
+func fail(err error, msg string) {
+	exit(exitCode(err), msg)
+}
+
+func exit(code int, msg string) {
 	fmt.Println(msg)
-	os.Exit(1)
+	os.Exit(code)
+}
+
+func exitCode(err error) int {
+	var soapErr *upnp.SOAPError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &soapErr):
+		switch soapErr.Code {
+		case upnp.ErrCodeConflictInMappingEntry, upnp.ErrCodeConflictWithOtherMechanisms:
+			return exitConflict
+		case upnp.ErrCodeActionNotAuthorized:
+			return exitNotAuthorized
+		case upnp.ErrCodeInvalidAction, upnp.ErrCodeOptionalActionNotImplemented:
+			return exitUnsupported
+		}
+		return exitUPnPError
+	case errors.Is(err, upnp.ErrForeignMapping):
+		return exitConflict
+	case errors.Is(err, upnp.ErrNoWANConnection), errors.Is(err, upnp.ErrNoInterfaceConfig), errors.Is(err, upnp.ErrNoFirewallControl):
+		return exitUnsupported
+	case errors.As(err, &netErr):
+		return exitNetwork
+	}
+	return exitError
 }
 
+// The traffic replayed instead of talking to devices, see -replay.
+var replayer *upnp.Replayer
+
 func discover() clients {
 	cs := make(clients, 0)
-	igds := upnp.Discover(intranet)
+	var igds []upnp.IGD
+	if replayer != nil {
+		igds = replayedDevices()
+	} else {
+		igds = upnp.Discover(intranet)
+	}
 	for _, igd := range igds {
 		host := igd.URL().Host
 		ip, _, _ := net.SplitHostPort(host)
@@ -228,6 +856,25 @@ func discover() clients {
 	return cs
 }
 
+// The devices of the recording replayed, as a discovery would have found them.
+func replayedDevices() []upnp.IGD {
+	c := *upnp.DefaultClient
+	if *intranet != "" {
+		c.LocalIP = *intranet
+	}
+	var igds []upnp.IGD
+	for _, location := range replayer.Locations() {
+		igd, err := c.LoadIGD(context.Background(), location)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Replaying %s failed: %s\n", location, err)
+			continue
+		}
+		igds = append(igds, *igd)
+	}
+	upnp.SortIGDs(igds)
+	return igds
+}
+
 type mapping struct {
 	external int
 	internal int
@@ -255,6 +902,21 @@ func (m *mapping) unmarshal(s string) error {
 	return nil
 }
 
+// Drop duplicate mappings, as the services of one device
+// commonly share a single mapping table.
+func uniqueMappings(mappings []upnp.PortMapping) []upnp.PortMapping {
+	var result []upnp.PortMapping
+	seen := map[string]bool{}
+	for _, m := range mappings {
+		key := fmt.Sprintf("%s/%s/%d", m.RemoteHost, m.Protocol, m.ExternalPort)
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
 type clients []*client
 
 type client struct {
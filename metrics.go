@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+// Upper bounds of the duration histogram buckets, in seconds.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	s := d.Seconds()
+	for i, b := range durationBuckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range durationBuckets {
+		var c uint64
+		if h.counts != nil {
+			c = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(b, 'g', -1, 64), c)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// metrics collects the daemon's metrics and writes them in the
+// Prometheus text exposition format.
+type metrics struct {
+	mut               sync.Mutex
+	discoveries       uint64
+	discoveryDuration histogram
+	devicesFound      int
+	soapRequests      map[string]uint64
+	soapErrors        map[[2]string]uint64
+	soapDuration      map[string]*histogram
+	renewalFailures   uint64
+	ipChanges         uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		soapRequests: map[string]uint64{},
+		soapErrors:   map[[2]string]uint64{},
+		soapDuration: map[string]*histogram{},
+	}
+}
+
+// Collect the metrics of the default client.
+func (m *metrics) install() {
+	upnp.DefaultClient.Metrics = m
+}
+
+// Count the external IP changes of the manager.
+func (m *metrics) follow(manager *upnp.Manager) {
+	events, _ := manager.Subscribe()
+	go func() {
+		for e := range events {
+			if e.Type == upnp.EventExternalIPChanged {
+				m.mut.Lock()
+				m.ipChanges++
+				m.mut.Unlock()
+			}
+		}
+	}()
+}
+
+func (m *metrics) Discovery(d time.Duration, found int, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.discoveries++
+	m.discoveryDuration.observe(d)
+	m.devicesFound = found
+}
+
+func (m *metrics) SOAPRequest(device, action string, d time.Duration, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.soapRequests[action]++
+	h, ok := m.soapDuration[action]
+	if !ok {
+		h = &histogram{}
+		m.soapDuration[action] = h
+	}
+	h.observe(d)
+	if err != nil {
+		code := "none"
+		var soapErr *upnp.SOAPError
+		if errors.As(err, &soapErr) {
+			code = strconv.Itoa(soapErr.Code)
+		}
+		m.soapErrors[[2]string{action, code}]++
+	}
+}
+
+func (m *metrics) Renewal(device string, protocol upnp.Protocol, port int, err error) {
+	if err != nil {
+		m.mut.Lock()
+		m.renewalFailures++
+		m.mut.Unlock()
+	}
+}
+
+func (m *metrics) write(w io.Writer, manager *upnp.Manager) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	fmt.Fprintf(w, "# HELP upnpctl_discovery_attempts_total Number of UPnP discoveries.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_discovery_attempts_total counter\n")
+	fmt.Fprintf(w, "upnpctl_discovery_attempts_total %d\n", m.discoveries)
+	fmt.Fprintf(w, "# HELP upnpctl_discovery_duration_seconds Duration of UPnP discoveries.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_discovery_duration_seconds histogram\n")
+	m.discoveryDuration.write(w, "upnpctl_discovery_duration_seconds", "")
+	fmt.Fprintf(w, "# HELP upnpctl_discovery_devices Number of devices found by the last discovery.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_discovery_devices gauge\n")
+	fmt.Fprintf(w, "upnpctl_discovery_devices %d\n", m.devicesFound)
+
+	actions := make([]string, 0, len(m.soapRequests))
+	for action := range m.soapRequests {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	fmt.Fprintf(w, "# HELP upnpctl_soap_requests_total Number of SOAP requests by action.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_soap_requests_total counter\n")
+	for _, action := range actions {
+		fmt.Fprintf(w, "upnpctl_soap_requests_total{action=%q} %d\n", action, m.soapRequests[action])
+	}
+	fmt.Fprintf(w, "# HELP upnpctl_soap_request_duration_seconds Duration of SOAP requests by action.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_soap_request_duration_seconds histogram\n")
+	for _, action := range actions {
+		m.soapDuration[action].write(w, "upnpctl_soap_request_duration_seconds", fmt.Sprintf("action=%q", action))
+	}
+	errKeys := make([][2]string, 0, len(m.soapErrors))
+	for k := range m.soapErrors {
+		errKeys = append(errKeys, k)
+	}
+	sort.Slice(errKeys, func(i, j int) bool {
+		return errKeys[i][0]+" "+errKeys[i][1] < errKeys[j][0]+" "+errKeys[j][1]
+	})
+	fmt.Fprintf(w, "# HELP upnpctl_soap_errors_total Number of failed SOAP requests by action and UPnP error code.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_soap_errors_total counter\n")
+	for _, k := range errKeys {
+		fmt.Fprintf(w, "upnpctl_soap_errors_total{action=%q,code=%q} %d\n", k[0], k[1], m.soapErrors[k])
+	}
+
+	mappings := manager.Mappings()
+	fmt.Fprintf(w, "# HELP upnpctl_managed_mappings Number of mappings kept alive by the daemon.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_managed_mappings gauge\n")
+	fmt.Fprintf(w, "upnpctl_managed_mappings %d\n", len(mappings))
+	fmt.Fprintf(w, "# HELP upnpctl_mapping_lease_remaining_seconds Remaining lease of managed mappings with a lease.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_mapping_lease_remaining_seconds gauge\n")
+	for _, mapping := range mappings {
+		if mapping.ExpiresAt.IsZero() {
+			continue
+		}
+		remaining := time.Until(mapping.ExpiresAt).Seconds()
+		if remaining < 0 {
+			remaining = 0
+		}
+		fmt.Fprintf(w, "upnpctl_mapping_lease_remaining_seconds{protocol=%q,external=\"%d\"} %.0f\n",
+			strings.ToLower(string(mapping.Protocol)), mapping.ExternalPort, remaining)
+	}
+	fmt.Fprintf(w, "# HELP upnpctl_renewal_failures_total Number of failed mapping renewals.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_renewal_failures_total counter\n")
+	fmt.Fprintf(w, "upnpctl_renewal_failures_total %d\n", m.renewalFailures)
+	fmt.Fprintf(w, "# HELP upnpctl_external_ip_changes_total Number of observed external IP address changes.\n")
+	fmt.Fprintf(w, "# TYPE upnpctl_external_ip_changes_total counter\n")
+	fmt.Fprintf(w, "upnpctl_external_ip_changes_total %d\n", m.ipChanges)
+}
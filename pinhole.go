@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpPinhole = `
+	Usage: upnpctl [-v] pinhole <command> [options] [args]...
+
+	manages IPv6 firewall pinholes on devices exposing
+	the WANIPv6FirewallControl service.
+
+	Commands:
+	  * add [port]...: opens a pinhole for each internal
+	    port, printing the pinhole's unique id
+	  * delete [uid]...: closes the pinholes
+	  * check [uid]...: reports whether the pinholes are
+	    working and how many packets they let through
+	  * list: shows the firewall status and probes for
+	    open pinholes (the service can not enumerate
+	    pinholes, so unique ids 1 to --max are queried)
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --type, port type: tcp, udp or any (defaults to 'tcp')
+
+	  --ip, the internal IPv6 address (defaults to the
+	  first global IPv6 address of this machine)
+
+	  --remote-host, only allow traffic from this host
+	  (defaults to any host)
+
+	  --remote-port, only allow traffic from this port
+	  (defaults to any port)
+
+	  --lease, pinhole lease, between 1s and 24h
+	  (defaults to 1h)
+
+	  --max, highest unique id probed by list
+	  (defaults to 64)
+` + helpFooter
+
+func pinholeCmd(args []string) {
+	ctx := context.Background()
+	if len(args) == 0 {
+		usage(helpPinhole)
+	}
+	sub := args[0]
+
+	f := flag.NewFlagSet(string(pinhole)+" "+sub, flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpPinhole)
+	}
+	id := f.String("id", "", "")
+	tf := f.String("type", "tcp", "")
+	ip := f.String("ip", "", "")
+	remoteHost := f.String("remote-host", "", "")
+	remotePort := f.Int("remote-port", 0, "")
+	lease := f.Duration("lease", time.Hour, "")
+	max := f.Int("max", 64, "")
+	f.Parse(args[1:])
+	args = f.Args()
+
+	var nums []int // ports for add, unique ids otherwise
+	switch sub {
+	case "add":
+		if len(args) == 0 {
+			usage(helpPinhole)
+		}
+		for _, a := range args {
+			p, err := strconv.Atoi(a)
+			if err != nil || !valid(p) {
+				usage("Invalid port '" + a + "'")
+			}
+			nums = append(nums, p)
+		}
+	case "delete", "check":
+		if len(args) == 0 {
+			usage(helpPinhole)
+		}
+		for _, a := range args {
+			uid, err := strconv.Atoi(a)
+			if err != nil || uid < 0 || uid > 65535 {
+				usage("Invalid unique id '" + a + "'")
+			}
+			nums = append(nums, uid)
+		}
+	case "list":
+	default:
+		usage("no match pinhole " + sub)
+	}
+
+	t := upnp.Protocol(strings.ToUpper(*tf))
+	switch t {
+	case upnp.TCP:
+	case upnp.UDP:
+	case "ANY":
+	default:
+		usage("Invalid type: " + string(t))
+	}
+	leaseTime := int(lease.Seconds())
+	if leaseTime < 1 || leaseTime > 86400 {
+		usage("Invalid lease: " + lease.String())
+	}
+
+	c := selectClient(*id)
+	fw, err := c.igd.Firewall()
+	if err != nil {
+		fail(err, err.Error())
+	}
+
+	switch sub {
+	case "add":
+		if *ip == "" {
+			addr, err := localIPv6()
+			if err != nil {
+				fail(err, err.Error())
+			}
+			*ip = addr
+		}
+		for _, p := range nums {
+			uid, err := fw.AddPinhole(ctx, upnp.Pinhole{
+				RemoteHost:     *remoteHost,
+				RemotePort:     *remotePort,
+				InternalClient: *ip,
+				InternalPort:   p,
+				Protocol:       t,
+				LeaseTime:      leaseTime,
+			})
+			if err != nil {
+				fail(err, fmt.Sprintf("Failed to add pinhole to [%s]:%d (%s)", *ip, p, err))
+			}
+			fmt.Printf("  #%d: [%s]:%d (%s, lease %s)\n", uid, *ip, p, strings.ToLower(string(t)), lease)
+		}
+	case "delete":
+		for _, uid := range nums {
+			if err := fw.DeletePinhole(ctx, uid); err != nil {
+				fail(err, fmt.Sprintf("Failed to delete pinhole #%d (%s)", uid, err))
+			}
+		}
+	case "check":
+		for _, uid := range nums {
+			working, err := fw.CheckPinholeWorking(ctx, uid)
+			if err != nil {
+				fail(err, fmt.Sprintf("Failed to check pinhole #%d (%s)", uid, err))
+			}
+			packets, err := fw.GetPinholePackets(ctx, uid)
+			if err != nil {
+				fail(err, fmt.Sprintf("Failed to check pinhole #%d (%s)", uid, err))
+			}
+			fmt.Printf("  #%d: working %t, %d packets\n", uid, working, packets)
+		}
+	case "list":
+		status, err := fw.GetFirewallStatus(ctx)
+		if err != nil {
+			fail(err, fmt.Sprintf("Failed to get firewall status (%s)", err))
+		}
+		fmt.Printf("Firewall enabled: %t, inbound pinholes allowed: %t\n", status.Enabled, status.InboundPinholeAllowed)
+		for uid := 1; uid <= *max; uid++ {
+			packets, err := fw.GetPinholePackets(ctx, uid)
+			if err != nil {
+				continue
+			}
+			fmt.Printf("  #%d: %d packets\n", uid, packets)
+		}
+	}
+
+	fmt.Println("Done")
+}
+
+// Find the first global unicast IPv6 address of this machine.
+func localIPv6() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil {
+			continue
+		}
+		if ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", errors.New("No global IPv6 address found, use --ip")
+}
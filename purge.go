@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpPurge = `
+	Usage: upnpctl [-v] purge [options]
+
+	removes all port mappings of a device which match
+	every given filter.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --desc-prefix, only remove mappings whose description
+	  starts with this prefix
+
+	  --older-than, only remove mappings added by upnpctl
+	  more than this long ago, e.g. "24h". routers do not
+	  report the age of mappings, so mappings created by
+	  other programs never match this filter.
+
+	  --proto, port type: tcp, udp or any (defaults to 'any')
+
+	  --dry-run, only print the mappings which would be
+	  removed
+` + helpFooter
+
+func purgeCmd(args []string) {
+	f := flag.NewFlagSet(string(purge), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpPurge)
+	}
+	id := f.String("id", "", "")
+	prefix := f.String("desc-prefix", "", "")
+	olderThan := f.Duration("older-than", 0, "")
+	proto := f.String("proto", "any", "")
+	dryRun := f.Bool("dry-run", false, "")
+	f.Parse(args)
+
+	ctx := context.Background()
+
+	t := upnp.Protocol(strings.ToUpper(*proto))
+	switch t {
+	case upnp.TCP:
+	case upnp.UDP:
+	case "ANY":
+		t = ""
+	default:
+		usage("Invalid type: " + string(t))
+	}
+
+	c := selectClient(*id)
+	lg := loadLedger()
+
+	mappings, err := c.igd.GetPortMappings(ctx)
+	if err != nil {
+		fail(err, fmt.Sprintf("Failed to list mappings (%s)", err))
+	}
+
+	mappings = uniqueMappings(mappings)
+	var matched []upnp.PortMapping
+	for _, m := range mappings {
+		if t != "" && m.Protocol != t {
+			continue
+		}
+		if !strings.HasPrefix(m.Description, *prefix) {
+			continue
+		}
+		if *olderThan > 0 {
+			created, ok := lg.created(&c.igd, m.Protocol, m.ExternalPort)
+			if !ok || time.Since(created) < *olderThan {
+				continue
+			}
+		}
+		matched = append(matched, m)
+	}
+
+	verb := "Removing"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d of %d mappings...\n", verb, len(matched), len(mappings))
+	for _, m := range matched {
+		fmt.Printf("  %s %d -> %s:%d (%s)\n", strings.ToLower(string(m.Protocol)), m.ExternalPort, m.InternalClient, m.InternalPort, m.Description)
+		if *dryRun {
+			continue
+		}
+		if err := c.igd.Delete(ctx, m); err != nil {
+			lg.save()
+			fail(err, fmt.Sprintf("Failed to remove mapping %d (%s)", m.ExternalPort, err))
+		}
+		lg.remove(&c.igd, m.Protocol, m.ExternalPort)
+	}
+	lg.save()
+
+	fmt.Println("Done")
+}
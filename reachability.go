@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpTest = `
+	Usage: upnpctl [-v] test [options]
+
+	checks whether UPnP port mapping actually works on
+	the device: maps a temporary TCP port, listens on it
+	and verifies that inbound connections arrive, then
+	removes the mapping again.
+
+	reachability is verified by connecting to the
+	external address from this machine (which requires
+	the router to support NAT loopback), by asking a
+	probe endpoint to connect back (--probe) and/or by
+	waiting for a connection from another host (--wait).
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --port, the port to map (defaults to a random
+	  port between 20000 and 60000)
+
+	  --probe, a URL which is requested so that a remote
+	  service connects back to this machine. "{ip}" and
+	  "{port}" are replaced with the external address.
+
+	  --wait, time to wait for a connection from another
+	  host, e.g. "telnet <ip> <port>" (defaults to 0,
+	  which disables the check)
+
+	  --stun, a STUN server (host:port) to cross-check
+	  the external IP with, e.g. stun.l.google.com:19302.
+	  disabled when empty (the default)
+
+	  --timeout, time to wait for each check
+	  (defaults to 5s)
+` + helpFooter
+
+// The lease requested for the temporary mapping, so it expires
+// on its own if upnpctl is killed before removing it.
+const testLease = 10 * 60
+
+func testCmd(args []string) {
+	f := flag.NewFlagSet(string(test), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpTest)
+	}
+	id := f.String("id", "", "")
+	port := f.Int("port", 0, "")
+	probe := f.String("probe", "", "")
+	wait := f.Duration("wait", 0, "")
+	stun := f.String("stun", "", "")
+	timeout := f.Duration("timeout", 5*time.Second, "")
+	f.Parse(args)
+
+	ctx := context.Background()
+
+	if *port == 0 {
+		n, _ := rand.Int(rand.Reader, big.NewInt(40000))
+		*port = 20000 + int(n.Int64())
+	}
+	if !valid(*port) {
+		usage("Invalid port '" + strconv.Itoa(*port) + "'")
+	}
+
+	tokenBytes := make([]byte, 8)
+	rand.Read(tokenBytes)
+	token := hex.EncodeToString(tokenBytes)
+
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(*port))
+	if err != nil {
+		fail(err, err.Error())
+	}
+	defer l.Close()
+	inbound := make(chan net.Addr, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Before answering, so the loopback check's own connection is drained
+			// rather than passing the probe check.
+			inbound <- conn.RemoteAddr()
+			fmt.Fprintf(conn, "upnpctl %s\n", token)
+			conn.Close()
+		}
+	}()
+
+	c := selectClient(*id)
+	ip, err := c.igd.GetExternalIPAddress(ctx)
+	if err != nil || ip == nil {
+		fail(err, fmt.Sprintf("Failed to get external IP address (%v)", err))
+	}
+
+	desc := "upnpctl v" + VERSION + " test"
+	if err := c.igd.AddPortMapping(ctx, upnp.TCP, *port, *port, desc, testLease); err != nil {
+		// some routers only support permanent leases
+		if err := c.igd.AddPortMapping(ctx, upnp.TCP, *port, *port, desc, 0); err != nil {
+			fail(err, fmt.Sprintf("FAIL: router refused to add mapping %d (%s)", *port, err))
+		}
+	}
+	cleanup := func() {
+		if err := c.igd.DeletePortMapping(ctx, upnp.TCP, *port); err != nil {
+			fmt.Printf("Failed to remove mapping %d (%s)\n", *port, err)
+		}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cleanup()
+		os.Exit(exitError)
+	}()
+
+	external := net.JoinHostPort(ip.String(), strconv.Itoa(*port))
+	fmt.Printf("Mapped %s to local port %d\n", external, *port)
+
+	if *stun != "" {
+		fmt.Printf("STUN check: ")
+		sctx, cancel := context.WithTimeout(ctx, *timeout)
+		r, err := c.igd.CheckSTUN(sctx, *stun)
+		cancel()
+		switch {
+		case err != nil:
+			fmt.Printf("inconclusive (%s)\n", err)
+		case r.Verdict == upnp.STUNMatch:
+			fmt.Printf("pass (%s)\n", r.ObservedIP)
+		default:
+			fmt.Printf("fail (STUN server sees %s, %s)\n", r.ObservedIP, r.Verdict)
+		}
+	}
+
+	passed := 0
+
+	// 1. NAT loopback
+	fmt.Printf("Loopback check: ")
+	if err := dialToken(external, token, *timeout); err != nil {
+		fmt.Printf("inconclusive (%s), the router may not support NAT loopback\n", err)
+	} else {
+		fmt.Printf("pass\n")
+		passed++
+	}
+	drain(inbound)
+
+	// 2. remote probe
+	if *probe != "" {
+		fmt.Printf("Probe check: ")
+		u := strings.NewReplacer("{ip}", ip.String(), "{port}", strconv.Itoa(*port)).Replace(*probe)
+		client := &http.Client{Timeout: *timeout}
+		resp, err := client.Get(u)
+		if err != nil {
+			fmt.Printf("fail (%s)\n", err)
+		} else {
+			resp.Body.Close()
+			if addr, ok := waitInbound(inbound, *timeout); ok {
+				fmt.Printf("pass (connection from %s)\n", addr)
+				passed++
+			} else {
+				fmt.Printf("fail (no inbound connection, probe returned %s)\n", resp.Status)
+			}
+		}
+	}
+
+	// 3. second host
+	if *wait > 0 {
+		fmt.Printf("Waiting %s for a connection to %s from another host...\n", *wait, external)
+		if addr, ok := waitInbound(inbound, *wait); ok {
+			fmt.Printf("Remote check: pass (connection from %s)\n", addr)
+			passed++
+		} else {
+			fmt.Printf("Remote check: fail (no inbound connection)\n")
+		}
+	}
+
+	cleanup()
+
+	if passed == 0 {
+		display("Result: reachability could not be verified")
+	}
+	fmt.Println("Result: UPnP port mapping works")
+}
+
+// Connect to addr and check that the listener answered with the token,
+// so a router answering on the same port is not mistaken for success.
+func dialToken(addr, token string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != "upnpctl "+token {
+		return fmt.Errorf("unexpected response %q", line)
+	}
+	return nil
+}
+
+func waitInbound(inbound <-chan net.Addr, timeout time.Duration) (net.Addr, bool) {
+	select {
+	case addr := <-inbound:
+		return addr, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func drain(inbound <-chan net.Addr) {
+	for {
+		select {
+		case <-inbound:
+		default:
+			return
+		}
+	}
+}
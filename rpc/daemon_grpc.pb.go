@@ -0,0 +1,375 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: daemon.proto
+
+// The gRPC API of the upnpctl daemon.
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Daemon_ListDevices_FullMethodName   = "/upnpctl.v1.Daemon/ListDevices"
+	Daemon_GetExternalIP_FullMethodName = "/upnpctl.v1.Daemon/GetExternalIP"
+	Daemon_ListMappings_FullMethodName  = "/upnpctl.v1.Daemon/ListMappings"
+	Daemon_AddMapping_FullMethodName    = "/upnpctl.v1.Daemon/AddMapping"
+	Daemon_DeleteMapping_FullMethodName = "/upnpctl.v1.Daemon/DeleteMapping"
+	Daemon_RenewMapping_FullMethodName  = "/upnpctl.v1.Daemon/RenewMapping"
+	Daemon_Events_FullMethodName        = "/upnpctl.v1.Daemon/Events"
+)
+
+// DaemonClient is the client API for Daemon service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Daemon manages the port mappings of the device used by upnpctl daemon.
+// When the daemon has a token, calls must carry it as "authorization: Bearer <token>" metadata.
+type DaemonClient interface {
+	// The discovered UPnP devices.
+	ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error)
+	// The external IP address of the device.
+	GetExternalIP(ctx context.Context, in *GetExternalIPRequest, opts ...grpc.CallOption) (*GetExternalIPResponse, error)
+	// The managed port mappings.
+	ListMappings(ctx context.Context, in *ListMappingsRequest, opts ...grpc.CallOption) (*ListMappingsResponse, error)
+	// Add a port mapping and keep it alive. Adding a managed mapping renews it.
+	AddMapping(ctx context.Context, in *AddMappingRequest, opts ...grpc.CallOption) (*Mapping, error)
+	// Stop managing a port mapping and delete it from the device.
+	DeleteMapping(ctx context.Context, in *DeleteMappingRequest, opts ...grpc.CallOption) (*DeleteMappingResponse, error)
+	// Renew a managed port mapping immediately.
+	RenewMapping(ctx context.Context, in *RenewMappingRequest, opts ...grpc.CallOption) (*Mapping, error)
+	// A stream of the daemon's events, until the call is canceled.
+	Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type daemonClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDaemonClient(cc grpc.ClientConnInterface) DaemonClient {
+	return &daemonClient{cc}
+}
+
+func (c *daemonClient) ListDevices(ctx context.Context, in *ListDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListDevicesResponse)
+	err := c.cc.Invoke(ctx, Daemon_ListDevices_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) GetExternalIP(ctx context.Context, in *GetExternalIPRequest, opts ...grpc.CallOption) (*GetExternalIPResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetExternalIPResponse)
+	err := c.cc.Invoke(ctx, Daemon_GetExternalIP_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) ListMappings(ctx context.Context, in *ListMappingsRequest, opts ...grpc.CallOption) (*ListMappingsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListMappingsResponse)
+	err := c.cc.Invoke(ctx, Daemon_ListMappings_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) AddMapping(ctx context.Context, in *AddMappingRequest, opts ...grpc.CallOption) (*Mapping, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Mapping)
+	err := c.cc.Invoke(ctx, Daemon_AddMapping_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) DeleteMapping(ctx context.Context, in *DeleteMappingRequest, opts ...grpc.CallOption) (*DeleteMappingResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteMappingResponse)
+	err := c.cc.Invoke(ctx, Daemon_DeleteMapping_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) RenewMapping(ctx context.Context, in *RenewMappingRequest, opts ...grpc.CallOption) (*Mapping, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Mapping)
+	err := c.cc.Invoke(ctx, Daemon_RenewMapping_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) Events(ctx context.Context, in *EventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[0], Daemon_Events_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[EventsRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Daemon_EventsClient = grpc.ServerStreamingClient[Event]
+
+// DaemonServer is the server API for Daemon service.
+// All implementations must embed UnimplementedDaemonServer
+// for forward compatibility.
+//
+// Daemon manages the port mappings of the device used by upnpctl daemon.
+// When the daemon has a token, calls must carry it as "authorization: Bearer <token>" metadata.
+type DaemonServer interface {
+	// The discovered UPnP devices.
+	ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error)
+	// The external IP address of the device.
+	GetExternalIP(context.Context, *GetExternalIPRequest) (*GetExternalIPResponse, error)
+	// The managed port mappings.
+	ListMappings(context.Context, *ListMappingsRequest) (*ListMappingsResponse, error)
+	// Add a port mapping and keep it alive. Adding a managed mapping renews it.
+	AddMapping(context.Context, *AddMappingRequest) (*Mapping, error)
+	// Stop managing a port mapping and delete it from the device.
+	DeleteMapping(context.Context, *DeleteMappingRequest) (*DeleteMappingResponse, error)
+	// Renew a managed port mapping immediately.
+	RenewMapping(context.Context, *RenewMappingRequest) (*Mapping, error)
+	// A stream of the daemon's events, until the call is canceled.
+	Events(*EventsRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedDaemonServer()
+}
+
+// UnimplementedDaemonServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedDaemonServer struct{}
+
+func (UnimplementedDaemonServer) ListDevices(context.Context, *ListDevicesRequest) (*ListDevicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDevices not implemented")
+}
+func (UnimplementedDaemonServer) GetExternalIP(context.Context, *GetExternalIPRequest) (*GetExternalIPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetExternalIP not implemented")
+}
+func (UnimplementedDaemonServer) ListMappings(context.Context, *ListMappingsRequest) (*ListMappingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMappings not implemented")
+}
+func (UnimplementedDaemonServer) AddMapping(context.Context, *AddMappingRequest) (*Mapping, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddMapping not implemented")
+}
+func (UnimplementedDaemonServer) DeleteMapping(context.Context, *DeleteMappingRequest) (*DeleteMappingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteMapping not implemented")
+}
+func (UnimplementedDaemonServer) RenewMapping(context.Context, *RenewMappingRequest) (*Mapping, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenewMapping not implemented")
+}
+func (UnimplementedDaemonServer) Events(*EventsRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Errorf(codes.Unimplemented, "method Events not implemented")
+}
+func (UnimplementedDaemonServer) mustEmbedUnimplementedDaemonServer() {}
+func (UnimplementedDaemonServer) testEmbeddedByValue()                {}
+
+// UnsafeDaemonServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DaemonServer will
+// result in compilation errors.
+type UnsafeDaemonServer interface {
+	mustEmbedUnimplementedDaemonServer()
+}
+
+func RegisterDaemonServer(s grpc.ServiceRegistrar, srv DaemonServer) {
+	// If the following call pancis, it indicates UnimplementedDaemonServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Daemon_ServiceDesc, srv)
+}
+
+func _Daemon_ListDevices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDevicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).ListDevices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_ListDevices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).ListDevices(ctx, req.(*ListDevicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_GetExternalIP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetExternalIPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).GetExternalIP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_GetExternalIP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).GetExternalIP(ctx, req.(*GetExternalIPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_ListMappings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMappingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).ListMappings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_ListMappings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).ListMappings(ctx, req.(*ListMappingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_AddMapping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddMappingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).AddMapping(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_AddMapping_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).AddMapping(ctx, req.(*AddMappingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_DeleteMapping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteMappingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).DeleteMapping(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_DeleteMapping_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).DeleteMapping(ctx, req.(*DeleteMappingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_RenewMapping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewMappingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).RenewMapping(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_RenewMapping_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).RenewMapping(ctx, req.(*RenewMappingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_Events_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(EventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DaemonServer).Events(m, &grpc.GenericServerStream[EventsRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Daemon_EventsServer = grpc.ServerStreamingServer[Event]
+
+// Daemon_ServiceDesc is the grpc.ServiceDesc for Daemon service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Daemon_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "upnpctl.v1.Daemon",
+	HandlerType: (*DaemonServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListDevices",
+			Handler:    _Daemon_ListDevices_Handler,
+		},
+		{
+			MethodName: "GetExternalIP",
+			Handler:    _Daemon_GetExternalIP_Handler,
+		},
+		{
+			MethodName: "ListMappings",
+			Handler:    _Daemon_ListMappings_Handler,
+		},
+		{
+			MethodName: "AddMapping",
+			Handler:    _Daemon_AddMapping_Handler,
+		},
+		{
+			MethodName: "DeleteMapping",
+			Handler:    _Daemon_DeleteMapping_Handler,
+		},
+		{
+			MethodName: "RenewMapping",
+			Handler:    _Daemon_RenewMapping_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Events",
+			Handler:       _Daemon_Events_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "daemon.proto",
+}
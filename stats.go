@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpStats = `
+	Usage: upnpctl [-v] stats [options]
+
+	polls the traffic counters of the device's WAN
+	interface and prints the computed download and
+	upload throughput.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found.
+
+	  --interval, time between samples (defaults to 2s)
+
+	  --count, number of samples to print before exiting
+	  (defaults to 0, which runs until interrupted)
+` + helpFooter
+
+func statsCmd(args []string) {
+	f := flag.NewFlagSet(string(stats), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpStats)
+	}
+	id := f.String("id", "", "")
+	interval := f.Duration("interval", 2*time.Second, "")
+	count := f.Int("count", 0, "")
+	f.Parse(args)
+
+	ctx := context.Background()
+
+	if *interval <= 0 {
+		usage("Invalid interval: " + interval.String())
+	}
+
+	c := selectClient(*id)
+
+	prev, err := c.igd.GetTrafficStats(ctx)
+	if err != nil {
+		fail(err, fmt.Sprintf("Failed to get traffic stats (%s)", err))
+	}
+	prevTime := time.Now()
+
+	fmt.Printf("Polling %s (%s) every %s...\n", c.name, c.ip, *interval)
+	for i := 0; *count == 0 || i < *count; i++ {
+		time.Sleep(*interval)
+		cur, err := c.igd.GetTrafficStats(ctx)
+		if err != nil {
+			fail(err, fmt.Sprintf("Failed to get traffic stats (%s)", err))
+		}
+		now := time.Now()
+		secs := now.Sub(prevTime).Seconds()
+
+		down := float64(upnp.CounterDelta(prev.BytesReceived, cur.BytesReceived)) / secs
+		up := float64(upnp.CounterDelta(prev.BytesSent, cur.BytesSent)) / secs
+		downPkts := float64(upnp.CounterDelta(prev.PacketsReceived, cur.PacketsReceived)) / secs
+		upPkts := float64(upnp.CounterDelta(prev.PacketsSent, cur.PacketsSent)) / secs
+
+		fmt.Printf("  down %s/s (%.0f pkt/s)  up %s/s (%.0f pkt/s)\n",
+			byteSize(down), downPkts, byteSize(up), upPkts)
+
+		prev, prevTime = cur, now
+	}
+}
+
+func byteSize(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0f B", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", b/div, "KMGTPE"[exp])
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpStatus = `
+	Usage: upnpctl [-v] status [options]
+
+	prints whether the device's WAN connection is up, and
+	the status of each of its WAN connection services.
+	exits with 1 when no connection is up.
+
+	Options:
+	  --id, the device id. required	when more than one
+	  device is found and none of them owns the default
+	  route.
+` + helpFooter
+
+func statusCmd(args []string) {
+	f := flag.NewFlagSet(string(wanStatus), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpStatus)
+	}
+	id := f.String("id", "", "")
+	f.Parse(args)
+
+	ctx := context.Background()
+	c := selectClient(*id)
+
+	fmt.Printf("WAN connections of %s (%s):\n", c.name, c.ip)
+	for _, s := range c.igd.Services() {
+		info, err := s.GetStatusInfo(ctx)
+		switch {
+		case upnp.IsErrorCode(err, upnp.ErrCodeInvalidAction, upnp.ErrCodeOptionalActionNotImplemented):
+			fmt.Printf("  %s: status unknown\n", s.ID())
+		case err != nil:
+			fmt.Printf("  %s: failed to get status (%s)\n", s.ID(), err)
+		case info.LastConnectionError != "" && info.LastConnectionError != "ERROR_NONE":
+			fmt.Printf("  %s: %s, up %s (last error %s)\n", s.ID(), info.ConnectionStatus, info.Uptime, info.LastConnectionError)
+		default:
+			fmt.Printf("  %s: %s, up %s\n", s.ID(), info.ConnectionStatus, info.Uptime)
+		}
+	}
+
+	connected, err := c.igd.IsConnected(ctx)
+	if err != nil {
+		fail(err, fmt.Sprintf("Failed to get the connection status (%s)", err))
+	}
+	if !connected {
+		fmt.Printf("%s is not connected\n", c.name)
+		os.Exit(exitError)
+	}
+	fmt.Printf("%s is connected\n", c.name)
+}
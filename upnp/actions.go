@@ -0,0 +1,155 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The action list of a service description (SCPD).
+type upnpSCPD struct {
+	Actions []struct {
+		Name string `xml:"name"`
+	} `xml:"actionList>action"`
+}
+
+// The actions a service supports, by control URL, so the SCPD is downloaded once.
+var serviceActions sync.Map
+
+type actionSet struct {
+	mut    sync.Mutex
+	loaded bool
+	// The actions of the SCPD, nil when it could not be read.
+	scpd map[string]bool
+	// Whether the control URL answered an OPTIONS request with an Allow header lacking
+	// POST, so it takes no actions at all.
+	noPost bool
+	// The results of probing actions without an SCPD.
+	probed map[string]bool
+}
+
+// The actions Supports may probe by sending them, which only read the device's state.
+var probedActions = map[string]bool{
+	"GetConnectionTypeInfo":       true,
+	"GetStatusInfo":               true,
+	"GetNATRSIPStatus":            true,
+	"GetExternalIPAddress":        true,
+	"GetGenericPortMappingEntry":  true,
+	"GetSpecificPortMappingEntry": true,
+	"GetListOfPortMappings":       true,
+	"GetCommonLinkProperties":     true,
+	"GetTotalBytesSent":           true,
+	"GetTotalBytesReceived":       true,
+	"GetTotalPacketsSent":         true,
+	"GetTotalPacketsReceived":     true,
+	"GetFirewallStatus":           true,
+	"GetOutboundPinholeTimeout":   true,
+	"GetPinholePackets":           true,
+	"CheckPinholeWorking":         true,
+}
+
+// List the actions of the service, as its description (SCPD) declares them.
+func (s *IGDService) Actions(ctx context.Context) ([]string, error) {
+	data, err := s.RawSCPD(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var scpd upnpSCPD
+	if err := s.client.unmarshalDescription(s.logger(), data, &scpd); err != nil {
+		return nil, fmt.Errorf("invalid service description: %w", err)
+	}
+	actions := make([]string, 0, len(scpd.Actions))
+	for _, a := range scpd.Actions {
+		if name := strings.TrimSpace(a.Name); name != "" {
+			actions = append(actions, name)
+		}
+	}
+	return actions, nil
+}
+
+// Whether the service supports the action, e.g. AddAnyPortMapping, so callers can pick
+// between alternatives without failing requests. It is looked up in the service's SCPD,
+// downloaded on first use. For services without a readable SCPD, an OPTIONS request to the
+// control URL tells whether it takes actions at all, and read-only actions (Get*) are
+// probed by sending them without arguments, which routers reject with Invalid Args when
+// they implement them. Other actions, which may change the device, are never sent and,
+// like those the probe is inconclusive for, are assumed to be supported.
+func (s *IGDService) Supports(action string) bool {
+	v, _ := serviceActions.LoadOrStore(s.serviceURL, &actionSet{})
+	set := v.(*actionSet)
+	set.mut.Lock()
+	defer set.mut.Unlock()
+
+	ctx := context.Background()
+	if !set.loaded {
+		set.loaded = true
+		if actions, err := s.Actions(ctx); err != nil || len(actions) == 0 {
+			s.logger().Debug("Cannot read actions from the service description, probing them", "err", err)
+		} else {
+			set.scpd = make(map[string]bool, len(actions))
+			for _, a := range actions {
+				set.scpd[a] = true
+			}
+		}
+		if set.scpd == nil {
+			set.noPost = s.refusesPost(ctx)
+		}
+	}
+	switch {
+	case set.scpd != nil:
+		return set.scpd[action]
+	case set.noPost:
+		return false
+	}
+
+	if supported, ok := set.probed[action]; ok {
+		return supported
+	}
+	if !probedActions[action] {
+		// Not worth risking a change to the device.
+		return true
+	}
+	body := fmt.Sprintf(`<u:%s xmlns:u="%s" />`, action, s.serviceURN)
+	_, err := s.soapRequest(ctx, action, body)
+	var soapErr *SOAPError
+	if err != nil && !errors.As(err, &soapErr) {
+		// Unreachable, the answer is only a guess.
+		return true
+	}
+	supported := !IsErrorCode(err, ErrCodeInvalidAction, ErrCodeOptionalActionNotImplemented)
+	if set.probed == nil {
+		set.probed = make(map[string]bool)
+	}
+	set.probed[action] = supported
+	return supported
+}
+
+// Whether the control URL answers an OPTIONS request with an Allow header lacking POST.
+// Devices which do not implement OPTIONS, most of them, are not taken to refuse POST.
+func (s *IGDService) refusesPost(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, s.client.requestTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, s.serviceURL, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := s.client.do(s.uuid, req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	allow := resp.Header.Get("Allow")
+	if resp.StatusCode >= 300 || allow == "" {
+		return false
+	}
+	for _, method := range strings.Split(allow, ",") {
+		if strings.EqualFold(strings.TrimSpace(method), http.MethodPost) {
+			return false
+		}
+	}
+	s.logger().Debug("Control URL does not allow POST", "allow", allow)
+	return true
+}
@@ -0,0 +1,102 @@
+package upnp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+// A transport failing the SCPD downloads of devices, recording the actions sent.
+type noSCPDTransport struct {
+	allow string
+
+	mut     sync.Mutex
+	actions []string
+}
+
+func (t *noSCPDTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	switch {
+	case r.Method == http.MethodGet && !strings.HasSuffix(r.URL.Path, "/rootDesc.xml"):
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{},
+			Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	case r.Method == http.MethodOptions && t.allow != "":
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Allow": {t.allow}},
+			Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	case r.Method == http.MethodPost:
+		action := r.Header.Get("SOAPAction")
+		t.mut.Lock()
+		t.actions = append(t.actions, action[strings.LastIndex(action, "#")+1:len(action)-1])
+		t.mut.Unlock()
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestSupports(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("SCPD", func(t *testing.T) {
+		s := upnptest.NewServer()
+		defer s.Close()
+		igd, err := (&upnp.Client{}).LoadIGD(ctx, s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service := igd.Services()[0]
+		if !service.Supports("AddPortMapping") {
+			t.Error("AddPortMapping not supported, the SCPD declares it")
+		}
+		if service.Supports("AddAnyPortMapping") {
+			t.Error("AddAnyPortMapping supported, the SCPD lacks it")
+		}
+	})
+
+	t.Run("probe", func(t *testing.T) {
+		s := upnptest.NewServer()
+		defer s.Close()
+		transport := &noSCPDTransport{}
+		igd, err := (&upnp.Client{HTTPClient: &http.Client{Transport: transport}}).LoadIGD(ctx, s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service := igd.Services()[0]
+		if !service.Supports("GetStatusInfo") {
+			t.Error("GetStatusInfo not supported, the server implements it")
+		}
+		if service.Supports("GetListOfPortMappings") {
+			t.Error("GetListOfPortMappings supported, the server fails it with Invalid Action")
+		}
+		for _, action := range []string{"ForceTermination", "RequestConnection", "AddPortMapping"} {
+			if !service.Supports(action) {
+				t.Errorf("%s not assumed to be supported", action)
+			}
+		}
+		transport.mut.Lock()
+		defer transport.mut.Unlock()
+		if want := []string{"GetStatusInfo", "GetListOfPortMappings"}; strings.Join(transport.actions, ",") != strings.Join(want, ",") {
+			t.Errorf("sent the actions %v, want %v", transport.actions, want)
+		}
+	})
+
+	t.Run("no POST", func(t *testing.T) {
+		s := upnptest.NewServer()
+		defer s.Close()
+		transport := &noSCPDTransport{allow: "GET, HEAD"}
+		igd, err := (&upnp.Client{HTTPClient: &http.Client{Transport: transport}}).LoadIGD(ctx, s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service := igd.Services()[0]
+		if service.Supports("GetStatusInfo") || service.Supports("AddPortMapping") {
+			t.Error("actions supported by a control URL refusing POST")
+		}
+		if len(transport.actions) > 0 {
+			t.Errorf("sent the actions %v", transport.actions)
+		}
+	})
+}
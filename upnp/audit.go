@@ -0,0 +1,129 @@
+package upnp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A change a client made or tried to make to a device, as recorded by an AuditSink.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// The UUID of the device, and the ID and control URL of the service acted on.
+	Device     string `json:"device"`
+	Service    string `json:"service"`
+	ControlURL string `json:"controlURL"`
+	// The local IP address of the client, which made the change.
+	LocalIP string `json:"localIP,omitempty"`
+	// The SOAP action and its arguments, e.g. AddPortMapping with its NewExternalPort.
+	Action    string            `json:"action"`
+	Arguments map[string]string `json:"arguments,omitempty"`
+	// Why the action failed, empty when it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// An AuditSink records the changes a client makes to devices: the port mappings and
+// pinholes it adds, updates and deletes. See Client.Audit.
+type AuditSink interface {
+	Record(AuditEntry)
+}
+
+// An AuditFunc is an AuditSink calling the function.
+type AuditFunc func(AuditEntry)
+
+func (f AuditFunc) Record(e AuditEntry) {
+	f(e)
+}
+
+// An AuditLog is an AuditSink writing the entries to a writer, like an audit log file
+// opened for appending, as JSON lines.
+type AuditLog struct {
+	mut sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// An AuditLog writing to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+func (l *AuditLog) Record(e AuditEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.err != nil {
+		return
+	}
+	_, l.err = l.w.Write(append(data, '\n'))
+}
+
+// The first error writing an entry, after which no more are written.
+func (l *AuditLog) Err() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.err
+}
+
+// The SOAP actions which change devices, and are audited.
+var auditedActions = map[string]bool{
+	"AddPortMapping":         true,
+	"AddAnyPortMapping":      true,
+	"DeletePortMapping":      true,
+	"DeletePortMappingRange": true,
+	"AddPinhole":             true,
+	"UpdatePinhole":          true,
+	"DeletePinhole":          true,
+}
+
+func (c *Client) audit() AuditSink {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.Audit
+}
+
+// Record the SOAP action with the message in the client's audit sink, if it is audited.
+func (s *IGDService) audit(start time.Time, action, message string, err error) {
+	sink := s.client.audit()
+	if sink == nil || !auditedActions[action] {
+		return
+	}
+	e := AuditEntry{
+		Time:       start,
+		Device:     s.uuid,
+		Service:    s.serviceID,
+		ControlURL: s.serviceURL,
+		LocalIP:    s.localIPAddress,
+		Action:     action,
+		Arguments:  actionArguments(message),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	sink.Record(e)
+}
+
+// The arguments of the SOAP action message, e.g. <u:DeletePinhole><UniqueID>1</UniqueID></u:DeletePinhole>.
+func actionArguments(message string) map[string]string {
+	var action struct {
+		Arguments []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	if xml.Unmarshal([]byte(message), &action) != nil {
+		return nil
+	}
+	args := make(map[string]string, len(action.Arguments))
+	for _, arg := range action.Arguments {
+		args[arg.XMLName.Local] = strings.TrimSpace(arg.Value)
+	}
+	return args
+}
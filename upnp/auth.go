@@ -0,0 +1,223 @@
+package upnp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The credentials of a device protecting its URLs with HTTP Basic or Digest authentication,
+// see Client.Auth.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// The credentials for requests to u of the device with the UUID uuid: those of the UUID,
+// else of the host of u, else the default ones. Nil when there are none.
+func (c *Client) credentials(uuid string, u *url.URL) *Credentials {
+	if c == nil {
+		c = DefaultClient
+	}
+	if creds, ok := c.DeviceAuth[uuid]; ok && uuid != "" {
+		return creds
+	}
+	if creds, ok := c.DeviceAuth[u.Hostname()]; ok {
+		return creds
+	}
+	return c.Auth
+}
+
+// Send the request req to the device with the UUID uuid, any when empty, authenticating
+// with its credentials when it answers with 401 Unauthorized. Requests to the same host
+// later answer the challenge right away.
+func (c *Client) do(uuid string, req *http.Request) (*http.Response, error) {
+	client := withRequestRedirectPolicy(c.capturingHTTPClient(c.deviceHTTPClient(uuid, req.URL)), req)
+	creds := c.credentials(uuid, req.URL)
+	if creds == nil {
+		return client.Do(req)
+	}
+
+	key := authKey{creds, req.URL.Host}
+	if ch, ok := authChallenges.Load(key); ok {
+		req.Header.Set("Authorization", ch.(*authChallenge).authorization(creds, req))
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	ch := parseAuthChallenge(resp.Header.Values("WWW-Authenticate"))
+	if ch == nil || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	authChallenges.Store(key, ch)
+	retry.Header.Set("Authorization", ch.authorization(creds, retry))
+	return client.Do(retry)
+}
+
+// The last authentication challenge of each host, by the credentials answering it.
+var authChallenges sync.Map
+
+type authKey struct {
+	creds *Credentials
+	host  string
+}
+
+// A Basic or Digest (RFC 7616) authentication challenge.
+type authChallenge struct {
+	digest    bool
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+
+	mut sync.Mutex
+	nc  int
+}
+
+// The challenge the device prefers of the WWW-Authenticate headers, Digest ones over
+// Basic ones. Nil when there is none of them.
+func parseAuthChallenge(headers []string) *authChallenge {
+	var basic *authChallenge
+	for _, h := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(h), " ")
+		switch strings.ToLower(scheme) {
+		case "basic":
+			basic = &authChallenge{}
+		case "digest":
+			ch := &authChallenge{digest: true}
+			for k, v := range parseAuthParams(params) {
+				switch k {
+				case "realm":
+					ch.realm = v
+				case "nonce":
+					ch.nonce = v
+				case "opaque":
+					ch.opaque = v
+				case "algorithm":
+					ch.algorithm = v
+				case "qop":
+					// Take auth from a list of the protections offered.
+					for _, q := range strings.Split(v, ",") {
+						if strings.TrimSpace(q) == "auth" {
+							ch.qop = "auth"
+						}
+					}
+				}
+			}
+			if ch.hash() != nil {
+				return ch
+			}
+		}
+	}
+	return basic
+}
+
+// The parameters of a challenge, e.g. realm="igd", nonce="abc".
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimSpace(rest)
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			value = strings.ReplaceAll(rest[1:min(end, len(rest))], `\`, "")
+			rest = rest[min(end+1, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[name] = value
+		rest = strings.TrimSpace(rest)
+		s = strings.TrimPrefix(rest, ",")
+		s = strings.TrimSpace(s)
+	}
+	return params
+}
+
+// The hash function of the digest algorithm, nil when it is not supported.
+func (ch *authChallenge) hash() func() hash.Hash {
+	switch strings.ToUpper(ch.algorithm) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// The Authorization header answering the challenge for the request req.
+func (ch *authChallenge) authorization(creds *Credentials, req *http.Request) string {
+	if !ch.digest {
+		r := &http.Request{Header: http.Header{}}
+		r.SetBasicAuth(creds.Username, creds.Password)
+		return r.Header.Get("Authorization")
+	}
+
+	h := ch.hash()
+	sum := func(s string) string {
+		d := h()
+		io.WriteString(d, s)
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	uri := req.URL.RequestURI()
+	ha1 := sum(creds.Username + ":" + ch.realm + ":" + creds.Password)
+	ha2 := sum(req.Method + ":" + uri)
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		quoteAuth(creds.Username), quoteAuth(ch.realm), quoteAuth(ch.nonce), quoteAuth(uri))
+	if ch.qop != "" {
+		ch.mut.Lock()
+		ch.nc++
+		nc := fmt.Sprintf("%08x", ch.nc)
+		ch.mut.Unlock()
+		var b [8]byte
+		rand.Read(b[:])
+		cnonce := hex.EncodeToString(b[:])
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+			nc, cnonce, sum(ha1+":"+ch.nonce+":"+nc+":"+cnonce+":auth:"+ha2))
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, sum(ha1+":"+ch.nonce+":"+ha2))
+	}
+	if ch.algorithm != "" {
+		header += ", algorithm=" + ch.algorithm
+	}
+	if ch.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, quoteAuth(ch.opaque))
+	}
+	return header
+}
+
+func quoteAuth(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
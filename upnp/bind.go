@@ -0,0 +1,105 @@
+package upnp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The HTTP clients with source bindings, by the client they are derived from and the
+// binding, so connections are reused.
+var boundClients sync.Map
+
+type boundClientKey struct {
+	base *http.Client
+	bind sourceBinding
+}
+
+// Where HTTP connections to devices are made from, see Client.SourceIP.
+type sourceBinding struct {
+	ip    string
+	iface string
+}
+
+// The client's HTTP client with its transport bound to the source address and interface
+// of the client. Clients with a transport other than an http.Transport are used as they are.
+func (c *Client) boundHTTPClient(base *http.Client) *http.Client {
+	var bind sourceBinding
+	if c.SourceIP != nil {
+		bind.ip = c.SourceIP.String()
+	}
+	if c.SourceInterface != nil {
+		bind.iface = c.SourceInterface.Name
+	}
+	key := boundClientKey{base, bind}
+	if client, ok := boundClients.Load(key); ok {
+		return client.(*http.Client)
+	}
+
+	var transport *http.Transport
+	switch t := base.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		c.logger().Warn("Not binding custom HTTP transport to the source address")
+		return base
+	}
+	transport.DialContext = bind.dialContext
+	client := *base
+	client.Transport = transport
+	actual, _ := boundClients.LoadOrStore(key, &client)
+	return actual.(*http.Client)
+}
+
+// Dial address from the source address, or the interface's address of the family of
+// address, bound to the interface where the system supports it.
+func (b sourceBinding) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	var remote net.IP
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		remote = net.ParseIP(host)
+	}
+	var ifi *net.Interface
+	if b.iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(b.iface); err != nil {
+			return nil, err
+		}
+		d.Control = bindToDevice(b.iface)
+	}
+	if src := b.source(ifi, remote); src != nil {
+		d.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// The source address of connections to remote: the binding's, else an address of ifi of
+// the same family. Nil to let the system choose.
+func (b sourceBinding) source(ifi *net.Interface, remote net.IP) net.IP {
+	if b.ip != "" {
+		return net.ParseIP(b.ip)
+	}
+	if ifi == nil {
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	v4 := remote == nil || remote.To4() != nil
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != v4 {
+			continue
+		}
+		if !v4 && ipNet.IP.IsLinkLocalUnicast() != remote.IsLinkLocalUnicast() {
+			continue
+		}
+		return ipNet.IP
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package upnp
+
+import "syscall"
+
+// Bind sockets to the network interface, so their traffic leaves through it whatever
+// the routing table says. This may need CAP_NET_RAW.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
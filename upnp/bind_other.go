@@ -0,0 +1,11 @@
+//go:build !linux
+
+package upnp
+
+import "syscall"
+
+// Sockets are only bound to interfaces on Linux, elsewhere the interface's address is
+// the source address.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,338 @@
+package upnp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Capture writes the SSDP and HTTP traffic of a client to a pcapng file, which Wireshark
+// and tcpdump open, e.g. to analyze interop problems with a router or to attach it to a
+// bug report. Add it to Client.Middleware: it captures the SSDP packets, and the HTTP
+// exchanges on the transport the client ends up using, with its TLS configuration and
+// source binding. It is also an http.RoundTripper, capturing the exchanges of other clients.
+//
+// The packets are rebuilt from what the client sends and receives, not sniffed: HTTP is
+// written as it is before TLS, and the local address of SSDP packets, which sockets do not
+// reveal, as the unspecified address.
+type Capture struct {
+	NopMiddleware
+	transport http.RoundTripper
+
+	mut     sync.Mutex
+	w       io.Writer
+	err     error
+	started bool
+	streams map[string]*tcpStream
+	port    uint16
+}
+
+// A TCP connection in a capture, with the next sequence numbers of the client and the server.
+type tcpStream struct {
+	client, server uint32
+}
+
+// A Capture sending HTTP requests through transport, or the shared transport of clients
+// without an HTTPClient when nil, and writing the packets to w.
+func NewCapture(w io.Writer, transport http.RoundTripper) *Capture {
+	if transport == nil {
+		transport = defaultHTTPClient.Transport
+	}
+	return &Capture{transport: transport, w: w, streams: make(map[string]*tcpStream), port: 49152}
+}
+
+// The first error writing the capture, after which no more packets are written.
+func (c *Capture) Err() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.err
+}
+
+func (c *Capture) OnSSDPPacket(p *SSDPPacket) bool {
+	remote, _ := p.Addr.(*net.UDPAddr)
+	if remote == nil {
+		return true
+	}
+	local := &net.UDPAddr{IP: unspecified(remote.IP)}
+	src, dst := local, remote
+	if !p.Outgoing {
+		src, dst = remote, local
+	}
+
+	udp := make([]byte, 8, 8+len(p.Data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(p.Data)))
+	udp = append(udp, p.Data...)
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.packet(time.Now(), src.IP, dst.IP, protocolUDP, udp)
+	return true
+}
+
+func (c *Capture) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.roundTrip(c.transport, req, DefaultClient.logger())
+}
+
+// A transport of a client capturing its HTTP exchanges to a Capture.
+type captureTransport struct {
+	c         *Capture
+	transport http.RoundTripper
+	logger    *slog.Logger
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.c.roundTrip(t.transport, req, t.logger)
+}
+
+func (c *Capture) wrapTransport(transport http.RoundTripper, logger *slog.Logger) http.RoundTripper {
+	if transport == c {
+		// Already the transport of the client.
+		return c
+	}
+	return &captureTransport{c, transport, logger}
+}
+
+// Send req through transport, capturing the exchange. A response whose body fails to read
+// is passed on uncaptured, failing to read the same way.
+func (c *Capture) roundTrip(transport http.RoundTripper, req *http.Request, logger *slog.Logger) (*http.Response, error) {
+	var local, remote *net.TCPAddr
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			local, _ = info.Conn.LocalAddr().(*net.TCPAddr)
+			remote, _ = info.Conn.RemoteAddr().(*net.TCPAddr)
+		},
+	}
+	sent := time.Now()
+	out, dumpErr := httputil.DumpRequestOut(req, true)
+	resp, err := transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	var in []byte
+	if err == nil {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			logger.Warn("Not capturing HTTP response", "url", req.URL.Redacted(), "err", readErr)
+			resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{readErr}))
+		} else {
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			in, _ = httputil.DumpResponse(resp, true)
+		}
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if local == nil || remote == nil {
+		// No connection to inspect, e.g. with a Replayer: make one up.
+		local, remote = c.addrs(req)
+	}
+	s := c.stream(sent, local, remote)
+	if dumpErr == nil {
+		c.segments(sent, local, remote, &s.client, s.server, out)
+	}
+	if in != nil {
+		c.segments(time.Now(), remote, local, &s.server, s.client, in)
+	}
+	return resp, err
+}
+
+// A reader failing with err.
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+// Made up addresses of a connection for req: an unspecified local one on a port of its
+// own, and the host of the URL when it is an IP address.
+func (c *Capture) addrs(req *http.Request) (local, remote *net.TCPAddr) {
+	remote = &net.TCPAddr{IP: net.ParseIP(req.URL.Hostname())}
+	if remote.IP == nil {
+		remote.IP = net.IPv4zero
+	}
+	remote.Port, _ = strconv.Atoi(req.URL.Port())
+	if remote.Port == 0 {
+		remote.Port = 80
+		if req.URL.Scheme == "https" {
+			remote.Port = 443
+		}
+	}
+	c.port++
+	if c.port == 0 {
+		c.port = 49152
+	}
+	return &net.TCPAddr{IP: unspecified(remote.IP), Port: int(c.port)}, remote
+}
+
+// The TCP connection from local to remote, starting it with a handshake if it is a new one.
+func (c *Capture) stream(t time.Time, local, remote *net.TCPAddr) *tcpStream {
+	key := local.String() + ">" + remote.String()
+	if s, ok := c.streams[key]; ok {
+		return s
+	}
+	s := &tcpStream{client: 1000, server: 5000}
+	c.packet(t, local.IP, remote.IP, protocolTCP, tcpSegment(local, remote, s.client, 0, tcpSYN, nil))
+	c.packet(t, remote.IP, local.IP, protocolTCP, tcpSegment(remote, local, s.server, s.client+1, tcpSYN|tcpACK, nil))
+	s.client++
+	s.server++
+	c.packet(t, local.IP, remote.IP, protocolTCP, tcpSegment(local, remote, s.client, s.server, tcpACK, nil))
+	c.streams[key] = s
+	return s
+}
+
+// Write data sent from src to dst as TCP segments, advancing the sequence number seq.
+func (c *Capture) segments(t time.Time, src, dst *net.TCPAddr, seq *uint32, ack uint32, data []byte) {
+	const mss = 1460
+	for len(data) > 0 {
+		n := min(len(data), mss)
+		c.packet(t, src.IP, dst.IP, protocolTCP, tcpSegment(src, dst, *seq, ack, tcpPSH|tcpACK, data[:n]))
+		*seq += uint32(n)
+		data = data[n:]
+	}
+}
+
+// TCP flags.
+const (
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+func tcpSegment(src, dst *net.TCPAddr, seq, ack uint32, flags byte, data []byte) []byte {
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	return append(tcp, data...)
+}
+
+// The unspecified address of the family of ip.
+func unspecified(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return net.IPv4zero
+	}
+	return net.IPv6unspecified
+}
+
+// The pcapng blocks, and the link type of packets starting with their IP header.
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 1
+	pcapngEnhancedPacket = 6
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngLinkTypeRaw    = 101
+)
+
+// The IP protocol numbers of TCP and UDP.
+const (
+	protocolTCP = 6
+	protocolUDP = 17
+)
+
+// Write the UDP or TCP segment from src to dst as an IP packet, filling in its
+// checksum. The caller holds the lock.
+func (c *Capture) packet(t time.Time, src, dst net.IP, protocol byte, segment []byte) {
+	var packet, pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(segment)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64
+		ip[9] = protocol
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		packet = ip
+
+		pseudo = append(append([]byte{}, src4...), dst4...)
+		pseudo = append(pseudo, 0, protocol)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(segment)))
+		ip[6] = protocol
+		ip[7] = 64
+		copy(ip[8:], src.To16())
+		copy(ip[24:], dst.To16())
+		packet = ip
+
+		pseudo = append(append([]byte{}, src.To16()...), dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, protocol)
+	}
+
+	offset := 16
+	if protocol == protocolUDP {
+		offset = 6
+	}
+	sum := checksum(pseudo, segment)
+	if sum == 0 && protocol == protocolUDP {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[offset:], sum)
+	packet = append(packet, segment...)
+
+	if !c.started {
+		c.started = true
+		shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+		shb = binary.LittleEndian.AppendUint16(shb, 1)
+		shb = binary.LittleEndian.AppendUint16(shb, 0)
+		shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // unknown section length
+		c.block(pcapngSectionHeader, shb)
+		idb := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeRaw)
+		idb = binary.LittleEndian.AppendUint16(idb, 0)
+		idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+		c.block(pcapngInterface, idb)
+	}
+	us := uint64(t.UnixMicro())
+	epb := binary.LittleEndian.AppendUint32(nil, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	c.block(pcapngEnhancedPacket, append(epb, packet...))
+}
+
+// Write a pcapng block with the body, padded to 32 bits.
+func (c *Capture) block(typ uint32, body []byte) {
+	if c.err != nil {
+		return
+	}
+	pad := (4 - len(body)%4) % 4
+	total := uint32(12 + len(body) + pad)
+	b := binary.LittleEndian.AppendUint32(nil, typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = append(b, make([]byte, pad)...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	_, c.err = c.w.Write(b)
+}
+
+// The internet checksum of the data.
+func checksum(data ...[]byte) uint16 {
+	var sum uint32
+	for _, d := range data {
+		for i := 0; i+1 < len(d); i += 2 {
+			sum += uint32(d[i])<<8 | uint32(d[i+1])
+		}
+		if len(d)%2 == 1 {
+			sum += uint32(d[len(d)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,77 @@
+package upnp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+// A Capture in the middleware captures the exchanges on the transport the client
+// configures, here one trusting the self-signed certificate of the device.
+func TestCaptureMiddleware(t *testing.T) {
+	s := upnptest.NewServer()
+	defer s.Close()
+	target, _ := url.Parse(s.URL)
+	https := httptest.NewTLSServer(httputil.NewSingleHostReverseProxy(&url.URL{Scheme: target.Scheme, Host: target.Host}))
+	defer https.Close()
+
+	var w bytes.Buffer
+	capture := upnp.NewCapture(&w, nil)
+	c := &upnp.Client{
+		AllowPublicAddresses: true,
+		TLS:                  &upnp.TLSConfig{RootCAs: https.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+		Middleware:           []upnp.Middleware{capture},
+	}
+	igd, err := c.LoadIGD(context.Background(), https.URL+"/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := igd.GetExternalIPAddress(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := capture.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"GET /rootDesc.xml", "POST /ctl/IPConn", "<NewExternalIPAddress>"} {
+		if !bytes.Contains(w.Bytes(), []byte(want)) {
+			t.Errorf("capture lacks %q", want)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// A response whose body fails to read is passed on, failing to read the same way.
+func TestCaptureBodyError(t *testing.T) {
+	errReset := errors.New("connection reset")
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		body := io.MultiReader(strings.NewReader("<root>"), &failingReader{errReset})
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(body), Request: r}, nil
+	})
+	capture := upnp.NewCapture(io.Discard, transport)
+	req, _ := http.NewRequest(http.MethodGet, "http://192.168.1.1:5000/rootDesc.xml", nil)
+	resp, err := capture.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("round trip failed with %v, want the response", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if string(body) != "<root>" || !errors.Is(err, errReset) {
+		t.Errorf("read %q and %v, want %q and %v", body, err, "<root>", errReset)
+	}
+}
+
+type failingReader struct{ err error }
+
+func (r *failingReader) Read(p []byte) (int, error) { return 0, r.err }
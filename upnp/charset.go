@@ -0,0 +1,100 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parse the device description data into v. Besides UTF-8, descriptions may be
+// encoded in US-ASCII, ISO-8859-1 or Windows-1252, as some older firmwares declare.
+// Malformed XML, e.g. with unescaped ampersands or unclosed elements, is parsed the way
+// browsers parse HTML unless the client is in strict mode.
+func (c *Client) unmarshalDescription(log *slog.Logger, data []byte, v any) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = c.charsetReader
+	err := d.Decode(v)
+	var syntaxErr *xml.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return err
+	}
+	if err := c.violation(log, "Malformed XML in description", "err", err); err != nil {
+		return err
+	}
+	reflect.ValueOf(v).Elem().SetZero()
+	d = xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = c.charsetReader
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	return d.Decode(v)
+}
+
+// Return a reader decoding input from charset to UTF-8. Unknown charsets are read as
+// UTF-8, as most devices declaring one send plain ASCII anyway, unless the client is in
+// strict mode.
+func (c *Client) charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "l1":
+		return &singleByteReader{r: bufio.NewReader(input)}, nil
+	case "windows-1252", "cp1252":
+		return &singleByteReader{r: bufio.NewReader(input), table: &windows1252}, nil
+	}
+	if c.parseMode() == ParseStrict || (c != nil && c.StrictCharset) {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return input, nil
+}
+
+// Decodes a single byte charset to UTF-8: ISO-8859-1, where each byte is the code point,
+// or a charset which differs from it in the range 0x80 to 0x9f.
+type singleByteReader struct {
+	r     *bufio.Reader
+	table *[32]rune
+	buf   []byte
+}
+
+func (s *singleByteReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(s.buf) > 0 {
+			c := copy(p[n:], s.buf)
+			s.buf = s.buf[c:]
+			n += c
+			continue
+		}
+		b, err := s.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		r := rune(b)
+		if s.table != nil && b >= 0x80 && b < 0xa0 {
+			r = s.table[b-0x80]
+		}
+		if r < utf8.RuneSelf {
+			p[n] = byte(r)
+			n++
+			continue
+		}
+		s.buf = utf8.AppendRune(s.buf[:0], r)
+	}
+	return n, nil
+}
+
+// The code points of the bytes 0x80 to 0x9f in Windows-1252, undefined ones mapped to themselves.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
@@ -0,0 +1,324 @@
+package upnp
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A Client discovers UPnP InternetGatewayDevices and performs requests on them.
+// The zero value is ready to use. Devices keep using the client which discovered them,
+// so clients with different configurations can be used side by side.
+type Client struct {
+	// The logger for discovery and SOAP requests. When nil, logging is
+	// controlled by the deprecated Debug and EnableLog.
+	Logger *slog.Logger
+
+	// The HTTP client for device descriptions and SOAP requests, defaults to a shared client
+	// which reuses connections to each gateway.
+	// Its transport may e.g. pin an interface or source address with a custom DialContext,
+	// add instrumentation or go through a proxy. The local IP address of devices is taken
+	// from the connections it makes.
+	HTTPClient *http.Client
+
+	// How long discovery waits for devices to respond, defaults to 3 seconds.
+	DiscoveryTimeout time.Duration
+
+	// The MX of search requests, the number of seconds devices may delay their responses
+	// by to spread them out. Defaults to what leaves SearchGrace of the discovery timeout,
+	// from 1 to 5 seconds.
+	SearchMX int
+
+	// How long discovery keeps listening after the MX, for devices answering late, defaults
+	// to 1 second, none when negative. Discovery listens for the discovery timeout or MX
+	// plus SearchGrace, whichever is longer.
+	SearchGrace time.Duration
+
+	// How many times discovery searches again when no devices respond, doubling the timeout
+	// each time, as the first search after an interface comes up is often lost.
+	DiscoveryRetries int
+
+	// Sort the results of Discover with SortIGDs, so callers taking the first
+	// device get the same, most suitable one on every run.
+	SortResults bool
+
+	// How long an attempt of a device description download or SOAP request may take, defaults to 10 seconds.
+	// A deadline of the request's context which is sooner takes precedence.
+	RequestTimeout time.Duration
+
+	// How failed SOAP requests and description downloads are retried, not at all when nil.
+	// Each attempt may take up to RequestTimeout.
+	Retry *RetryPolicy
+
+	// The maximum size of a device description or SOAP response, defaults to DefaultMaxResponseSize.
+	// Larger responses fail with ErrResponseTooLarge.
+	MaxResponseSize int64
+
+	// How strictly device descriptions and search responses are parsed, ParseLenient by
+	// default.
+	ParseMode ParseMode
+
+	// Fail on device descriptions declaring a charset other than UTF-8, US-ASCII, ISO-8859-1
+	// and Windows-1252, instead of reading them as UTF-8.
+	//
+	// Deprecated: ParseStrict fails on them too.
+	StrictCharset bool
+
+	// The network interface to send search requests on, defaults to the system's choice.
+	Interface *net.Interface
+
+	// The local address and interface HTTP connections to devices are made from, e.g. on
+	// multi-WAN or VPN hosts whose default route would send control traffic the wrong way.
+	// Connections from SourceInterface are made from its address of the device's address
+	// family unless SourceIP is set, and on Linux are bound to it. They replace the dialer
+	// of the HTTPClient's transport.
+	SourceIP        net.IP
+	SourceInterface *net.Interface
+
+	// The UDP address search requests are sent to, defaults to the SSDP multicast address
+	// 239.255.255.250:1900. A unicast address searches a single device, e.g. a upnptest.Server.
+	SearchAddr string
+
+	// The local IP address port mappings point to. When empty, LocalIPStrategy determines
+	// it for each device, by default the address used to reach the device.
+	LocalIP         string
+	LocalIPStrategy LocalIPStrategy
+
+	// The User-Agent of description and SOAP requests, defaults to DefaultUserAgent.
+	// Some routers apply quirks based on it.
+	UserAgent string
+
+	// Headers added to every description and SOAP request. WithHeader adds headers to single requests.
+	Header http.Header
+
+	// Which services the port mapping methods of devices act on, all of them by default.
+	// DefaultClient acts on those whose connection is up, PolicyConnectedServices.
+	ServicePolicy ServicePolicy
+
+	// The service types PreferredService prefers, defaults to DefaultServicePreference.
+	ServicePreference []string
+
+	// The quirks applied to devices with known-broken firmware, DefaultQuirks when nil.
+	Quirks []Quirk
+
+	// Read port mappings back with GetSpecificPortMappingEntry after adding them, and fail
+	// with ErrMappingNotEffective when the router silently ignored them. This costs a
+	// request per mapping, and routers which cannot look up mappings are not checked.
+	VerifyMappings bool
+
+	// The maximum number of concurrent SOAP requests to each device, unlimited when 0.
+	// Some router firmwares crash or return garbage when hit with parallel requests;
+	// 1 serializes the requests to each device.
+	MaxConcurrentRequests int
+
+	// The maximum rate of SOAP requests to each device per second, unlimited when 0.
+	// Bulk operations like listing hundreds of mappings can trip the watchdog of routers
+	// with slow CPUs. RequestBurst requests may be sent at once after a pause, 1 when 0.
+	RequestRate  float64
+	RequestBurst int
+
+	// Load devices whose description, control and event URLs point anywhere. By default
+	// they must point to private, link-local or loopback addresses, and devices found by
+	// discovery only to the subnet of the interface their answer arrived on, so devices
+	// cannot make the client send requests to other hosts (SSDP-based SSRF).
+	AllowPublicAddresses bool
+
+	// Which devices the client operates on, all when nil. Devices it rules out are left out
+	// of discovery results and fail to load with ErrDeviceNotAllowed.
+	Devices *DeviceFilter
+
+	// How HTTPS requests to devices verify their certificates, e.g. to accept the
+	// self-signed ones of devices with https control URLs. DeviceTLS configures single
+	// devices, by UUID or the host of their URLs, and takes precedence.
+	TLS       *TLSConfig
+	DeviceTLS map[string]*TLSConfig
+
+	// The credentials for devices protecting their description and control URLs with
+	// HTTP Basic or Digest authentication. DeviceAuth sets those of single devices, by UUID
+	// or the host of their URLs, and takes precedence. They are sent once a device asks
+	// for them.
+	Auth       *Credentials
+	DeviceAuth map[string]*Credentials
+
+	// The HTTP server the GENA events of subscriptions are delivered to.
+	Callback CallbackConfig
+
+	// The lease file coordinating external ports with other processes on the host, none
+	// when nil. Managers reserve the ports of the mappings they add, and fail with
+	// ErrPortReserved for ports another process reserved; Listen and MapPacketConn then
+	// pick other ports.
+	PortPool *PortPool
+
+	// Where the changes the client makes to devices are recorded, e.g. an AuditLog, not
+	// at all when nil. It records every attempt to add, update or delete a port mapping or
+	// pinhole with its arguments and result.
+	Audit AuditSink
+
+	// The middleware the client's SOAP requests and SSDP packets pass through, in order.
+	Middleware []Middleware
+
+	// Receives the durations and results of the client's discoveries, SOAP requests and
+	// the renewals of Managers of its devices.
+	Metrics Metrics
+
+	// Receives the raw SSDP packets the client sends and receives, and the full bodies of
+	// its SOAP requests and responses, for debugging beyond what the Logger shows.
+	// The data is passed through TraceRedact first, RedactSecrets when nil.
+	Trace       TraceSink
+	TraceRedact func(data []byte) []byte
+}
+
+// The User-Agent of clients without one.
+const DefaultUserAgent = "upnpctl UPnP/1.1"
+
+// The client used by the package-level functions.
+var DefaultClient = &Client{ServicePolicy: PolicyConnectedServices}
+
+func (c *Client) logger() *slog.Logger {
+	if c == nil {
+		c = DefaultClient
+	}
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return legacyLogger
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c == nil {
+		c = DefaultClient
+	}
+	base := defaultHTTPClient
+	if c.HTTPClient != nil {
+		base = c.HTTPClient
+	}
+	if c.SourceIP == nil && c.SourceInterface == nil {
+		return base
+	}
+	return c.boundHTTPClient(base)
+}
+
+// A semaphore limiting the concurrent requests to one device, nil when unlimited.
+func (c *Client) newLimiter() chan struct{} {
+	if c == nil || c.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	return make(chan struct{}, c.MaxConcurrentRequests)
+}
+
+// The client the IGD performs its requests with.
+func (n *IGD) Client() *Client {
+	if n.client == nil {
+		return DefaultClient
+	}
+	return n.client
+}
+
+// Perform the IGD's requests with the client c, e.g. after restoring it from JSON.
+// It must not be called while requests are in flight.
+func (n *IGD) UseClient(c *Client) {
+	n.client = c
+	limiter := c.newLimiter()
+	if n.quirks.SequentialSOAP && cap(limiter) != 1 {
+		limiter = make(chan struct{}, 1)
+	}
+	rate := c.newRateLimiter()
+	if n.latency == nil {
+		n.latency = &latencies{}
+	}
+	if n.statuses == nil {
+		n.statuses = &statusCache{}
+	}
+	for _, list := range [][]IGDService{n.services, n.interfaces, n.firewalls, n.protections} {
+		for i := range list {
+			list[i].client = c
+			list[i].limiter = limiter
+			list[i].rate = rate
+			list[i].latency = n.latency
+		}
+	}
+}
+
+type headerKey struct{}
+
+// Return a context whose description and SOAP requests carry the headers h,
+// in addition to those of the Client. Headers of inner contexts take precedence.
+func WithHeader(ctx context.Context, h http.Header) context.Context {
+	merged := http.Header{}
+	if outer, ok := ctx.Value(headerKey{}).(http.Header); ok {
+		for k, v := range outer {
+			merged[k] = v
+		}
+	}
+	for k, v := range h {
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	return context.WithValue(ctx, headerKey{}, merged)
+}
+
+// Set the User-Agent and extra headers of the client and of the request's context on req.
+func (c *Client) setHeaders(req *http.Request) {
+	if c == nil {
+		c = DefaultClient
+	}
+	ua := c.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	for k, v := range c.Header {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if h, ok := req.Context().Value(headerKey{}).(http.Header); ok {
+		for k, v := range h {
+			req.Header[k] = v
+		}
+	}
+}
+
+func (c *Client) requestTimeout() time.Duration {
+	if c == nil {
+		c = DefaultClient
+	}
+	if c.RequestTimeout > 0 {
+		return c.RequestTimeout
+	}
+	return 10 * time.Second
+}
+
+func (c *Client) discoveryTimeout() time.Duration {
+	if c.DiscoveryTimeout > 0 {
+		return c.DiscoveryTimeout
+	}
+	return 3 * time.Second
+}
+
+// The MX of a search for timeout and how long to listen for its responses.
+func (c *Client) searchWindow(timeout time.Duration) (int, time.Duration) {
+	grace := time.Second
+	if c.SearchGrace != 0 {
+		grace = max(c.SearchGrace, 0)
+	}
+	mx := c.SearchMX
+	if mx <= 0 {
+		mx = max(1, min(5, int(math.Ceil((timeout-grace).Seconds()))))
+	}
+	return mx, max(timeout, time.Duration(mx)*time.Second+grace)
+}
+
+// Discover discovers UPnP InternetGatewayDevices using the DefaultClient. When
+// intranet points to a non-empty address, port mappings point to it instead of
+// the address used to reach each device.
+// The order in which the devices appear in the result list is not deterministic.
+func Discover(intranet *string) []IGD {
+	c := DefaultClient
+	if intranet != nil && *intranet != "" {
+		copy := *DefaultClient
+		copy.LocalIP = *intranet
+		c = &copy
+	}
+	return c.Discover()
+}
@@ -0,0 +1,84 @@
+package upnp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The differences between two lists of port mappings, see DiffMappings.
+type MappingDiff struct {
+	// The mappings only in the second and only in the first list.
+	Added   []PortMapping
+	Removed []PortMapping
+	// The mappings in both lists which differ.
+	Modified []MappingChange
+}
+
+// A port mapping in both lists of a MappingDiff, which differs between them.
+type MappingChange struct {
+	Old, New PortMapping
+	// What differs, e.g. "internal port 80 -> 8080".
+	Changes []string
+}
+
+// Whether the lists have the same mappings.
+func (d MappingDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// Compare two lists of port mappings, e.g. the mapping table of a router before and after
+// a change, or an exported one and the current one. Mappings are the same mapping when
+// they have the same protocol, external port and remote host. They differ in their internal
+// client and port, whether they are enabled, their description, and whether they are
+// permanent; remaining leases are not compared, as they count down. The mappings are in
+// the order of the list they are in.
+func DiffMappings(old, new []PortMapping) MappingDiff {
+	key := func(m PortMapping) string {
+		return fmt.Sprintf("%s/%d/%s", strings.ToUpper(string(m.Protocol)), m.ExternalPort, m.RemoteHost)
+	}
+	olds := make(map[string]PortMapping, len(old))
+	for _, m := range old {
+		olds[key(m)] = m
+	}
+	news := make(map[string]bool, len(new))
+
+	var diff MappingDiff
+	for _, n := range new {
+		news[key(n)] = true
+		o, ok := olds[key(n)]
+		if !ok {
+			diff.Added = append(diff.Added, n)
+			continue
+		}
+		if changes := mappingChanges(o, n); len(changes) > 0 {
+			diff.Modified = append(diff.Modified, MappingChange{Old: o, New: n, Changes: changes})
+		}
+	}
+	for _, o := range old {
+		if !news[key(o)] {
+			diff.Removed = append(diff.Removed, o)
+		}
+	}
+	return diff
+}
+
+// How the mapping n differs from o.
+func mappingChanges(o, n PortMapping) []string {
+	var changes []string
+	if o.InternalClient != n.InternalClient {
+		changes = append(changes, fmt.Sprintf("internal client %s -> %s", o.InternalClient, n.InternalClient))
+	}
+	if o.InternalPort != n.InternalPort {
+		changes = append(changes, fmt.Sprintf("internal port %d -> %d", o.InternalPort, n.InternalPort))
+	}
+	if o.Enabled != n.Enabled {
+		changes = append(changes, fmt.Sprintf("enabled %t -> %t", o.Enabled, n.Enabled))
+	}
+	if o.Description != n.Description {
+		changes = append(changes, fmt.Sprintf("description %q -> %q", o.Description, n.Description))
+	}
+	if (o.Lease == 0) != (n.Lease == 0) {
+		changes = append(changes, fmt.Sprintf("lease %s -> %s", o.Lease, n.Lease))
+	}
+	return changes
+}
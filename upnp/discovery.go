@@ -0,0 +1,241 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoGatewayFound is returned when a discovery found no InternetGatewayDevice, after
+// the client's DiscoveryRetries.
+var ErrNoGatewayFound = errors.New("upnp: no gateway found")
+
+// A Discovery is a discovery running in the background, see StartDiscovery.
+type Discovery struct {
+	results   chan IGD
+	done      chan struct{}
+	err       error
+	truncated bool
+	flushed   []IGD
+}
+
+// StartDiscovery starts discovering UPnP InternetGatewayDevices using the DefaultClient, see Client.StartDiscovery.
+func StartDiscovery(ctx context.Context) *Discovery {
+	return DefaultClient.StartDiscovery(ctx)
+}
+
+// StartDiscovery starts discovering UPnP InternetGatewayDevices in the background and returns
+// immediately. The discovery ends after the discovery timeout or when ctx is cancelled.
+// The devices found must be received from Results, or the discovery stalls until ctx is cancelled.
+func (c *Client) StartDiscovery(ctx context.Context) *Discovery {
+	d := &Discovery{
+		results: make(chan IGD, 8),
+		done:    make(chan struct{}),
+	}
+	go d.run(ctx, c)
+	return d
+}
+
+// The devices as they are found, in no particular order. The channel is closed when the discovery ends.
+// Devices it could not pass on after ctx was cancelled are left in Flushed.
+func (d *Discovery) Results() <-chan IGD {
+	return d.results
+}
+
+// Closed when the discovery has ended and all devices found have been sent to Results.
+func (d *Discovery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Whether ctx was cancelled before the discovery ended, once Done is closed: devices
+// answering late, or whose descriptions were still loading, are missing then.
+func (d *Discovery) Truncated() bool {
+	select {
+	case <-d.done:
+		return d.truncated
+	default:
+		return false
+	}
+}
+
+// The devices whose descriptions had loaded by the time ctx was cancelled, but which were
+// not received from Results, once Done is closed.
+func (d *Discovery) Flushed() []IGD {
+	select {
+	case <-d.done:
+		return d.flushed
+	default:
+		return nil
+	}
+}
+
+// Why the discovery ended early or found nothing, once Done is closed: the error of ctx when
+// it was cancelled, the errors sending the search requests when none of them could be sent,
+// or ErrNoGatewayFound when no devices were found after the client's DiscoveryRetries.
+// Nil otherwise.
+func (d *Discovery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+func (d *Discovery) run(ctx context.Context, c *Client) {
+	defer close(d.done)
+
+	log := c.logger()
+	log.Info("Starting UPnP discovery")
+	start := time.Now()
+
+	// Count and log the devices as they are passed on.
+	found := 0
+	results := make(chan IGD)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for igd := range results {
+			for _, service := range igd.services {
+				log.Debug("Discovered service", "device", igd.uuid, "service", service.serviceID, "url", service.serviceURL)
+			}
+			found++
+			select {
+			case d.results <- igd:
+			case <-ctx.Done():
+				d.flushed = append(d.flushed, igd)
+			}
+		}
+	}()
+
+	// Search again with a longer timeout while no devices answer, as the first search
+	// after an interface comes up is often lost.
+	var seen seenDevices
+	var errs []error
+	timeout := c.discoveryTimeout()
+	for attempt := 0; ; attempt++ {
+		var n int
+		n, errs = c.search(ctx, timeout, &seen, results)
+		if n > 0 || attempt >= c.DiscoveryRetries || ctx.Err() != nil {
+			break
+		}
+		timeout *= 2
+		log.Info("No UPnP devices found, searching again", "attempt", attempt+2, "timeout", timeout)
+	}
+	close(results)
+	<-forwarded
+	close(d.results)
+
+	switch {
+	case ctx.Err() != nil:
+		d.err = ctx.Err()
+		d.truncated = true
+	case len(errs) == 2:
+		d.err = errors.Join(errs...)
+	case found == 0:
+		d.err = ErrNoGatewayFound
+	}
+
+	log.Info("UPnP discovery complete", "found", found, "duration", time.Since(start))
+
+	c.metrics().Discovery(time.Since(start), found, d.err)
+	if OnDiscovery != nil {
+		OnDiscovery(time.Since(start), found)
+	}
+}
+
+// Search for InternetGatewayDevice:2 devices, then for InternetGatewayDevice:1 devices,
+// for timeout each, returning the number of devices sent to results and the errors sending
+// the search requests. InternetGatewayDevice:2 devices that correctly respond to the IGD:1
+// request as well will not be reported twice.
+func (c *Client) search(ctx context.Context, timeout time.Duration, seen *seenDevices, results chan<- IGD) (int, []error) {
+	found := 0
+	counted := make(chan IGD)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for igd := range counted {
+			found++
+			results <- igd
+		}
+	}()
+
+	var errs []error
+	for _, deviceType := range []string{"urn:schemas-upnp-org:device:InternetGatewayDevice:2", "urn:schemas-upnp-org:device:InternetGatewayDevice:1"} {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := c.discover(ctx, deviceType, timeout, seen, counted); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	close(counted)
+	<-done
+	return found, errs
+}
+
+// The UUIDs of the devices a discovery has found or is loading, and the loads of their descriptions.
+type seenDevices struct {
+	mut   sync.Mutex
+	uuids map[string]struct{}
+	loads map[string]*descriptionLoad
+}
+
+// Claim the device with the UUID for loading, false when it is already claimed.
+func (s *seenDevices) claim(uuid string) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.uuids[uuid]; ok {
+		return false
+	}
+	if s.uuids == nil {
+		s.uuids = make(map[string]struct{})
+	}
+	s.uuids[uuid] = struct{}{}
+	return true
+}
+
+// Release the claim on a device which failed to load.
+func (s *seenDevices) release(uuid string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.uuids, uuid)
+}
+
+// The load of the description at a location, complete when done is closed.
+type descriptionLoad struct {
+	done chan struct{}
+	igd  *IGD
+	err  error
+}
+
+// Load the description at location with load, once per discovery. Routers often answer a
+// search with several responses pointing to the same location, e.g. with a USN for each of
+// their devices. Callers for a location already loaded or being loaded wait for that load,
+// and get its result with shared set. Failed loads are forgotten once done, so retries
+// load the location again.
+func (s *seenDevices) loadOnce(location string, load func() (*IGD, error)) (igd *IGD, shared bool, err error) {
+	s.mut.Lock()
+	if l, ok := s.loads[location]; ok {
+		s.mut.Unlock()
+		<-l.done
+		return l.igd, true, l.err
+	}
+	l := &descriptionLoad{done: make(chan struct{})}
+	if s.loads == nil {
+		s.loads = make(map[string]*descriptionLoad)
+	}
+	s.loads[location] = l
+	s.mut.Unlock()
+
+	l.igd, l.err = load()
+	if l.err != nil {
+		// Let a later search of the discovery load it again, e.g. once the router has booted.
+		s.mut.Lock()
+		delete(s.loads, location)
+		s.mut.Unlock()
+	}
+	close(l.done)
+	return l.igd, false, l.err
+}
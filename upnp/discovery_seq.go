@@ -0,0 +1,45 @@
+//go:build go1.23
+
+package upnp
+
+import (
+	"context"
+	"iter"
+)
+
+// DiscoverSeq discovers UPnP InternetGatewayDevices using the DefaultClient, see Client.DiscoverSeq.
+func DiscoverSeq(ctx context.Context) iter.Seq2[IGD, error] {
+	return DefaultClient.DiscoverSeq(ctx)
+}
+
+// DiscoverSeq discovers UPnP InternetGatewayDevices, yielding them as they are found, like
+// StartDiscovery. Breaking out of the loop stops the discovery. Should it end early or find
+// nothing (see Discovery.Err), the error is yielded last, with a zero IGD.
+//
+//	for igd, err := range client.DiscoverSeq(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		if igd.UUID() == want {
+//			break
+//		}
+//	}
+func (c *Client) DiscoverSeq(ctx context.Context) iter.Seq2[IGD, error] {
+	return func(yield func(IGD, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		d := c.StartDiscovery(ctx)
+		for igd := range d.Results() {
+			if !yield(igd, nil) {
+				cancel()
+				<-d.Done()
+				return
+			}
+		}
+		<-d.Done()
+		if err := d.Err(); err != nil {
+			yield(IGD{}, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package upnp_test
+
+import (
+	"testing"
+	"time"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+// Each search of a discovery listens for its MX plus SearchGrace, past the
+// discovery timeout, for devices delaying their responses.
+func TestDiscoverSearchWindow(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		grace time.Duration
+		found int
+	}{
+		{"grace", 500 * time.Millisecond, 1},
+		{"no grace", -1, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := upnptest.NewServer()
+			defer s.Close()
+			s.SetSearchDelay(1300 * time.Millisecond)
+
+			c := &upnp.Client{SearchAddr: s.SSDPAddr, DiscoveryTimeout: 200 * time.Millisecond,
+				SearchMX: 1, SearchGrace: tt.grace}
+			start := time.Now()
+			igds := c.Discover()
+			if len(igds) != tt.found {
+				t.Errorf("discovered %d devices, want %d", len(igds), tt.found)
+			}
+			if elapsed, want := time.Since(start), time.Second+max(tt.grace, 0); elapsed < want {
+				t.Errorf("discovery took %s, want at least the MX plus the grace, %s", elapsed, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package upnp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// ErrNoWANConnection is returned when an IGD does not expose a WANIPConnection or WANPPPConnection service.
+var ErrNoWANConnection = errors.New("no WAN connection service found")
+
+// ErrMappingNotEffective is returned when a port mapping the IGD accepted is not in effect, see Client.VerifyMappings.
+var ErrMappingNotEffective = errors.New("port mapping not in effect")
+
+// UPnP error codes returned by IGD services, as defined by the UPnP Device Architecture and the WANIPConnection specification.
+const (
+	ErrCodeInvalidAction                    = 401
+	ErrCodeInvalidArgs                      = 402
+	ErrCodeActionFailed                     = 501
+	ErrCodeArgumentValueInvalid             = 600
+	ErrCodeArgumentValueOutOfRange          = 601
+	ErrCodeOptionalActionNotImplemented     = 602
+	ErrCodeOutOfMemory                      = 603
+	ErrCodeHumanInterventionRequired        = 604
+	ErrCodeStringArgumentTooLong            = 605
+	ErrCodeActionNotAuthorized              = 606
+	ErrCodeNoSuchEntry                      = 704
+	ErrCodeSpecifiedArrayIndexInvalid       = 713
+	ErrCodeNoSuchEntryInArray               = 714
+	ErrCodeWildCardNotPermittedInSrcIP      = 715
+	ErrCodeWildCardNotPermittedInExtPort    = 716
+	ErrCodeConflictInMappingEntry           = 718
+	ErrCodeSamePortValuesRequired           = 724
+	ErrCodeOnlyPermanentLeasesSupported     = 725
+	ErrCodeRemoteHostOnlySupportsWildcard   = 726
+	ErrCodeExternalPortOnlySupportsWildcard = 727
+	ErrCodeNoPortMapsAvailable              = 728
+	ErrCodeConflictWithOtherMechanisms      = 729
+	ErrCodeWildCardNotPermittedInIntPort    = 732
+)
+
+// A SOAPError is a UPnP error returned by a device in response to a SOAP action.
+type SOAPError struct {
+	Action      string
+	Code        int
+	Description string
+}
+
+func (e *SOAPError) Error() string {
+	return fmt.Sprintf("%s: UPnP error %d (%s)", e.Action, e.Code, e.Description)
+}
+
+// Whether err is a SOAPError with one of the given codes.
+func IsErrorCode(err error, codes ...int) bool {
+	var soapErr *SOAPError
+	if !errors.As(err, &soapErr) {
+		return false
+	}
+	for _, code := range codes {
+		if soapErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+type soapFaultEnvelope struct {
+	XMLName xml.Name
+	Body    soapFaultBody `xml:"Body"`
+}
+
+type soapFaultBody struct {
+	XMLName xml.Name
+	Fault   soapFault `xml:"Fault"`
+}
+
+type soapFault struct {
+	FaultString string    `xml:"faultstring"`
+	UPnPError   upnpError `xml:"detail>UPnPError"`
+}
+
+type upnpError struct {
+	ErrorCode        int    `xml:"errorCode"`
+	ErrorDescription string `xml:"errorDescription"`
+}
+
+// Parse the UPnPError of a SOAP fault response, returning nil if the response does not contain one.
+func parseSOAPFault(function string, resp []byte) *SOAPError {
+	envelope := &soapFaultEnvelope{}
+	if err := xml.Unmarshal(resp, envelope); err != nil {
+		return nil
+	}
+	fault := envelope.Body.Fault.UPnPError
+	if fault.ErrorCode == 0 {
+		return nil
+	}
+	return &SOAPError{Action: function, Code: fault.ErrorCode, Description: fault.ErrorDescription}
+}
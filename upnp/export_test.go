@@ -0,0 +1,13 @@
+package upnp
+
+import "time"
+
+// Handle the announcement as WatchAnnouncements does on receiving it.
+func (m *Manager) Announced(a Announcement) {
+	m.announced(a)
+}
+
+// Renew the mappings as due on the tick at now.
+func (m *Manager) RenewDue(now time.Time) {
+	m.renewDue(now)
+}
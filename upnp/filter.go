@@ -0,0 +1,67 @@
+package upnp
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strings"
+)
+
+// ErrDeviceNotAllowed is returned when loading a device the client's DeviceFilter rules out.
+var ErrDeviceNotAllowed = errors.New("device not allowed by the device filter")
+
+// A DeviceFilter restricts which devices a client operates on, e.g. so a daemon on a
+// shared network leaves the routers of neighbors and rogue SSDP responders alone.
+//
+// Each entry is a device UUID, a subnet like 192.168.1.0/24 the device's URL must be in,
+// or a glob of friendly names like "FRITZ!Box*" (see path.Match).
+type DeviceFilter struct {
+	// The devices the client operates on, all when empty.
+	Allow []string
+	// The devices the client leaves alone, even if Allow lists them.
+	Deny []string
+}
+
+// Whether the filter lets the client operate on the device.
+func (f *DeviceFilter) Allows(igd *IGD) bool {
+	if f == nil {
+		return true
+	}
+	for _, entry := range f.Deny {
+		if matchDevice(entry, igd) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, entry := range f.Allow {
+		if matchDevice(entry, igd) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) deviceFilter() *DeviceFilter {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.Devices
+}
+
+// Whether the device is the one of the filter entry.
+func matchDevice(entry string, igd *IGD) bool {
+	if _, subnet, err := net.ParseCIDR(entry); err == nil {
+		if igd.url == nil {
+			return false
+		}
+		ip := net.ParseIP(igd.url.Hostname())
+		return ip != nil && subnet.Contains(ip)
+	}
+	if uuid := strings.TrimPrefix(entry, "uuid:"); uuidPattern.MatchString(uuid) {
+		return strings.EqualFold(uuid, igd.uuid)
+	}
+	ok, _ := path.Match(entry, igd.friendlyName)
+	return ok
+}
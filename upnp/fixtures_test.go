@@ -0,0 +1,147 @@
+package upnp_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+func TestFixtures(t *testing.T) {
+	for _, f := range upnptest.Fixtures() {
+		f := f
+		t.Run(f.Name, func(t *testing.T) {
+			t.Parallel()
+			s := upnptest.NewFixtureServer(f)
+			defer s.Close()
+
+			c := &upnp.Client{SearchAddr: s.SSDPAddr, DiscoveryTimeout: 500 * time.Millisecond, SearchGrace: -1}
+			igds := c.Discover()
+			if len(igds) != 1 {
+				t.Fatalf("discovered %d devices, want 1", len(igds))
+			}
+			igd := &igds[0]
+			if igd.UUID() != f.UUID {
+				t.Errorf("UUID %q, want %q", igd.UUID(), f.UUID)
+			}
+			if igd.DeviceType() != f.DeviceType {
+				t.Errorf("device type %q, want %q", igd.DeviceType(), f.DeviceType)
+			}
+			if igd.FriendlyName() != f.FriendlyName {
+				t.Errorf("friendly name %q, want %q", igd.FriendlyName(), f.FriendlyName)
+			}
+			if igd.Manufacturer() != f.Manufacturer {
+				t.Errorf("manufacturer %q, want %q", igd.Manufacturer(), f.Manufacturer)
+			}
+			if igd.ModelName() != f.ModelName {
+				t.Errorf("model name %q, want %q", igd.ModelName(), f.ModelName)
+			}
+
+			services := igd.Services()
+			if len(services) != len(f.Services) {
+				t.Fatalf("%d services, want %d", len(services), len(f.Services))
+			}
+			for i, want := range f.Services {
+				if services[i].URN() != want.Type {
+					t.Errorf("service %d has type %q, want %q", i, services[i].URN(), want.Type)
+				}
+				u, err := url.Parse(services[i].ControlURL())
+				if err != nil || u.Path != want.ControlURL {
+					t.Errorf("service %d has control URL %q, want path %q", i, services[i].ControlURL(), want.ControlURL)
+				}
+			}
+
+			ctx := context.Background()
+			ip, err := igd.GetExternalIPAddress(ctx)
+			if err != nil {
+				t.Fatalf("getting the external IP address: %v", err)
+			}
+			if ip.String() != f.ExternalIP {
+				t.Errorf("external IP address %s, want %s", ip, f.ExternalIP)
+			}
+			// The fixture's responses are those of every service, so list one of them.
+			mappings, err := services[0].GetPortMappings(ctx)
+			if err != nil {
+				t.Fatalf("listing the port mappings: %v", err)
+			}
+			if len(mappings) != f.Mappings {
+				t.Errorf("%d port mappings, want %d", len(mappings), f.Mappings)
+			}
+		})
+	}
+}
+
+// Mappings taking their port as a preference: IGD:2 devices map the next free port with
+// AddAnyPortMapping, IGD:1 ones fall back to AddPortMapping, and renewals use the action
+// the mapping was added with.
+func TestAnyPort(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		server    func() *upnptest.Server
+		transport http.RoundTripper
+		// Whether another client has the port mapped already.
+		taken      bool
+		wantPort   int
+		wantAction string
+		// The AddAnyPortMapping requests sent, the fallback one included.
+		wantAny int
+	}{
+		{"IGD:2", upnptest.NewServer2, nil, false, 8080, "AddAnyPortMapping", 1},
+		{"IGD:2 port taken", upnptest.NewServer2, nil, true, 8081, "AddAnyPortMapping", 1},
+		{"IGD:1", upnptest.NewServer, nil, false, 8080, "AddPortMapping", 0},
+		// Without the SCPD, AddAnyPortMapping is tried and fails with Invalid Action.
+		{"IGD:1 without SCPD", upnptest.NewServer, &noSCPDTransport{}, false, 8080, "AddPortMapping", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server()
+			defer s.Close()
+			if tt.taken {
+				s.AddMapping(upnp.PortMapping{Protocol: upnp.TCP, ExternalPort: 8080, InternalPort: 8080,
+					InternalClient: "192.168.1.30", Enabled: true, Description: "other host"})
+			}
+			c := &upnp.Client{AllowPublicAddresses: true}
+			if tt.transport != nil {
+				c.HTTPClient = &http.Client{Transport: tt.transport}
+			}
+			igd, err := c.LoadIGD(context.Background(), s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := upnp.NewManager(igd)
+			defer m.Stop()
+
+			added, err := m.Map(upnp.ManagedMapping{PortMapping: upnp.PortMapping{Protocol: upnp.TCP, ExternalPort: 8080,
+				InternalPort: 80, Description: "any port test mapping", Lease: time.Hour}, AnyPort: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added.ExternalPort != tt.wantPort || added.Action != tt.wantAction {
+				t.Errorf("mapped port %d with %s, want port %d with %s", added.ExternalPort, added.Action, tt.wantPort, tt.wantAction)
+			}
+			if n := s.Requests("AddAnyPortMapping"); n != tt.wantAny {
+				t.Errorf("sent %d AddAnyPortMapping requests, want %d", n, tt.wantAny)
+			}
+
+			before := s.Requests(tt.wantAction)
+			if err := m.RenewNow(upnp.TCP, added.ExternalPort); err != nil {
+				t.Fatal(err)
+			}
+			if n := s.Requests(tt.wantAction); n != before+1 {
+				t.Errorf("renewal sent %d %s requests, want 1", n-before, tt.wantAction)
+			}
+			found := false
+			for _, mapping := range s.Mappings() {
+				if mapping.ExternalPort == tt.wantPort && mapping.InternalPort == 80 {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("router has no mapping of port %d to 80: %v", tt.wantPort, s.Mappings())
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package upnp
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fuzz targets for the parsers of the bytes devices on the network send us. Run one with e.g.
+//
+//	go test -fuzz FuzzSearchResponse ./upnp
+//
+// The descriptions of upnptest/fixtures seed FuzzDescription.
+
+// Fuzz the parser of responses to search requests.
+func FuzzSearchResponse(f *testing.F) {
+	f.Add([]byte(benchSearchResponse))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := parseSearchResponse(data)
+		if err != nil {
+			return
+		}
+		if r.location == "" || r.uuid == "" {
+			t.Fatal("search response accepted without location or UUID")
+		}
+	})
+}
+
+var fuzzLocation, _ = url.Parse("http://192.0.2.1:5000/rootDesc.xml")
+
+// Fuzz the device description decoder and the resolution of the services described.
+func FuzzDescription(f *testing.F) {
+	descriptions, err := filepath.Glob("upnptest/fixtures/*/description.xml")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range descriptions {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := &Client{}
+		var root upnpRoot
+		log := c.logger()
+		if err := c.unmarshalDescription(log, data, &root); err != nil {
+			return
+		}
+		c.validateDescription(log, root)
+		device := findIGD(root.Device)
+		baseURL := descriptionBaseURL(log, fuzzLocation, root.URLBase)
+		setMetadata(log, &IGD{}, baseURL, root.Device, device)
+		services, err := getServiceDescriptions(log, baseURL, device)
+		getInterfaceConfigServices(log, baseURL, device)
+		getFirewallServices(log, baseURL, device)
+		getDeviceProtectionServices(log, baseURL, root.Device, device)
+		if err != nil {
+			return
+		}
+		for _, s := range services {
+			if s.serviceURL == "" {
+				t.Fatal("service accepted without control URL")
+			}
+		}
+	})
+}
+
+// Fuzz the parser of SOAP fault responses.
+func FuzzSOAPFault(f *testing.F) {
+	f.Add([]byte(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>718</errorCode><errorDescription>ConflictInMappingEntry</errorDescription></UPnPError></detail>
+</s:Fault></s:Body>
+</s:Envelope>`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := parseSOAPFault("AddPortMapping", data); err != nil && err.Code == 0 {
+			t.Fatal("SOAP fault accepted without error code")
+		}
+	})
+}
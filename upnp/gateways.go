@@ -0,0 +1,137 @@
+package upnp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Gateways are InternetGatewayDevices operated on together, e.g. on LANs with redundant
+// uplinks. Their operations run on all gateways concurrently and report per gateway.
+type Gateways []*IGD
+
+// Gateways of the discovered devices igds.
+func NewGateways(igds []IGD) Gateways {
+	result := make(Gateways, len(igds))
+	for i := range igds {
+		result[i] = &igds[i]
+	}
+	return result
+}
+
+// The result of a query of Gateways on one gateway.
+type GatewayResult[T any] struct {
+	IGD   *IGD
+	Value T
+	Err   error
+}
+
+// A failure of an operation of Gateways on one gateway.
+type GatewayError struct {
+	IGD *IGD
+	Err error
+}
+
+// The failures of an operation of Gateways, in the order of the gateways.
+type GatewaysError []GatewayError
+
+func (e GatewaysError) Error() string {
+	msgs := make([]string, len(e))
+	for i, ge := range e {
+		msgs[i] = ge.IGD.FriendlyIdentifier() + ": " + ge.Err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e GatewaysError) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, ge := range e {
+		errs[i] = ge.Err
+	}
+	return errs
+}
+
+// The error of the operation on the gateway igd, nil when it succeeded there.
+func (e GatewaysError) ErrorOf(igd *IGD) error {
+	for _, ge := range e {
+		if ge.IGD == igd {
+			return ge.Err
+		}
+	}
+	return nil
+}
+
+// Run f on each gateway concurrently, and collect the results in the order of the gateways.
+func fanOut[T any](g Gateways, f func(igd *IGD) (T, error)) []GatewayResult[T] {
+	results := make([]GatewayResult[T], len(g))
+	var wg sync.WaitGroup
+	for i, igd := range g {
+		wg.Add(1)
+		go func(i int, igd *IGD) {
+			defer wg.Done()
+			value, err := f(igd)
+			results[i] = GatewayResult[T]{IGD: igd, Value: value, Err: err}
+		}(i, igd)
+	}
+	wg.Wait()
+	return results
+}
+
+// The errors of results, nil when there are none.
+func gatewaysError[T any](results []GatewayResult[T]) error {
+	var errs GatewaysError
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, GatewayError{r.IGD, r.Err})
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	return errs
+}
+
+// Add the port mapping m to all gateways (see IGD.Add). The error is a GatewaysError
+// listing the gateways it failed on; it was added to the others.
+func (g Gateways) Add(ctx context.Context, m PortMapping) error {
+	return gatewaysError(fanOut(g, func(igd *IGD) (struct{}, error) {
+		return struct{}{}, igd.Add(ctx, m)
+	}))
+}
+
+// Delete the port mapping m from all gateways (see IGD.Delete). The error is a
+// GatewaysError listing the gateways it failed on; it was deleted from the others.
+func (g Gateways) Delete(ctx context.Context, m PortMapping) error {
+	return gatewaysError(fanOut(g, func(igd *IGD) (struct{}, error) {
+		return struct{}{}, igd.Delete(ctx, m)
+	}))
+}
+
+// The gateways whose WAN connection is up (see IGD.IsConnected), so operations skip dead
+// uplinks quickly. Gateways which cannot be queried are left out.
+func (g Gateways) Connected(ctx context.Context) Gateways {
+	var connected Gateways
+	for _, r := range fanOut(g, func(igd *IGD) (bool, error) {
+		return igd.IsConnected(ctx)
+	}) {
+		if r.Err == nil && r.Value {
+			connected = append(connected, r.IGD)
+		}
+	}
+	return connected
+}
+
+// The external IP address of each gateway.
+func (g Gateways) GetExternalIPAddresses(ctx context.Context) []GatewayResult[net.IP] {
+	return fanOut(g, func(igd *IGD) (net.IP, error) {
+		return igd.GetExternalIPAddress(ctx)
+	})
+}
+
+// The port mappings of each gateway.
+func (g Gateways) GetPortMappings(ctx context.Context) []GatewayResult[[]PortMapping] {
+	return fanOut(g, func(igd *IGD) ([]PortMapping, error) {
+		return igd.GetPortMappings(ctx)
+	})
+}
@@ -0,0 +1,499 @@
+package upnp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The subscription timeout requested from devices, which may grant a different one.
+var EventSubscriptionTimeout = 30 * time.Minute
+
+// The HTTP server GENA events are delivered to, shared by the subscriptions of clients with
+// the same CallbackConfig. The zero value listens on an ephemeral port of the local IP
+// address each device is reached from.
+type CallbackConfig struct {
+	// The network interface to listen on, its first IPv4 address. Address takes precedence.
+	Interface *net.Interface
+	// The IP address to listen on, e.g. "0.0.0.0" for all of them.
+	Address string
+	// The range of ports to listen on, the first free one is used. Any free port when zero;
+	// MaxPort defaults to MinPort.
+	MinPort, MaxPort int
+	// The callback URL advertised to devices instead of the listen address, e.g. of a port
+	// published by a container runtime. The path of each subscription is appended to it.
+	URL string
+}
+
+// A Subscription receives the GENA events of a service, the state variables which changed,
+// and renews itself until it is closed.
+type Subscription struct {
+	service   *IGDService
+	server    *eventServer
+	path      string
+	events    chan map[string]string
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mut     sync.Mutex
+	sid     string
+	expires time.Time
+	closed  bool
+}
+
+// Subscribe to the events of the service, delivered to the callback server of the client's
+// CallbackConfig. Devices send the current value of all evented state variables right away.
+func (s *IGDService) SubscribeEvents(ctx context.Context) (*Subscription, error) {
+	if s.eventSubURL == "" {
+		return nil, fmt.Errorf("service %s does not support eventing", s.serviceID)
+	}
+	sub := &Subscription{
+		service: s,
+		path:    "/" + randomToken(),
+		events:  make(chan map[string]string, 16),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := attachEventServer(s.client.callbackConfig(), s.localIPAddress, sub); err != nil {
+		return nil, err
+	}
+	if err := sub.subscribe(ctx); err != nil {
+		sub.server.remove(sub)
+		return nil, err
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// The events, closed when the subscription is. Events are dropped when they are not received
+// in time.
+func (sub *Subscription) Events() <-chan map[string]string {
+	return sub.events
+}
+
+// The subscription identifier the device assigned.
+func (sub *Subscription) SID() string {
+	sub.mut.Lock()
+	defer sub.mut.Unlock()
+	return sub.sid
+}
+
+// When the subscription expires unless it is renewed.
+func (sub *Subscription) Expires() time.Time {
+	sub.mut.Lock()
+	defer sub.mut.Unlock()
+	return sub.expires
+}
+
+// The service subscribed to.
+func (sub *Subscription) Service() *IGDService {
+	return sub.service
+}
+
+// Stop renewing and cancel the subscription on the device. Calls after the first do
+// nothing.
+func (sub *Subscription) Close() error {
+	var err error
+	sub.closeOnce.Do(func() {
+		close(sub.stop)
+		<-sub.done
+		sub.server.remove(sub)
+		sub.mut.Lock()
+		sub.closed = true
+		close(sub.events)
+		sub.mut.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), sub.service.client.requestTimeout())
+		defer cancel()
+		_, err = sub.request(ctx, "UNSUBSCRIBE", map[string]string{"SID": sub.SID()})
+	})
+	return err
+}
+
+// The state of a Subscription, to resume it after a restart with IGDService.ResumeEvents.
+type SubscriptionState struct {
+	UUID        string    `json:"uuid"`
+	ServiceID   string    `json:"serviceId"`
+	EventSubURL string    `json:"eventSubURL"`
+	SID         string    `json:"sid"`
+	Callback    string    `json:"callback"`
+	Expires     time.Time `json:"expires"`
+}
+
+// The current state of the subscription, which changes as it is renewed.
+func (sub *Subscription) State() SubscriptionState {
+	sub.mut.Lock()
+	defer sub.mut.Unlock()
+	return SubscriptionState{
+		UUID:        sub.service.uuid,
+		ServiceID:   sub.service.serviceID,
+		EventSubURL: sub.service.eventSubURL,
+		SID:         sub.sid,
+		Callback:    sub.server.url + sub.path,
+		Expires:     sub.expires,
+	}
+}
+
+// Resume the subscription of a previous process to the events of the service, rather than
+// leaving it on the device until it expires. It is renewed when its callback URL is the one
+// of the callback server for this process, i.e. the server has a fixed port or URL, and
+// cancelled for a new subscription otherwise. Without a previous subscription, or one of
+// another service, it is SubscribeEvents.
+func (s *IGDService) ResumeEvents(ctx context.Context, state SubscriptionState) (*Subscription, error) {
+	if state.SID == "" || !time.Now().Before(state.Expires) {
+		return s.SubscribeEvents(ctx)
+	}
+	if state.EventSubURL != s.eventSubURL {
+		s.client.CancelSubscription(ctx, state)
+		return s.SubscribeEvents(ctx)
+	}
+
+	path := "/" + randomToken()
+	if u, err := url.Parse(state.Callback); err == nil && len(u.Path) > 1 {
+		path = u.Path
+	}
+	sub := &Subscription{
+		service: s,
+		path:    path,
+		events:  make(chan map[string]string, 16),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		sid:     state.SID,
+	}
+	if err := attachEventServer(s.client.callbackConfig(), s.localIPAddress, sub); err != nil {
+		return nil, err
+	}
+
+	log := s.logger().With("service", s.serviceID, "sid", state.SID)
+	err := errors.New("callback URL changed")
+	if sub.server.url+sub.path == state.Callback {
+		if err = sub.renew(ctx); err == nil {
+			log.Debug("Resumed event subscription")
+			go sub.run()
+			return sub, nil
+		}
+	} else {
+		s.client.CancelSubscription(ctx, state)
+	}
+	log.Debug("Not resuming event subscription", "err", err)
+
+	if err := sub.subscribe(ctx); err != nil {
+		sub.server.remove(sub)
+		return nil, err
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// Cancel the subscription of a previous process, e.g. one which is no longer wanted.
+func (c *Client) CancelSubscription(ctx context.Context, state SubscriptionState) error {
+	_, err := c.genaRequest(ctx, "UNSUBSCRIBE", state.UUID, state.EventSubURL, map[string]string{"SID": state.SID})
+	return err
+}
+
+func (sub *Subscription) run() {
+	defer close(sub.done)
+	log := sub.service.logger().With("service", sub.service.serviceID)
+	var wait time.Duration
+	for {
+		if wait == 0 {
+			wait = time.Until(sub.Expires()) / 2
+		}
+		select {
+		case <-sub.stop:
+			return
+		case <-time.After(wait):
+		}
+		wait = 0
+
+		err := sub.renew(context.Background())
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.code == http.StatusPreconditionFailed {
+			// The device forgot the subscription, e.g. after a reboot.
+			log.Info("Event subscription lost, subscribing again")
+			err = sub.subscribe(context.Background())
+		}
+		if err != nil {
+			log.Warn("Renewing event subscription failed", "err", err)
+			wait = RenewRetryInterval
+			continue
+		}
+		log.Debug("Renewed event subscription", "sid", sub.SID())
+	}
+}
+
+func (sub *Subscription) subscribe(ctx context.Context) error {
+	// Accept the initial event of the new subscription, which may come before its SID.
+	sub.mut.Lock()
+	sub.sid = ""
+	sub.mut.Unlock()
+
+	header, err := sub.request(ctx, "SUBSCRIBE", map[string]string{
+		"CALLBACK": "<" + sub.server.url + sub.path + ">",
+		"NT":       "upnp:event",
+		"TIMEOUT":  formatTimeout(EventSubscriptionTimeout),
+	})
+	if err != nil {
+		return err
+	}
+	sid := header.Get("SID")
+	if sid == "" {
+		return errors.New("SUBSCRIBE response without SID")
+	}
+	sub.mut.Lock()
+	sub.sid = sid
+	sub.expires = time.Now().Add(parseTimeout(header.Get("TIMEOUT")))
+	sub.mut.Unlock()
+	return nil
+}
+
+func (sub *Subscription) renew(ctx context.Context) error {
+	header, err := sub.request(ctx, "SUBSCRIBE", map[string]string{
+		"SID":     sub.SID(),
+		"TIMEOUT": formatTimeout(EventSubscriptionTimeout),
+	})
+	if err != nil {
+		return err
+	}
+	sub.mut.Lock()
+	sub.expires = time.Now().Add(parseTimeout(header.Get("TIMEOUT")))
+	sub.mut.Unlock()
+	return nil
+}
+
+// Send a GENA request to the service's event subscription URL, returning the response headers.
+func (sub *Subscription) request(ctx context.Context, method string, headers map[string]string) (http.Header, error) {
+	return sub.service.client.genaRequest(ctx, method, sub.service.uuid, sub.service.eventSubURL, headers)
+}
+
+// Send a GENA request to the event subscription URL of the device with the UUID uuid,
+// returning the response headers.
+func (c *Client) genaRequest(ctx context.Context, method, uuid, url string, headers map[string]string) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.do(uuid, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{resp.StatusCode, method + ": " + resp.Status}
+	}
+	return resp.Header, nil
+}
+
+func formatTimeout(d time.Duration) string {
+	return "Second-" + strconv.Itoa(int(d/time.Second))
+}
+
+// Parse a GENA TIMEOUT header. Devices granting infinite or unparseable timeouts are
+// renewed as if they had granted the one requested.
+func parseTimeout(s string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(s), "Second-"))
+	if err != nil || seconds <= 0 {
+		return EventSubscriptionTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+type propertySet struct {
+	Properties []struct {
+		Variables []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"property"`
+}
+
+// Deliver a NOTIFY request to the subscription.
+func (sub *Subscription) notify(w http.ResponseWriter, r *http.Request) {
+	if sid := sub.SID(); sid != "" && r.Header.Get("SID") != sid {
+		// The initial event may come before the SUBSCRIBE response, but no others.
+		http.Error(w, "unknown SID", http.StatusPreconditionFailed)
+		return
+	}
+	body, err := sub.service.client.readBody(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var set propertySet
+	if err := xml.Unmarshal(body, &set); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	event := make(map[string]string)
+	for _, p := range set.Properties {
+		for _, v := range p.Variables {
+			event[v.XMLName.Local] = strings.TrimSpace(v.Value)
+		}
+	}
+	sub.mut.Lock()
+	defer sub.mut.Unlock()
+	if sub.closed {
+		return
+	}
+	select {
+	case sub.events <- event:
+	default:
+		sub.service.logger().Warn("Dropping event for slow receiver", "service", sub.service.serviceID)
+	}
+}
+
+func (c *Client) callbackConfig() CallbackConfig {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.Callback
+}
+
+// The callback servers, by configuration and listen address.
+var eventServers = struct {
+	sync.Mutex
+	m map[string]*eventServer
+}{m: make(map[string]*eventServer)}
+
+// An HTTP server receiving the events of subscriptions, by path.
+type eventServer struct {
+	key    string
+	url    string
+	server *http.Server
+
+	mut  sync.Mutex
+	subs map[string]*Subscription
+}
+
+// Add the subscription to the callback server for cfg, started when there is none. localIP
+// is the address the device reaches, which the server listens on unless cfg tells otherwise.
+func attachEventServer(cfg CallbackConfig, localIP string, sub *Subscription) error {
+	ip, err := cfg.listenIP(localIP)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s %d-%d %s", ip, cfg.MinPort, cfg.MaxPort, cfg.URL)
+
+	eventServers.Lock()
+	defer eventServers.Unlock()
+	s, ok := eventServers.m[key]
+	if !ok {
+		if s, err = startEventServer(cfg, ip, localIP); err != nil {
+			return fmt.Errorf("event callback server: %w", err)
+		}
+		s.key = key
+		eventServers.m[key] = s
+	}
+	s.mut.Lock()
+	s.subs[sub.path] = sub
+	s.mut.Unlock()
+	sub.server = s
+	return nil
+}
+
+func startEventServer(cfg CallbackConfig, ip, localIP string) (*eventServer, error) {
+	l, err := cfg.listen(ip)
+	if err != nil {
+		return nil, err
+	}
+	s := &eventServer{subs: make(map[string]*Subscription)}
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	switch addr := l.Addr().(*net.TCPAddr); {
+	case cfg.URL != "":
+		s.url = strings.TrimSuffix(cfg.URL, "/")
+	case addr.IP.IsUnspecified():
+		s.url = "http://" + net.JoinHostPort(localIP, strconv.Itoa(addr.Port))
+	default:
+		s.url = "http://" + addr.String()
+	}
+	go s.server.Serve(l)
+	return s, nil
+}
+
+// The IP address to listen on.
+func (cfg CallbackConfig) listenIP(localIP string) (string, error) {
+	switch {
+	case cfg.Address != "":
+		return cfg.Address, nil
+	case cfg.Interface != nil:
+		addrs, err := cfg.Interface.Addrs()
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+				return n.IP.String(), nil
+			}
+		}
+		return "", fmt.Errorf("interface %s has no IPv4 address", cfg.Interface.Name)
+	}
+	return localIP, nil
+}
+
+// Listen on the first free port of the range.
+func (cfg CallbackConfig) listen(ip string) (net.Listener, error) {
+	min, max := cfg.MinPort, cfg.MaxPort
+	if max < min {
+		max = min
+	}
+	var err error
+	for port := min; port <= max; port++ {
+		var l net.Listener
+		if l, err = net.Listen("tcp4", net.JoinHostPort(ip, strconv.Itoa(port))); err == nil {
+			return l, nil
+		}
+	}
+	return nil, err
+}
+
+// Remove the subscription, closing the server after the last one.
+func (s *eventServer) remove(sub *Subscription) {
+	eventServers.Lock()
+	defer eventServers.Unlock()
+	s.mut.Lock()
+	delete(s.subs, sub.path)
+	last := len(s.subs) == 0
+	s.mut.Unlock()
+	if last {
+		delete(eventServers.m, s.key)
+		s.server.Close()
+	}
+}
+
+func (s *eventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	sub, ok := s.subs[r.URL.Path]
+	s.mut.Unlock()
+	if !ok || r.Method != "NOTIFY" {
+		http.NotFound(w, r)
+		return
+	}
+	sub.notify(w, r)
+}
+
+// A random token, hard to guess for other hosts sending events.
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,43 @@
+package upnp_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+// Closing a subscription again, even concurrently, does nothing.
+func TestSubscriptionCloseTwice(t *testing.T) {
+	s := upnptest.NewServer()
+	defer s.Close()
+	c := &upnp.Client{AllowPublicAddresses: true, Callback: upnp.CallbackConfig{Address: "127.0.0.1"}}
+	igd, err := c.LoadIGD(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		service := igd.Services()[0]
+		sub, err := service.SubscribeEvents(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				sub.Close()
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if err := sub.Close(); err != nil {
+			t.Errorf("closing the subscription again: %v", err)
+		}
+	}
+}
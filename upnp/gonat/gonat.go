@@ -0,0 +1,274 @@
+// Package gonat adapts InternetGatewayDevices of package upnp to the NAT interfaces of
+// github.com/libp2p/go-nat and github.com/fd/go-nat, so projects built on either can use
+// upnpctl for their port mappings without rewriting their traversal code:
+//
+//	gw, err := gonat.DiscoverGateway(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	var nat nat.NAT = gw // libp2p's
+//
+// The types satisfy the interfaces structurally; this package imports neither, but checks
+// against copies of them.
+package gonat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"upnpctl/upnp"
+)
+
+// The interfaces of go-nat and fd's go-nat.
+type (
+	goNAT interface {
+		Type() string
+		GetDeviceAddress() (net.IP, error)
+		GetExternalAddress() (net.IP, error)
+		GetInternalAddress() (net.IP, error)
+		AddPortMapping(ctx context.Context, protocol string, internalPort int, description string, timeout time.Duration) (int, error)
+		DeletePortMapping(ctx context.Context, protocol string, internalPort int) error
+	}
+	fdNAT interface {
+		Type() string
+		GetDeviceAddress() (net.IP, error)
+		GetExternalAddress() (net.IP, error)
+		GetInternalAddress() (net.IP, error)
+		AddPortMapping(protocol string, internalPort int, description string, timeout time.Duration) (int, error)
+		DeletePortMapping(protocol string, internalPort int) error
+	}
+)
+
+var (
+	_ goNAT = (*NAT)(nil)
+	_ fdNAT = LegacyNAT{}
+)
+
+// How many external ports AddPortMapping tries when the router reports a conflict.
+const mappingAttempts = 5
+
+// A NAT with the method set of nat.NAT of github.com/libp2p/go-nat.
+//
+// Like go-nat's implementations, it identifies mappings by their internal port: the external
+// port AddPortMapping picked is reused when the mapping is renewed, and DeletePortMapping
+// deletes it.
+type NAT struct {
+	igd *upnp.IGD
+
+	mut      sync.Mutex
+	mappings map[mappingKey]mapped
+}
+
+type mappingKey struct {
+	protocol     upnp.Protocol
+	internalPort int
+}
+
+// The external port of a mapping and the action which added it, used again to renew it.
+type mapped struct {
+	external int
+	action   string
+}
+
+// Adapt the IGD.
+func New(igd *upnp.IGD) *NAT {
+	return &NAT{igd: igd, mappings: make(map[mappingKey]mapped)}
+}
+
+// Discover the IGD owning the default route, or the most suitable IGD found (see
+// upnp.SortIGDs), with the DefaultClient, like go-nat's DiscoverGateway.
+func DiscoverGateway(ctx context.Context) (*NAT, error) {
+	var igds []upnp.IGD
+	for igd := range upnp.DefaultClient.StartDiscovery(ctx).Results() {
+		igds = append(igds, igd)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(igds) == 0 {
+		return nil, upnp.ErrNoGatewayFound
+	}
+	igd, ok := upnp.SelectDefaultGateway(igds)
+	if !ok {
+		upnp.SortIGDs(igds)
+		igd = &igds[0]
+	}
+	return New(igd), nil
+}
+
+// The adapted IGD.
+func (n *NAT) IGD() *upnp.IGD {
+	return n.igd
+}
+
+// The type of the NAT, "UPNP (IGD1)" or "UPNP (IGD2)" as go-nat names them.
+func (n *NAT) Type() string {
+	if strings.HasSuffix(n.igd.DeviceType(), ":2") {
+		return "UPNP (IGD2)"
+	}
+	return "UPNP (IGD1)"
+}
+
+// The IP address of the IGD.
+func (n *NAT) GetDeviceAddress() (net.IP, error) {
+	ips, err := net.LookupIP(n.igd.URL().Hostname())
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// The external IP address of the IGD.
+func (n *NAT) GetExternalAddress() (net.IP, error) {
+	return n.igd.GetExternalIPAddress(context.Background())
+}
+
+// The local IP address the IGD is reached from, which mappings point to.
+func (n *NAT) GetInternalAddress() (net.IP, error) {
+	ip := net.ParseIP(n.igd.LocalIP())
+	if ip == nil {
+		return nil, fmt.Errorf("no local IP address for %s", n.igd.FriendlyIdentifier())
+	}
+	return ip, nil
+}
+
+// Map an external port to the internal port of this host for timeout (rounded up to a full
+// second, permanent when zero), returning the external port. protocol is "tcp" or "udp".
+// The router picks the port with AddAnyPortMapping where it supports it, preferring the
+// internal port.
+func (n *NAT) AddPortMapping(ctx context.Context, protocol string, internalPort int, description string, timeout time.Duration) (int, error) {
+	proto, err := parseProtocol(protocol)
+	if err != nil {
+		return 0, err
+	}
+	key := mappingKey{proto, internalPort}
+	m := upnp.PortMapping{
+		Protocol:     proto,
+		InternalPort: internalPort,
+		Enabled:      true,
+		Description:  description,
+		Lease:        (timeout + time.Second - 1) / time.Second * time.Second,
+	}
+
+	n.mut.Lock()
+	previous, ok := n.mappings[key]
+	n.mut.Unlock()
+	external, action := previous.external, previous.action
+	if !ok {
+		external, action = internalPort, "AddAnyPortMapping"
+	}
+	// The port of a renewed mapping stays reserved when renewing it fails.
+	held := -1
+	if ok {
+		held = external
+	}
+
+	pool := n.igd.Client().PortPool
+	for attempt := 1; ; attempt++ {
+		err = nil
+		if pool != nil {
+			err = pool.Reserve(n.igd.UUID(), proto, external)
+		}
+		if err == nil {
+			var port int
+			var used string
+			port, used, err = n.add(ctx, m, external, action)
+			if err == nil && pool != nil && port != external {
+				// The port the router picked takes the place of the one reserved.
+				if err = pool.Reserve(n.igd.UUID(), proto, port); err != nil {
+					n.igd.DeletePortMapping(ctx, proto, port)
+				}
+			}
+			if pool != nil && (err != nil && external != held || err == nil && port != external) {
+				pool.Release(n.igd.UUID(), proto, external)
+			}
+			if err == nil {
+				external, action = port, used
+			}
+		}
+		if !upnp.IsErrorCode(err, upnp.ErrCodeConflictInMappingEntry) && !errors.Is(err, upnp.ErrPortReserved) || attempt == mappingAttempts || ctx.Err() != nil {
+			break
+		}
+		external = 1024 + rand.Intn(65536-1024)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n.mut.Lock()
+	n.mappings[key] = mapped{external, action}
+	n.mut.Unlock()
+	return external, nil
+}
+
+// Add the mapping m of the external port with the action, returning the port mapped and the
+// action used.
+func (n *NAT) add(ctx context.Context, m upnp.PortMapping, external int, action string) (int, string, error) {
+	m.ExternalPort = external
+	if action == "AddAnyPortMapping" {
+		port, used, err := n.igd.AddAny(ctx, m)
+		if err != nil {
+			return external, action, err
+		}
+		return port, used, nil
+	}
+	return external, action, n.igd.Add(ctx, m)
+}
+
+// Delete the mapping AddPortMapping added for the internal port.
+func (n *NAT) DeletePortMapping(ctx context.Context, protocol string, internalPort int) error {
+	proto, err := parseProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	key := mappingKey{proto, internalPort}
+	n.mut.Lock()
+	previous, ok := n.mappings[key]
+	delete(n.mappings, key)
+	n.mut.Unlock()
+	external := previous.external
+	if !ok {
+		external = internalPort
+	}
+	if pool := n.igd.Client().PortPool; pool != nil {
+		pool.Release(n.igd.UUID(), proto, external)
+	}
+	return n.igd.DeletePortMapping(ctx, proto, external)
+}
+
+func parseProtocol(protocol string) (upnp.Protocol, error) {
+	switch strings.ToLower(protocol) {
+	case "tcp":
+		return upnp.TCP, nil
+	case "udp":
+		return upnp.UDP, nil
+	}
+	return "", fmt.Errorf("unsupported protocol %q", protocol)
+}
+
+// A LegacyNAT has the method set of nat.NAT of github.com/fd/go-nat, which go-nat forked:
+// the same as NAT's, without contexts.
+type LegacyNAT struct {
+	*NAT
+}
+
+// Adapt the IGD.
+func NewLegacy(igd *upnp.IGD) LegacyNAT {
+	return LegacyNAT{New(igd)}
+}
+
+// See NAT.AddPortMapping.
+func (n LegacyNAT) AddPortMapping(protocol string, internalPort int, description string, timeout time.Duration) (int, error) {
+	return n.NAT.AddPortMapping(context.Background(), protocol, internalPort, description, timeout)
+}
+
+// See NAT.DeletePortMapping.
+func (n LegacyNAT) DeletePortMapping(protocol string, internalPort int) error {
+	return n.NAT.DeletePortMapping(context.Background(), protocol, internalPort)
+}
@@ -0,0 +1,216 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+// ErrResponseTooLarge is returned when a device description or SOAP response exceeds Client.MaxResponseSize.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// The maximum size of device descriptions and SOAP responses of clients without one.
+const DefaultMaxResponseSize = 1 << 20
+
+// The HTTP client of clients without one. Its transport keeps a few idle
+// connections to each gateway, so issuing many SOAP requests in a row (e.g.
+// listing hundreds of port mappings) does not pay for a TCP handshake each time.
+// Idle connections are dropped quickly, as many routers close them after a few seconds.
+var defaultHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        32,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     15 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+func (c *Client) maxResponseSize() int64 {
+	if c == nil {
+		c = DefaultClient
+	}
+	if c.MaxResponseSize > 0 {
+		return c.MaxResponseSize
+	}
+	return DefaultMaxResponseSize
+}
+
+// Read the body r up to the client's maximum response size.
+func (c *Client) readBody(r io.Reader) ([]byte, error) {
+	limit := c.maxResponseSize()
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return body, err
+	}
+	if int64(len(body)) > limit {
+		return body[:limit], fmt.Errorf("%w (more than %d bytes)", ErrResponseTooLarge, limit)
+	}
+	return body, nil
+}
+
+// Read the body of the response as readBody does, coping with how the HTTP servers of
+// routers frame it. Some HTTP/1.0 ones send it chunked, which the HTTP client only decodes
+// for HTTP/1.1, some send neither a Content-Length nor chunks but keep the connection open,
+// so only the end of the XML document ends the body, and some send a Content-Length
+// longer than the body.
+func (c *Client) readResponse(resp *http.Response) ([]byte, error) {
+	r := bufio.NewReader(resp.Body)
+	framed := resp.ContentLength >= 0 || len(resp.TransferEncoding) > 0
+	chunked := false
+	if !framed {
+		chunked = startsWithChunk(r)
+	}
+	var body []byte
+	var err error
+	switch {
+	case chunked:
+		body, err = c.readBody(httputil.NewChunkedReader(r))
+	case !framed:
+		body, err = c.readDocument(r)
+	default:
+		body, err = c.readBody(r)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) && scanDocument(bytes.NewReader(body)) {
+		// Cut short of its Content-Length or the end of its chunks, but complete.
+		err = nil
+	}
+	return body, err
+}
+
+// The longest size line of a chunk startsWithChunk looks at, extensions included.
+const maxChunkLine = 256
+
+// Whether r starts with the size line of a chunk: hex digits, optionally followed by
+// extensions, and CRLF. XML starts with markup or whitespace instead, and bodies which
+// are not chunked are only peeked at as long as they look like they are.
+func startsWithChunk(r *bufio.Reader) bool {
+	digits, extension := 0, false
+	for n := 1; n <= maxChunkLine; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return false
+		}
+		switch c := b[n-1]; {
+		case !extension && strings.IndexByte("0123456789abcdefABCDEF", c) >= 0:
+			digits++
+		case digits == 0:
+			return false
+		case c == '\r':
+			b, err := r.Peek(n + 1)
+			return err == nil && b[n] == '\n'
+		case c == ';':
+			extension = true
+		case !extension:
+			return false
+		}
+	}
+	return false
+}
+
+// Read the XML document r holds up to the client's maximum response size, stopping at the
+// end of its root element. Bodies that are not XML are read to their end.
+func (c *Client) readDocument(r io.Reader) ([]byte, error) {
+	limit := c.maxResponseSize()
+	var body bytes.Buffer
+	tee := io.TeeReader(io.LimitReader(r, limit+1), &body)
+	if !scanDocument(tee) {
+		if _, err := io.Copy(io.Discard, tee); err != nil {
+			return body.Bytes(), err
+		}
+	}
+	if int64(body.Len()) > limit {
+		return body.Bytes()[:limit], fmt.Errorf("%w (more than %d bytes)", ErrResponseTooLarge, limit)
+	}
+	return body.Bytes(), nil
+}
+
+// Read r up to the end of the root element of the XML document it holds, and report
+// whether there was one. Other charsets than UTF-8 are read as is, which serves finding
+// the elements of the ones routers use.
+func scanDocument(r io.Reader) bool {
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	depth := 0
+	for {
+		token, err := dec.RawToken()
+		if err != nil {
+			return false
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			if depth--; depth == 0 {
+				return true
+			}
+		}
+	}
+}
+
+// How many redirects description downloads follow, as some routers redirect them to
+// another port.
+const maxDescriptionRedirects = 3
+
+type redirectPolicyKey struct{}
+
+// Return a context whose requests follow redirects as check allows, overriding the
+// CheckRedirect of the client's HTTPClient for them only.
+func withRedirectPolicy(ctx context.Context, check func(req *http.Request, via []*http.Request) error) context.Context {
+	return context.WithValue(ctx, redirectPolicyKey{}, check)
+}
+
+// The HTTP client with the redirect policy of the request's context, if it has one.
+func withRequestRedirectPolicy(client *http.Client, req *http.Request) *http.Client {
+	check, ok := req.Context().Value(redirectPolicyKey{}).(func(*http.Request, []*http.Request) error)
+	if !ok {
+		return client
+	}
+	scoped := *client
+	scoped.CheckRedirect = check
+	return &scoped
+}
+
+// Perform the GET request req to the device with the UUID uuid, any when empty, as the
+// client's RetryPolicy allows, and return the body and headers of the response. Each
+// attempt may take up to the request timeout.
+func (c *Client) get(log *slog.Logger, uuid string, req *http.Request) ([]byte, http.Header, error) {
+	var body []byte
+	var header http.Header
+	err := c.retryPolicy().do(req.Context(), log, func() error {
+		ctx, cancel := context.WithTimeout(req.Context(), c.requestTimeout())
+		defer cancel()
+
+		response, err := c.do(uuid, req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode >= 400 {
+			return &statusError{response.StatusCode, response.Status}
+		}
+
+		header = response.Header
+		body, err = c.readResponse(response)
+		return err
+	})
+	return body, header, err
+}
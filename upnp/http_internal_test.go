@@ -0,0 +1,34 @@
+package upnp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Unframed bodies are only read as chunked when they start with a chunk's size line.
+func TestReadResponseUnframed(t *testing.T) {
+	const document = "<root><a>b</a></root>"
+	for _, tt := range []struct {
+		name, body, want string
+	}{
+		{"XML", document, document},
+		{"chunked", "15\r\n" + document + "\r\n0\r\n\r\n", document},
+		{"chunk extension", "15;name=value\r\n" + document + "\r\n0\r\n\r\n", document},
+		// Not XML, so read to its end, but starting with hex digits.
+		{"hex digits", "cafe babe", "cafe babe"},
+		{"hex line without CR", "15\n" + document, "15\n" + document},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{ContentLength: -1, Body: io.NopCloser(strings.NewReader(tt.body))}
+			body, err := (&Client{}).readResponse(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("body %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
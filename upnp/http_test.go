@@ -0,0 +1,63 @@
+package upnp_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+// Descriptions and SOAP responses framed as the HTTP servers of routers frame them.
+func TestResponseFraming(t *testing.T) {
+	for _, framing := range []upnptest.Framing{
+		upnptest.FramingDefault,
+		upnptest.FramingHTTP10,
+		upnptest.FramingChunkedHTTP10,
+		upnptest.FramingUnframed,
+		upnptest.FramingLongContentLength,
+	} {
+		name := string(framing)
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			s := upnptest.NewServer()
+			defer s.Close()
+			s.SetFraming(framing)
+			s.SetExternalIP(net.ParseIP("198.51.100.7"))
+			// Enough entries for the responses to span several chunks.
+			for port := 8000; port < 8020; port++ {
+				s.AddMapping(upnp.PortMapping{Protocol: upnp.TCP, ExternalPort: port, InternalPort: port,
+					InternalClient: "192.168.1.20", Enabled: true, Description: "framing test mapping"})
+			}
+
+			// Bodies the client cannot tell the end of would run into the timeout.
+			c := &upnp.Client{RequestTimeout: 2 * time.Second}
+			ctx := context.Background()
+			igd, err := c.LoadIGD(ctx, s.URL)
+			if err != nil {
+				t.Fatalf("loading the description: %v", err)
+			}
+			if igd.UUID() != s.UUID {
+				t.Errorf("UUID %q, want %q", igd.UUID(), s.UUID)
+			}
+			ip, err := igd.GetExternalIPAddress(ctx)
+			if err != nil {
+				t.Fatalf("getting the external IP address: %v", err)
+			}
+			if ip.String() != "198.51.100.7" {
+				t.Errorf("external IP address %s, want 198.51.100.7", ip)
+			}
+			mappings, err := igd.GetPortMappings(ctx)
+			if err != nil {
+				t.Fatalf("listing the port mappings: %v", err)
+			}
+			if len(mappings) != 20 {
+				t.Errorf("%d port mappings, want 20", len(mappings))
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package upnp
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+)
+
+// The JSON form of an IGD, which is stable so discovery results can be cached between runs.
+type igdJSON struct {
+	UUID            string       `json:"uuid"`
+	USN             string       `json:"usn,omitempty"`
+	FriendlyName    string       `json:"friendlyName"`
+	DeviceType      string       `json:"deviceType"`
+	Manufacturer    string       `json:"manufacturer,omitempty"`
+	ModelName       string       `json:"modelName,omitempty"`
+	ModelNumber     string       `json:"modelNumber,omitempty"`
+	SerialNumber    string       `json:"serialNumber,omitempty"`
+	PresentationURL string       `json:"presentationURL,omitempty"`
+	Icons           []Icon       `json:"icons,omitempty"`
+	URL             string       `json:"url"`
+	LocalIP         string       `json:"localIP"`
+	Services        []IGDService `json:"services"`
+	Interfaces      []IGDService `json:"interfaces,omitempty"`
+	Firewalls       []IGDService `json:"firewalls,omitempty"`
+	Protections     []IGDService `json:"deviceProtection,omitempty"`
+	Quirks          *Quirk       `json:"quirks,omitempty"`
+	Server          string       `json:"server,omitempty"`
+}
+
+type igdServiceJSON struct {
+	Device      string `json:"device"`
+	ID          string `json:"id"`
+	URN         string `json:"urn"`
+	ControlURL  string `json:"controlURL"`
+	EventSubURL string `json:"eventSubURL,omitempty"`
+	SCPDURL     string `json:"scpdURL,omitempty"`
+}
+
+func (n IGD) MarshalJSON() ([]byte, error) {
+	j := igdJSON{
+		UUID:            n.uuid,
+		USN:             n.usn,
+		FriendlyName:    n.friendlyName,
+		DeviceType:      n.deviceType,
+		Manufacturer:    n.manufacturer,
+		ModelName:       n.modelName,
+		ModelNumber:     n.modelNumber,
+		SerialNumber:    n.serialNumber,
+		PresentationURL: n.presentationURL,
+		Icons:           n.icons,
+		LocalIP:         n.localIPAddress,
+		Services:        n.services,
+		Interfaces:      n.interfaces,
+		Firewalls:       n.firewalls,
+		Protections:     n.protections,
+		Server:          n.server,
+	}
+	if n.url != nil {
+		j.URL = n.url.String()
+	}
+	if n.quirks.any() {
+		j.Quirks = &n.quirks
+	}
+	return json.Marshal(j)
+}
+
+// Restore an IGD marshalled to JSON. It performs requests with the DefaultClient until UseClient is called.
+func (n *IGD) UnmarshalJSON(b []byte) error {
+	var j igdJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	u, err := url.Parse(j.URL)
+	if err != nil {
+		return err
+	}
+	*n = IGD{
+		uuid:            j.UUID,
+		usn:             j.USN,
+		friendlyName:    j.FriendlyName,
+		deviceType:      j.DeviceType,
+		manufacturer:    j.Manufacturer,
+		modelName:       j.ModelName,
+		modelNumber:     j.ModelNumber,
+		serialNumber:    j.SerialNumber,
+		presentationURL: j.PresentationURL,
+		icons:           j.Icons,
+		url:             u,
+		localIPAddress:  j.LocalIP,
+		services:        j.Services,
+		interfaces:      j.Interfaces,
+		firewalls:       j.Firewalls,
+		protections:     j.Protections,
+		server:          j.Server,
+	}
+	if j.Quirks != nil {
+		n.quirks = *j.Quirks
+	}
+	for _, list := range [][]IGDService{n.services, n.interfaces, n.firewalls, n.protections} {
+		for i := range list {
+			list[i].localIPAddress = j.LocalIP
+			list[i].quirks = n.quirks
+		}
+	}
+	// Set up the limiter of the quirks on concurrent requests.
+	n.UseClient(nil)
+	return nil
+}
+
+func (s IGDService) MarshalJSON() ([]byte, error) {
+	return json.Marshal(igdServiceJSON{
+		Device:      s.uuid,
+		ID:          s.serviceID,
+		URN:         s.serviceURN,
+		ControlURL:  s.serviceURL,
+		EventSubURL: s.eventSubURL,
+		SCPDURL:     s.scpdURL,
+	})
+}
+
+func (s *IGDService) UnmarshalJSON(b []byte) error {
+	var j igdServiceJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*s = IGDService{
+		uuid:        j.Device,
+		serviceID:   j.ID,
+		serviceURN:  j.URN,
+		serviceURL:  j.ControlURL,
+		eventSubURL: j.EventSubURL,
+		scpdURL:     j.SCPDURL,
+	}
+	return nil
+}
+
+// The JSON form of a PortMapping, with the lease in seconds.
+type portMappingJSON struct {
+	RemoteHost     string     `json:"remoteHost"`
+	ExternalPort   int        `json:"externalPort"`
+	Protocol       Protocol   `json:"protocol"`
+	InternalPort   int        `json:"internalPort"`
+	InternalClient string     `json:"internalClient"`
+	Enabled        bool       `json:"enabled"`
+	Description    string     `json:"description"`
+	LeaseDuration  int        `json:"leaseDuration"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (m PortMapping) MarshalJSON() ([]byte, error) {
+	j := portMappingJSON{
+		RemoteHost:     m.RemoteHost,
+		ExternalPort:   m.ExternalPort,
+		Protocol:       m.Protocol,
+		InternalPort:   m.InternalPort,
+		InternalClient: m.InternalClient,
+		Enabled:        m.Enabled,
+		Description:    m.Description,
+		LeaseDuration:  int(m.Lease.Seconds()),
+	}
+	if !m.ExpiresAt.IsZero() {
+		j.ExpiresAt = &m.ExpiresAt
+	}
+	return json.Marshal(j)
+}
+
+func (m *PortMapping) UnmarshalJSON(b []byte) error {
+	var j portMappingJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*m = PortMapping{
+		RemoteHost:     j.RemoteHost,
+		ExternalPort:   j.ExternalPort,
+		Protocol:       j.Protocol,
+		InternalPort:   j.InternalPort,
+		InternalClient: j.InternalClient,
+		Enabled:        j.Enabled,
+		Description:    j.Description,
+		Lease:          time.Duration(j.LeaseDuration) * time.Second,
+	}
+	if j.ExpiresAt != nil {
+		m.ExpiresAt = *j.ExpiresAt
+	}
+	return nil
+}
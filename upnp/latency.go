@@ -0,0 +1,60 @@
+package upnp
+
+import (
+	"sync"
+	"time"
+)
+
+// The response times of a device, shared by the IGD and its services.
+type latencies struct {
+	mut         sync.Mutex
+	description time.Duration
+	soap        time.Duration
+	soapCount   int
+}
+
+// Note the response time of a SOAP request. The average weighs recent requests most, so it
+// follows a device getting slower or faster.
+func (l *latencies) observeSOAP(d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.soapCount == 0 {
+		l.soap = d
+	} else {
+		l.soap += (d - l.soap) / 4
+	}
+	l.soapCount++
+}
+
+// The Server header the InternetGatewayDevice sent with its description, or with its
+// search response when the description had none, which identifies its UPnP stack and
+// often its firmware. Empty when it sent neither.
+func (n *IGD) Server() string {
+	return n.server
+}
+
+// How long fetching the InternetGatewayDevice's description took when it was loaded,
+// including retries. Zero for devices restored from JSON.
+func (n *IGD) DescriptionLatency() time.Duration {
+	if n.latency == nil {
+		return 0
+	}
+	n.latency.mut.Lock()
+	defer n.latency.mut.Unlock()
+	return n.latency.description
+}
+
+// The average time the InternetGatewayDevice's services took to answer SOAP requests,
+// weighing recent requests most, and the number of requests it is over. Requests that
+// got no response are not counted. Zero before the first response.
+func (n *IGD) SOAPLatency() (time.Duration, int) {
+	if n.latency == nil {
+		return 0, 0
+	}
+	n.latency.mut.Lock()
+	defer n.latency.mut.Unlock()
+	return n.latency.soap, n.latency.soapCount
+}
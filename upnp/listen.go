@@ -0,0 +1,167 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// The lease Listen requests for its mappings, which the listener renews until it is closed.
+const ListenLease = time.Hour
+
+// How many external ports Listen tries when the router reports a conflict.
+const listenAttempts = 5
+
+// A Listener is a net.Listener whose port is mapped on an InternetGatewayDevice, so it is
+// reachable from the internet at the external address Addr reports. See Listen.
+type Listener struct {
+	net.Listener
+	manager  *Manager
+	external *net.TCPAddr
+}
+
+// Listen on the local network address like net.Listen and map its port on an IGD found by
+// the DefaultClient, see Client.Listen.
+func Listen(ctx context.Context, network, address string) (*Listener, error) {
+	return DefaultClient.Listen(ctx, network, address)
+}
+
+// Listen on the local network address like net.Listen and map its port on the IGD owning
+// the default route, or the most suitable IGD found (see SortIGDs). ctx bounds the discovery;
+// the listener keeps the mapping alive until it is closed.
+// The network must be "tcp" or "tcp4", as IGDs only map IPv4 ports.
+func (c *Client) Listen(ctx context.Context, network, address string) (*Listener, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("upnp: cannot map listeners on network %q", network)
+	}
+	igd, err := c.gateway(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return igd.Listen(ctx, network, address)
+}
+
+// The IGD owning the default route, or the most suitable IGD found (see SortIGDs).
+func (c *Client) gateway(ctx context.Context) (*IGD, error) {
+	var igds []IGD
+	for igd := range c.StartDiscovery(ctx).Results() {
+		igds = append(igds, igd)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(igds) == 0 {
+		return nil, errors.New("upnp: no InternetGatewayDevice found")
+	}
+	igd, ok := SelectDefaultGateway(igds)
+	if !ok {
+		SortIGDs(igds)
+		igd = &igds[0]
+	}
+	return igd, nil
+}
+
+// Listen on the local network address like net.Listen and map its port on the IGD.
+// The external port is the local one, or a random one when the router reports a conflict.
+func (n *IGD) Listen(ctx context.Context, network, address string) (*Listener, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("upnp: cannot map listeners on network %q", network)
+	}
+	ip, err := n.GetExternalIPAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return nil, errors.New("upnp: IGD reported no external IP address")
+	}
+
+	l, err := net.Listen("tcp4", address)
+	if err != nil {
+		return nil, err
+	}
+	local := l.Addr().(*net.TCPAddr)
+
+	m, external, err := n.mapLocalPort(ctx, TCP, local.IP, local.Port, fmt.Sprintf("upnp.Listen %d", local.Port))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &Listener{
+		Listener: l,
+		manager:  m,
+		external: &net.TCPAddr{IP: ip, Port: external},
+	}, nil
+}
+
+// The external address the listener is reachable at from the internet. It follows changes
+// of the external IP address of the IGD.
+func (l *Listener) Addr() net.Addr {
+	addr := *l.external
+	if ip := l.manager.ExternalIP(); ip != nil {
+		addr.IP = ip
+	}
+	return &addr
+}
+
+// The local address the listener listens on.
+func (l *Listener) LocalAddr() net.Addr {
+	return l.Listener.Addr()
+}
+
+// The manager keeping the listener's mapping alive, e.g. to subscribe to its events.
+func (l *Listener) Manager() *Manager {
+	return l.manager
+}
+
+// Stop listening and delete the mapping from the router.
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	if merr := l.manager.Close(); err == nil {
+		err = merr
+	}
+	return err
+}
+
+// Map the local port of a socket bound to ip on the IGD and keep the mapping renewed with a
+// Manager. The external port is the local one, or a random one when the router reports a
+// conflict or another process reserved it in the client's PortPool.
+func (n *IGD) mapLocalPort(ctx context.Context, protocol Protocol, ip net.IP, port int, description string) (*Manager, int, error) {
+	mapping := ManagedMapping{PortMapping: PortMapping{
+		Protocol:     protocol,
+		ExternalPort: port,
+		InternalPort: port,
+		Description:  description,
+		Lease:        ListenLease,
+	}}
+	// A socket bound to a single address is only reachable there.
+	if !ip.IsUnspecified() {
+		mapping.InternalClient = ip.String()
+	}
+
+	m := NewManager(n)
+	pool := n.Client().portPool()
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		err = m.Add(mapping)
+		if !IsErrorCode(err, ErrCodeConflictInMappingEntry) && !errors.Is(err, ErrPortReserved) || attempt == listenAttempts {
+			break
+		}
+		if pool == nil {
+			mapping.ExternalPort = 1024 + rand.Intn(65536-1024)
+		} else if mapping.ExternalPort, err = pool.ReserveAny(n.uuid, protocol); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		m.Stop()
+		return nil, 0, err
+	}
+	return m, mapping.ExternalPort, nil
+}
@@ -0,0 +1,81 @@
+package upnp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+)
+
+// How a client determines the local IP address port mappings point to, when its LocalIP
+// does not set one.
+type LocalIPStrategy int
+
+const (
+	// The local address of the connection the device description is fetched over, or
+	// of a connection dialed to the device when that one cannot be inspected.
+	LocalIPConnection LocalIPStrategy = iota
+	// The address of the local interface in the subnet of the device's address, on
+	// the client's Interface when it has one. When the device's description URL is
+	// reached through another VLAN or a route than the data path, this is the address
+	// on the device's own network. Falls back to LocalIPConnection when no interface is
+	// in the subnet.
+	LocalIPSubnet
+	// The client's LocalIP, without which loading devices fails.
+	LocalIPExplicit
+)
+
+// ErrNoLocalIP is returned when loading a device with LocalIPExplicit and no LocalIP.
+var ErrNoLocalIP = errors.New("upnp: no local IP address set")
+
+// The local IP address for port mappings of the device at u, whose description was fetched
+// over a connection from connLocalIP, empty when it cannot be inspected.
+func (c *Client) localIPFor(u *url.URL, connLocalIP string) (string, error) {
+	if c.LocalIP != "" {
+		return c.LocalIP, nil
+	}
+	switch c.LocalIPStrategy {
+	case LocalIPExplicit:
+		return "", ErrNoLocalIP
+	case LocalIPSubnet:
+		if ip := subnetLocalIP(c.Interface, net.ParseIP(u.Hostname())); ip != nil {
+			return ip.String(), nil
+		}
+		c.logger().Debug("No local interface in the subnet of the device, using the connection's address", "url", u.Redacted())
+	}
+	if connLocalIP != "" {
+		return connLocalIP, nil
+	}
+	return localIP(u, "")
+}
+
+// The address of a local interface, ifi when not nil, whose subnet contains ip.
+// Nil when there is none.
+func subnetLocalIP(ifi *net.Interface, ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	var interfaces []net.Interface
+	if ifi != nil {
+		interfaces = []net.Interface{*ifi}
+	} else {
+		var err error
+		if interfaces, err = net.Interfaces(); err != nil {
+			return nil
+		}
+	}
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if subnet, ok := addr.(*net.IPNet); ok && subnet.Contains(ip) && !subnet.IP.Equal(ip) {
+				return subnet.IP
+			}
+		}
+	}
+	return nil
+}
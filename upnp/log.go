@@ -0,0 +1,42 @@
+package upnp
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// Debugging
+//
+// Deprecated: Set Client.Logger instead. Debug makes the default logger,
+// once enabled with EnableLog, include debug messages.
+var Debug = false
+
+var logEnabled atomic.Bool
+
+// Enable logging to stdout for clients without a logger.
+//
+// Deprecated: Set Client.Logger instead.
+func EnableLog() {
+	logEnabled.Store(true)
+}
+
+// The logger of clients without one, controlled by the deprecated Debug and EnableLog.
+var legacyLogger = slog.New(legacyHandler{slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})})
+
+type legacyHandler struct {
+	slog.Handler
+}
+
+func (h legacyHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return logEnabled.Load() && (level > slog.LevelDebug || Debug)
+}
+
+func (h legacyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return legacyHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h legacyHandler) WithGroup(name string) slog.Handler {
+	return legacyHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,1075 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often permanent mappings are re-added, in case the router lost them (e.g. after a reboot).
+var PermanentRefreshInterval = 10 * time.Minute
+
+// How often the manager checks for mappings due for renewal.
+var managerTick = 5 * time.Second
+
+// How long the manager waits before retrying a failed renewal.
+var RenewRetryInterval = 30 * time.Second
+
+// How often the manager checks the external IP address of the IGD.
+var ExternalIPCheckInterval = time.Minute
+
+// The kinds of events published by a Manager.
+type EventType string
+
+const (
+	EventExternalIPChanged EventType = "external-ip-changed"
+	EventRenewalFailed     EventType = "renewal-failed"
+	EventDeviceLost        EventType = "device-lost"
+	EventDeviceFound       EventType = "device-found"
+	EventNetworkChanged    EventType = "network-changed"
+	EventLeaseTruncated    EventType = "lease-truncated"
+	EventDeviceMoved       EventType = "device-moved"
+)
+
+// An Event describes a change observed by a Manager. Depending on the type,
+// Mapping holds the affected mapping, ExternalIP the new external IP address and Err the cause.
+// EventLeaseTruncated is published when the router grants a mapping a shorter lease than the
+// one requested, see ManagedMapping.Granted, and EventDeviceMoved when the IGD announced
+// another location, see WatchAnnouncements. EventDeviceLost is also published when the IGD
+// announces ssdp:byebye, with Err ErrDeviceByebye.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	UUID       string
+	Mapping    *ManagedMapping
+	ExternalIP net.IP
+	Err        error
+}
+
+// A mapping kept alive by a Manager. Its Lease is the lease requested from the
+// router, zero for a permanent mapping, and its ExpiresAt when the lease the router
+// granted runs out unless it is renewed; managed mappings are enabled unless Disabled is set.
+type ManagedMapping struct {
+	PortMapping
+
+	// When the mapping was last added or renewed, and the error of the last attempt.
+	Renewed   time.Time
+	LastError error
+
+	// The lease the router reported right after the mapping was last added or renewed,
+	// zero when it is unknown. Some firmwares clamp or ignore the lease requested, so
+	// renewals are scheduled off this one when it is known.
+	Granted time.Duration
+
+	// Overwrite and delete the mapping on the router even if another owner created it,
+	// see Manager.SetOwner.
+	Force bool
+
+	// Keep the mapping on the router without forwarding traffic for it, e.g. to stage it.
+	// See Manager.SetEnabled.
+	Disabled bool
+
+	// The IGD announced ssdp:byebye, so renewals are paused until it announces itself again
+	// or answers the manager's checks, see Manager.WatchAnnouncements.
+	Orphaned bool
+
+	// Take ExternalPort as a preference, letting the router map another port when it is
+	// taken, with AddAnyPortMapping where the IGD supports it. See Manager.Map.
+	AnyPort bool
+
+	// The action which added the mapping, "AddPortMapping" or "AddAnyPortMapping";
+	// renewals use the same one.
+	Action string
+
+	retry time.Time
+}
+
+// Record a successful renewal at t, in which the router granted a lease of granted.
+func (m *ManagedMapping) renewed(t time.Time, granted time.Duration) {
+	m.Renewed = t
+	m.Granted = granted
+	m.ExpiresAt = time.Time{}
+	if lease := m.lease(); lease > 0 {
+		m.ExpiresAt = t.Add(lease)
+	}
+}
+
+// The lease the mapping has after a renewal: the one granted if known, else the one requested.
+func (m *ManagedMapping) lease() time.Duration {
+	if m.Lease > 0 && m.Granted > 0 {
+		return m.Granted
+	}
+	return m.Lease
+}
+
+func (m *ManagedMapping) key() string {
+	return fmt.Sprintf("%s/%d", m.Protocol, m.ExternalPort)
+}
+
+// When the mapping is next due for renewal: halfway through its lease.
+func (m *ManagedMapping) due() time.Time {
+	if m.retry.After(m.Renewed) {
+		return m.retry
+	}
+	if m.Lease == 0 {
+		return m.Renewed.Add(PermanentRefreshInterval)
+	}
+	return m.Renewed.Add(m.lease() / 2)
+}
+
+// A Manager keeps a set of port mappings alive on an InternetGatewayDevice,
+// renewing their leases until they are removed or the manager is closed.
+type Manager struct {
+	// The IGD, which FollowNetwork replaces when the host moves networks.
+	igd         atomic.Pointer[IGD]
+	mut         sync.Mutex
+	mappings    map[string]*ManagedMapping
+	subscribers map[chan Event]struct{}
+	// Serializes the router requests for each mapping, so a renewal cannot re-add a
+	// mapping being removed.
+	locks      keyLocks
+	externalIP net.IP
+	lost       bool
+	stop       chan struct{}
+	done       chan struct{}
+	// Signalled to check the external IP address right away, e.g. on an event.
+	check chan struct{}
+	// The GENA subscription of WatchEvents.
+	subscription *Subscription
+
+	// The IGD mappings are cascaded through, and the external IP address of igd they point to.
+	upstream *IGD
+	innerIP  net.IP
+
+	// The user of Login, and its password.
+	loginName, loginPassword string
+
+	// The description prefix of SetOwner.
+	owner string
+}
+
+// Mutexes by mapping key, kept while they are held or waited for.
+type keyLocks struct {
+	mut   sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock the key, returning the function unlocking it.
+func (l *keyLocks) lock(key string) func() {
+	l.mut.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	k, ok := l.locks[key]
+	if !ok {
+		k = &keyLock{}
+		l.locks[key] = k
+	}
+	k.refs++
+	l.mut.Unlock()
+
+	k.Lock()
+	return func() {
+		k.Unlock()
+		l.mut.Lock()
+		if k.refs--; k.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mut.Unlock()
+	}
+}
+
+// ErrForeignMapping is returned when a Manager would overwrite or delete a mapping another
+// owner created, see Manager.SetOwner.
+var ErrForeignMapping = errors.New("mapping created by another owner")
+
+// ErrDeviceByebye is the Err of the EventDeviceLost published when the IGD announces
+// ssdp:byebye, e.g. as it is powered off.
+var ErrDeviceByebye = errors.New("device announced ssdp:byebye")
+
+// Create a manager for the specified InternetGatewayDevice and start its renewal loop.
+func NewManager(igd *IGD) *Manager {
+	m := &Manager{
+		mappings:    make(map[string]*ManagedMapping),
+		subscribers: make(map[chan Event]struct{}),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		check:       make(chan struct{}, 1),
+	}
+	m.igd.Store(igd)
+	go m.run()
+	return m
+}
+
+// The InternetGatewayDevice the manager operates on.
+func (m *Manager) IGD() *IGD {
+	return m.igd.Load()
+}
+
+// The external IP address of the IGD as last checked, or of the upstream IGD when cascading.
+// Nil before the first check.
+func (m *Manager) ExternalIP() net.IP {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.externalIP
+}
+
+// Cascade the managed mappings through upstream, the IGD the manager's one is behind (see
+// IGD.CheckDoubleNAT), for double NAT setups where both routers speak UPnP. Each mapping is also
+// added to upstream, forwarding its external port to the same port on the external IP address
+// of the manager's IGD, and both are renewed and removed together. The events of the manager
+// then report the external IP address of upstream. It must be called before adding mappings.
+func (m *Manager) Cascade(upstream *IGD) {
+	m.mut.Lock()
+	m.upstream = upstream
+	m.mut.Unlock()
+}
+
+// Log in to the DeviceProtection service of the IGD as the user name (see IGD.Login), for
+// routers which only let authorized control points add mappings. The manager logs in again
+// whenever adding a mapping is not authorized, as devices forget logins with the TLS session.
+func (m *Manager) Login(ctx context.Context, name, password string) error {
+	m.mut.Lock()
+	m.loginName, m.loginPassword = name, password
+	m.mut.Unlock()
+	return m.IGD().Login(ctx, name, password)
+}
+
+// Tag the descriptions of the mappings the manager adds with the prefix tag, e.g.
+// "upnpctl: ", and refuse to overwrite or delete mappings on the router whose description
+// lacks it, which were created by hand or by other applications. Adding, renewing and
+// removing such mappings fails with ErrForeignMapping, unless they have Force set.
+// It must be called before adding mappings.
+func (m *Manager) SetOwner(tag string) {
+	m.mut.Lock()
+	m.owner = tag
+	m.mut.Unlock()
+}
+
+// Check that the router has no mapping of the port, or one of the manager's owner.
+// Routers which cannot look up mappings are not checked.
+func (m *Manager) checkOwner(mapping ManagedMapping) error {
+	m.mut.Lock()
+	owner := m.owner
+	m.mut.Unlock()
+	if owner == "" || mapping.Force {
+		return nil
+	}
+	entry, err := m.IGD().GetSpecificPortMappingEntry(context.Background(), mapping.Protocol, mapping.ExternalPort)
+	if err != nil || strings.HasPrefix(entry.Description, owner) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w (%q)", mapping.key(), ErrForeignMapping, entry.Description)
+}
+
+// Add a mapping to the router and keep it alive. Adding a mapping which is already managed replaces and renews it.
+func (m *Manager) Add(mapping ManagedMapping) error {
+	_, err := m.Map(mapping)
+	return err
+}
+
+// Add a mapping to the router and keep it alive like Add, returning it as managed. With
+// AnyPort set, the router may have mapped another external port than the one asked for.
+func (m *Manager) Map(mapping ManagedMapping) (ManagedMapping, error) {
+	mapping.Enabled = !mapping.Disabled
+	mapping.Action = "AddPortMapping"
+	if mapping.AnyPort {
+		mapping.Action = "AddAnyPortMapping"
+	}
+	m.mut.Lock()
+	if !strings.HasPrefix(mapping.Description, m.owner) {
+		mapping.Description = m.owner + mapping.Description
+	}
+	m.mut.Unlock()
+	defer m.locks.lock(mapping.key())()
+	if err := m.checkOwner(mapping); err != nil {
+		return ManagedMapping{}, err
+	}
+	igd := m.IGD()
+	pool := igd.Client().portPool()
+	if pool != nil {
+		if err := pool.Reserve(igd.uuid, mapping.Protocol, mapping.ExternalPort); err != nil {
+			return ManagedMapping{}, err
+		}
+	}
+	added, action, err := m.add(context.Background(), mapping.PortMapping, mapping.Action, mapping.AnyPort)
+	if err == nil && pool != nil && added.ExternalPort != mapping.ExternalPort {
+		// The port the router mapped instead takes the place of the one reserved.
+		m.releaseUnmanaged(pool, igd, mapping)
+		if err := pool.Reserve(igd.uuid, added.Protocol, added.ExternalPort); err != nil {
+			m.IGD().Delete(context.Background(), added)
+			if upstream := m.cascade(); upstream != nil {
+				upstream.Delete(context.Background(), added)
+			}
+			return ManagedMapping{}, err
+		}
+	}
+	if err != nil {
+		if m.cascade() != nil {
+			// Do not leave a half cascaded mapping behind.
+			m.IGD().Delete(context.Background(), added)
+		}
+		if pool != nil {
+			m.releaseUnmanaged(pool, igd, mapping)
+		}
+		return ManagedMapping{}, err
+	}
+
+	mapping.PortMapping, mapping.Action = added, action
+	mapping.renewed(time.Now(), m.grantedLease(mapping))
+	mapping.LastError = nil
+
+	m.mut.Lock()
+	m.mappings[mapping.key()] = &mapping
+	m.mut.Unlock()
+
+	return mapping, nil
+}
+
+// Release the port of the mapping in the pool unless a managed mapping holds it.
+func (m *Manager) releaseUnmanaged(pool *PortPool, igd *IGD, mapping ManagedMapping) {
+	m.mut.Lock()
+	_, managed := m.mappings[mapping.key()]
+	m.mut.Unlock()
+	if !managed {
+		pool.Release(igd.uuid, mapping.Protocol, mapping.ExternalPort)
+	}
+}
+
+// Stop managing a mapping and delete it from the router. A mapping another owner took over
+// stays managed, and Remove fails with ErrForeignMapping.
+func (m *Manager) Remove(protocol Protocol, externalPort int) error {
+	return m.remove(context.Background(), protocol, externalPort)
+}
+
+func (m *Manager) remove(ctx context.Context, protocol Protocol, externalPort int) error {
+	key := fmt.Sprintf("%s/%d", protocol, externalPort)
+	defer m.locks.lock(key)()
+
+	m.mut.Lock()
+	mapping, ok := m.mappings[key]
+	m.mut.Unlock()
+
+	if !ok {
+		return fmt.Errorf("mapping %s is not managed", key)
+	}
+	if err := m.checkOwner(*mapping); err != nil {
+		return err
+	}
+	m.mut.Lock()
+	delete(m.mappings, key)
+	m.mut.Unlock()
+	if pool := m.IGD().Client().portPool(); pool != nil {
+		defer pool.Release(m.IGD().uuid, mapping.Protocol, mapping.ExternalPort)
+	}
+
+	err := m.IGD().Delete(ctx, mapping.PortMapping)
+	if upstream := m.cascade(); upstream != nil {
+		if upErr := upstream.Delete(ctx, mapping.PortMapping); upErr != nil && err == nil {
+			err = fmt.Errorf("upstream: %w", upErr)
+		}
+	}
+	return err
+}
+
+func (m *Manager) cascade() *IGD {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.upstream
+}
+
+// Add the mapping to the IGD with the action, and to the upstream IGD when cascading,
+// returning it as added and the action used. With AddAnyPortMapping the IGD may map another
+// external port, which is kept when moving is set and undone otherwise, as when renewing.
+func (m *Manager) add(ctx context.Context, mapping PortMapping, action string, moving bool) (PortMapping, string, error) {
+	addTo := func(igd *IGD) (PortMapping, string, error) {
+		if action != "AddAnyPortMapping" {
+			return mapping, action, igd.Add(ctx, mapping)
+		}
+		added := mapping
+		port, used, err := igd.AddAny(ctx, mapping)
+		added.ExternalPort = port
+		return added, used, err
+	}
+	added, used, err := addTo(m.IGD())
+	if IsErrorCode(err, ErrCodeActionNotAuthorized) {
+		m.mut.Lock()
+		name, password := m.loginName, m.loginPassword
+		m.mut.Unlock()
+		if name != "" {
+			if loginErr := m.IGD().Login(ctx, name, password); loginErr != nil {
+				m.IGD().logger().Warn("Logging in failed", "user", name, "err", loginErr)
+			} else {
+				added, used, err = addTo(m.IGD())
+			}
+		}
+	}
+	if err != nil {
+		return mapping, action, err
+	}
+	if !moving && added.ExternalPort != mapping.ExternalPort {
+		// Another client took the port, which AddPortMapping fails on.
+		m.IGD().Delete(ctx, added)
+		return mapping, action, fmt.Errorf("%s/%d is taken, the router mapped port %d instead", mapping.Protocol, mapping.ExternalPort, added.ExternalPort)
+	}
+
+	m.mut.Lock()
+	upstream, innerIP := m.upstream, m.innerIP
+	m.mut.Unlock()
+	if upstream == nil {
+		return added, used, nil
+	}
+	if innerIP == nil {
+		ip, err := m.IGD().GetExternalIPAddress(ctx)
+		if err != nil {
+			return added, used, fmt.Errorf("upstream: getting the external IP address to forward to: %w", err)
+		}
+		m.mut.Lock()
+		m.innerIP, innerIP = ip, ip
+		m.mut.Unlock()
+	}
+
+	outer := added
+	outer.InternalPort = added.ExternalPort
+	outer.InternalClient = innerIP.String()
+	if err := upstream.Add(ctx, outer); err != nil {
+		return added, used, fmt.Errorf("upstream: %w", err)
+	}
+	return added, used, nil
+}
+
+// A snapshot of the managed mappings, ordered by protocol and external port.
+func (m *Manager) Mappings() []ManagedMapping {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	result := make([]ManagedMapping, 0, len(m.mappings))
+	for _, mapping := range m.mappings {
+		result = append(result, *mapping)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Protocol != result[j].Protocol {
+			return result[i].Protocol < result[j].Protocol
+		}
+		return result[i].ExternalPort < result[j].ExternalPort
+	})
+	return result
+}
+
+// The managed mapping whose lease expires first, e.g. to show a countdown or to renew it
+// ahead of the manager. False when all mappings are permanent.
+func (m *Manager) NextExpiry() (ManagedMapping, bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	var next *ManagedMapping
+	for _, mapping := range m.mappings {
+		if mapping.ExpiresAt.IsZero() {
+			continue
+		}
+		if next == nil || mapping.ExpiresAt.Before(next.ExpiresAt) ||
+			mapping.ExpiresAt.Equal(next.ExpiresAt) && mapping.key() < next.key() {
+			next = mapping
+		}
+	}
+	if next == nil {
+		return ManagedMapping{}, false
+	}
+	return *next, true
+}
+
+// Subscribe to the manager's events. Events are dropped for subscribers which do not keep up.
+// The returned function cancels the subscription and closes the channel.
+func (m *Manager) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+
+	m.mut.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mut.Unlock()
+
+	return ch, func() {
+		m.mut.Lock()
+		defer m.mut.Unlock()
+		if _, ok := m.subscribers[ch]; ok {
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (m *Manager) publish(event Event) {
+	event.Time = time.Now()
+	event.UUID = m.IGD().UUID()
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	for ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+			m.IGD().logger().Warn("Dropping event for slow subscriber", "event", event.Type)
+		}
+	}
+}
+
+func (m *Manager) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(managerTick)
+	defer ticker.Stop()
+
+	m.checkExternalIP()
+	lastCheck := time.Now()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.check:
+			m.checkExternalIP()
+			lastCheck = time.Now()
+		case now := <-ticker.C:
+			m.renewDue(now)
+			if now.Sub(lastCheck) >= ExternalIPCheckInterval {
+				m.checkExternalIP()
+				lastCheck = now
+			}
+		}
+	}
+}
+
+// Follow the host across networks until ctx is done: on each change WatchNetwork reports
+// (polling every interval, NetworkPollInterval when zero), search for IGDs again, switch to
+// the one with the same UUID, or else the one owning the default route, and re-add all
+// mappings, so they point to the host's new address. Switching publishes an
+// EventNetworkChanged. Cascading is not followed.
+func (m *Manager) FollowNetwork(ctx context.Context, interval time.Duration) {
+	go func() {
+		for change := range WatchNetwork(ctx, interval) {
+			m.networkChanged(change)
+		}
+	}()
+}
+
+func (m *Manager) networkChanged(change NetworkChange) {
+	current := m.IGD()
+	log := current.logger()
+	log.Info("Network changed, searching for IGDs", "resumed", change.Resumed, "gateways", change.Gateways)
+
+	igds := current.Client().Discover()
+	var next *IGD
+	for i := range igds {
+		if igds[i].uuid == current.uuid {
+			next = &igds[i]
+		}
+	}
+	if next == nil {
+		next, _ = SelectDefaultGateway(igds)
+	}
+
+	if next != nil && (next.uuid != current.uuid || next.url.String() != current.url.String() || next.localIPAddress != current.localIPAddress) {
+		log.Info("Switching IGD", "uuid", next.uuid, "url", next.url, "localIP", next.localIPAddress)
+		m.switchIGD(next, EventNetworkChanged)
+	}
+	m.revalidate()
+}
+
+// Manage the mappings on next instead of the current IGD, publishing an event of type t.
+func (m *Manager) switchIGD(next *IGD, t EventType) {
+	m.igd.Store(next)
+	m.adopt()
+	m.publish(Event{Type: t})
+	if m.EventSubscription() != nil {
+		if err := m.WatchEvents(context.Background()); err != nil {
+			next.logger().Warn("Subscribing to the events of the new IGD failed", "err", err)
+		}
+	}
+}
+
+// Re-validate the mappings and the external IP address on the next tick, or right away.
+func (m *Manager) revalidate() {
+	m.renewAllNow()
+	select {
+	case m.check <- struct{}{}:
+	default:
+	}
+}
+
+// Follow the SSDP announcements of the IGD until ctx is done: when it announces another
+// description location with ssdp:alive or ssdp:update, e.g. after DHCP renumbered its LAN
+// address, reload it from there and manage the mappings on it, publishing an
+// EventDeviceMoved. The IGD must keep its UUID and no longer answer at its previous
+// location. When it announces ssdp:byebye, publish an EventDeviceLost and mark the
+// mappings Orphaned, pausing their renewals rather than retrying them against a router
+// which is off, until it announces itself again or answers the check of the external IP
+// address, which carries on every ExternalIPCheckInterval.
+func (m *Manager) WatchAnnouncements(ctx context.Context) error {
+	announcements, err := m.IGD().Client().MonitorAnnouncements(ctx)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for a := range announcements {
+			m.announced(a)
+		}
+	}()
+	return nil
+}
+
+func (m *Manager) announced(a Announcement) {
+	current := m.IGD()
+	if !strings.EqualFold(a.UUID, current.uuid) {
+		return
+	}
+	switch a.Kind {
+	case AnnounceByebye:
+		m.byebye()
+		return
+	case AnnounceAlive, AnnounceUpdate:
+	default:
+		return
+	}
+	if m.adopt() {
+		current.logger().Info("IGD announced itself again, resuming renewals")
+		m.revalidate()
+	}
+	if a.Location == "" || a.Location == current.url.String() {
+		return
+	}
+	c := current.Client()
+	log := current.logger().With("url", a.Location)
+	// Anyone on the network can send a NOTIFY, so the IGD is only followed once it
+	// stopped answering at the location it was loaded from.
+	if previous, err := c.loadIGD(context.Background(), log, current.url.String(), current.uuid, nil); err == nil && strings.EqualFold(previous.uuid, current.uuid) {
+		log.Warn("Ignoring new location of the IGD, it still answers at the previous one", "previous", current.url)
+		return
+	}
+	log.Info("IGD announced a new location, reloading it", "previous", current.url)
+	next, err := c.loadIGD(context.Background(), log, a.Location, "", c.searchScope(a.From))
+	switch {
+	case err != nil:
+		log.Warn("Loading the IGD from its new location failed", "err", err)
+		return
+	case !strings.EqualFold(next.uuid, current.uuid):
+		log.Warn("Ignoring new location of the IGD describing another device", "uuid", next.uuid)
+		return
+	case !c.deviceFilter().Allows(next):
+		log.Info("Ignoring new location of the IGD ruled out by the device filter")
+		return
+	}
+	next.usn = current.usn
+	m.switchIGD(next, EventDeviceMoved)
+	m.revalidate()
+}
+
+// Mark the mappings Orphaned as the IGD said ssdp:byebye, publishing an EventDeviceLost
+// unless it was already lost. Devices send one for each of their devices and services.
+func (m *Manager) byebye() {
+	m.mut.Lock()
+	wasLost, orphaned := m.lost, false
+	m.lost = true
+	for _, mapping := range m.mappings {
+		orphaned = orphaned || !mapping.Orphaned
+		mapping.Orphaned = true
+	}
+	m.mut.Unlock()
+
+	if orphaned {
+		m.IGD().logger().Info("IGD announced ssdp:byebye, pausing renewals")
+	}
+	if !wasLost {
+		m.publish(Event{Type: EventDeviceLost, Err: ErrDeviceByebye})
+	}
+}
+
+// Clear Orphaned from the mappings, reporting whether any had it.
+func (m *Manager) adopt() bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	adopted := false
+	for _, mapping := range m.mappings {
+		adopted = adopted || mapping.Orphaned
+		mapping.Orphaned = false
+	}
+	return adopted
+}
+
+// Subscribe to the GENA events of the IGD's preferred service, and check the external IP
+// address whenever it or the connection status changes, rather than only every
+// ExternalIPCheckInterval. The events are delivered to the callback server of the IGD's client.
+func (m *Manager) WatchEvents(ctx context.Context) error {
+	return m.watchEvents(ctx, (*IGDService).SubscribeEvents)
+}
+
+// WatchEvents, resuming the subscription of a previous process (see IGDService.ResumeEvents).
+func (m *Manager) ResumeWatchEvents(ctx context.Context, state SubscriptionState) error {
+	return m.watchEvents(ctx, func(s *IGDService, ctx context.Context) (*Subscription, error) {
+		return s.ResumeEvents(ctx, state)
+	})
+}
+
+// The GENA subscription of WatchEvents, nil when there is none.
+func (m *Manager) EventSubscription() *Subscription {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.subscription
+}
+
+func (m *Manager) watchEvents(ctx context.Context, subscribe func(*IGDService, context.Context) (*Subscription, error)) error {
+	service, err := m.IGD().PreferredService(ctx)
+	if err != nil {
+		return err
+	}
+	sub, err := subscribe(service, ctx)
+	if err != nil {
+		return err
+	}
+	m.mut.Lock()
+	previous := m.subscription
+	m.subscription = sub
+	m.mut.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+
+	go func() {
+		for event := range sub.Events() {
+			_, ip := event["ExternalIPAddress"]
+			_, status := event["ConnectionStatus"]
+			if ip || status {
+				select {
+				case m.check <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Poll the external IP address, which also tells whether the IGD is still reachable.
+// When cascading, the external IP address is that of the upstream IGD, and the mappings
+// are re-added when the one of the manager's IGD changes, as they point to it.
+func (m *Manager) checkExternalIP() {
+	ctx := context.Background()
+	ip, err := m.IGD().GetExternalIPAddress(ctx)
+
+	m.mut.Lock()
+	previous, wasLost := m.externalIP, m.lost
+	upstream, previousInner := m.upstream, m.innerIP
+	m.lost = err != nil
+	if err == nil && upstream != nil {
+		m.innerIP = ip
+	}
+	m.mut.Unlock()
+
+	switch {
+	case err != nil && !wasLost:
+		m.publish(Event{Type: EventDeviceLost, Err: err})
+	case err != nil:
+		return
+	case wasLost:
+		m.publish(Event{Type: EventDeviceFound, ExternalIP: ip})
+	}
+	if err != nil {
+		return
+	}
+	if m.adopt() {
+		// The IGD is back without announcing it, or the announcement was lost.
+		m.IGD().logger().Info("IGD answered again, resuming renewals")
+		m.renewAllNow()
+	}
+
+	if upstream != nil {
+		if previousInner != nil && !previousInner.Equal(ip) {
+			m.IGD().logger().Info("External IP address changed, re-adding cascaded mappings", "ip", ip)
+			m.renewAllNow()
+		}
+		ip, err = upstream.GetExternalIPAddress(ctx)
+		if err != nil {
+			upstream.logger().Warn("Getting the upstream external IP address failed", "err", err)
+			return
+		}
+	}
+
+	m.mut.Lock()
+	m.externalIP = ip
+	m.mut.Unlock()
+
+	if previous != nil && !previous.Equal(ip) {
+		m.publish(Event{Type: EventExternalIPChanged, ExternalIP: ip})
+	}
+}
+
+// Make all mappings due for renewal on the next tick.
+func (m *Manager) renewAllNow() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	now := time.Now()
+	for _, mapping := range m.mappings {
+		mapping.retry = now
+	}
+}
+
+func (m *Manager) renewDue(now time.Time) {
+	m.mut.Lock()
+	var due []ManagedMapping
+	for _, mapping := range m.mappings {
+		if !mapping.Orphaned && !now.Before(mapping.due()) {
+			due = append(due, *mapping)
+		}
+	}
+	m.mut.Unlock()
+
+	for _, mapping := range due {
+		m.renew(mapping.key(), nil)
+	}
+}
+
+// Read back the lease the router granted the mapping just added, zero when it is permanent
+// or the router cannot look it up.
+func (m *Manager) grantedLease(mapping ManagedMapping) time.Duration {
+	if mapping.Lease == 0 {
+		return 0
+	}
+	entry, err := m.IGD().GetSpecificPortMappingEntry(context.Background(), mapping.Protocol, mapping.ExternalPort)
+	if err != nil {
+		return 0
+	}
+	changed := mapping.Granted == 0 || differs(entry.Lease, mapping.Granted)
+	if entry.Lease > 0 && differs(entry.Lease, mapping.Lease) && changed {
+		m.IGD().logger().Warn("Router granted a different lease", "mapping", mapping.key(), "requested", mapping.Lease, "granted", entry.Lease)
+		if entry.Lease < mapping.Lease {
+			truncated := mapping
+			truncated.Granted = entry.Lease
+			m.publish(Event{Type: EventLeaseTruncated, Mapping: &truncated,
+				Err: fmt.Errorf("requested a lease of %s, granted %s", mapping.Lease, entry.Lease)})
+		}
+	}
+	return entry.Lease
+}
+
+// Whether two leases read back from the router differ by more than the time passing
+// between the requests.
+func differs(a, b time.Duration) bool {
+	d := a - b
+	return d < -time.Minute || d > time.Minute
+}
+
+// Renew the managed mapping with the key, after applying update to it unless nil,
+// reporting false when it is not managed (anymore).
+func (m *Manager) renew(key string, update func(*ManagedMapping)) (bool, error) {
+	defer m.locks.lock(key)()
+	m.mut.Lock()
+	mapping, ok := m.mappings[key]
+	var snapshot ManagedMapping
+	if ok {
+		if update != nil {
+			update(mapping)
+		}
+		snapshot = *mapping
+	}
+	m.mut.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, m.renewMapping(snapshot)
+}
+
+// Renew the mapping on the router, recording the result. The key of the mapping must be locked.
+func (m *Manager) renewMapping(mapping ManagedMapping) error {
+	err := m.checkOwner(mapping)
+	if err == nil {
+		_, _, err = m.add(context.Background(), mapping.PortMapping, mapping.Action, false)
+	}
+	var granted time.Duration
+	if err == nil {
+		granted = m.grantedLease(mapping)
+	}
+	m.IGD().client.metrics().Renewal(m.IGD().uuid, mapping.Protocol, mapping.ExternalPort, err)
+	if err != nil {
+		m.IGD().logger().Warn("Renewing mapping failed", "mapping", mapping.key(), "err", err)
+		failed := mapping
+		failed.LastError = err
+		m.publish(Event{Type: EventRenewalFailed, Mapping: &failed, Err: err})
+	} else {
+		m.IGD().logger().Debug("Renewed mapping", "mapping", mapping.key())
+	}
+
+	m.mut.Lock()
+	if current, ok := m.mappings[mapping.key()]; ok {
+		current.LastError = err
+		if err == nil {
+			current.renewed(time.Now(), granted)
+		} else {
+			current.retry = time.Now().Add(RenewRetryInterval)
+		}
+	}
+	m.mut.Unlock()
+	return err
+}
+
+// Renew a managed mapping right away rather than when it is due, e.g. before the host goes
+// to sleep. Failures are retried and reported like those of scheduled renewals.
+func (m *Manager) RenewNow(protocol Protocol, externalPort int) error {
+	key := fmt.Sprintf("%s/%d", protocol, externalPort)
+	ok, err := m.renew(key, nil)
+	if !ok {
+		return fmt.Errorf("mapping %s is not managed", key)
+	}
+	return err
+}
+
+// Enable or disable a managed mapping on the router, pausing it without deleting it.
+// Renewals keep it in that state.
+func (m *Manager) SetEnabled(protocol Protocol, externalPort int, enabled bool) error {
+	key := fmt.Sprintf("%s/%d", protocol, externalPort)
+	ok, err := m.renew(key, func(mapping *ManagedMapping) {
+		mapping.Disabled, mapping.Enabled = !enabled, enabled
+	})
+	if !ok {
+		return fmt.Errorf("mapping %s is not managed", key)
+	}
+	return err
+}
+
+// Renew all managed mappings right away, see RenewNow, returning the first error encountered.
+func (m *Manager) RenewAll() error {
+	var firstErr error
+	for _, mapping := range m.Mappings() {
+		// Mappings removed in the meantime are skipped.
+		if _, err := m.renew(mapping.key(), nil); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stop renewing the managed mappings without deleting them from the router,
+// so they stay in place until their leases expire. Event subscriptions are closed.
+func (m *Manager) Stop() {
+	select {
+	case <-m.stop:
+		return
+	default:
+	}
+	close(m.stop)
+	<-m.done
+
+	m.mut.Lock()
+	sub := m.subscription
+	m.subscription = nil
+	m.mut.Unlock()
+	if sub != nil {
+		if err := sub.Close(); err != nil {
+			m.IGD().logger().Debug("Cancelling event subscription failed", "err", err)
+		}
+	}
+
+	m.mut.Lock()
+	for ch := range m.subscribers {
+		delete(m.subscribers, ch)
+		close(ch)
+	}
+	m.mut.Unlock()
+}
+
+// A channel closed when the manager has stopped renewing, after Stop or Close.
+func (m *Manager) Done() <-chan struct{} {
+	return m.done
+}
+
+// Stop renewing and delete all managed mappings from the router, returning the first error encountered.
+// Event subscriptions are closed.
+func (m *Manager) Close() error {
+	return m.CloseAllMappings(context.Background(), TeardownDelete)
+}
+
+// What CloseAllMappings does with the managed mappings: TeardownDelete, TeardownLeave or
+// ShortenLeaseTo.
+type TeardownPolicy struct {
+	leave bool
+	lease time.Duration
+}
+
+var (
+	// Delete the mappings from the router, so they disappear right away.
+	TeardownDelete = TeardownPolicy{}
+	// Leave the mappings in place until their leases expire, permanent ones for good.
+	TeardownLeave = TeardownPolicy{leave: true}
+)
+
+// Renew the mappings with a lease of d, so they expire shortly after the application exits
+// but survive a quick restart. Mappings expiring sooner are left alone, and those the router
+// refuses the lease for are deleted.
+func ShortenLeaseTo(d time.Duration) TeardownPolicy {
+	if d <= 0 {
+		return TeardownDelete
+	}
+	return TeardownPolicy{lease: d}
+}
+
+// Stop renewing and tear the managed mappings down as the policy says, e.g. when the
+// application shuts down, returning the first error encountered. Event subscriptions are
+// closed. The requests to the router are made with ctx, so a deadline bounds the shutdown.
+func (m *Manager) CloseAllMappings(ctx context.Context, policy TeardownPolicy) error {
+	m.Stop()
+	if policy.leave {
+		return nil
+	}
+
+	var firstErr error
+	for _, mapping := range m.Mappings() {
+		var err error
+		if policy.lease > 0 {
+			err = m.shorten(ctx, mapping, policy.lease)
+		} else {
+			err = m.remove(ctx, mapping.Protocol, mapping.ExternalPort)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stop managing the mapping, renewing it with the lease unless it expires sooner.
+func (m *Manager) shorten(ctx context.Context, mapping ManagedMapping, lease time.Duration) error {
+	if !mapping.ExpiresAt.IsZero() && time.Until(mapping.ExpiresAt) <= lease {
+		m.release(mapping)
+		return nil
+	}
+	if err := m.checkOwner(mapping); err != nil {
+		m.release(mapping)
+		return err
+	}
+	short := mapping.PortMapping
+	short.Lease = lease
+	if _, _, err := m.add(ctx, short, mapping.Action, false); err != nil {
+		m.IGD().logger().Warn("Shortening lease failed, deleting mapping", "mapping", mapping.key(), "err", err)
+		return m.remove(ctx, mapping.Protocol, mapping.ExternalPort)
+	}
+	m.release(mapping)
+	return nil
+}
+
+// Stop managing the mapping, leaving it on the router.
+func (m *Manager) release(mapping ManagedMapping) {
+	m.mut.Lock()
+	delete(m.mappings, mapping.key())
+	m.mut.Unlock()
+	if pool := m.IGD().Client().portPool(); pool != nil {
+		pool.Release(m.IGD().uuid, mapping.Protocol, mapping.ExternalPort)
+	}
+}
@@ -0,0 +1,209 @@
+package upnp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+// Another host claiming the UUID of the IGD: it serves the IGD's description, never
+// mind what it controls.
+func newImpostor(t *testing.T, igd *upnptest.Server) *httptest.Server {
+	t.Helper()
+	resp, err := http.Get(igd.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	description, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := upnptest.NewServer()
+	t.Cleanup(other.Close)
+	target, _ := url.Parse(other.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	impostor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/rootDesc.xml" {
+			w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+			w.Write(description)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(impostor.Close)
+	return impostor
+}
+
+func TestManagerFollowsAnnouncedLocation(t *testing.T) {
+	s := upnptest.NewServer()
+	impostor := newImpostor(t, s)
+	c := &upnp.Client{AllowPublicAddresses: true}
+	igd, err := c.LoadIGD(context.Background(), s.URL)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	m := upnp.NewManager(igd)
+	defer m.Stop()
+	events, cancel := m.Subscribe()
+	defer cancel()
+
+	moved := upnp.Announcement{Kind: upnp.AnnounceAlive, UUID: s.UUID, Location: impostor.URL + "/rootDesc.xml"}
+	m.Announced(moved)
+	if got := m.IGD().URL().String(); got != s.URL {
+		s.Close()
+		t.Fatalf("followed the IGD to %s, while it still answers at %s", got, s.URL)
+	}
+
+	s.Close()
+	m.Announced(moved)
+	if got := m.IGD().URL().String(); got != moved.Location {
+		t.Fatalf("IGD at %s, want %s after it stopped answering at %s", got, moved.Location, s.URL)
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == upnp.EventDeviceMoved {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no EventDeviceMoved published")
+		}
+	}
+}
+
+// A transport holding the AddPortMapping requests while held, signalling entered as
+// each comes in.
+type heldTransport struct {
+	mut     sync.Mutex
+	held    chan struct{}
+	entered chan struct{}
+}
+
+func (t *heldTransport) hold() {
+	t.mut.Lock()
+	t.held, t.entered = make(chan struct{}), make(chan struct{}, 1)
+	t.mut.Unlock()
+}
+
+func (t *heldTransport) release() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.held != nil {
+		close(t.held)
+		t.held = nil
+	}
+}
+
+func (t *heldTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mut.Lock()
+	held, entered := t.held, t.entered
+	t.mut.Unlock()
+	if held != nil && strings.HasSuffix(r.Header.Get("SOAPAction"), `#AddPortMapping"`) {
+		entered <- struct{}{}
+		<-held
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// Removing a mapping while it is being renewed leaves it removed from the router.
+func TestManagerRemoveWhileRenewing(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		renew func(m *upnp.Manager) error
+	}{
+		{"scheduled", func(m *upnp.Manager) error {
+			m.RenewDue(time.Now().Add(time.Hour))
+			return nil
+		}},
+		{"RenewNow", func(m *upnp.Manager) error { return m.RenewNow(upnp.TCP, 8080) }},
+		{"RenewAll", func(m *upnp.Manager) error { return m.RenewAll() }},
+		{"SetEnabled", func(m *upnp.Manager) error { return m.SetEnabled(upnp.TCP, 8080, false) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := upnptest.NewServer()
+			defer s.Close()
+			transport := &heldTransport{}
+			c := &upnp.Client{AllowPublicAddresses: true, HTTPClient: &http.Client{Transport: transport}}
+			igd, err := c.LoadIGD(context.Background(), s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := upnp.NewManager(igd)
+			defer m.Stop()
+			mapping := upnp.ManagedMapping{PortMapping: upnp.PortMapping{Protocol: upnp.TCP, ExternalPort: 8080,
+				InternalPort: 8080, Description: "race test mapping", Lease: 10 * time.Minute}}
+			if err := m.Add(mapping); err != nil {
+				t.Fatal(err)
+			}
+
+			transport.hold()
+			defer transport.release()
+			renewed := make(chan error, 1)
+			go func() { renewed <- tt.renew(m) }()
+			<-transport.entered
+			removed := make(chan error, 1)
+			go func() { removed <- m.Remove(upnp.TCP, 8080) }()
+			select {
+			case err := <-removed:
+				t.Fatalf("removed the mapping while it was being renewed (%v)", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			transport.release()
+			<-renewed
+			if err := <-removed; err != nil {
+				t.Fatal(err)
+			}
+
+			if mappings := s.Mappings(); len(mappings) != 0 {
+				t.Errorf("router has %d port mappings after the removal, want none", len(mappings))
+			}
+			if mappings := m.Mappings(); len(mappings) != 0 {
+				t.Errorf("manager has %d managed mappings after the removal, want none", len(mappings))
+			}
+		})
+	}
+}
+
+// A mapping another owner took over is neither deleted nor dropped by Remove.
+func TestManagerRemoveForeignMapping(t *testing.T) {
+	s := upnptest.NewServer()
+	defer s.Close()
+	igd, err := (&upnp.Client{AllowPublicAddresses: true}).LoadIGD(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := upnp.NewManager(igd)
+	defer m.Stop()
+	m.SetOwner("upnpctl: ")
+	mapping := upnp.PortMapping{Protocol: upnp.TCP, ExternalPort: 8080, InternalPort: 8080,
+		InternalClient: "192.168.1.20", Enabled: true, Description: "web"}
+	if err := m.Add(upnp.ManagedMapping{PortMapping: mapping}); err != nil {
+		t.Fatal(err)
+	}
+	mapping.InternalClient, mapping.Description = "192.168.1.30", "other application"
+	s.AddMapping(mapping)
+
+	if err := m.Remove(upnp.TCP, 8080); !errors.Is(err, upnp.ErrForeignMapping) {
+		t.Fatalf("removing the mapping: %v, want %v", err, upnp.ErrForeignMapping)
+	}
+	if mappings := s.Mappings(); len(mappings) != 1 || mappings[0].Description != "other application" {
+		t.Errorf("router has the port mappings %v, want the other owner's", mappings)
+	}
+	if mappings := m.Mappings(); len(mappings) != 1 {
+		t.Errorf("manager has %d managed mappings, want the one it failed to remove", len(mappings))
+	}
+}
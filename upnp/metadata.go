@@ -0,0 +1,166 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// An icon of a device, from the iconList of its description.
+type Icon struct {
+	MIMEType string `json:"mimetype"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Depth    int    `json:"depth"`
+	// The absolute URL of the icon.
+	URL string `json:"url"`
+}
+
+type upnpIcon struct {
+	MIMEType string `xml:"mimetype"`
+	Width    int    `xml:"width"`
+	Height   int    `xml:"height"`
+	Depth    int    `xml:"depth"`
+	URL      string `xml:"url"`
+}
+
+// The manufacturer of the InternetGatewayDevice, e.g. AVM Berlin.
+func (n *IGD) Manufacturer() string {
+	return n.manufacturer
+}
+
+// The model name of the InternetGatewayDevice, e.g. FRITZ!Box 7590.
+func (n *IGD) ModelName() string {
+	return n.modelName
+}
+
+// The model number of the InternetGatewayDevice, often the firmware version.
+func (n *IGD) ModelNumber() string {
+	return n.modelNumber
+}
+
+// The serial number of the InternetGatewayDevice, empty for most devices.
+func (n *IGD) SerialNumber() string {
+	return n.serialNumber
+}
+
+// The absolute URL of the InternetGatewayDevice's web interface, empty when it has none.
+func (n *IGD) PresentationURL() string {
+	return n.presentationURL
+}
+
+// The icons of the InternetGatewayDevice.
+func (n *IGD) Icons() []Icon {
+	return append([]Icon(nil), n.icons...)
+}
+
+// The device description XML of the InternetGatewayDevice, exactly as the device sent it,
+// e.g. for bug reports. Nil for devices restored from JSON.
+func (n *IGD) RawDescription() []byte {
+	return append([]byte(nil), n.rawDescription...)
+}
+
+// Download the service description (SCPD) XML of the service, exactly as the device sends it.
+func (s *IGDService) RawSCPD(ctx context.Context) ([]byte, error) {
+	if s.scpdURL == "" {
+		return nil, errors.New("service has no SCPD URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.scpdURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.client.setHeaders(req)
+	data, _, err := s.client.get(s.logger().With("url", s.scpdURL), s.uuid, req)
+	return data, err
+}
+
+// Set the metadata of igd from its description. It describes the product, so it is taken
+// from the root device, and from the IGD when it is embedded and the root lacks it.
+func setMetadata(log *slog.Logger, igd *IGD, baseURL *url.URL, root, device upnpDevice) {
+	first := func(a, b string) string {
+		if a = strings.TrimSpace(a); a != "" {
+			return a
+		}
+		return strings.TrimSpace(b)
+	}
+	igd.manufacturer = first(root.Manufacturer, device.Manufacturer)
+	igd.modelName = first(root.ModelName, device.ModelName)
+	igd.modelNumber = first(root.ModelNumber, device.ModelNumber)
+	igd.serialNumber = first(root.SerialNumber, device.SerialNumber)
+
+	if p := first(root.PresentationURL, device.PresentationURL); p != "" {
+		if u, err := url.Parse(p); err != nil {
+			log.Debug("Ignoring invalid presentation URL", "presentation", p, "err", err)
+		} else {
+			igd.presentationURL = baseURL.ResolveReference(u).String()
+		}
+	}
+
+	icons := root.Icons
+	if len(icons) == 0 {
+		icons = device.Icons
+	}
+	for _, icon := range icons {
+		u, err := url.Parse(strings.TrimSpace(icon.URL))
+		if err != nil || icon.URL == "" {
+			log.Debug("Ignoring icon with invalid URL", "icon", icon.URL, "err", err)
+			continue
+		}
+		igd.icons = append(igd.icons, Icon{
+			MIMEType: strings.TrimSpace(icon.MIMEType),
+			Width:    icon.Width,
+			Height:   icon.Height,
+			Depth:    icon.Depth,
+			URL:      baseURL.ResolveReference(u).String(),
+		})
+	}
+}
+
+// ErrNoIcon is returned by FetchIcon for devices without icons.
+var ErrNoIcon = errors.New("device has no icons")
+
+// The icon best shown at size x size pixels: the smallest one at least that large, or else the
+// largest one, preferring PNG over other formats of the same size. False when there are no icons.
+func (n *IGD) BestIcon(size int) (Icon, bool) {
+	var best Icon
+	found := false
+	for _, icon := range n.icons {
+		if !found || betterIcon(icon, best, size) {
+			best, found = icon, true
+		}
+	}
+	return best, found
+}
+
+// Whether a is better than b for showing at size.
+func betterIcon(a, b Icon, size int) bool {
+	aFits, bFits := a.Width >= size && a.Height >= size, b.Width >= size && b.Height >= size
+	switch {
+	case aFits != bFits:
+		return aFits
+	case a.Width != b.Width:
+		// Among fitting icons the smallest, among too small ones the largest.
+		return (a.Width < b.Width) == aFits
+	}
+	return a.MIMEType == "image/png" && b.MIMEType != "image/png"
+}
+
+// Download the icon best shown at size x size pixels, see BestIcon.
+func (n *IGD) FetchIcon(ctx context.Context, size int) (Icon, []byte, error) {
+	icon, ok := n.BestIcon(size)
+	if !ok {
+		return icon, nil, ErrNoIcon
+	}
+	c := n.Client()
+	req, err := http.NewRequestWithContext(ctx, "GET", icon.URL, nil)
+	if err != nil {
+		return icon, nil, err
+	}
+	c.setHeaders(req)
+
+	data, _, err := c.get(n.logger().With("url", icon.URL), n.uuid, req)
+	return icon, data, err
+}
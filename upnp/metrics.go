@@ -0,0 +1,39 @@
+package upnp
+
+import "time"
+
+// Metrics receives the measurements of a Client, e.g. to export them with Prometheus,
+// statsd or expvar without the package depending on them. Embed NopMetrics to implement
+// only some of the methods. The methods are called synchronously, from many goroutines
+// at once, so they should return quickly.
+type Metrics interface {
+	// Called after each discovery with its duration, the number of devices found and the
+	// error it failed with, if any.
+	Discovery(duration time.Duration, found int, err error)
+	// Called after each SOAP request with the UUID of the device, the action, the duration
+	// of the request including its retries and the error, if any.
+	SOAPRequest(device, action string, duration time.Duration, err error)
+	// Called after a Manager renewed a mapping on the device with the UUID, with the error,
+	// if any.
+	Renewal(device string, protocol Protocol, port int, err error)
+}
+
+// Metrics doing nothing, to embed in implementations of some of its methods.
+type NopMetrics struct{}
+
+func (NopMetrics) Discovery(duration time.Duration, found int, err error) {}
+
+func (NopMetrics) SOAPRequest(device, action string, duration time.Duration, err error) {}
+
+func (NopMetrics) Renewal(device string, protocol Protocol, port int, err error) {}
+
+// The metrics of the client, NopMetrics when it has none.
+func (c *Client) metrics() Metrics {
+	if c == nil {
+		c = DefaultClient
+	}
+	if c.Metrics == nil {
+		return NopMetrics{}
+	}
+	return c.Metrics
+}
@@ -0,0 +1,119 @@
+package upnp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// A Middleware observes and alters the traffic of a Client, e.g. to log it, add headers,
+// rate limit requests, capture packets or work around broken firmware the Quirk flags do not
+// cover. Embed NopMiddleware to implement only some of the methods.
+// The methods are called synchronously, from many goroutines at once.
+type Middleware interface {
+	// Called before each attempt of a SOAP request. It may change the request's headers and
+	// body, and fails the attempt without sending it by returning an error.
+	OnSOAPRequest(ctx context.Context, r *SOAPRequest) error
+	// Called with the response to each attempt of a SOAP request, or the error it failed with.
+	// It may change the response's body, e.g. to fix a malformed one, and fails the attempt by
+	// returning an error.
+	OnSOAPResponse(ctx context.Context, r *SOAPRequest, resp *SOAPResponse) error
+	// Called with each SSDP packet sent or received. It may change the packet's data, and
+	// drops it by returning false.
+	OnSSDPPacket(p *SSDPPacket) bool
+}
+
+// A SOAP request as Middleware sees it.
+type SOAPRequest struct {
+	// The service the request is performed on.
+	Service *IGDService
+	// The quirks of the device of the service.
+	Quirks Quirk
+	Action string
+	Header http.Header
+	Body   []byte
+}
+
+// The response to a SOAP request as Middleware sees it.
+type SOAPResponse struct {
+	// The HTTP status, 0 when the request failed with Err.
+	Status int
+	Header http.Header
+	Body   []byte
+	Err    error
+}
+
+// An SSDP packet as Middleware sees it.
+type SSDPPacket struct {
+	// Whether the packet is sent, rather than received.
+	Outgoing bool
+	// The address the packet is sent to or was received from.
+	Addr net.Addr
+	Data []byte
+}
+
+// A Middleware doing nothing, to embed in implementations of some of its methods.
+type NopMiddleware struct{}
+
+func (NopMiddleware) OnSOAPRequest(ctx context.Context, r *SOAPRequest) error { return nil }
+
+func (NopMiddleware) OnSOAPResponse(ctx context.Context, r *SOAPRequest, resp *SOAPResponse) error {
+	return nil
+}
+
+func (NopMiddleware) OnSSDPPacket(p *SSDPPacket) bool { return true }
+
+func (c *Client) middleware() []Middleware {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.Middleware
+}
+
+// A Middleware also capturing the HTTP exchanges of the client, e.g. a Capture.
+type transportMiddleware interface {
+	wrapTransport(transport http.RoundTripper, logger *slog.Logger) http.RoundTripper
+}
+
+// The client with its transport wrapped by the middleware capturing HTTP exchanges.
+func (c *Client) capturingHTTPClient(client *http.Client) *http.Client {
+	transport := client.Transport
+	for _, m := range c.middleware() {
+		if m, ok := m.(transportMiddleware); ok {
+			if transport == nil {
+				transport = http.DefaultTransport
+			}
+			transport = m.wrapTransport(transport, c.logger())
+		}
+	}
+	if transport == client.Transport {
+		return client
+	}
+	wrapped := *client
+	wrapped.Transport = transport
+	return &wrapped
+}
+
+// Pass the response to a SOAP request through the client's middleware, returning the first
+// error one of them returned, or the error of the response.
+func (c *Client) soapResponse(ctx context.Context, r *SOAPRequest, resp *SOAPResponse) error {
+	for _, m := range c.middleware() {
+		if err := m.OnSOAPResponse(ctx, r, resp); err != nil {
+			return err
+		}
+	}
+	return resp.Err
+}
+
+// Pass the SSDP packet through the client's middleware, returning false when it was dropped,
+// and trace it otherwise.
+func (c *Client) filterSSDP(p *SSDPPacket) bool {
+	for _, m := range c.middleware() {
+		if !m.OnSSDPPacket(p) {
+			return false
+		}
+	}
+	c.traceSSDP(p)
+	return true
+}
@@ -0,0 +1,112 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The kinds of SSDP announcements.
+const (
+	AnnounceAlive  = "ssdp:alive"
+	AnnounceUpdate = "ssdp:update"
+	AnnounceByebye = "ssdp:byebye"
+)
+
+// An SSDP announcement (NOTIFY) a device multicast to the network.
+type Announcement struct {
+	// AnnounceAlive, AnnounceUpdate or AnnounceByebye.
+	Kind string
+	// The notification type, e.g. the device or a service type, and the USN and UUID of
+	// the device.
+	NT   string
+	USN  string
+	UUID string
+	// The URL of the device description, empty for AnnounceByebye.
+	Location string
+	// The address the announcement came from.
+	From net.Addr
+}
+
+// Monitor the SSDP announcements of devices using the DefaultClient, see Client.MonitorAnnouncements.
+func MonitorAnnouncements(ctx context.Context) (<-chan Announcement, error) {
+	return DefaultClient.MonitorAnnouncements(ctx)
+}
+
+// Listen for the SSDP announcements devices multicast on the client's Interface, when
+// they come up, change or leave, until ctx is done. The channel is closed then.
+// Announcements come from anyone on the network, so they are hints at best.
+func (c *Client) MonitorAnnouncements(ctx context.Context) (<-chan Announcement, error) {
+	group := &net.UDPAddr{IP: []byte{239, 255, 255, 250}, Port: 1900}
+	socket, err := net.ListenMulticastUDP("udp4", c.Interface, group)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { socket.Close() })
+
+	log := c.logger()
+	announcements := make(chan Announcement, 16)
+	go func() {
+		defer close(announcements)
+		defer stop()
+		defer socket.Close()
+
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := socket.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Warn("Reading SSDP announcement failed", "err", err)
+				}
+				return
+			}
+			in := &SSDPPacket{Addr: addr, Data: buf[:n]}
+			if !c.filterSSDP(in) {
+				continue
+			}
+			a, ok := parseAnnouncement(in.Data)
+			if !ok {
+				continue
+			}
+			a.From = in.Addr
+			if log.Enabled(ctx, slog.LevelDebug) {
+				log.Debug("SSDP announcement", "kind", a.Kind, "device", a.UUID, "nt", a.NT, "url", a.Location)
+			}
+			select {
+			case announcements <- a:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return announcements, nil
+}
+
+// Parse an SSDP NOTIFY request. False for other packets, like the searches of other
+// control points, and for announcements without a device UUID.
+func parseAnnouncement(data []byte) (Announcement, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Method != "NOTIFY" {
+		return Announcement{}, false
+	}
+	req.Body.Close()
+	a := Announcement{
+		Kind:     strings.TrimSpace(req.Header.Get("NTS")),
+		NT:       strings.TrimSpace(req.Header.Get("NT")),
+		USN:      strings.TrimSpace(req.Header.Get("USN")),
+		Location: strings.TrimSpace(req.Header.Get("Location")),
+	}
+	switch a.Kind {
+	case AnnounceAlive, AnnounceUpdate, AnnounceByebye:
+	default:
+		return Announcement{}, false
+	}
+	if a.UUID = parseUUID(a.USN); a.UUID == "" {
+		return Announcement{}, false
+	}
+	return a, true
+}
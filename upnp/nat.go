@@ -0,0 +1,175 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// A NATVerdict tells what kind of network is upstream of an IGD, from its external IP address.
+type NATVerdict int
+
+const (
+	// The external IP address is public, port mappings are reachable from the internet.
+	NATPublic NATVerdict = iota
+	// The external IP address is private (RFC 1918) or link-local: the IGD is behind
+	// another router, which has to forward the mapped ports too.
+	NATPrivate
+	// The external IP address is in the shared address space of carrier-grade NAT (RFC 6598):
+	// the ISP does not assign a public address, so mappings are not reachable from the internet.
+	NATCarrierGrade
+)
+
+func (v NATVerdict) String() string {
+	switch v {
+	case NATPublic:
+		return "public"
+	case NATPrivate:
+		return "double NAT"
+	case NATCarrierGrade:
+		return "carrier-grade NAT"
+	}
+	return "unknown"
+}
+
+// The result of CheckDoubleNAT.
+type DoubleNATResult struct {
+	ExternalIP net.IP
+	Verdict    NATVerdict
+	// The IGD upstream of the checked one, when it was searched for and found. The mappings
+	// it adds point to the external IP address of the checked IGD.
+	Upstream *IGD
+}
+
+// Whether the IGD is behind another NAT.
+func (r DoubleNATResult) DoubleNAT() bool {
+	return r.Verdict != NATPublic
+}
+
+var cgnat = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// Classify the external IP address ip.
+func natVerdict(ip net.IP) NATVerdict {
+	switch {
+	case cgnat.Contains(ip):
+		return NATCarrierGrade
+	case ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLoopback():
+		return NATPrivate
+	}
+	return NATPublic
+}
+
+// How long CheckDoubleNAT waits for an upstream IGD to answer.
+const upstreamSearchTimeout = 2 * time.Second
+
+// Check whether the InternetGatewayDevice is behind another NAT, by its external IP address.
+// With searchUpstream, the usual addresses of a router on the IGD's WAN network are searched
+// for an upstream IGD, which port mappings can be forwarded through as well.
+func (n *IGD) CheckDoubleNAT(ctx context.Context, searchUpstream bool) (DoubleNATResult, error) {
+	ip, err := n.GetExternalIPAddress(ctx)
+	if err != nil {
+		return DoubleNATResult{}, err
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return DoubleNATResult{ExternalIP: ip}, errors.New("IGD reported no external IP address")
+	}
+	result := DoubleNATResult{ExternalIP: ip, Verdict: natVerdict(ip)}
+	if result.Verdict != NATPrivate || !searchUpstream {
+		return result, nil
+	}
+
+	// Mappings on the upstream IGD point to this one.
+	c := *n.Client()
+	c.LocalIP = ip.String()
+	for _, igd := range c.searchAt(ctx, upstreamCandidates(ip), upstreamSearchTimeout) {
+		if igd.uuid != n.uuid {
+			igd := igd
+			result.Upstream = &igd
+			break
+		}
+	}
+	return result, nil
+}
+
+// The addresses routers usually have on the network of ip: the first and last host of its /24.
+func upstreamCandidates(ip net.IP) []net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	var result []net.IP
+	for _, last := range []byte{1, 254} {
+		candidate := net.IPv4(ip4[0], ip4[1], ip4[2], last)
+		if !candidate.Equal(ip) {
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
+
+// Search the hosts for InternetGatewayDevices with unicast search requests, which reach
+// devices on networks multicast does not, e.g. beyond the WAN interface of a router.
+func (c *Client) searchAt(ctx context.Context, hosts []net.IP, timeout time.Duration) []IGD {
+	log := c.logger()
+
+	socket, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		log.Warn("Unicast search failed", "err", err)
+		return nil
+	}
+	defer socket.Close()
+
+	stop := context.AfterFunc(ctx, func() { socket.Close() })
+	defer stop()
+
+	if err := socket.SetDeadline(time.Now().Add(timeout)); err != nil {
+		log.Warn("Unicast search failed", "err", err)
+		return nil
+	}
+
+	for _, host := range hosts {
+		addr := &net.UDPAddr{IP: host, Port: 1900}
+		for _, deviceType := range []string{"urn:schemas-upnp-org:device:InternetGatewayDevice:2", "urn:schemas-upnp-org:device:InternetGatewayDevice:1"} {
+			out := &SSDPPacket{Outgoing: true, Addr: addr, Data: searchRequest(addr.String(), deviceType, 0)}
+			if !c.filterSSDP(out) {
+				continue
+			}
+			if _, err := socket.WriteTo(out.Data, addr); err != nil {
+				log.Debug("Sending unicast search request failed", "host", host, "err", err)
+			}
+		}
+	}
+
+	var result []IGD
+	results := make(chan IGD)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for igd := range results {
+			result = append(result, igd)
+		}
+	}()
+
+	var seen seenDevices
+	var handlers sync.WaitGroup
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := socket.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		in := &SSDPPacket{Addr: from, Data: buf[:n]}
+		if !c.filterSSDP(in) {
+			continue
+		}
+		// Any InternetGatewayDevice type will do.
+		c.handleSearchResponse(ctx, "", &seen, in.Addr, in.Data, results, &handlers)
+	}
+	handlers.Wait()
+	close(results)
+	<-collected
+
+	return result
+}
@@ -0,0 +1,90 @@
+package upnp
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often WatchNetwork polls the network configuration of clients without a NetworkPollInterval.
+var NetworkPollInterval = 5 * time.Second
+
+// A change of the host's network configuration, observed by WatchNetwork.
+type NetworkChange struct {
+	Time time.Time
+	// Whether the host resumed from sleep, after which it may be on another network even if
+	// its configuration looks the same.
+	Resumed bool
+	// The default gateways afterwards, see DefaultGateways.
+	Gateways []net.IP
+}
+
+// Watch the host's network configuration, sending a NetworkChange whenever an interface goes
+// up or down or changes its addresses, the default gateways change, or the host resumes from
+// sleep. It polls every interval, NetworkPollInterval when zero, until ctx is done, and then
+// closes the channel.
+func WatchNetwork(ctx context.Context, interval time.Duration) <-chan NetworkChange {
+	if interval <= 0 {
+		interval = NetworkPollInterval
+	}
+	changes := make(chan NetworkChange, 1)
+	go func() {
+		defer close(changes)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		state := networkState()
+		// The wall clock, which unlike the monotonic one keeps running while the host sleeps.
+		last := time.Now().Round(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			now := time.Now().Round(0)
+			resumed := now.Sub(last) > 3*interval
+			last = now
+
+			current := networkState()
+			if current == state && !resumed {
+				continue
+			}
+			state = current
+			change := NetworkChange{Time: now, Resumed: resumed, Gateways: defaultGateways()}
+			select {
+			case changes <- change:
+			default:
+				// The receiver has yet to handle the previous change, which covers this one.
+			}
+		}
+	}()
+	return changes
+}
+
+// A summary of the up interfaces, their addresses and the default gateways, which changes
+// when the host moves networks.
+func networkState() string {
+	var parts []string
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			addrs, _ := iface.Addrs()
+			var list []string
+			for _, addr := range addrs {
+				list = append(list, addr.String())
+			}
+			sort.Strings(list)
+			parts = append(parts, iface.Name+"="+strings.Join(list, ","))
+		}
+	}
+	for _, gw := range defaultGateways() {
+		parts = append(parts, "gw="+gw.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,117 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An option of AddMapping, setting an argument of the AddPortMapping action.
+type MappingOption func(*PortMapping)
+
+// Set the description of the mapping, which some routers display alongside it.
+func WithDescription(description string) MappingOption {
+	return func(m *PortMapping) {
+		m.Description = description
+	}
+}
+
+// Set the description of the mapping to the template expanded with ExpandDescription, e.g.
+// "{app} on {hostname} (pid {pid}) port {internal}", so the mappings listed on the router
+// tell who created them.
+func WithDescriptionTemplate(template string) MappingOption {
+	return func(m *PortMapping) {
+		m.Description = ExpandDescription(template, *m)
+	}
+}
+
+// Expand the placeholders of a description template for the mapping: {app}, the name of
+// the program, {hostname} and {pid} of the process, and {protocol}, {external} and
+// {internal}, the protocol and ports of the mapping. Other text, including unknown
+// placeholders, is kept as it is.
+func ExpandDescription(template string, m PortMapping) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	hostname, _ := os.Hostname()
+	return strings.NewReplacer(
+		"{app}", filepath.Base(os.Args[0]),
+		"{hostname}", hostname,
+		"{pid}", strconv.Itoa(os.Getpid()),
+		"{protocol}", strings.ToLower(string(m.Protocol)),
+		"{external}", strconv.Itoa(m.ExternalPort),
+		"{internal}", strconv.Itoa(m.InternalPort),
+	).Replace(template)
+}
+
+// Request a lease for the mapping, which routers take in whole seconds. Zero requests a permanent mapping.
+func WithLease(lease time.Duration) MappingOption {
+	return func(m *PortMapping) {
+		m.Lease = lease
+	}
+}
+
+// Only forward traffic from the remote host, instead of from any host.
+func WithRemoteHost(host string) MappingOption {
+	return func(m *PortMapping) {
+		m.RemoteHost = host
+	}
+}
+
+// Forward to another host of the local network than the one discovering the device.
+// Many routers only allow hosts to add mappings to themselves.
+func WithInternalClient(client string) MappingOption {
+	return func(m *PortMapping) {
+		m.InternalClient = client
+	}
+}
+
+// Add the mapping enabled (the default) or disabled.
+func WithEnabled(enabled bool) MappingOption {
+	return func(m *PortMapping) {
+		m.Enabled = enabled
+	}
+}
+
+func newMapping(localIP string, protocol Protocol, externalPort, internalPort int, opts []MappingOption) PortMapping {
+	m := PortMapping{
+		Protocol:       protocol,
+		ExternalPort:   externalPort,
+		InternalPort:   internalPort,
+		InternalClient: localIP,
+		Enabled:        true,
+	}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return m
+}
+
+// Add a port mapping to the relevant services of the InternetGatewayDevice (see AddPortMapping),
+// pointing to the local IP address unless WithInternalClient is given.
+func (n *IGD) AddMapping(ctx context.Context, protocol Protocol, externalPort, internalPort int, opts ...MappingOption) error {
+	return n.Add(ctx, newMapping(n.localIPAddress, protocol, externalPort, internalPort, opts))
+}
+
+// Add a port mapping like AddMapping, letting the InternetGatewayDevice map another external
+// port when externalPort is taken (see AddAny). Returns the external port mapped.
+func (n *IGD) AddAnyMapping(ctx context.Context, protocol Protocol, externalPort, internalPort int, opts ...MappingOption) (int, error) {
+	port, _, err := n.AddAny(ctx, newMapping(n.localIPAddress, protocol, externalPort, internalPort, opts))
+	return port, err
+}
+
+// Add a port mapping to the IGD service, pointing to the local IP address unless WithInternalClient is given.
+func (s *IGDService) AddMapping(ctx context.Context, protocol Protocol, externalPort, internalPort int, opts ...MappingOption) error {
+	return s.Add(ctx, newMapping(s.localIPAddress, protocol, externalPort, internalPort, opts))
+}
+
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// How often MapPacketConn checks whether the conn was closed, to delete its mapping.
+const packetConnPollInterval = time.Second
+
+// Map the local port of conn on an IGD found by the DefaultClient, see Client.MapPacketConn.
+func MapPacketConn(ctx context.Context, conn *net.UDPConn) (netip.AddrPort, error) {
+	return DefaultClient.MapPacketConn(ctx, conn)
+}
+
+// Map the local port of conn on the IGD owning the default route, or the most suitable IGD
+// found (see SortIGDs), and return the external address to advertise to peers, e.g. as a
+// QUIC server address or a WebRTC candidate. ctx bounds the discovery; the mapping is kept
+// renewed while conn is open and deleted from the router once it is closed.
+func (c *Client) MapPacketConn(ctx context.Context, conn *net.UDPConn) (netip.AddrPort, error) {
+	igd, err := c.gateway(ctx)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return igd.MapPacketConn(ctx, conn)
+}
+
+// Map the local port of conn on the IGD, see Client.MapPacketConn.
+// The external port is the local one, or a random one when the router reports a conflict.
+func (n *IGD) MapPacketConn(ctx context.Context, conn *net.UDPConn) (netip.AddrPort, error) {
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}, errors.New("upnp: conn is not bound")
+	}
+	if !local.IP.IsUnspecified() && local.IP.To4() == nil {
+		return netip.AddrPort{}, fmt.Errorf("upnp: cannot map %s, IGDs only map IPv4 ports", local)
+	}
+	ip, err := n.GetExternalIPAddress(ctx)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	external, ok := netip.AddrFromSlice(ip.To4())
+	if !ok || external.IsUnspecified() {
+		return netip.AddrPort{}, errors.New("upnp: IGD reported no external IP address")
+	}
+
+	m, port, err := n.mapLocalPort(ctx, UDP, local.IP, local.Port, fmt.Sprintf("upnp.MapPacketConn %d", local.Port))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	go closeWithConn(m, conn)
+	return netip.AddrPortFrom(external, uint16(port)), nil
+}
+
+// Close the manager once conn is closed. The conn does not tell, but its file descriptor
+// can no longer be used once it is.
+func closeWithConn(m *Manager, conn *net.UDPConn) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		m.Close()
+		return
+	}
+	ticker := time.NewTicker(packetConnPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if raw.Control(func(uintptr) {}) != nil {
+			break
+		}
+	}
+	if err := m.Close(); err != nil {
+		m.IGD().logger().Warn("Deleting the mapping of a closed conn failed", "err", err)
+	}
+}
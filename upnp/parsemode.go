@@ -0,0 +1,150 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// How strictly a Client parses what devices send, see Client.ParseMode.
+type ParseMode int
+
+const (
+	// Tolerate what devices get wrong as long as the device remains usable: missing
+	// elements, UUIDs which are not RFC 4122 ones, malformed XML and services with
+	// invalid URLs, logging a warning for each.
+	ParseLenient ParseMode = iota
+	// Fail on the first violation of the UPnP Device Architecture, e.g. in tests and
+	// certification tooling.
+	ParseStrict
+)
+
+func (m ParseMode) String() string {
+	switch m {
+	case ParseLenient:
+		return "lenient"
+	case ParseStrict:
+		return "strict"
+	}
+	return fmt.Sprintf("ParseMode(%d)", int(m))
+}
+
+// ErrSpecViolation is wrapped by the errors of clients in ParseStrict mode failing on
+// devices violating the UPnP Device Architecture.
+var ErrSpecViolation = errors.New("violates the UPnP Device Architecture")
+
+func (c *Client) parseMode() ParseMode {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.ParseMode
+}
+
+// Report a violation of the specification, described by the log message and attributes:
+// return it as an error in strict mode, log it as a warning otherwise.
+func (c *Client) violation(log *slog.Logger, msg string, args ...any) error {
+	if c.parseMode() != ParseStrict {
+		log.Warn(msg, args...)
+		return nil
+	}
+	return fmt.Errorf("upnp: %s: %w", describeViolation(msg, args), ErrSpecViolation)
+}
+
+// The log message and attributes of a violation as text, e.g.
+// "device UDN is not an RFC 4122 UUID (udn=uuid:1)".
+func describeViolation(msg string, args []any) string {
+	var attrs []string
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs = append(attrs, fmt.Sprintf("%v=%v", args[i], args[i+1]))
+	}
+	msg = strings.ToLower(msg[:1]) + msg[1:]
+	if len(attrs) > 0 {
+		msg += " (" + strings.Join(attrs, ", ") + ")"
+	}
+	return msg
+}
+
+// Receives the violations found in a description, stopping the check when it returns an error.
+type violationFunc func(msg string, args ...any) error
+
+// Check the device description for violations of the specification which loading it
+// tolerates.
+func (c *Client) validateDescription(log *slog.Logger, root upnpRoot) error {
+	return checkDescription(root, func(msg string, args ...any) error {
+		return c.violation(log, msg, args...)
+	})
+}
+
+// Pass the violations of the specification in the device description to report.
+func checkDescription(root upnpRoot, report violationFunc) error {
+	if base := strings.TrimSpace(root.URLBase); base != "" {
+		if u, err := url.Parse(base); err != nil || !u.IsAbs() || u.Host == "" {
+			if err := report("Invalid URLBase in device description", "base", base); err != nil {
+				return err
+			}
+		}
+	}
+	return checkDevice(root.Device, report)
+}
+
+// Pass the violations in the description of the device, its services and embedded
+// devices to report.
+func checkDevice(d upnpDevice, report violationFunc) error {
+	for _, e := range []struct{ name, value string }{
+		{"deviceType", d.DeviceType},
+		{"friendlyName", d.FriendlyName},
+		{"manufacturer", d.Manufacturer},
+		{"modelName", d.ModelName},
+		{"UDN", d.UDN},
+	} {
+		if strings.TrimSpace(e.value) == "" {
+			if err := report("Device description lacks a required element", "type", d.DeviceType, "element", e.name); err != nil {
+				return err
+			}
+		}
+	}
+	if udn := strings.TrimSpace(d.UDN); udn != "" {
+		if !strings.HasPrefix(udn, "uuid:") || !uuidPattern.MatchString(udn[5:]) {
+			if err := report("Device UDN is not an RFC 4122 UUID", "type", d.DeviceType, "udn", udn); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, s := range d.Services {
+		for _, e := range []struct {
+			name, value string
+			url         bool
+			// The element may be empty, as eventSubURL is for services without events.
+			empty bool
+		}{
+			{"serviceType", s.ServiceType, false, false},
+			{"serviceId", s.ServiceID, false, false},
+			{"SCPDURL", s.SCPDURL, true, false},
+			{"controlURL", s.ControlURL, true, false},
+			{"eventSubURL", s.EventSubURL, true, true},
+		} {
+			value := strings.TrimSpace(e.value)
+			var err error
+			if value == "" {
+				if !e.empty {
+					err = report("Service description lacks a required element", "type", s.ServiceType, "element", e.name)
+				}
+			} else if _, parseErr := url.Parse(value); e.url && parseErr != nil {
+				err = report("Service description has an invalid URL", "type", s.ServiceType, "element", e.name, "err", parseErr)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, child := range d.Devices {
+		if err := checkDevice(child, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
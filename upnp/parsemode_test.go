@@ -0,0 +1,45 @@
+package upnp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheckDeviceServiceURLs(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		service upnpService
+		want    int
+	}{
+		{"complete", upnpService{EventSubURL: "/evt/IPConn"}, 0},
+		{"no events", upnpService{}, 0},
+		{"no control URL", upnpService{ControlURL: " "}, 1},
+		{"invalid event URL", upnpService{EventSubURL: "http://[::1"}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.service
+			s.ServiceID = "urn:upnp-org:serviceId:WANIPConn1"
+			s.ServiceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+			s.SCPDURL = "/WANIPCn.xml"
+			if s.ControlURL == "" {
+				s.ControlURL = "/ctl/IPConn"
+			}
+			d := upnpDevice{
+				DeviceType:   "urn:schemas-upnp-org:device:WANConnectionDevice:1",
+				FriendlyName: "WANConnectionDevice",
+				Manufacturer: "Example",
+				ModelName:    "Example Router",
+				UDN:          "uuid:9d3b2bd3-6d5b-4d1e-8a0f-2a3c4e5f6a7b",
+				Services:     []upnpService{s},
+			}
+			var violations []string
+			checkDevice(d, func(msg string, args ...any) error {
+				violations = append(violations, msg+fmt.Sprint(args...))
+				return nil
+			})
+			if len(violations) != tt.want {
+				t.Errorf("violations %q, want %d", violations, tt.want)
+			}
+		})
+	}
+}
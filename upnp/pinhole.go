@@ -0,0 +1,136 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrNoFirewallControl is returned when an IGD does not expose a WANIPv6FirewallControl service.
+var ErrNoFirewallControl = errors.New("no WANIPv6FirewallControl service found")
+
+// The state of an IPv6 firewall, as reported by a WANIPv6FirewallControl service.
+type FirewallStatus struct {
+	Enabled               bool
+	InboundPinholeAllowed bool
+}
+
+// An IPv6 pinhole: a firewall rule allowing inbound traffic to an internal host.
+// An empty RemoteHost and a zero RemotePort act as wildcards.
+type Pinhole struct {
+	RemoteHost     string
+	RemotePort     int
+	InternalClient string
+	InternalPort   int
+	Protocol       Protocol
+	LeaseTime      int
+}
+
+// The IANA protocol number used by WANIPv6FirewallControl to identify a protocol.
+func (p Protocol) number() int {
+	switch p {
+	case TCP:
+		return 6
+	case UDP:
+		return 17
+	}
+	return 65535 // wildcard
+}
+
+// Firewall returns the IGD's first WANIPv6FirewallControl service.
+func (n *IGD) Firewall() (*IGDService, error) {
+	if len(n.firewalls) == 0 {
+		return nil, ErrNoFirewallControl
+	}
+	return &n.firewalls[0], nil
+}
+
+// Query the WANIPv6FirewallControl service for the state of the firewall.
+func (s *IGDService) GetFirewallStatus(ctx context.Context) (FirewallStatus, error) {
+	tpl := `<u:GetFirewallStatus xmlns:u="%s" />`
+	body := fmt.Sprintf(tpl, s.serviceURN)
+
+	args, err := s.soapAction(ctx, "GetFirewallStatus", body)
+	if err != nil {
+		return FirewallStatus{}, err
+	}
+
+	return FirewallStatus{
+		Enabled:               args["FirewallEnabled"] == "1",
+		InboundPinholeAllowed: args["InboundPinholeAllowed"] == "1",
+	}, nil
+}
+
+// Open a pinhole on the WANIPv6FirewallControl service, returning its unique id.
+func (s *IGDService) AddPinhole(ctx context.Context, p Pinhole) (int, error) {
+	tpl := `<u:AddPinhole xmlns:u="%s">
+	<RemoteHost>%s</RemoteHost>
+	<RemotePort>%d</RemotePort>
+	<InternalClient>%s</InternalClient>
+	<InternalPort>%d</InternalPort>
+	<Protocol>%d</Protocol>
+	<LeaseTime>%d</LeaseTime>
+	</u:AddPinhole>`
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(p.RemoteHost), p.RemotePort, escapeXML(p.InternalClient), p.InternalPort, p.Protocol.number(), p.LeaseTime)
+
+	args, err := s.soapAction(ctx, "AddPinhole", body)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(args["UniqueID"])
+}
+
+// Extend the lease of a pinhole on the WANIPv6FirewallControl service.
+func (s *IGDService) UpdatePinhole(ctx context.Context, uniqueID, leaseTime int) error {
+	tpl := `<u:UpdatePinhole xmlns:u="%s">
+	<UniqueID>%d</UniqueID>
+	<NewLeaseTime>%d</NewLeaseTime>
+	</u:UpdatePinhole>`
+	body := fmt.Sprintf(tpl, s.serviceURN, uniqueID, leaseTime)
+
+	_, err := s.soapRequest(ctx, "UpdatePinhole", body)
+	return err
+}
+
+// Close a pinhole on the WANIPv6FirewallControl service.
+func (s *IGDService) DeletePinhole(ctx context.Context, uniqueID int) error {
+	tpl := `<u:DeletePinhole xmlns:u="%s">
+	<UniqueID>%d</UniqueID>
+	</u:DeletePinhole>`
+	body := fmt.Sprintf(tpl, s.serviceURN, uniqueID)
+
+	_, err := s.soapRequest(ctx, "DeletePinhole", body)
+	return err
+}
+
+// Query the WANIPv6FirewallControl service for the number of packets that went through a pinhole.
+func (s *IGDService) GetPinholePackets(ctx context.Context, uniqueID int) (int, error) {
+	tpl := `<u:GetPinholePackets xmlns:u="%s">
+	<UniqueID>%d</UniqueID>
+	</u:GetPinholePackets>`
+	body := fmt.Sprintf(tpl, s.serviceURN, uniqueID)
+
+	args, err := s.soapAction(ctx, "GetPinholePackets", body)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(args["PinholePackets"])
+}
+
+// Ask the WANIPv6FirewallControl service whether a pinhole is working.
+func (s *IGDService) CheckPinholeWorking(ctx context.Context, uniqueID int) (bool, error) {
+	tpl := `<u:CheckPinholeWorking xmlns:u="%s">
+	<UniqueID>%d</UniqueID>
+	</u:CheckPinholeWorking>`
+	body := fmt.Sprintf(tpl, s.serviceURN, uniqueID)
+
+	args, err := s.soapAction(ctx, "CheckPinholeWorking", body)
+	if err != nil {
+		return false, err
+	}
+
+	return args["IsWorking"] == "1", nil
+}
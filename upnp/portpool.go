@@ -0,0 +1,135 @@
+package upnp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// ErrPortReserved is returned when another process on the host has reserved an external
+// port in the client's PortPool.
+var ErrPortReserved = errors.New("external port reserved by another process")
+
+// A PortPool coordinates the external ports processes on the same host map, through a
+// lease file they share, so two local applications picking ports do not race for the same
+// one. A process reserves a port of a device before mapping it; the reservation lasts until
+// it is released or the process exits. See Client.PortPool.
+type PortPool struct {
+	path string
+}
+
+// A port pool sharing the lease file at path, e.g. in $XDG_RUNTIME_DIR. The file and the
+// lock file next to it are created when needed.
+func NewPortPool(path string) *PortPool {
+	return &PortPool{path: path}
+}
+
+// A reservation in the lease file.
+type portLease struct {
+	Device   string    `json:"device"`
+	Protocol Protocol  `json:"protocol"`
+	Port     int       `json:"port"`
+	PID      int       `json:"pid"`
+	Time     time.Time `json:"time"`
+}
+
+// Reserve the external port of the device with the UUID uuid for this process. Reserving
+// a port the process holds already succeeds; one another process holds fails with
+// ErrPortReserved.
+func (p *PortPool) Reserve(uuid string, protocol Protocol, port int) error {
+	return p.update(func(leases []portLease) ([]portLease, error) {
+		for _, l := range leases {
+			if l.Device == uuid && l.Protocol == protocol && l.Port == port {
+				if l.PID == os.Getpid() {
+					return leases, nil
+				}
+				return leases, fmt.Errorf("%s/%d: %w (pid %d)", protocol, port, ErrPortReserved, l.PID)
+			}
+		}
+		return append(leases, portLease{uuid, protocol, port, os.Getpid(), time.Now()}), nil
+	})
+}
+
+// Reserve a random external port of at least 1024 of the device which no process holds,
+// and return it.
+func (p *PortPool) ReserveAny(uuid string, protocol Protocol) (int, error) {
+	var port int
+	err := p.update(func(leases []portLease) ([]portLease, error) {
+		taken := make(map[int]bool)
+		for _, l := range leases {
+			if l.Device == uuid && l.Protocol == protocol {
+				taken[l.Port] = true
+			}
+		}
+		for attempt := 0; attempt < 100; attempt++ {
+			if port = 1024 + rand.Intn(65536-1024); !taken[port] {
+				return append(leases, portLease{uuid, protocol, port, os.Getpid(), time.Now()}), nil
+			}
+		}
+		return leases, fmt.Errorf("%w: no free port found", ErrPortReserved)
+	})
+	return port, err
+}
+
+// Release the reservation of the external port of the device, if this process holds it.
+func (p *PortPool) Release(uuid string, protocol Protocol, port int) error {
+	return p.update(func(leases []portLease) ([]portLease, error) {
+		kept := leases[:0]
+		for _, l := range leases {
+			if l.Device != uuid || l.Protocol != protocol || l.Port != port || l.PID != os.Getpid() {
+				kept = append(kept, l)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// Update the leases of live processes in the lease file with f, holding its lock.
+func (p *PortPool) update(f func([]portLease) ([]portLease, error)) error {
+	unlock, err := lockFile(p.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var leases []portLease
+	data, err := os.ReadFile(p.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &leases); err != nil {
+			return fmt.Errorf("invalid port lease file %s: %w", p.path, err)
+		}
+	}
+
+	live := leases[:0]
+	for _, l := range leases {
+		if processAlive(l.PID) {
+			live = append(live, l)
+		}
+	}
+	leases, ferr := f(live)
+
+	if data, err = json.MarshalIndent(leases, "", "\t"); err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		return err
+	}
+	return ferr
+}
+
+func (c *Client) portPool() *PortPool {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.PortPool
+}
@@ -0,0 +1,38 @@
+//go:build !unix
+
+package upnp
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// How long a lock file may be held before it is taken to be left behind by a crashed process.
+const staleLock = 10 * time.Second
+
+// Take the lock of the file at path by creating it exclusively.
+func lockFile(path string) (unlock func(), err error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Whether the process with the ID pid is running. On Windows, finding a process fails
+// when it is not.
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
@@ -0,0 +1,93 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// ErrPublicAddress is returned when a device description or service URL points outside the
+// private network, see Client.AllowPublicAddresses.
+var ErrPublicAddress = errors.New("address outside the private network")
+
+// The shared address space of carrier-grade NATs (RFC 6598), which upstream routers of
+// double NATs use.
+var sharedAddressSpace = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// Whether ip is an address private to a site: an RFC 1918 or RFC 4193 address, one of
+// the shared address space, or a link-local or loopback address.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || sharedAddressSpace.Contains(ip)
+}
+
+// Which addresses the URLs of a device may point to.
+type addressScope func(ip net.IP) bool
+
+// The addresses the URLs of devices loaded by location may point to: private ones, nil
+// when the client allows any.
+func (c *Client) locationScope() addressScope {
+	if c.allowPublicAddresses() {
+		return nil
+	}
+	return isPrivateIP
+}
+
+// The addresses the URLs of a device answering a search from the address from may point
+// to: those of the subnet of the interface the answer arrived on, or private ones other than
+// loopback addresses when from is not on a local subnet (e.g. it answered a unicast search
+// routed to it). nil when the client allows any.
+func (c *Client) searchScope(from net.Addr) addressScope {
+	if c.allowPublicAddresses() {
+		return nil
+	}
+	if udp, ok := from.(*net.UDPAddr); ok {
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, addr := range addrs {
+				if subnet, ok := addr.(*net.IPNet); ok && subnet.Contains(udp.IP) {
+					return subnet.Contains
+				}
+			}
+		}
+	}
+	return func(ip net.IP) bool {
+		return isPrivateIP(ip) && !ip.IsLoopback()
+	}
+}
+
+func (c *Client) allowPublicAddresses() bool {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.AllowPublicAddresses
+}
+
+// Check that the host of the URL u resolves to addresses in scope only.
+func (scope addressScope) check(ctx context.Context, u string) error {
+	if scope == nil || u == "" {
+		return nil
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	host := parsed.Hostname()
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !scope(ip) {
+			return fmt.Errorf("upnp: refusing %s: %w (%s)", u, ErrPublicAddress, ip)
+		}
+	}
+	return nil
+}
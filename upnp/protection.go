@@ -0,0 +1,210 @@
+package upnp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoDeviceProtection is returned when an IGD does not expose a DeviceProtection service.
+var ErrNoDeviceProtection = errors.New("no DeviceProtection service found")
+
+// The service type of DeviceProtection:1, which IGD:2 devices may lock actions behind.
+const DeviceProtectionURN = "urn:schemas-upnp-org:service:DeviceProtection:1"
+
+// The protocols a DeviceProtection service supports for introducing control points and
+// for logging users in, e.g. WPS and PKCS5.
+type ProtectionProtocols struct {
+	Introduction []string
+	Login        []string
+}
+
+// DeviceProtection returns the IGD's DeviceProtection service.
+//
+// Devices identify control points by the certificate they present over TLS (see
+// TLSConfig.Certificates) and grant them roles after an introduction, like WPS pairing
+// through SendSetupMessage, or for the session after a user logs in with Login. Actions
+// a control point lacks the roles for fail with ErrCodeActionNotAuthorized.
+func (n *IGD) DeviceProtection() (*IGDService, error) {
+	if len(n.protections) == 0 {
+		return nil, ErrNoDeviceProtection
+	}
+	return &n.protections[0], nil
+}
+
+// Log in to the IGD's DeviceProtection service as the user name, see IGDService.Login.
+func (n *IGD) Login(ctx context.Context, name, password string) error {
+	s, err := n.DeviceProtection()
+	if err != nil {
+		return err
+	}
+	return s.Login(ctx, name, password)
+}
+
+// The roles the IGD requires for the action of the service, see IGDService.GetRolesForAction.
+func (n *IGD) RolesForAction(ctx context.Context, service *IGDService, action string) (roles, restricted []string, err error) {
+	s, err := n.DeviceProtection()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.GetRolesForAction(ctx, "uuid:"+service.uuid, service.serviceID, action)
+}
+
+// Query the DeviceProtection service for the introduction and login protocols it supports.
+func (s *IGDService) GetSupportedProtocols(ctx context.Context) (ProtectionProtocols, error) {
+	tpl := `<u:GetSupportedProtocols xmlns:u="%s" />`
+	body := fmt.Sprintf(tpl, s.serviceURN)
+
+	args, err := s.soapAction(ctx, "GetSupportedProtocols", body)
+	if err != nil {
+		return ProtectionProtocols{}, err
+	}
+
+	var list struct {
+		Introduction []string `xml:"Introduction>Name"`
+		Login        []string `xml:"Login>Name"`
+	}
+	if err := xml.Unmarshal([]byte(args["ProtocolList"]), &list); err != nil {
+		return ProtectionProtocols{}, fmt.Errorf("invalid ProtocolList: %w", err)
+	}
+	return ProtectionProtocols{Introduction: list.Introduction, Login: list.Login}, nil
+}
+
+// Send a message of the introduction protocol, e.g. one of the WPS registration protocol,
+// to the DeviceProtection service and return its answer.
+func (s *IGDService) SendSetupMessage(ctx context.Context, protocol string, message []byte) ([]byte, error) {
+	tpl := `<u:SendSetupMessage xmlns:u="%s">
+	<ProtocolType>%s</ProtocolType>
+	<InMessage>%s</InMessage>
+	</u:SendSetupMessage>`
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(protocol), base64.StdEncoding.EncodeToString(message))
+
+	args, err := s.soapAction(ctx, "SendSetupMessage", body)
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(args["OutMessage"])
+}
+
+// Ask the DeviceProtection service for the salt and challenge of a login of the user name.
+func (s *IGDService) GetUserLoginChallenge(ctx context.Context, protocol, name string) (salt, challenge []byte, err error) {
+	tpl := `<u:GetUserLoginChallenge xmlns:u="%s">
+	<ProtocolType>%s</ProtocolType>
+	<Name>%s</Name>
+	</u:GetUserLoginChallenge>`
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(protocol), escapeXML(name))
+
+	args, err := s.soapAction(ctx, "GetUserLoginChallenge", body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if salt, err = base64.StdEncoding.DecodeString(args["Salt"]); err != nil {
+		return nil, nil, fmt.Errorf("invalid Salt: %w", err)
+	}
+	if challenge, err = base64.StdEncoding.DecodeString(args["Challenge"]); err != nil {
+		return nil, nil, fmt.Errorf("invalid Challenge: %w", err)
+	}
+	return salt, challenge, nil
+}
+
+// Answer a login challenge of the DeviceProtection service with the authenticator.
+func (s *IGDService) UserLogin(ctx context.Context, protocol string, challenge, authenticator []byte) error {
+	tpl := `<u:UserLogin xmlns:u="%s">
+	<ProtocolType>%s</ProtocolType>
+	<Challenge>%s</Challenge>
+	<Authenticator>%s</Authenticator>
+	</u:UserLogin>`
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(protocol),
+		base64.StdEncoding.EncodeToString(challenge), base64.StdEncoding.EncodeToString(authenticator))
+
+	_, err := s.soapRequest(ctx, "UserLogin", body)
+	return err
+}
+
+// Log in to the DeviceProtection service as the user name with the PKCS5 protocol, which
+// proves knowledge of the password without sending it. The roles of the user are granted
+// for the TLS session, which the client's transport keeps while requests follow each other;
+// log in again when actions fail with ErrCodeActionNotAuthorized after a pause.
+func (s *IGDService) Login(ctx context.Context, name, password string) error {
+	salt, challenge, err := s.GetUserLoginChallenge(ctx, "PKCS5", name)
+	if err != nil {
+		return err
+	}
+	return s.UserLogin(ctx, "PKCS5", challenge, loginAuthenticator(name, password, salt, challenge))
+}
+
+// The authenticator of a PKCS5 login: the first 20 bytes of HMAC-SHA-256(STORED, Challenge),
+// where STORED is the 16 byte PBKDF2 key of name and password, with the salt and 5000
+// iterations of HMAC-SHA-256.
+func loginAuthenticator(name, password string, salt, challenge []byte) []byte {
+	stored := pbkdf2SHA256([]byte(name+password), salt, 5000, 16)
+	mac := hmac.New(sha256.New, stored)
+	mac.Write(challenge)
+	return mac.Sum(nil)[:20]
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA-256, for keys up to one hash long.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key[:keyLen]
+}
+
+// End the login of the session on the DeviceProtection service.
+func (s *IGDService) UserLogout(ctx context.Context) error {
+	tpl := `<u:UserLogout xmlns:u="%s" />`
+	body := fmt.Sprintf(tpl, s.serviceURN)
+
+	_, err := s.soapRequest(ctx, "UserLogout", body)
+	return err
+}
+
+// Query the DeviceProtection service for the roles the control point has in the session.
+func (s *IGDService) GetAssignedRoles(ctx context.Context) ([]string, error) {
+	tpl := `<u:GetAssignedRoles xmlns:u="%s" />`
+	body := fmt.Sprintf(tpl, s.serviceURN)
+
+	args, err := s.soapAction(ctx, "GetAssignedRoles", body)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(args["RoleList"]), nil
+}
+
+// Query the DeviceProtection service for the roles required for the action of the service
+// serviceID of the device deviceUDN: any of roles, or any of restricted, for actions whose
+// arguments are restricted to the control point's own resources.
+func (s *IGDService) GetRolesForAction(ctx context.Context, deviceUDN, serviceID, action string) (roles, restricted []string, err error) {
+	tpl := `<u:GetRolesForAction xmlns:u="%s">
+	<DeviceUDN>%s</DeviceUDN>
+	<ServiceId>%s</ServiceId>
+	<ActionName>%s</ActionName>
+	</u:GetRolesForAction>`
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(deviceUDN), escapeXML(serviceID), escapeXML(action))
+
+	args, err := s.soapAction(ctx, "GetRolesForAction", body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return strings.Fields(args["RoleList"]), strings.Fields(args["RestrictedRoleList"]), nil
+}
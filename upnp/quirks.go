@@ -0,0 +1,107 @@
+package upnp
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+)
+
+// A Quirk adjusts how a Client treats devices with known-broken firmware. It applies to
+// the devices matching all of its non-empty match fields, which are compared with the
+// device's properties case-insensitively, as substrings. Quirks without match fields
+// apply to no devices.
+type Quirk struct {
+	// The manufacturer and model name of the device description.
+	Manufacturer string `json:"manufacturer,omitempty"`
+	ModelName    string `json:"modelName,omitempty"`
+	// The Server header of the device's responses.
+	Server string `json:"server,omitempty"`
+	// Why the quirk exists.
+	Note string `json:"note,omitempty"`
+
+	// Add port mappings with a permanent lease, as the device rejects or mishandles others.
+	PermanentLeases bool `json:"permanentLeases,omitempty"`
+	// Send one SOAP request to the device at a time, as it fails on concurrent ones.
+	SequentialSOAP bool `json:"sequentialSOAP,omitempty"`
+	// Resolve the relative URLs of the device description against the root path of the
+	// device, rather than the path of the description.
+	RootRelativeURLs bool `json:"rootRelativeURLs,omitempty"`
+	// Accept the device's search responses whatever search target they report. Only quirks
+	// matching on Server alone apply, as search responses carry no description.
+	IgnoreSearchTarget bool `json:"ignoreSearchTarget,omitempty"`
+}
+
+//go:embed quirks.json
+var quirksJSON []byte
+
+// The quirks of clients without Quirks, shipped with the package. Callers may extend them
+// by setting Client.Quirks to entries of their own, e.g. from ParseQuirks, followed by DefaultQuirks.
+var DefaultQuirks = mustParseQuirks(quirksJSON)
+
+// Parse a JSON array of quirks, in the format of the quirks.json shipped with the package.
+func ParseQuirks(data []byte) ([]Quirk, error) {
+	var quirks []Quirk
+	if err := json.Unmarshal(data, &quirks); err != nil {
+		return nil, err
+	}
+	return quirks, nil
+}
+
+func mustParseQuirks(data []byte) []Quirk {
+	quirks, err := ParseQuirks(data)
+	if err != nil {
+		panic("upnp: invalid quirks.json: " + err.Error())
+	}
+	return quirks
+}
+
+// The quirks applied to the device, merged from all entries matching it.
+func (n *IGD) Quirks() Quirk {
+	return n.quirks
+}
+
+// Whether the quirk changes any behavior.
+func (q Quirk) any() bool {
+	return q.PermanentLeases || q.SequentialSOAP || q.RootRelativeURLs || q.IgnoreSearchTarget
+}
+
+func (q Quirk) matches(manufacturer, modelName, server string) bool {
+	if q.Manufacturer == "" && q.ModelName == "" && q.Server == "" {
+		return false
+	}
+	return containsFold(manufacturer, q.Manufacturer) &&
+		containsFold(modelName, q.ModelName) &&
+		containsFold(server, q.Server)
+}
+
+// Whether s contains substr, ignoring case. Everything contains the empty string.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// The quirks of the client matching a device, merged into one without match fields.
+func (c *Client) quirksFor(manufacturer, modelName, server string) Quirk {
+	if c == nil {
+		c = DefaultClient
+	}
+	quirks := c.Quirks
+	if quirks == nil {
+		quirks = DefaultQuirks
+	}
+	var result Quirk
+	var notes []string
+	for _, q := range quirks {
+		if !q.matches(manufacturer, modelName, server) {
+			continue
+		}
+		result.PermanentLeases = result.PermanentLeases || q.PermanentLeases
+		result.SequentialSOAP = result.SequentialSOAP || q.SequentialSOAP
+		result.RootRelativeURLs = result.RootRelativeURLs || q.RootRelativeURLs
+		result.IgnoreSearchTarget = result.IgnoreSearchTarget || q.IgnoreSearchTarget
+		if q.Note != "" {
+			notes = append(notes, q.Note)
+		}
+	}
+	result.Note = strings.Join(notes, " ")
+	return result
+}
@@ -0,0 +1,66 @@
+package upnp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A token bucket limiting the rate of requests to one device.
+type rateLimiter struct {
+	interval time.Duration
+	burst    float64
+
+	mut    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// A rate limiter limiting the SOAP requests to one device, nil when unlimited.
+func (c *Client) newRateLimiter() *rateLimiter {
+	if c == nil || c.RequestRate <= 0 {
+		return nil
+	}
+	burst := c.RequestBurst
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / c.RequestRate),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+	}
+}
+
+// Wait until a request may be sent, or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mut.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	// Take the token now, even if it is yet to come, so waiting requests queue up.
+	l.tokens--
+	delay := time.Duration(-l.tokens * float64(l.interval))
+	l.mut.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back, the request is not sent.
+		l.mut.Lock()
+		l.tokens++
+		l.mut.Unlock()
+		return ctx.Err()
+	}
+}
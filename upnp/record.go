@@ -0,0 +1,236 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An HTTP request to a device and its response, as recorded by a Recorder.
+type Exchange struct {
+	Time           time.Time   `json:"time"`
+	Duration       string      `json:"duration"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"requestHeader,omitempty"`
+	RequestBody    string      `json:"requestBody,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	ResponseBody   string      `json:"responseBody,omitempty"`
+	// Why the request failed, empty when there is a response.
+	Error string `json:"error,omitempty"`
+	// The local address of the connection the request went over.
+	LocalAddr string `json:"localAddr,omitempty"`
+}
+
+// The request headers not recorded, as they carry credentials.
+var redactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// A Recorder is an http.RoundTripper recording the device descriptions, SOAP requests and
+// other HTTP exchanges it carries, e.g. to reproduce an intermittent router bug offline
+// with a Replayer. Use it as the Transport of Client.HTTPClient.
+type Recorder struct {
+	transport http.RoundTripper
+
+	mut sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// A Recorder sending the requests through transport, or the shared transport of clients
+// without an HTTPClient when nil, and writing the exchanges to w as JSON lines.
+// Credentials are not recorded.
+func NewRecorder(w io.Writer, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = defaultHTTPClient.Transport
+	}
+	return &Recorder{transport: transport, w: w}
+}
+
+// The first error writing an exchange, after which no more are written.
+func (r *Recorder) Err() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.err
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := Exchange{Time: time.Now(), Method: req.Method, URL: req.URL.String(), RequestHeader: req.Header.Clone()}
+	for _, h := range redactedHeaders {
+		if e.RequestHeader.Get(h) != "" {
+			e.RequestHeader.Set(h, "REDACTED")
+		}
+	}
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			e.RequestBody = string(data)
+		}
+	}
+
+	var localAddr string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr = info.Conn.LocalAddr().String()
+		},
+	}
+	resp, err := r.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	e.LocalAddr = localAddr
+	if err != nil {
+		e.Duration = time.Since(e.Time).String()
+		e.Error = err.Error()
+		r.write(e)
+		return resp, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	e.Duration = time.Since(e.Time).String()
+	e.Status = resp.StatusCode
+	e.ResponseHeader = resp.Header.Clone()
+	e.ResponseBody = string(data)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.write(e)
+
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, err
+}
+
+func (r *Recorder) write(e Exchange) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.err != nil {
+		return
+	}
+	_, r.err = r.w.Write(append(data, '\n'))
+}
+
+// A Replayer is an http.RoundTripper answering requests with the responses a Recorder
+// recorded, without any network access. Use it as the Transport of Client.HTTPClient.
+// Devices loaded through it have the local IP address of the recording.
+//
+// Requests are matched by method, URL and body. Requests recorded several times, like
+// polls of GetExternalIPAddress, are answered in the order they were recorded, and the
+// last response is repeated once they run out.
+type Replayer struct {
+	mut       sync.Mutex
+	exchanges map[string][]Exchange
+	locations []string
+}
+
+// A Replayer of the exchanges a Recorder wrote to r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	p := &Replayer{exchanges: make(map[string][]Exchange)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+		key := replayKey(e.Method, e.URL, e.RequestBody)
+		if _, ok := p.exchanges[key]; !ok && e.Method == "GET" && e.Error == "" && isDeviceDescription(e.ResponseBody) {
+			p.locations = append(p.locations, e.URL)
+		}
+		p.exchanges[key] = append(p.exchanges[key], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Whether body is a device description, rather than e.g. an SCPD or an icon.
+func isDeviceDescription(body string) bool {
+	return strings.Contains(body, "urn:schemas-upnp-org:device-1-0") && strings.Contains(body, "<device")
+}
+
+// The URLs of the device descriptions recorded, in the order they were first fetched.
+// Loading them with Client.LoadIGD restores the devices a recorded discovery found.
+func (p *Replayer) Locations() []string {
+	return append([]string(nil), p.locations...)
+}
+
+func replayKey(method, url, body string) string {
+	return method + " " + url + "\n" + body
+}
+
+func (p *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := replayKey(req.Method, req.URL.String(), string(body))
+	p.mut.Lock()
+	queue := p.exchanges[key]
+	if len(queue) == 0 {
+		p.mut.Unlock()
+		return nil, fmt.Errorf("no recorded response to %s %s", req.Method, req.URL)
+	}
+	e := queue[0]
+	if len(queue) > 1 {
+		p.exchanges[key] = queue[1:]
+	}
+	p.mut.Unlock()
+
+	// Report the recorded connection, which tells the local IP address.
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil && e.LocalAddr != "" {
+		if addr, err := net.ResolveTCPAddr("tcp", e.LocalAddr); err == nil {
+			trace.GotConn(httptrace.GotConnInfo{Conn: replayConn{local: addr}})
+		}
+	}
+
+	if e.Status == 0 {
+		return nil, errors.New(e.Error)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.ResponseHeader.Clone(),
+		Body:          io.NopCloser(strings.NewReader(e.ResponseBody)),
+		ContentLength: int64(len(e.ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+// The connection a replayed exchange went over. Only its addresses are of use.
+type replayConn struct {
+	net.Conn
+	local *net.TCPAddr
+}
+
+func (c replayConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c replayConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
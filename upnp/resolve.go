@@ -0,0 +1,80 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrDeviceNotFound is returned by ResolveIGD when no device with the UUID answers.
+var ErrDeviceNotFound = errors.New("upnp: device not found")
+
+// Find the InternetGatewayDevice with the UUID using the DefaultClient, see Client.ResolveIGD.
+func ResolveIGD(ctx context.Context, uuid string) (*IGD, error) {
+	return DefaultClient.ResolveIGD(ctx, uuid)
+}
+
+// Find the InternetGatewayDevice with the UUID, e.g. of a device stored with its mappings,
+// and load it afresh, so state kept across restarts reconnects to the same router even
+// if its address changed. The device is searched for by UUID with a unicast request to
+// each default gateway of the host first, which is quick, and then with a multicast one
+// (to the client's SearchAddr if it has one) for up to the discovery timeout.
+func (c *Client) ResolveIGD(ctx context.Context, uuid string) (*IGD, error) {
+	if c == nil {
+		c = DefaultClient
+	}
+	uuid = parseUUID(uuid)
+	if uuid == "" {
+		return nil, errors.New("upnp: no UUID to resolve")
+	}
+
+	var searches []*Client
+	if c.SearchAddr == "" {
+		for _, gateway := range defaultGateways() {
+			unicast := *c
+			unicast.SearchAddr = net.JoinHostPort(gateway.String(), "1900")
+			searches = append(searches, &unicast)
+		}
+	}
+	searches = append(searches, c)
+
+	for i, search := range searches {
+		timeout := time.Second
+		if i == len(searches)-1 {
+			timeout = c.discoveryTimeout()
+		}
+		if igd := search.resolve(ctx, uuid, timeout); igd != nil {
+			igd.UseClient(c)
+			return igd, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, uuid)
+}
+
+// Search for the device with the UUID for at least timeout, nil when it does not answer.
+func (c *Client) resolve(ctx context.Context, uuid string, timeout time.Duration) *IGD {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var seen seenDevices
+	results := make(chan IGD)
+	go func() {
+		c.discover(ctx, "uuid:"+uuid, timeout, &seen, results)
+		close(results)
+	}()
+	var found *IGD
+	for igd := range results {
+		igd := igd
+		if found == nil && strings.EqualFold(igd.uuid, uuid) {
+			found = &igd
+			cancel()
+		}
+	}
+	return found
+}
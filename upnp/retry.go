@@ -0,0 +1,129 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// A RetryPolicy tells how often and how fast a Client retries failed SOAP requests and
+// description downloads, as consumer routers frequently return transient errors or
+// reset connections under load. Requests failing on the network are always retryable.
+// Note that a retried request may already have taken effect, e.g. a retried
+// DeletePortMapping may fail with ErrCodeNoSuchEntry.
+type RetryPolicy struct {
+	// The number of attempts of a request, including the first one. No retries when 1 or less.
+	Attempts int
+
+	// The delay before the first retry, doubled for each further retry up to MaxBackoff.
+	// Defaults to 250 milliseconds.
+	Backoff time.Duration
+
+	// The maximum delay between retries, defaults to 5 seconds.
+	MaxBackoff time.Duration
+
+	// The HTTP status codes of responses without a SOAP fault to retry,
+	// defaults to DefaultRetryStatusCodes.
+	StatusCodes []int
+
+	// The UPnP error codes of SOAP faults to retry, defaults to DefaultRetryErrorCodes.
+	ErrorCodes []int
+}
+
+// The HTTP status codes retried by policies without StatusCodes.
+var DefaultRetryStatusCodes = []int{500, 502, 503, 504}
+
+// The UPnP error codes retried by policies without ErrorCodes. ActionFailed is returned by
+// several firmwares when they are busy; other faults are not expected to go away.
+var DefaultRetryErrorCodes = []int{ErrCodeActionFailed}
+
+// A retry policy suitable for most routers.
+var DefaultRetryPolicy = &RetryPolicy{Attempts: 3}
+
+func (c *Client) retryPolicy() *RetryPolicy {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.Retry
+}
+
+// An unsuccessful HTTP response without a SOAP fault.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// Perform attempt until it succeeds, fails with an error which is not retryable, or the
+// attempts of the policy are used up. A nil policy performs a single attempt.
+func (p *RetryPolicy) do(ctx context.Context, log *slog.Logger, attempt func() error) error {
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || p == nil || i >= p.Attempts || !p.retryable(ctx, err) {
+			return err
+		}
+		delay := p.backoff(i)
+		log.Debug("Retrying request", "attempt", i+1, "delay", delay, "err", err)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+func (p *RetryPolicy) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrResponseTooLarge) {
+		return false
+	}
+	var soapErr *SOAPError
+	if errors.As(err, &soapErr) {
+		codes := p.ErrorCodes
+		if codes == nil {
+			codes = DefaultRetryErrorCodes
+		}
+		return containsInt(codes, soapErr.Code)
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		codes := p.StatusCodes
+		if codes == nil {
+			codes = DefaultRetryStatusCodes
+		}
+		return containsInt(codes, statusErr.code)
+	}
+	return true
+}
+
+// The delay before the retry following the nth attempt.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	delay, maxDelay := p.Backoff, p.MaxBackoff
+	if delay <= 0 {
+		delay = 250 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = 5 * time.Second
+	}
+	for i := 1; i < n && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func containsInt(list []int, v int) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package upnp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The IPv4 addresses of the default gateways, read from the kernel's routing table,
+// by increasing metric.
+func defaultGateways() []net.IP {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	type route struct {
+		gateway net.IP
+		metric  uint64
+	}
+	var routes []route
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		metric, _ := strconv.ParseUint(fields[6], 10, 32)
+		ip := make(net.IP, 4)
+		binary.NativeEndian.PutUint32(ip, uint32(gw)) // printed in host byte order
+		routes = append(routes, route{ip, metric})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].metric < routes[j].metric
+	})
+	result := make([]net.IP, len(routes))
+	for i, r := range routes {
+		result[i] = r.gateway
+	}
+	return result
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package upnp
+
+import "net"
+
+// The default gateways are only determined on Linux.
+func defaultGateways() []net.IP {
+	return nil
+}
@@ -0,0 +1,71 @@
+package upnp
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+)
+
+const benchSearchResponse = "HTTP/1.1 200 OK\r\n" +
+	"Cache-Control: max-age=120\r\n" +
+	"Location: http://192.0.2.1:5000/rootDesc.xml\r\n" +
+	"Server: OpenWRT/21.02 UPnP/1.1 MiniUPnPd/2.2.1\r\n" +
+	"St: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"Usn: uuid:9d3b2bd3-6d5b-4d1e-8a0f-2a3c4e5f6a7b::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"Ext:\r\n\r\n"
+
+// Responses of devices already found, as routers send several, and of other devices
+// answering the search, which make up most of the packets on busy networks.
+func BenchmarkHandleSearchResponse(b *testing.B) {
+	c := &Client{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1900}
+	for _, bm := range []struct {
+		name       string
+		deviceType string
+	}{
+		{"known device", "urn:schemas-upnp-org:device:InternetGatewayDevice:1"},
+		{"other device type", "urn:schemas-upnp-org:device:InternetGatewayDevice:2"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var seen seenDevices
+			seen.claim("9d3b2bd3-6d5b-4d1e-8a0f-2a3c4e5f6a7b")
+			var loaders sync.WaitGroup
+			resp := []byte(benchSearchResponse)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.handleSearchResponse(context.Background(), bm.deviceType, &seen, from, resp, nil, &loaders)
+			}
+			loaders.Wait()
+		})
+	}
+}
+
+// Receiving packets into the buffers of packetPool, as the search loop does.
+func BenchmarkReceiveSearchResponse(b *testing.B) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	sender, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sender.Close()
+	resp := []byte(benchSearchResponse)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := sender.Write(resp); err != nil {
+			b.Fatal(err)
+		}
+		buf := packetPool.Get().(*[]byte)
+		if _, _, err := conn.ReadFrom(*buf); err != nil {
+			b.Fatal(err)
+		}
+		packetPool.Put(buf)
+	}
+}
@@ -0,0 +1,280 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The service types PreferredService prefers, most preferred first.
+var DefaultServicePreference = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// Which services the port mapping methods of an IGD act on.
+type ServicePolicy int
+
+const (
+	// Act on all relevant services, failing if the action fails on any of them.
+	PolicyAllServices ServicePolicy = iota
+	// Act on the single service chosen by PreferredService.
+	PolicyPreferredService
+	// Act on the services whose connection is up, see ConnectedServices, failing if the
+	// action fails on any of them. With several WAN connections, e.g. DSL with LTE
+	// failover, mappings so land on the active uplink.
+	PolicyConnectedServices
+)
+
+// How long ConnectedServices goes by the connection statuses it queried, so a series of
+// operations does not query them before each one.
+const connectionStatusTTL = 10 * time.Second
+
+// Which services of an IGD were connected, by control URL, when ConnectedServices last
+// queried them.
+type statusCache struct {
+	mut       sync.Mutex
+	connected map[string]bool
+	queried   time.Time
+}
+
+// The status of a WAN connection service, as reported by GetStatusInfo.
+type StatusInfo struct {
+	// Connected, Disconnected, Connecting, PendingDisconnect or Unconfigured, among others.
+	ConnectionStatus    string
+	LastConnectionError string
+	Uptime              time.Duration
+}
+
+// Whether the connection is up.
+func (s StatusInfo) Connected() bool {
+	return s.ConnectionStatus == "Connected"
+}
+
+// Query the IGD service for the status of its WAN connection.
+func (s *IGDService) GetStatusInfo(ctx context.Context) (StatusInfo, error) {
+	tpl := `<u:GetStatusInfo xmlns:u="%s" />`
+	body := fmt.Sprintf(tpl, s.serviceURN)
+
+	args, err := s.soapAction(ctx, "GetStatusInfo", body)
+	if err != nil {
+		return StatusInfo{}, err
+	}
+
+	result := StatusInfo{
+		ConnectionStatus:    args["NewConnectionStatus"],
+		LastConnectionError: args["NewLastConnectionError"],
+	}
+	uptime, _ := strconv.Atoi(args["NewUptime"])
+	result.Uptime = time.Duration(uptime) * time.Second
+
+	return result, nil
+}
+
+func (c *Client) servicePreference() []string {
+	if c == nil || c.ServicePreference == nil {
+		return DefaultServicePreference
+	}
+	return c.ServicePreference
+}
+
+// Choose the service port mappings are best added to: among the services whose
+// connection is up according to GetStatusInfo (or all of them, when none is),
+// the one whose type comes first in the Client's ServicePreference.
+// Services which do not implement GetStatusInfo are treated as connected.
+func (n *IGD) PreferredService(ctx context.Context) (*IGDService, error) {
+	if len(n.services) == 0 {
+		return nil, ErrNoWANConnection
+	}
+
+	preference := n.client.servicePreference()
+	rank := func(s IGDService) int {
+		for i, urn := range preference {
+			if s.serviceURN == urn {
+				return i
+			}
+		}
+		return len(preference)
+	}
+
+	candidates := n.Services()
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rank(candidates[i]) < rank(candidates[j])
+	})
+
+	if len(candidates) == 1 {
+		return &candidates[0], nil
+	}
+	for i := range candidates {
+		status, err := candidates[i].GetStatusInfo(ctx)
+		if err != nil && !IsErrorCode(err, ErrCodeInvalidAction, ErrCodeOptionalActionNotImplemented) {
+			n.logger().Debug("Querying connection status failed", "service", candidates[i].serviceID, "err", err)
+			continue
+		}
+		if err != nil || status.Connected() {
+			return &candidates[i], nil
+		}
+	}
+	return &candidates[0], nil
+}
+
+// The services whose connection is up according to GetStatusInfo, or all of them when
+// none is. Services which do not implement GetStatusInfo are treated as connected, and
+// the status of a single service is not queried. The statuses are queried again after
+// 10 seconds.
+func (n *IGD) ConnectedServices(ctx context.Context) []IGDService {
+	if len(n.services) <= 1 {
+		return n.Services()
+	}
+	up := n.connectionStatuses(ctx)
+	var connected []IGDService
+	for _, s := range n.services {
+		if up[s.serviceURL] {
+			connected = append(connected, s)
+		}
+	}
+	if len(connected) == 0 {
+		return n.Services()
+	}
+	return connected
+}
+
+// Which services are connected, by control URL, queried unless they were within
+// connectionStatusTTL.
+func (n *IGD) connectionStatuses(ctx context.Context) map[string]bool {
+	if n.statuses != nil {
+		n.statuses.mut.Lock()
+		defer n.statuses.mut.Unlock()
+		if n.statuses.connected != nil && time.Since(n.statuses.queried) < connectionStatusTTL {
+			return n.statuses.connected
+		}
+	}
+	connected := make(map[string]bool, len(n.services))
+	for _, s := range n.services {
+		status, err := s.GetStatusInfo(ctx)
+		if err != nil && !IsErrorCode(err, ErrCodeInvalidAction, ErrCodeOptionalActionNotImplemented) {
+			n.logger().Debug("Querying connection status failed", "service", s.serviceID, "err", err)
+			continue
+		}
+		connected[s.serviceURL] = err != nil || status.Connected()
+	}
+	if n.statuses != nil {
+		n.statuses.connected, n.statuses.queried = connected, time.Now()
+	}
+	return connected
+}
+
+// Whether any WAN connection of the IGD is up according to GetStatusInfo. A device whose
+// services do not implement GetStatusInfo is assumed to be connected. The error is that of
+// the first service which could not be queried, when none could.
+func (n *IGD) IsConnected(ctx context.Context) (bool, error) {
+	var firstErr error
+	queried := false
+	for _, s := range n.services {
+		status, err := s.GetStatusInfo(ctx)
+		if IsErrorCode(err, ErrCodeInvalidAction, ErrCodeOptionalActionNotImplemented) {
+			return true, nil
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if status.Connected() {
+			return true, nil
+		}
+		queried = true
+	}
+	if !queried && firstErr != nil {
+		return false, firstErr
+	}
+	if !queried {
+		return false, ErrNoWANConnection
+	}
+	return false, nil
+}
+
+// The services the port mapping methods act on, according to the Client's ServicePolicy.
+func (n *IGD) targetServices(ctx context.Context) ([]IGDService, error) {
+	switch n.Client().ServicePolicy {
+	case PolicyAllServices:
+		return n.services, nil
+	case PolicyPreferredService:
+		s, err := n.PreferredService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []IGDService{*s}, nil
+	}
+	return n.ConnectedServices(ctx), nil
+}
+
+// Query the IGD service for how long its on-demand connection may be idle before it is
+// disconnected, zero when it never is.
+func (s *IGDService) GetIdleDisconnectTime(ctx context.Context) (time.Duration, error) {
+	return s.getSeconds(ctx, "GetIdleDisconnectTime", "NewIdleDisconnectTime")
+}
+
+// Set how long the on-demand connection of the IGD service may be idle before it is
+// disconnected, in whole seconds; zero keeps it up, e.g. while long-lived mappings are in use.
+func (s *IGDService) SetIdleDisconnectTime(ctx context.Context, d time.Duration) error {
+	return s.setSeconds(ctx, "SetIdleDisconnectTime", "NewIdleDisconnectTime", d)
+}
+
+// Query the IGD service for how long it warns the users of its connection before
+// disconnecting it.
+func (s *IGDService) GetWarnDisconnectDelay(ctx context.Context) (time.Duration, error) {
+	return s.getSeconds(ctx, "GetWarnDisconnectDelay", "NewWarnDisconnectDelay")
+}
+
+// Set how long the IGD service warns the users of its connection before disconnecting it,
+// in whole seconds.
+func (s *IGDService) SetWarnDisconnectDelay(ctx context.Context, d time.Duration) error {
+	return s.setSeconds(ctx, "SetWarnDisconnectDelay", "NewWarnDisconnectDelay", d)
+}
+
+// Query the IGD service for how long after it is established its connection is
+// disconnected, zero when it is not.
+func (s *IGDService) GetAutoDisconnectTime(ctx context.Context) (time.Duration, error) {
+	return s.getSeconds(ctx, "GetAutoDisconnectTime", "NewAutoDisconnectTime")
+}
+
+// Set how long after it is established the connection of the IGD service is disconnected,
+// in whole seconds; zero never disconnects it.
+func (s *IGDService) SetAutoDisconnectTime(ctx context.Context, d time.Duration) error {
+	return s.setSeconds(ctx, "SetAutoDisconnectTime", "NewAutoDisconnectTime", d)
+}
+
+// Perform the action returning the number of seconds arg.
+func (s *IGDService) getSeconds(ctx context.Context, action, arg string) (time.Duration, error) {
+	tpl := `<u:%s xmlns:u="%s" />`
+	body := fmt.Sprintf(tpl, action, s.serviceURN)
+
+	args, err := s.soapAction(ctx, action, body)
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := strconv.Atoi(args[arg])
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", arg, args[arg])
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// Perform the action setting the argument arg to the seconds of d, rounded up.
+func (s *IGDService) setSeconds(ctx context.Context, action, arg string, d time.Duration) error {
+	tpl := `<u:%s xmlns:u="%s">
+	<%s>%d</%s>
+	</u:%s>`
+	seconds := int((d + time.Second - 1) / time.Second)
+	body := fmt.Sprintf(tpl, action, s.serviceURN, arg, seconds, arg, action)
+
+	_, err := s.soapRequest(ctx, action, body)
+	return err
+}
@@ -0,0 +1,43 @@
+package upnp_test
+
+import (
+	"context"
+	"testing"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+// The values of the policies are kept, as callers store them.
+func TestServicePolicyValues(t *testing.T) {
+	if upnp.PolicyAllServices != 0 || upnp.PolicyPreferredService != 1 || upnp.PolicyConnectedServices != 2 {
+		t.Errorf("policies numbered %d, %d and %d, want 0, 1 and 2",
+			upnp.PolicyAllServices, upnp.PolicyPreferredService, upnp.PolicyConnectedServices)
+	}
+}
+
+// The connection statuses of the services are queried once for a series of operations.
+func TestConnectedServicesCached(t *testing.T) {
+	f, err := upnptest.LoadFixture("fritzbox-7590")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := upnptest.NewFixtureServer(f)
+	defer s.Close()
+	c := &upnp.Client{AllowPublicAddresses: true, ServicePolicy: upnp.PolicyConnectedServices}
+	igd, err := c.LoadIGD(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if services := igd.ConnectedServices(context.Background()); len(services) != 2 {
+			t.Fatalf("%d connected services, want both", len(services))
+		}
+		if _, err := igd.GetExternalIPAddress(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.Requests("GetStatusInfo"); n != 2 {
+		t.Errorf("sent %d GetStatusInfo requests, want one per service", n)
+	}
+}
@@ -0,0 +1,90 @@
+package upnp
+
+import (
+	"slices"
+	"strings"
+)
+
+// The differences between two discoveries, see DiffSnapshots.
+type SnapshotDiff struct {
+	// The devices only found by the second and only by the first discovery.
+	Added   []IGD
+	Removed []IGD
+	// The devices found by both which changed in between.
+	Changed []DeviceChange
+}
+
+// How a device changed between two discoveries.
+type DeviceChange struct {
+	Old, New IGD
+	// The device rebooted, according to the BOOTID.UPNP.ORG of its answers; only UPnP 1.1
+	// devices report one.
+	Rebooted bool
+	// The description URL of the device changed, e.g. as DHCP renumbered it.
+	Moved bool
+	// The device has other services or service URLs.
+	ServicesChanged bool
+}
+
+// Whether the discoveries found the same devices, unchanged.
+func (d SnapshotDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Compare the devices of two discoveries by UUID, e.g. to report the devices coming and
+// going between periodic discoveries. The devices are in the order of the discovery listing them.
+func DiffSnapshots(old, new []IGD) SnapshotDiff {
+	find := func(igds []IGD, uuid string) *IGD {
+		for i := range igds {
+			if strings.EqualFold(igds[i].uuid, uuid) {
+				return &igds[i]
+			}
+		}
+		return nil
+	}
+
+	var diff SnapshotDiff
+	for _, n := range new {
+		o := find(old, n.uuid)
+		if o == nil {
+			diff.Added = append(diff.Added, n)
+			continue
+		}
+		change := DeviceChange{
+			Old:             *o,
+			New:             n,
+			Rebooted:        o.bootID != 0 && n.bootID != 0 && o.bootID != n.bootID,
+			Moved:           o.location() != n.location(),
+			ServicesChanged: !slices.Equal(o.serviceKeys(), n.serviceKeys()),
+		}
+		if change.Rebooted || change.Moved || change.ServicesChanged {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+	for _, o := range old {
+		if find(new, o.uuid) == nil {
+			diff.Removed = append(diff.Removed, o)
+		}
+	}
+	return diff
+}
+
+// The description URL of the device, empty when it has none.
+func (n *IGD) location() string {
+	if n.url == nil {
+		return ""
+	}
+	return n.url.String()
+}
+
+// The IDs, types and URLs of all services of the device, sorted.
+func (n *IGD) serviceKeys() []string {
+	var keys []string
+	for _, list := range [][]IGDService{n.services, n.interfaces, n.firewalls, n.protections} {
+		for _, s := range list {
+			keys = append(keys, strings.Join([]string{s.serviceID, s.serviceURN, s.serviceURL, s.eventSubURL, s.scpdURL}, " "))
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package upnp
+
+import (
+	"net"
+	"sort"
+)
+
+// The IPv4 addresses of the host's default gateways, most preferred first. Only determined
+// on Linux, nil elsewhere and when there is no default route.
+func DefaultGateways() []net.IP {
+	return defaultGateways()
+}
+
+// Whether the IGD is one of the gateways, by the address its description is served from.
+func (n *IGD) isGateway(gateways []net.IP) bool {
+	if n.url == nil {
+		return false
+	}
+	ip := net.ParseIP(n.url.Hostname())
+	for _, gw := range gateways {
+		if gw.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the IGD is the host's default gateway, the router which carries its outbound
+// traffic, rather than e.g. a secondary IGD like a mesh node. Always false where the
+// default gateways cannot be determined, see DefaultGateways.
+func (n *IGD) IsDefaultGateway() bool {
+	return n.isGateway(defaultGateways())
+}
+
+// Select the device owning the host's default route from igds, preferring the routes with
+// the lowest metric. False when none of them does or it cannot be determined.
+func SelectDefaultGateway(igds []IGD) (*IGD, bool) {
+	for _, gw := range defaultGateways() {
+		for i := range igds {
+			if igds[i].isGateway([]net.IP{gw}) {
+				return &igds[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Sort devices deterministically, most suitable first: InternetGatewayDevice:2
+// before InternetGatewayDevice:1, then the device owning the default route
+// (where it can be determined), then by UUID.
+func SortIGDs(igds []IGD) {
+	gateways := defaultGateways()
+	rank := func(n *IGD) int {
+		r := 0
+		if n.deviceType != "urn:schemas-upnp-org:device:InternetGatewayDevice:2" {
+			r += 2
+		}
+		if !n.isGateway(gateways) {
+			r++
+		}
+		return r
+	}
+	sort.SliceStable(igds, func(i, j int) bool {
+		ri, rj := rank(&igds[i]), rank(&igds[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return igds[i].uuid < igds[j].uuid
+	})
+}
@@ -0,0 +1,79 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrNoInterfaceConfig is returned when an IGD does not expose a WANCommonInterfaceConfig service.
+var ErrNoInterfaceConfig = errors.New("no WANCommonInterfaceConfig service found")
+
+// Traffic counters of a WAN interface, as reported by a WANCommonInterfaceConfig service.
+// Routers are only required to report 32 bit counters, which wrap around on busy links.
+type TrafficStats struct {
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+}
+
+// Query the IGD's first WANCommonInterfaceConfig service for its traffic counters.
+func (n *IGD) GetTrafficStats(ctx context.Context) (TrafficStats, error) {
+	if len(n.interfaces) == 0 {
+		return TrafficStats{}, ErrNoInterfaceConfig
+	}
+	return n.interfaces[0].GetTrafficStats(ctx)
+}
+
+// Query the WANCommonInterfaceConfig service for its byte and packet counters.
+func (s *IGDService) GetTrafficStats(ctx context.Context) (TrafficStats, error) {
+	var stats TrafficStats
+	var err error
+
+	if stats.BytesSent, err = s.getCounter(ctx, "GetTotalBytesSent", "NewTotalBytesSent"); err != nil {
+		return stats, err
+	}
+	if stats.BytesReceived, err = s.getCounter(ctx, "GetTotalBytesReceived", "NewTotalBytesReceived"); err != nil {
+		return stats, err
+	}
+	if stats.PacketsSent, err = s.getCounter(ctx, "GetTotalPacketsSent", "NewTotalPacketsSent"); err != nil {
+		return stats, err
+	}
+	if stats.PacketsReceived, err = s.getCounter(ctx, "GetTotalPacketsReceived", "NewTotalPacketsReceived"); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+func (s *IGDService) getCounter(ctx context.Context, function, argument string) (uint64, error) {
+	tpl := `<u:%s xmlns:u="%s" />`
+	body := fmt.Sprintf(tpl, function, s.serviceURN)
+
+	args, err := s.soapAction(ctx, function, body)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := args[argument]
+	if !ok {
+		return 0, errors.New(function + ": missing " + argument + " in response")
+	}
+
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// Compute the increase of a counter between two samples, accounting for
+// routers which wrap their 32 bit counters.
+func CounterDelta(previous, current uint64) uint64 {
+	if current >= previous {
+		return current - previous
+	}
+	if previous <= 0xffffffff {
+		return (1 << 32) - previous + current
+	}
+	// Counter was reset (e.g. the router rebooted)
+	return current
+}
@@ -0,0 +1,216 @@
+package upnp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// A public STUN server, for callers without one of their own.
+const DefaultSTUNServer = "stun.l.google.com:19302"
+
+// A STUNVerdict tells how the external IP address an IGD reports compares to the one a
+// STUN server observes.
+type STUNVerdict int
+
+const (
+	// Both addresses are the same: the IGD is what connects this host to the internet.
+	STUNMatch STUNVerdict = iota
+	// The IGD reports a private or carrier-grade NAT address, and the STUN server observes
+	// the public address of the NAT upstream of it. Mappings on the IGD alone are not
+	// reachable from the internet.
+	STUNUpstreamNAT
+	// The IGD reports a public address other than the one observed: its report is stale or
+	// wrong, or traffic leaves through another route, like a second WAN link or a VPN.
+	STUNMismatch
+)
+
+func (v STUNVerdict) String() string {
+	switch v {
+	case STUNMatch:
+		return "match"
+	case STUNUpstreamNAT:
+		return "upstream NAT"
+	case STUNMismatch:
+		return "mismatch"
+	}
+	return "unknown"
+}
+
+// The result of CheckSTUN.
+type STUNResult struct {
+	// The external IP address the IGD reports.
+	ExternalIP net.IP
+	// The address the STUN server observed requests from this host to come from.
+	ObservedIP net.IP
+	Verdict    STUNVerdict
+}
+
+// Cross-check the external IP address of the InternetGatewayDevice with the one the STUN
+// server (host:port) observes, to detect carrier-grade NAT and routers lying about their
+// address. The STUN request is sent from the local IP address the IGD is reached from.
+func (n *IGD) CheckSTUN(ctx context.Context, server string) (STUNResult, error) {
+	ip, err := n.GetExternalIPAddress(ctx)
+	if err != nil {
+		return STUNResult{}, err
+	}
+	observed, err := STUNAddr(ctx, server, net.ParseIP(n.LocalIP()))
+	if err != nil {
+		return STUNResult{ExternalIP: ip}, err
+	}
+	result := STUNResult{ExternalIP: ip, ObservedIP: observed.IP}
+	switch {
+	case ip.Equal(observed.IP):
+		result.Verdict = STUNMatch
+	case ip == nil || natVerdict(ip) != NATPublic:
+		result.Verdict = STUNUpstreamNAT
+	default:
+		result.Verdict = STUNMismatch
+	}
+	return result, nil
+}
+
+// The STUN protocol constants (RFC 5389).
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112a442
+	stunMappedAddress   = 0x0001
+	stunXORMappedAddr   = 0x0020
+	stunHeaderLength    = 20
+)
+
+// How long STUNAddr waits for a response before retransmitting the request, doubled for
+// each retransmission.
+const stunRTO = 500 * time.Millisecond
+
+// How many times STUNAddr sends the request.
+const stunAttempts = 4
+
+// Ask the STUN server (host:port) for the address it observes the request to come from,
+// sending it from localIP when not nil, so it leaves through the same route as traffic to
+// the IGD.
+func STUNAddr(ctx context.Context, server string, localIP net.IP) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return nil, err
+	}
+	defer socket.Close()
+
+	stop := context.AfterFunc(ctx, func() { socket.Close() })
+	defer stop()
+
+	request := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	if _, err := rand.Read(request[8:stunHeaderLength]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	rto := stunRTO
+	for attempt := 0; attempt < stunAttempts; attempt++ {
+		if _, err := socket.WriteTo(request, raddr); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		socket.SetReadDeadline(time.Now().Add(rto))
+		rto *= 2
+		for {
+			n, from, err := socket.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				var nerr net.Error
+				if errors.As(err, &nerr) && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+				continue
+			}
+			addr, err := parseSTUNResponse(buf[:n], request[8:stunHeaderLength])
+			if err != nil {
+				return nil, fmt.Errorf("STUN server %s: %w", server, err)
+			}
+			if addr != nil {
+				return addr, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("STUN server %s did not respond", server)
+}
+
+// Parse a Binding response to the transaction, returning nil for messages of other
+// transactions, e.g. late responses to a request sent before.
+func parseSTUNResponse(msg, transaction []byte) (*net.UDPAddr, error) {
+	if len(msg) < stunHeaderLength || binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie ||
+		string(msg[8:stunHeaderLength]) != string(transaction) {
+		return nil, nil
+	}
+	if t := binary.BigEndian.Uint16(msg); t != stunBindingResponse {
+		return nil, fmt.Errorf("unexpected message type %#04x", t)
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if stunHeaderLength+length > len(msg) {
+		return nil, errors.New("truncated message")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := msg[stunHeaderLength : stunHeaderLength+length]
+	for len(attrs) >= 4 {
+		t, l := binary.BigEndian.Uint16(attrs), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			return nil, errors.New("truncated attribute")
+		}
+		value := attrs[4 : 4+l]
+		switch t {
+		case stunXORMappedAddr:
+			// Preferred, as NATs rewriting addresses in payloads cannot garble it.
+			if addr := parseSTUNAddress(value, msg[4:8]); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = parseSTUNAddress(value, nil)
+		}
+		// Attributes are padded to a multiple of 4 bytes.
+		l = (l + 3) &^ 3
+		if 4+l > len(attrs) {
+			break
+		}
+		attrs = attrs[4+l:]
+	}
+	if mapped == nil {
+		return nil, errors.New("response without mapped address")
+	}
+	return mapped, nil
+}
+
+// Parse an IPv4 (XOR-)MAPPED-ADDRESS attribute value, XORed with key when not nil.
+func parseSTUNAddress(value, key []byte) *net.UDPAddr {
+	// Reserved byte, family 0x01 for IPv4, port and address.
+	if len(value) != 8 || value[1] != 0x01 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := net.IPv4(value[4], value[5], value[6], value[7]).To4()
+	if key != nil {
+		port ^= binary.BigEndian.Uint16(key)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
@@ -0,0 +1,125 @@
+package upnp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// How HTTPS requests to a device verify its certificate, see Client.TLS.
+// The zero value verifies it against the system's root certificates.
+type TLSConfig struct {
+	// The root certificates the device's certificate is verified against, the system's when nil.
+	RootCAs *x509.CertPool
+	// The SHA-256 fingerprints of the certificates the device may present, in hex with
+	// optional colons. When set, the device's certificate must have one of them instead
+	// of being verified against RootCAs, which pins self-signed certificates.
+	Fingerprints []string
+	// Accept any certificate, which leaves the requests open to interception.
+	InsecureSkipVerify bool
+	// The certificates presented to the device, by which DeviceProtection services
+	// identify control points.
+	Certificates []tls.Certificate
+}
+
+// The configuration applying to requests to u of the device with the UUID uuid: that
+// of the UUID, else of the host of u, else the default one. Nil for plain HTTP URLs.
+func (c *Client) tlsConfig(uuid string, u *url.URL) *TLSConfig {
+	if c == nil {
+		c = DefaultClient
+	}
+	if u.Scheme != "https" {
+		return nil
+	}
+	if cfg, ok := c.DeviceTLS[uuid]; ok && uuid != "" {
+		return cfg
+	}
+	if cfg, ok := c.DeviceTLS[u.Hostname()]; ok {
+		return cfg
+	}
+	return c.TLS
+}
+
+// The HTTP client for requests to u of the device with the UUID uuid, any when empty.
+// It is the client's, with the TLS configuration of the device if it has one. Clients with
+// a transport other than an http.Transport cannot be configured and are used as they are.
+func (c *Client) deviceHTTPClient(uuid string, u *url.URL) *http.Client {
+	base := c.httpClient()
+	cfg := c.tlsConfig(uuid, u)
+	if cfg == nil {
+		return base
+	}
+	key := tlsClientKey{base, cfg}
+	if client, ok := tlsClients.Load(key); ok {
+		return client.(*http.Client)
+	}
+
+	var transport *http.Transport
+	switch t := base.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		c.logger().Warn("Not applying device TLS configuration to custom HTTP transport", "url", u.Redacted())
+		return base
+	}
+	transport.TLSClientConfig = cfg.clientConfig(transport.TLSClientConfig)
+	client := *base
+	client.Transport = transport
+	actual, _ := tlsClients.LoadOrStore(key, &client)
+	return actual.(*http.Client)
+}
+
+// The HTTP clients with device TLS configurations, by the client they are derived from and
+// the configuration, so connections are reused.
+var tlsClients sync.Map
+
+type tlsClientKey struct {
+	base *http.Client
+	cfg  *TLSConfig
+}
+
+// The tls.Config of the transport's one, base when nil, with cfg applied.
+func (cfg *TLSConfig) clientConfig(base *tls.Config) *tls.Config {
+	var result *tls.Config
+	if base != nil {
+		result = base.Clone()
+	} else {
+		result = &tls.Config{}
+	}
+	if cfg.RootCAs != nil {
+		result.RootCAs = cfg.RootCAs
+	}
+	if cfg.InsecureSkipVerify {
+		result.InsecureSkipVerify = true
+	}
+	if len(cfg.Certificates) > 0 {
+		result.Certificates = cfg.Certificates
+	}
+	if len(cfg.Fingerprints) > 0 {
+		pins := make(map[string]bool, len(cfg.Fingerprints))
+		for _, f := range cfg.Fingerprints {
+			pins[strings.ToLower(strings.ReplaceAll(f, ":", ""))] = true
+		}
+		// The chain is not verified, the pin is checked instead.
+		result.InsecureSkipVerify = true
+		result.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("upnp: device presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !pins[hex.EncodeToString(sum[:])] {
+				return errors.New("upnp: device certificate does not match the pinned fingerprints")
+			}
+			return nil
+		}
+	}
+	return result
+}
@@ -0,0 +1,113 @@
+package upnp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The kinds of TraceRecords.
+const (
+	TraceSSDP = "ssdp"
+	TraceSOAP = "soap"
+)
+
+// A raw SSDP packet or SOAP payload a client sent or received, as passed to a TraceSink.
+type TraceRecord struct {
+	Time time.Time `json:"time"`
+	// TraceSSDP or TraceSOAP.
+	Kind     string `json:"kind"`
+	Outgoing bool   `json:"outgoing"`
+	// The address an SSDP packet was sent to or received from, the control URL of a SOAP
+	// request.
+	Addr string `json:"addr"`
+	// The UUID of the device and the action of a SOAP request.
+	Device string `json:"device,omitempty"`
+	Action string `json:"action,omitempty"`
+	// The packet or the body of the SOAP request or response, redacted.
+	Data []byte `json:"data"`
+}
+
+// A TraceSink receives the raw traffic of a client, see Client.Trace.
+type TraceSink interface {
+	Trace(TraceRecord)
+}
+
+// A TraceFunc is a TraceSink calling the function.
+type TraceFunc func(TraceRecord)
+
+func (f TraceFunc) Trace(r TraceRecord) {
+	f(r)
+}
+
+// A TraceLog is a TraceSink writing the records to a writer as JSON lines, with the data
+// as a string.
+type TraceLog struct {
+	mut sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// A TraceLog writing to w.
+func NewTraceLog(w io.Writer) *TraceLog {
+	return &TraceLog{w: w}
+}
+
+type traceRecordJSON struct {
+	TraceRecord
+	Data string `json:"data"`
+}
+
+func (l *TraceLog) Trace(r TraceRecord) {
+	// Keep the XML of SOAP payloads readable.
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(traceRecordJSON{r, string(r.Data)}); err != nil {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.err != nil {
+		return
+	}
+	_, l.err = l.w.Write(b.Bytes())
+}
+
+// The arguments of SOAP payloads carrying secrets, like the authenticator of a DeviceProtection login.
+var secretArguments = regexp.MustCompile(`(?is)(<([\w:]*(?:Password|Passphrase|Authenticator|StoredValue|Secret)\w*)\b[^>]*>)(.*?)(</[\w:]*>)`)
+
+// Replace the values of SOAP arguments carrying secrets in data with REDACTED. It is the
+// redaction of clients without TraceRedact.
+func RedactSecrets(data []byte) []byte {
+	return secretArguments.ReplaceAll(data, []byte("${1}REDACTED${4}"))
+}
+
+// Pass a copy of data to the client's trace sink, if it has one, after redaction.
+func (c *Client) trace(r TraceRecord, data []byte) {
+	if c == nil {
+		c = DefaultClient
+	}
+	if c.Trace == nil {
+		return
+	}
+	redact := c.TraceRedact
+	if redact == nil {
+		redact = RedactSecrets
+	}
+	r.Time = time.Now()
+	r.Data = redact(append([]byte(nil), data...))
+	c.Trace.Trace(r)
+}
+
+// Trace the SSDP packet.
+func (c *Client) traceSSDP(p *SSDPPacket) {
+	var addr string
+	if p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	c.trace(TraceRecord{Kind: TraceSSDP, Outgoing: p.Outgoing, Addr: addr}, p.Data)
+}
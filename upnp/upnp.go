@@ -13,37 +13,60 @@ package upnp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-// Debugging
-var Debug = false
-
-var l = log.New(ioutil.Discard, "", 0)
-
-func EnableLog() {
-	l = log.New(os.Stdout, "upnp: ", log.LstdFlags)
-}
+// Instrumentation hooks, e.g. for exporting metrics. They are called
+// synchronously and must be safe for concurrent use.
+//
+// Deprecated: Use Client.Metrics, which also gets the device of SOAP requests.
+var (
+	// Called after each discovery with its duration and the number of devices found.
+	OnDiscovery func(duration time.Duration, found int)
+	// Called after each SOAP request with the action, the request duration and the error, if any.
+	OnSOAPRequest func(action string, duration time.Duration, err error)
+)
 
 // A container for relevant properties of a UPnP InternetGatewayDevice.
+// An IGD and its services are safe for concurrent use; copies share the
+// limit of the Client on concurrent requests to the device.
 type IGD struct {
-	uuid           string
-	friendlyName   string
-	services       []IGDService
-	url            *url.URL
-	localIPAddress string
+	uuid            string
+	usn             string
+	bootID          int
+	friendlyName    string
+	deviceType      string
+	manufacturer    string
+	modelName       string
+	modelNumber     string
+	serialNumber    string
+	presentationURL string
+	icons           []Icon
+	rawDescription  []byte
+	services        []IGDService
+	interfaces      []IGDService
+	firewalls       []IGDService
+	protections     []IGDService
+	url             *url.URL
+	localIPAddress  string
+	quirks          Quirk
+	server          string
+	latency         *latencies
+	statuses        *statusCache
+	client          *Client
 }
 
 // The InternetGatewayDevice's UUID.
@@ -51,11 +74,28 @@ func (n *IGD) UUID() string {
 	return n.uuid
 }
 
+// The BOOTID.UPNP.ORG the InternetGatewayDevice answered discovery with, which it increases
+// when it reboots. Zero for devices loaded with LoadIGD and for UPnP 1.0 devices.
+func (n *IGD) BootID() int {
+	return n.bootID
+}
+
+// The unique service name the InternetGatewayDevice answered discovery with, which UUID is
+// parsed from. Empty for devices loaded with LoadIGD.
+func (n *IGD) USN() string {
+	return n.usn
+}
+
 // The InternetGatewayDevice's friendly name.
 func (n *IGD) FriendlyName() string {
 	return n.friendlyName
 }
 
+// The InternetGatewayDevice's device type, e.g. urn:schemas-upnp-org:device:InternetGatewayDevice:2.
+func (n *IGD) DeviceType() string {
+	return n.deviceType
+}
+
 // The InternetGatewayDevice's friendly identifier (friendly name + IP address).
 func (n *IGD) FriendlyIdentifier() string {
 	return "'" + n.FriendlyName() + "' (" + strings.Split(n.URL().Host, ":")[0] + ")"
@@ -66,17 +106,71 @@ func (n *IGD) URL() *url.URL {
 	return n.url
 }
 
+// The InternetGatewayDevice's WANIPConnection and WANPPPConnection services, which manage port mappings.
+func (n *IGD) Services() []IGDService {
+	return append([]IGDService(nil), n.services...)
+}
+
+// The local IP address port mappings added with AddPortMapping point to.
+func (n *IGD) LocalIP() string {
+	return n.localIPAddress
+}
+
 // A container for relevant properties of a UPnP service of an IGD.
 type IGDService struct {
-	serviceID  string
-	serviceURL string
-	serviceURN string
+	serviceID   string
+	serviceURL  string
+	serviceURN  string
+	eventSubURL string
+	scpdURL     string
+	uuid        string
+	// The local IP address of the IGD the service belongs to.
+	localIPAddress string
+	// The quirks of the IGD the service belongs to.
+	quirks  Quirk
+	client  *Client
+	limiter chan struct{}
+	rate    *rateLimiter
+	latency *latencies
 }
 
 func (s *IGDService) ID() string {
 	return s.serviceID
 }
 
+// The URL SOAP requests to the service are sent to, the same as ControlURL.
+func (s *IGDService) ServiceURL() string {
+	return s.serviceURL
+}
+
+// The service's type, e.g. urn:schemas-upnp-org:service:WANIPConnection:1.
+func (s *IGDService) URN() string {
+	return s.serviceURN
+}
+
+// The URL of the service's control endpoint.
+func (s *IGDService) ControlURL() string {
+	return s.serviceURL
+}
+
+// The URL of the service's GENA event subscription endpoint, empty when the service does not support eventing.
+func (s *IGDService) EventSubURL() string {
+	return s.eventSubURL
+}
+
+// The URL of the service's description (SCPD), listing its actions and state variables.
+func (s *IGDService) SCPDURL() string {
+	return s.scpdURL
+}
+
+func (n *IGD) logger() *slog.Logger {
+	return n.client.logger().With("device", n.uuid)
+}
+
+func (s *IGDService) logger() *slog.Logger {
+	return s.client.logger().With("device", s.uuid, "service", s.serviceID)
+}
+
 type Protocol string
 
 const (
@@ -88,258 +182,504 @@ type upnpService struct {
 	ServiceID   string `xml:"serviceId"`
 	ServiceType string `xml:"serviceType"`
 	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+	SCPDURL     string `xml:"SCPDURL"`
 }
 
 type upnpDevice struct {
-	DeviceType   string        `xml:"deviceType"`
-	FriendlyName string        `xml:"friendlyName"`
-	Devices      []upnpDevice  `xml:"deviceList>device"`
-	Services     []upnpService `xml:"serviceList>service"`
+	DeviceType      string        `xml:"deviceType"`
+	Manufacturer    string        `xml:"manufacturer"`
+	ModelName       string        `xml:"modelName"`
+	ModelNumber     string        `xml:"modelNumber"`
+	SerialNumber    string        `xml:"serialNumber"`
+	PresentationURL string        `xml:"presentationURL"`
+	Icons           []upnpIcon    `xml:"iconList>icon"`
+	UDN             string        `xml:"UDN"`
+	FriendlyName    string        `xml:"friendlyName"`
+	Devices         []upnpDevice  `xml:"deviceList>device"`
+	Services        []upnpService `xml:"serviceList>service"`
 }
 
 type upnpRoot struct {
-	Device upnpDevice `xml:"device"`
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
 }
 
-// Discover discovers UPnP InternetGatewayDevices.
-// The order in which the devices appear in the result list is not deterministic.
-func Discover(intranet *string) []IGD {
-	var result []IGD
-	l.Println("Starting UPnP discovery...")
-
-	timeout := 3
-
-	// Search for InternetGatewayDevice:2 devices
-	result = append(result, discover("urn:schemas-upnp-org:device:InternetGatewayDevice:2", timeout, result, intranet)...)
-
-	// Search for InternetGatewayDevice:1 devices
-	// InternetGatewayDevice:2 devices that correctly respond to the IGD:1 request as well will not be re-added to the result list
-	result = append(result, discover("urn:schemas-upnp-org:device:InternetGatewayDevice:1", timeout, result, intranet)...)
+// Discover discovers UPnP InternetGatewayDevices, waiting for the full discovery timeout.
+// The order in which the devices appear in the result list is not deterministic, unless SortResults is set.
+func (c *Client) Discover() []IGD {
+	return c.DiscoverContext(context.Background()).Devices
+}
 
-	if len(result) > 0 && Debug {
-		l.Println("UPnP discovery result:")
-		for _, resultDevice := range result {
-			l.Println("[" + resultDevice.uuid + "]")
+// The devices a discovery found, see DiscoverContext.
+type DiscoveryResult struct {
+	Devices []IGD
+	// Whether ctx was cancelled before the discovery timeout, so that devices answering
+	// late or whose descriptions were still loading are missing.
+	Truncated bool
+}
 
-			for _, resultService := range resultDevice.services {
-				l.Println("* [" + resultService.serviceID + "] " + resultService.serviceURL)
-			}
-		}
+// DiscoverContext discovers UPnP InternetGatewayDevices like Discover, until the discovery
+// timeout or until ctx is cancelled. Devices whose descriptions had loaded by then are
+// returned either way.
+func (c *Client) DiscoverContext(ctx context.Context) DiscoveryResult {
+	var result DiscoveryResult
+	d := c.StartDiscovery(ctx)
+	for igd := range d.Results() {
+		result.Devices = append(result.Devices, igd)
 	}
+	<-d.Done()
+	result.Devices = append(result.Devices, d.Flushed()...)
+	result.Truncated = d.Truncated()
 
-	suffix := "devices"
-	if len(result) == 1 {
-		suffix = "device"
+	if c.SortResults {
+		SortIGDs(result.Devices)
 	}
 
-	l.Printf("UPnP discovery complete (found %d %s).", len(result), suffix)
-
 	return result
 }
 
-// Search for UPnP InternetGatewayDevices for <timeout> seconds, ignoring responses from any devices listed in knownDevices.
-// The order in which the devices appear in the result list is not deterministic
-func discover(deviceType string, timeout int, knownDevices []IGD, intranet *string) []IGD {
-	ssdp := &net.UDPAddr{IP: []byte{239, 255, 255, 250}, Port: 1900}
+// Search for UPnP InternetGatewayDevices for at least timeout, as searchWindow has it,
+// sending the devices found to results. Devices already claimed in seen, e.g. by the search for another device type, are ignored.
+// It returns once all responses have been handled, with an error if the search could not be sent.
+func (c *Client) discover(ctx context.Context, deviceType string, timeout time.Duration, seen *seenDevices, results chan<- IGD) error {
+	log := c.logger().With("type", deviceType)
 
-	tpl := `M-SEARCH * HTTP/1.1
-Host: 239.255.255.250:1900
-St: %s
-Man: "ssdp:discover"
-Mx: %d
+	ssdp := &net.UDPAddr{IP: []byte{239, 255, 255, 250}, Port: 1900}
+	if c.SearchAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp4", c.SearchAddr)
+		if err != nil {
+			log.Warn("Discovery failed", "err", err)
+			return err
+		}
+		ssdp = addr
+	}
 
-`
-	searchStr := fmt.Sprintf(tpl, deviceType, timeout)
+	mx, wait := c.searchWindow(timeout)
+	search := searchRequest(ssdp.String(), deviceType, mx)
 
-	search := []byte(strings.Replace(searchStr, "\n", "\r\n", -1))
+	log.Debug("Starting discovery of device type", "mx", mx, "wait", wait)
 
-	if Debug {
-		l.Println("Starting discovery of device type " + deviceType + "...")
+	var socket *net.UDPConn
+	var err error
+	if ssdp.IP.IsMulticast() {
+		socket, err = net.ListenMulticastUDP("udp4", c.Interface, &net.UDPAddr{IP: ssdp.IP})
+	} else {
+		socket, err = net.ListenUDP("udp4", nil)
 	}
-
-	var results []IGD
-	resultChannel := make(chan IGD, 8)
-
-	socket, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: ssdp.IP})
 	if err != nil {
-		l.Println(err)
-		return results
+		log.Warn("Discovery failed", "err", err)
+		return err
 	}
 	defer socket.Close() // Make sure our socket gets closed
 
-	err = socket.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-	if err != nil {
-		l.Println(err)
-		return results
-	}
+	// Unblock the read loop when the discovery is cancelled.
+	stop := context.AfterFunc(ctx, func() { socket.Close() })
+	defer stop()
 
-	if Debug {
-		l.Println("Sending search request for device type " + deviceType + "...")
+	err = socket.SetDeadline(time.Now().Add(wait))
+	if err != nil {
+		log.Warn("Discovery failed", "err", err)
+		return err
 	}
 
-	var resultWaitGroup sync.WaitGroup
+	log.Debug("Sending search request")
 
-	_, err = socket.WriteTo(search, ssdp)
+	out := &SSDPPacket{Outgoing: true, Addr: ssdp, Data: search}
+	if !c.filterSSDP(out) {
+		log.Debug("Search request dropped by middleware")
+		return nil
+	}
+	_, err = socket.WriteTo(out.Data, ssdp)
 	if err != nil {
-		l.Println(err)
-		return results
+		log.Warn("Discovery failed", "err", err)
+		return err
 	}
 
-	if Debug {
-		l.Println("Listening for UPnP response for device type " + deviceType + "...")
+	log.Debug("Listening for UPnP responses")
+
+	// Responses are checked by a few workers, so we can immediately return to listening
+	// for more responses; busy networks see hundreds of unrelated packets per second.
+	// The devices found are loaded in goroutines of their own, as that takes a while.
+	var handlers sync.WaitGroup
+	packets := make(chan ssdpPacket, 64)
+	for i := 0; i < discoveryWorkers; i++ {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			for p := range packets {
+				in := &SSDPPacket{Addr: p.addr, Data: (*p.buf)[:p.n]}
+				if c.filterSSDP(in) {
+					c.handleSearchResponse(ctx, deviceType, seen, in.Addr, in.Data, results, &handlers)
+				}
+				packetPool.Put(p.buf)
+			}
+		}()
 	}
 
 	// Listen for responses until a timeout is reached
 	for {
-		resp := make([]byte, 1500)
-		n, _, err := socket.ReadFrom(resp)
+		buf := packetPool.Get().(*[]byte)
+		n, addr, err := socket.ReadFrom(*buf)
 		if err != nil {
-			if e, ok := err.(net.Error); !ok || !e.Timeout() {
-				l.Println(err) //legitimate error, not a timeout.
+			packetPool.Put(buf)
+			if e, ok := err.(net.Error); ctx.Err() == nil && (!ok || !e.Timeout()) {
+				log.Warn("Reading UPnP response failed", "err", err) //legitimate error, not a timeout.
 			}
-
 			break
-		} else {
-			// Process results in a separate go routine so we can immediately return to listening for more responses
-			resultWaitGroup.Add(1)
-			go handleSearchResponse(deviceType, knownDevices, resp, n, resultChannel, &resultWaitGroup, intranet)
 		}
+		packets <- ssdpPacket{buf, n, addr}
 	}
+	close(packets)
 
-	// Wait for all result handlers to finish processing, then close result channel
-	resultWaitGroup.Wait()
-	close(resultChannel)
+	// Wait for all result handlers to finish processing
+	handlers.Wait()
 
-	// Collect our results from the result handlers using the result channel
-	for result := range resultChannel {
-		// Check for existing results (some routers send multiple response packets)
-		for _, existingResult := range results {
-			if existingResult.uuid == result.uuid {
-				if Debug {
-					l.Println("Already processed device with UUID", existingResult.uuid, "continuing...")
-				}
-				continue
-			}
-		}
+	log.Debug("Discovery of device type finished")
 
-		// No existing results, okay to append
-		results = append(results, result)
-	}
+	return nil
+}
 
-	if Debug {
-		l.Println("Discovery for device type " + deviceType + " finished.")
+// An M-SEARCH request for the device type, to send to host. Multicast requests carry the
+// maximum number of seconds devices may wait before answering, unicast ones (mx 0) do not.
+func searchRequest(host, deviceType string, mx int) []byte {
+	lines := []string{
+		"M-SEARCH * HTTP/1.1",
+		"Host: " + host,
+		"St: " + deviceType,
+		`Man: "ssdp:discover"`,
+	}
+	if mx > 0 {
+		lines = append(lines, "Mx: "+strconv.Itoa(mx))
 	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n\r\n")
+}
 
-	return results
+// The number of goroutines checking the responses to a search request.
+const discoveryWorkers = 4
+
+// An SSDP packet received from addr, n bytes long.
+type ssdpPacket struct {
+	buf  *[]byte
+	n    int
+	addr net.Addr
 }
 
-func handleSearchResponse(deviceType string, knownDevices []IGD, resp []byte, length int, resultChannel chan<- IGD, resultWaitGroup *sync.WaitGroup, intranet *string) {
-	defer resultWaitGroup.Done() // Signal when we've finished processing
+// Buffers for receiving SSDP packets, which fit into an Ethernet frame.
+var packetPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 1500)
+		return &buf
+	},
+}
 
-	if Debug {
-		l.Println("Handling UPnP response:\n\n" + string(resp[:length]))
+// Check a response to a search request for deviceType, any IGD type when empty, received from the address from, and load the
+// device it announces in a goroutine tracked by loaders when it is a new one. resp is not used after it returns.
+func (c *Client) handleSearchResponse(ctx context.Context, deviceType string, seen *seenDevices, from net.Addr, resp []byte, results chan<- IGD, loaders *sync.WaitGroup) {
+	log := c.logger()
+	if log.Enabled(ctx, slog.LevelDebug) {
+		log.Debug("Handling UPnP response", "response", string(resp))
 	}
 
-	reader := bufio.NewReader(bytes.NewBuffer(resp[:length]))
-	request := &http.Request{}
-	response, err := http.ReadResponse(reader, request)
+	r, err := parseSearchResponse(resp)
 	if err != nil {
-		l.Println(err)
+		log.Warn("Invalid UPnP response", "err", err)
 		return
 	}
 
-	respondingDeviceType := response.Header.Get("St")
-	if respondingDeviceType != deviceType {
-		l.Println("Unrecognized UPnP device of type " + respondingDeviceType)
+	respondingDeviceType := r.st
+	if deviceType == "" && isIGDType(respondingDeviceType) {
+		deviceType = respondingDeviceType
+	}
+	if respondingDeviceType != deviceType && !c.quirksFor("", "", r.server).IgnoreSearchTarget {
+		log.Info("Unrecognized UPnP device", "type", respondingDeviceType)
 		return
 	}
 
-	deviceDescriptionLocation := response.Header.Get("Location")
-	if deviceDescriptionLocation == "" {
-		l.Println("Invalid IGD response: no location specified.")
+	deviceDescriptionLocation := r.location
+	log = log.With("url", deviceDescriptionLocation)
+	deviceUSN := r.usn
+	deviceUUID := r.uuid
+	if !uuidPattern.MatchString(deviceUUID) {
+		if err := c.violation(log, "Device UUID is not an RFC 4122 UUID", "device", deviceUUID); err != nil {
+			log.Warn("Invalid UPnP response", "err", err)
+			return
+		}
+	}
+	log = log.With("device", deviceUUID)
+
+	// Don't re-add devices that are already known, e.g. because they sent several responses
+	if !seen.claim(deviceUUID) {
+		log.Debug("Ignoring known device")
 		return
 	}
 
-	deviceDescriptionURL, err := url.Parse(deviceDescriptionLocation)
+	loaders.Add(1)
+	go func() {
+		defer loaders.Done()
+
+		igd, shared, err := seen.loadOnce(deviceDescriptionLocation, func() (*IGD, error) {
+			return c.loadIGD(ctx, log, deviceDescriptionLocation, deviceUUID, c.searchScope(from))
+		})
+		if err != nil {
+			if !shared {
+				log.Warn("Loading device failed", "err", err)
+			}
+			// Let another response of the device have a go.
+			seen.release(deviceUUID)
+			return
+		}
+		if shared {
+			log.Debug("Ignoring device with an already loaded description")
+			return
+		}
+		if !c.deviceFilter().Allows(igd) {
+			log.Info("Ignoring device ruled out by the device filter", "name", igd.friendlyName)
+			return
+		}
+
+		igd.usn = deviceUSN
+		igd.bootID = r.bootID
+		if igd.server == "" {
+			igd.server = strings.TrimSpace(r.server)
+		}
+
+		// Sent also once ctx is cancelled, as the discovery still returns the devices
+		// loaded, see Discovery.Flushed. The receivers read until the results are closed.
+		results <- *igd
+
+		log.Debug("Finished handling of UPnP response")
+	}()
+}
+
+// The headers of a response to a search request.
+type searchResponse struct {
+	st, location, usn, uuid, server string
+	bootID                          int
+}
 
+// Parse a response to a search request, which comes from anyone on the network. Its
+// location must be an absolute HTTP URL and its USN must carry a device UUID.
+func parseSearchResponse(resp []byte) (searchResponse, error) {
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), &http.Request{})
 	if err != nil {
-		l.Println("Invalid IGD location: " + err.Error())
+		return searchResponse{}, err
 	}
+	response.Body.Close()
 
-	deviceUSN := response.Header.Get("USN")
-	if deviceUSN == "" {
-		l.Println("Invalid IGD response: USN not specified.")
-		return
+	r := searchResponse{
+		st:       strings.TrimSpace(response.Header.Get("St")),
+		location: strings.TrimSpace(response.Header.Get("Location")),
+		usn:      strings.TrimSpace(response.Header.Get("USN")),
+		server:   response.Header.Get("Server"),
+	}
+	r.bootID, _ = strconv.Atoi(strings.TrimSpace(response.Header.Get("BOOTID.UPNP.ORG")))
+	if r.location == "" {
+		return r, errors.New("no location specified")
+	}
+	if u, err := url.Parse(r.location); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return r, fmt.Errorf("invalid location %q", r.location)
+	}
+	if r.usn == "" {
+		return r, errors.New("USN not specified")
+	}
+	if r.uuid = parseUUID(r.usn); r.uuid == "" {
+		return r, fmt.Errorf("no device UUID in USN %q", r.usn)
+	}
+	return r, nil
+}
+
+var uuidPattern = regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$")
+
+// Parse the UUID from a USN like uuid:<UUID>::urn:schemas-upnp-org:device:InternetGatewayDevice:1,
+// or from a UDN like uuid:<UUID>. The uuid: prefix may be in any case or missing, and the
+// UUID does not have to be an RFC 4122 one, as not all devices use those.
+func parseUUID(usn string) string {
+	id, _, _ := strings.Cut(strings.TrimSpace(usn), "::")
+	if len(id) >= 5 && strings.EqualFold(id[:5], "uuid:") {
+		id = id[5:]
 	}
+	return strings.TrimSpace(id)
+}
 
-	deviceUUID := strings.TrimLeft(strings.Split(deviceUSN, "::")[0], "uuid:")
-	matched, err := regexp.MatchString("[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}", deviceUUID)
-	if !matched {
-		l.Println("Invalid IGD response: invalid device UUID", deviceUUID, "(continuing anyway)")
+// Load the InternetGatewayDevice described at location, without discovering it first.
+// This is useful when SSDP is blocked or the location is already known.
+func (c *Client) LoadIGD(ctx context.Context, location string) (*IGD, error) {
+	igd, err := c.loadIGD(ctx, c.logger().With("url", location), location, "", c.locationScope())
+	if err != nil {
+		return nil, err
+	}
+	if !c.deviceFilter().Allows(igd) {
+		return nil, ErrDeviceNotAllowed
+	}
+	return igd, nil
+}
+
+// Fetch and parse the device description at location. The UUID is taken from the
+// description when the caller does not know it from the device's search response.
+// The location and the URLs of the services must point to addresses in scope, any when nil.
+func (c *Client) loadIGD(ctx context.Context, log *slog.Logger, location, uuid string, scope addressScope) (*IGD, error) {
+	deviceDescriptionURL, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if err := scope.check(ctx, location); err != nil {
+		return nil, err
 	}
 
-	// Don't re-add devices that are already known
-	for _, knownDevice := range knownDevices {
-		if deviceUUID == knownDevice.uuid {
-			if Debug {
-				l.Println("Ignoring known device with UUID " + deviceUUID)
+	// Note the local end of the connection the description is fetched over, which
+	// tells our IP number on the network used to reach the IGD, also when the
+	// HTTP client pins an interface or source address.
+	// The remote ends are checked against the scope too, as the host may resolve to
+	// other addresses by the time it is connected to.
+	var connLocalIP string
+	var connRemoteIPs []net.IP
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+				connLocalIP = addr.IP.String()
 			}
-			return
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP != nil {
+				connRemoteIPs = append(connRemoteIPs, addr.IP)
+			}
+		},
+	}
+	// Follow a few redirects, within scope, and resolve the URLs of the description
+	// against the one it was served from.
+	finalURL := deviceDescriptionURL
+	redirects := func(next *http.Request, via []*http.Request) error {
+		if len(via) > maxDescriptionRedirects {
+			return fmt.Errorf("upnp: stopped after %d redirects", maxDescriptionRedirects)
 		}
+		if err := scope.check(next.Context(), next.URL.String()); err != nil {
+			return err
+		}
+		log.Debug("Following redirect of device description", "to", next.URL.Redacted())
+		finalURL = next.URL
+		return nil
 	}
-
-	response, err = http.Get(deviceDescriptionLocation)
+	reqCtx := withRedirectPolicy(httptrace.WithClientTrace(ctx, trace), redirects)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", location, nil)
 	if err != nil {
-		l.Println(err)
-		return
+		return nil, err
 	}
-	defer response.Body.Close()
+	c.setHeaders(req)
 
-	if response.StatusCode >= 400 {
-		l.Println(errors.New(response.Status))
-		return
+	start := time.Now()
+	description, header, err := c.get(log, uuid, req)
+	if err != nil {
+		return nil, err
 	}
-
+	elapsed := time.Since(start)
+	if scope != nil && !isProxied(c.httpClient(), req) {
+		for _, ip := range connRemoteIPs {
+			if !scope(ip) {
+				return nil, fmt.Errorf("upnp: refusing %s: %w (connected to %s)", location, ErrPublicAddress, ip)
+			}
+		}
+	}
+	server := strings.TrimSpace(header.Get("Server"))
 	var upnpRoot upnpRoot
-	err = xml.NewDecoder(response.Body).Decode(&upnpRoot)
+	err = c.unmarshalDescription(log, description, &upnpRoot)
 	if err != nil {
-		l.Println(err)
-		return
+		return nil, err
+	}
+	if err := c.validateDescription(log, upnpRoot); err != nil {
+		return nil, err
+	}
+
+	// Some devices embed the IGD under a root device of a vendor specific type.
+	device := findIGD(upnpRoot.Device)
+
+	if uuid == "" {
+		uuid = parseUUID(device.UDN)
+		log = log.With("device", uuid)
 	}
 
-	services, err := getServiceDescriptions(deviceDescriptionLocation, upnpRoot.Device)
+	baseURL := descriptionBaseURL(log, finalURL, upnpRoot.URLBase)
+	igd := &IGD{}
+	setMetadata(log, igd, baseURL, upnpRoot.Device, device)
+
+	quirks := c.quirksFor(igd.manufacturer, igd.modelName, server)
+	if quirks.any() {
+		log.Debug("Applying device quirks", "quirks", quirks)
+	}
+	if quirks.RootRelativeURLs {
+		root := *baseURL
+		root.Path, root.RawPath = "/", ""
+		baseURL = &root
+	}
+	services, err := getServiceDescriptions(log, baseURL, device)
 	if err != nil {
-		l.Println(err)
-		return
+		return nil, err
+	}
+
+	interfaces := getInterfaceConfigServices(log, baseURL, device)
+	firewalls := getFirewallServices(log, baseURL, device)
+	protections := getDeviceProtectionServices(log, baseURL, upnpRoot.Device, device)
+	for _, list := range [][]IGDService{services, interfaces, firewalls, protections} {
+		for _, s := range list {
+			for _, u := range []string{s.serviceURL, s.eventSubURL, s.scpdURL} {
+				if err := scope.check(ctx, u); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
 	// Figure out our IP number, on the network used to reach the IGD.
-	// We do this in a fairly roundabout way by connecting to the IGD and
-	// checking the address of the local end of the socket. I'm open to
-	// suggestions on a better way to do this...
-	localIPAddress, err := localIP(deviceDescriptionURL, intranet)
+	// When the HTTP client did not use a TCP connection we can inspect (e.g. it
+	// goes through a proxy), we do this in a fairly roundabout way by connecting
+	// to the IGD and checking the address of the local end of the socket.
+	if isProxied(c.httpClient(), req) {
+		connLocalIP = ""
+	}
+	localIPAddress, err := c.localIPFor(deviceDescriptionURL, connLocalIP)
 	if err != nil {
-		l.Println(err)
-		return
+		return nil, err
 	}
 
-	igd := IGD{
-		uuid:           deviceUUID,
-		friendlyName:   upnpRoot.Device.FriendlyName,
-		url:            deviceDescriptionURL,
-		services:       services,
-		localIPAddress: localIPAddress,
+	igd.uuid = uuid
+	igd.friendlyName = device.FriendlyName
+	igd.deviceType = device.DeviceType
+	igd.url = deviceDescriptionURL
+	igd.services = services
+	igd.interfaces = interfaces
+	igd.firewalls = firewalls
+	igd.protections = protections
+	igd.localIPAddress = localIPAddress
+	igd.quirks = quirks
+	igd.server = server
+	igd.latency = &latencies{description: elapsed}
+	igd.statuses = &statusCache{}
+	igd.rawDescription = description
+	for _, list := range [][]IGDService{igd.services, igd.interfaces, igd.firewalls, igd.protections} {
+		for i := range list {
+			list[i].uuid = uuid
+			list[i].localIPAddress = localIPAddress
+			list[i].quirks = quirks
+		}
 	}
+	igd.UseClient(c)
 
-	resultChannel <- igd
+	return igd, nil
+}
 
-	if Debug {
-		l.Println("Finished handling of UPnP response.")
+// Whether the HTTP client sends the request through a proxy.
+func isProxied(client *http.Client, req *http.Request) bool {
+	t, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		t, ok = http.DefaultTransport.(*http.Transport), true
+	}
+	if !ok || t.Proxy == nil {
+		return false
 	}
+	u, err := t.Proxy(req)
+	return err == nil && u != nil
 }
 
-func localIP(url *url.URL, intranet *string) (string, error) {
-	if *intranet == "" {
+func localIP(url *url.URL, intranet string) (string, error) {
+	if intranet == "" {
 		conn, err := net.Dial("tcp", url.Host)
 		if err != nil {
 			return "", err
@@ -352,7 +692,34 @@ func localIP(url *url.URL, intranet *string) (string, error) {
 		}
 		return localIPAddress, nil
 	}
-	return *intranet, nil
+	return intranet, nil
+}
+
+// Whether the device type is InternetGatewayDevice:1 or InternetGatewayDevice:2.
+func isIGDType(deviceType string) bool {
+	return deviceType == "urn:schemas-upnp-org:device:InternetGatewayDevice:1" ||
+		deviceType == "urn:schemas-upnp-org:device:InternetGatewayDevice:2"
+}
+
+// Find the InternetGatewayDevice in the device tree of a description, searching depth-first
+// from the root. The root is returned when there is none, to be rejected as not an IGD.
+func findIGD(root upnpDevice) upnpDevice {
+	if d, ok := findIGDDevice(root); ok {
+		return d
+	}
+	return root
+}
+
+func findIGDDevice(d upnpDevice) (upnpDevice, bool) {
+	if isIGDType(d.DeviceType) {
+		return d, true
+	}
+	for _, child := range d.Devices {
+		if igd, ok := findIGDDevice(child); ok {
+			return igd, true
+		}
+	}
+	return upnpDevice{}, false
 }
 
 func getChildDevices(d upnpDevice, deviceType string) []upnpDevice {
@@ -375,41 +742,41 @@ func getChildServices(d upnpDevice, serviceType string) []upnpService {
 	return result
 }
 
-func getServiceDescriptions(rootURL string, device upnpDevice) ([]IGDService, error) {
+func getServiceDescriptions(log *slog.Logger, baseURL *url.URL, device upnpDevice) ([]IGDService, error) {
 	var result []IGDService
 
 	if device.DeviceType == "urn:schemas-upnp-org:device:InternetGatewayDevice:1" {
-		descriptions := getIGDServices(rootURL, device,
+		descriptions := getIGDServices(log, baseURL, device,
 			"urn:schemas-upnp-org:device:WANDevice:1",
 			"urn:schemas-upnp-org:device:WANConnectionDevice:1",
 			[]string{"urn:schemas-upnp-org:service:WANIPConnection:1", "urn:schemas-upnp-org:service:WANPPPConnection:1"})
 
 		result = append(result, descriptions...)
 	} else if device.DeviceType == "urn:schemas-upnp-org:device:InternetGatewayDevice:2" {
-		descriptions := getIGDServices(rootURL, device,
+		descriptions := getIGDServices(log, baseURL, device,
 			"urn:schemas-upnp-org:device:WANDevice:2",
 			"urn:schemas-upnp-org:device:WANConnectionDevice:2",
 			[]string{"urn:schemas-upnp-org:service:WANIPConnection:2", "urn:schemas-upnp-org:service:WANPPPConnection:1"})
 
 		result = append(result, descriptions...)
 	} else {
-		return result, errors.New("[" + rootURL + "] Malformed root device description: not an InternetGatewayDevice.")
+		return result, errors.New("[" + baseURL.String() + "] Malformed root device description: not an InternetGatewayDevice.")
 	}
 
 	if len(result) < 1 {
-		return result, errors.New("[" + rootURL + "] Malformed device description: no compatible service descriptions found.")
+		return result, errors.New("[" + baseURL.String() + "] Malformed device description: no compatible service descriptions found.")
 	} else {
 		return result, nil
 	}
 }
 
-func getIGDServices(rootURL string, device upnpDevice, wanDeviceURN string, wanConnectionURN string, serviceURNs []string) []IGDService {
+func getIGDServices(log *slog.Logger, baseURL *url.URL, device upnpDevice, wanDeviceURN string, wanConnectionURN string, serviceURNs []string) []IGDService {
 	var result []IGDService
 
 	devices := getChildDevices(device, wanDeviceURN)
 
 	if len(devices) < 1 {
-		l.Println("[" + rootURL + "] Malformed InternetGatewayDevice description: no WANDevices specified.")
+		log.Warn("Malformed InternetGatewayDevice description: no WANDevices specified")
 		return result
 	}
 
@@ -417,32 +784,74 @@ func getIGDServices(rootURL string, device upnpDevice, wanDeviceURN string, wanC
 		connections := getChildDevices(device, wanConnectionURN)
 
 		if len(connections) < 1 {
-			l.Println("[" + rootURL + "] Malformed " + wanDeviceURN + " description: no WANConnectionDevices specified.")
+			log.Warn("Malformed WANDevice description: no WANConnectionDevices specified", "type", wanDeviceURN)
 		}
 
 		for _, connection := range connections {
 			for _, serviceURN := range serviceURNs {
 				services := getChildServices(connection, serviceURN)
 
-				if len(services) < 1 && Debug {
-					l.Println("[" + rootURL + "] No services of type " + serviceURN + " found on connection.")
+				if len(services) < 1 {
+					log.Debug("No services of type found on connection", "type", serviceURN)
 				}
 
 				for _, service := range services {
 					if len(service.ControlURL) == 0 {
-						l.Println("[" + rootURL + "] Malformed " + service.ServiceType + " description: no control URL.")
+						log.Debug("Ignoring service without control URL", "type", service.ServiceType)
+					} else if s, err := newIGDService(log, baseURL, service); err != nil {
+						log.Debug("Ignoring service with invalid URL", "type", service.ServiceType, "err", err)
 					} else {
-						u, _ := url.Parse(rootURL)
-						replaceRawPath(u, service.ControlURL)
+						result = append(result, s)
+					}
+				}
+			}
+		}
+	}
+
+	return result
+}
 
-						if Debug {
-							l.Println("[" + rootURL + "] Found " + service.ServiceType + " with URL " + u.String())
-						}
+// Search the WANDevices of an IGD for WANCommonInterfaceConfig services, which report WAN link properties and traffic counters.
+func getInterfaceConfigServices(log *slog.Logger, baseURL *url.URL, device upnpDevice) []IGDService {
+	var result []IGDService
 
-						service := IGDService{serviceID: service.ServiceID, serviceURL: u.String(), serviceURN: service.ServiceType}
+	wanDeviceURN := "urn:schemas-upnp-org:device:WANDevice:1"
+	if device.DeviceType == "urn:schemas-upnp-org:device:InternetGatewayDevice:2" {
+		wanDeviceURN = "urn:schemas-upnp-org:device:WANDevice:2"
+	}
 
-						result = append(result, service)
-					}
+	for _, device := range getChildDevices(device, wanDeviceURN) {
+		for _, service := range getChildServices(device, "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1") {
+			if len(service.ControlURL) == 0 {
+				log.Debug("Ignoring service without control URL", "type", service.ServiceType)
+			} else if s, err := newIGDService(log, baseURL, service); err != nil {
+				log.Debug("Ignoring service with invalid URL", "type", service.ServiceType, "err", err)
+			} else {
+				result = append(result, s)
+			}
+		}
+	}
+
+	return result
+}
+
+// Search the WANConnectionDevices of an IGD:2 for WANIPv6FirewallControl services, which manage IPv6 pinholes.
+func getFirewallServices(log *slog.Logger, baseURL *url.URL, device upnpDevice) []IGDService {
+	var result []IGDService
+
+	if device.DeviceType != "urn:schemas-upnp-org:device:InternetGatewayDevice:2" {
+		return result
+	}
+
+	for _, device := range getChildDevices(device, "urn:schemas-upnp-org:device:WANDevice:2") {
+		for _, connection := range getChildDevices(device, "urn:schemas-upnp-org:device:WANConnectionDevice:2") {
+			for _, service := range getChildServices(connection, "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1") {
+				if len(service.ControlURL) == 0 {
+					log.Debug("Ignoring service without control URL", "type", service.ServiceType)
+				} else if s, err := newIGDService(log, baseURL, service); err != nil {
+					log.Debug("Ignoring service with invalid URL", "type", service.ServiceType, "err", err)
+				} else {
+					result = append(result, s)
 				}
 			}
 		}
@@ -451,82 +860,233 @@ func getIGDServices(rootURL string, device upnpDevice, wanDeviceURN string, wanC
 	return result
 }
 
-func replaceRawPath(u *url.URL, rp string) {
-	asURL, err := url.Parse(rp)
-	if err != nil {
-		return
-	} else if asURL.IsAbs() {
-		u.Path = asURL.Path
-		u.RawQuery = asURL.RawQuery
-	} else {
-		var p, q string
-		fs := strings.Split(rp, "?")
-		p = fs[0]
-		if len(fs) > 1 {
-			q = fs[1]
+// Search the root device and the IGD of an IGD:2 for DeviceProtection services, which lock
+// actions behind authentication.
+func getDeviceProtectionServices(log *slog.Logger, baseURL *url.URL, root, device upnpDevice) []IGDService {
+	var result []IGDService
+
+	if device.DeviceType != "urn:schemas-upnp-org:device:InternetGatewayDevice:2" {
+		return result
+	}
+
+	devices := []upnpDevice{device}
+	if root.UDN != device.UDN {
+		devices = append(devices, root)
+	}
+	for _, device := range devices {
+		for _, service := range getChildServices(device, DeviceProtectionURN) {
+			if len(service.ControlURL) == 0 {
+				log.Debug("Ignoring service without control URL", "type", service.ServiceType)
+			} else if s, err := newIGDService(log, baseURL, service); err != nil {
+				log.Debug("Ignoring service with invalid URL", "type", service.ServiceType, "err", err)
+			} else {
+				result = append(result, s)
+			}
 		}
+	}
+
+	return result
+}
 
-		if p[0] == '/' {
-			u.Path = p
-		} else {
-			u.Path += p
+func newIGDService(log *slog.Logger, baseURL *url.URL, service upnpService) (IGDService, error) {
+	result := IGDService{serviceID: service.ServiceID, serviceURN: service.ServiceType}
+	for _, u := range []struct {
+		ref    string
+		target *string
+	}{
+		{service.ControlURL, &result.serviceURL},
+		{service.EventSubURL, &result.eventSubURL},
+		{service.SCPDURL, &result.scpdURL},
+	} {
+		if u.ref == "" {
+			continue
+		}
+		ref, err := url.Parse(strings.TrimSpace(u.ref))
+		if err != nil {
+			return result, err
 		}
-		u.RawQuery = q
+		*u.target = baseURL.ResolveReference(ref).String()
 	}
+
+	log.Debug("Found service", "type", service.ServiceType, "control", result.serviceURL)
+
+	return result, nil
 }
 
-func soapRequest(url, service, function, message string) ([]byte, error) {
+// The URL the URLs in a device description are relative to: its URLBase when it has a
+// valid one, which is deprecated since UPnP 1.1 but still used by some devices, and the
+// location it was fetched from otherwise.
+func descriptionBaseURL(log *slog.Logger, location *url.URL, urlBase string) *url.URL {
+	urlBase = strings.TrimSpace(urlBase)
+	if urlBase == "" {
+		return location
+	}
+	base, err := url.Parse(urlBase)
+	if err != nil || !base.IsAbs() || base.Host == "" {
+		log.Debug("Ignoring invalid URLBase of device description", "base", urlBase)
+		return location
+	}
+	return base
+}
+
+// Perform a SOAP request on the service, retrying it as the client's RetryPolicy allows.
+func (s *IGDService) soapRequest(ctx context.Context, function, message string) (resp []byte, err error) {
+	url := s.serviceURL
 	tpl := `<?xml version="1.0" ?>
 	<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
 	<s:Body>%s</s:Body>
 	</s:Envelope>
 `
-	var resp []byte
+	start := time.Now()
+	defer func() {
+		s.client.metrics().SOAPRequest(s.uuid, function, time.Since(start), err)
+		if OnSOAPRequest != nil {
+			OnSOAPRequest(function, time.Since(start), err)
+		}
+	}()
+	defer func() {
+		s.audit(start, function, message, err)
+	}()
 
 	body := fmt.Sprintf(tpl, message)
+	log := s.logger().With("action", function, "url", url)
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	err = s.client.retryPolicy().do(ctx, log, func() error {
+		resp, err = s.soapAttempt(ctx, log, function, body)
+		return err
+	})
+	return resp, err
+}
+
+// Perform a single attempt of a SOAP request on the service.
+func (s *IGDService) soapAttempt(ctx context.Context, log *slog.Logger, function, body string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.client.requestTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.serviceURL, strings.NewReader(body))
 	if err != nil {
-		return resp, err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
-	req.Header.Set("User-Agent", "syncthing/1.0")
-	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, service, function))
-	req.Header.Set("Connection", "Close")
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, s.serviceURN, function))
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Pragma", "no-cache")
+	s.client.setHeaders(req)
 
-	if Debug {
-		l.Println("SOAP Request URL: " + url)
-		l.Println("SOAP Action: " + req.Header.Get("SOAPAction"))
-		l.Println("SOAP Request:\n\n" + body)
+	sr := &SOAPRequest{Service: s, Quirks: s.quirks, Action: function, Header: req.Header, Body: []byte(body)}
+	if middleware := s.client.middleware(); len(middleware) > 0 {
+		for _, m := range middleware {
+			if err := m.OnSOAPRequest(ctx, sr); err != nil {
+				return nil, err
+			}
+		}
+		if string(sr.Body) != body {
+			body = string(sr.Body)
+			if req, err = http.NewRequestWithContext(ctx, "POST", s.serviceURL, strings.NewReader(body)); err != nil {
+				return nil, err
+			}
+		}
+		req.Header = sr.Header
 	}
 
-	r, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return resp, err
+	if s.rate != nil {
+		if err := s.rate.wait(ctx); err != nil {
+			return nil, err
+		}
 	}
+	if s.limiter != nil {
+		select {
+		case s.limiter <- struct{}{}:
+			defer func() { <-s.limiter }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	log.Debug("SOAP request", "body", body)
+	s.client.trace(TraceRecord{Kind: TraceSOAP, Outgoing: true, Addr: s.serviceURL, Device: s.uuid, Action: function}, []byte(body))
 
-	resp, _ = ioutil.ReadAll(r.Body)
-	if Debug {
-		l.Println("SOAP Response:\n\n" + string(resp) + "\n")
+	start := time.Now()
+	r, err := s.client.do(s.uuid, req)
+	if err != nil {
+		log.Debug("SOAP request failed", "err", err)
+		return nil, s.client.soapResponse(ctx, sr, &SOAPResponse{Err: err})
 	}
 
+	resp, err := s.client.readResponse(r)
 	r.Body.Close()
+	if err == nil {
+		s.latency.observeSOAP(time.Since(start))
+	}
+	if len(s.client.middleware()) > 0 {
+		sresp := &SOAPResponse{Status: r.StatusCode, Header: r.Header, Body: resp, Err: err}
+		err = s.client.soapResponse(ctx, sr, sresp)
+		resp = sresp.Body
+	}
+	s.client.trace(TraceRecord{Kind: TraceSOAP, Addr: s.serviceURL, Device: s.uuid, Action: function}, resp)
+	if err != nil {
+		log.Debug("SOAP response failed", "status", r.StatusCode, "err", err)
+		return resp, err
+	}
+	log.Debug("SOAP response", "status", r.StatusCode, "body", string(resp))
 
 	if r.StatusCode >= 400 {
-		return resp, errors.New(function + ": " + r.Status)
+		if soapErr := parseSOAPFault(function, resp); soapErr != nil {
+			return resp, soapErr
+		}
+		return resp, &statusError{r.StatusCode, function + ": " + r.Status}
 	}
 
 	return resp, nil
 }
 
+type soapResponseEnvelope struct {
+	XMLName xml.Name
+	Body    soapResponseBody `xml:"Body"`
+}
+
+type soapResponseBody struct {
+	XMLName  xml.Name
+	Response soapActionResponse `xml:",any"`
+}
+
+type soapActionResponse struct {
+	XMLName   xml.Name
+	Arguments []soapArgument `xml:",any"`
+}
+
+type soapArgument struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// Perform a SOAP request and collect the output arguments of the action response by name.
+func (s *IGDService) soapAction(ctx context.Context, function, message string) (map[string]string, error) {
+	response, err := s.soapRequest(ctx, function, message)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &soapResponseEnvelope{}
+	err = xml.Unmarshal(response, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, arg := range envelope.Body.Response.Arguments {
+		result[arg.XMLName.Local] = strings.TrimSpace(arg.Value)
+	}
+
+	return result, nil
+}
+
 // func (i *IGD) GetPortMappings() {
 // 	for _, service := range n.services {
 
 // 		soapRequest(url, service, function, message)
 
-// 		_, err := soapRequest(s.serviceURL, s.serviceURN, "AddPortMapping", body)
+// 		_, err := s.soapRequest(ctx, "AddPortMapping", body)
 // 		if err != nil {
 // 			l.Printf("GetPortMappings error: %s", err)
 // 			continue
@@ -537,30 +1097,133 @@ func soapRequest(url, service, function, message string) ([]byte, error) {
 
 // Add a port mapping to all relevant services on the specified InternetGatewayDevice.
 // Port mapping will fail and return an error if action is fails for _any_ of the relevant services.
-// For this reason, it is generally better to configure port mapping for each individual service instead.
-func (n *IGD) AddPortMapping(protocol Protocol, externalPort, internalPort int, description string, timeout int) error {
-	for _, service := range n.services {
-		err := service.AddPortMapping(n.localIPAddress, protocol, externalPort, internalPort, description, timeout)
-		if err != nil {
+// For this reason, it is generally better to configure port mapping for each individual service instead,
+// or to set the ServicePolicy of the Client to PolicyPreferredService.
+func (n *IGD) AddPortMapping(ctx context.Context, protocol Protocol, externalPort, internalPort int, description string, timeout int) error {
+	return n.AddClientPortMapping(ctx, n.localIPAddress, protocol, externalPort, internalPort, description, timeout)
+}
+
+// Add the port mapping m to the relevant services of the InternetGatewayDevice (see AddPortMapping).
+// The InternalClient defaults to the local IP address, ExpiresAt is ignored.
+func (n *IGD) Add(ctx context.Context, m PortMapping) error {
+	if m.InternalClient == "" {
+		m.InternalClient = n.localIPAddress
+	}
+	services, err := n.targetServices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := service.Add(ctx, m); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Add the port mapping m to the relevant services of the InternetGatewayDevice like Add, but
+// let the router pick another external port when ExternalPort is taken, with
+// AddAnyPortMapping on the first service if it supports it, see IGDService.AddAny. The other
+// services map the port picked. Devices without AddAnyPortMapping, which IGD:1 lacks, get
+// AddPortMapping for ExternalPort instead. Returns the external port mapped and the action
+// which mapped it on the first service, "AddAnyPortMapping" or "AddPortMapping".
+func (n *IGD) AddAny(ctx context.Context, m PortMapping) (int, string, error) {
+	if m.InternalClient == "" {
+		m.InternalClient = n.localIPAddress
+	}
+	services, err := n.targetServices(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	action := "AddPortMapping"
+	for i, service := range services {
+		if i == 0 && service.Supports("AddAnyPortMapping") {
+			port, err := service.AddAny(ctx, m)
+			if err == nil {
+				m.ExternalPort, action = port, "AddAnyPortMapping"
+				continue
+			}
+			if !IsErrorCode(err, ErrCodeInvalidAction, ErrCodeOptionalActionNotImplemented) {
+				return 0, "", err
+			}
+			service.logger().Debug("AddAnyPortMapping not implemented, using AddPortMapping", "err", err)
+		}
+		if err := service.Add(ctx, m); err != nil {
+			return 0, "", err
+		}
+	}
+	return m.ExternalPort, action, nil
+}
+
+// Add a port mapping to another host of the local network to all relevant services on the specified InternetGatewayDevice,
+// or to its preferred service with PolicyPreferredService.
+// Many routers only allow hosts to add mappings to themselves.
+func (n *IGD) AddClientPortMapping(ctx context.Context, internalClient string, protocol Protocol, externalPort, internalPort int, description string, timeout int) error {
+	return n.AddMapping(ctx, protocol, externalPort, internalPort,
+		WithInternalClient(internalClient), WithDescription(description), WithLease(time.Duration(timeout)*time.Second))
+}
+
 // Delete a port mapping from all relevant services on the specified InternetGatewayDevice.
 // Port mapping will fail and return an error if action is fails for _any_ of the relevant services.
-// For this reason, it is generally better to configure port mapping for each individual service instead.
-func (n *IGD) DeletePortMapping(protocol Protocol, externalPort int) error {
-	for _, service := range n.services {
-		err := service.DeletePortMapping(protocol, externalPort)
-		if err != nil {
+// For this reason, it is generally better to configure port mapping for each individual service instead,
+// or to set the ServicePolicy of the Client to PolicyPreferredService.
+func (n *IGD) DeletePortMapping(ctx context.Context, protocol Protocol, externalPort int) error {
+	return n.Delete(ctx, PortMapping{Protocol: protocol, ExternalPort: externalPort})
+}
+
+// Delete the port mapping with the remote host, protocol and external port of m from the relevant services
+// of the InternetGatewayDevice (see DeletePortMapping).
+func (n *IGD) Delete(ctx context.Context, m PortMapping) error {
+	services, err := n.targetServices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := service.Delete(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enable the port mapping of an external port on the relevant services of the InternetGatewayDevice,
+// so the router forwards traffic for a mapping added disabled or paused with DisableMapping.
+func (n *IGD) EnableMapping(ctx context.Context, protocol Protocol, externalPort int) error {
+	return n.setMappingEnabled(ctx, protocol, externalPort, true)
+}
+
+// Disable the port mapping of an external port on the relevant services of the InternetGatewayDevice,
+// which pauses it without deleting it.
+func (n *IGD) DisableMapping(ctx context.Context, protocol Protocol, externalPort int) error {
+	return n.setMappingEnabled(ctx, protocol, externalPort, false)
+}
+
+func (n *IGD) setMappingEnabled(ctx context.Context, protocol Protocol, externalPort int, enabled bool) error {
+	services, err := n.targetServices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := service.SetMappingEnabled(ctx, protocol, externalPort, enabled); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Query the first relevant service of the specified InternetGatewayDevice for its external IP address,
+// or its preferred service with PolicyPreferredService.
+func (n *IGD) GetExternalIPAddress(ctx context.Context) (net.IP, error) {
+	services, err := n.targetServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, ErrNoWANConnection
+	}
+	return services[0].GetExternalIPAddress(ctx)
+}
+
 type soapGetExternalIPAddressResponseEnvelope struct {
 	XMLName xml.Name
 	Body    soapGetExternalIPAddressResponseBody `xml:"Body"`
@@ -576,53 +1239,307 @@ type getExternalIPAddressResponse struct {
 }
 
 // Add a port mapping to the specified IGD service.
-func (s *IGDService) AddPortMapping(localIPAddress string, protocol Protocol, externalPort, internalPort int, description string, timeout int) error {
+func (s *IGDService) AddPortMapping(ctx context.Context, localIPAddress string, protocol Protocol, externalPort, internalPort int, description string, timeout int) error {
+	return s.Add(ctx, PortMapping{
+		ExternalPort:   externalPort,
+		Protocol:       protocol,
+		InternalPort:   internalPort,
+		InternalClient: localIPAddress,
+		Enabled:        true,
+		Description:    description,
+		Lease:          time.Duration(timeout) * time.Second,
+	})
+}
+
+// Add the port mapping m to the IGD service. The InternalClient defaults to the local IP address,
+// ExpiresAt is ignored.
+func (s *IGDService) Add(ctx context.Context, m PortMapping) error {
+	if m.InternalClient == "" {
+		m.InternalClient = s.localIPAddress
+	}
+	if s.quirks.PermanentLeases {
+		m.Lease = 0
+	}
 	tpl := `<u:AddPortMapping xmlns:u="%s">
-	<NewRemoteHost></NewRemoteHost>
+	<NewRemoteHost>%s</NewRemoteHost>
 	<NewExternalPort>%d</NewExternalPort>
 	<NewProtocol>%s</NewProtocol>
 	<NewInternalPort>%d</NewInternalPort>
 	<NewInternalClient>%s</NewInternalClient>
-	<NewEnabled>1</NewEnabled>
+	<NewEnabled>%d</NewEnabled>
 	<NewPortMappingDescription>%s</NewPortMappingDescription>
 	<NewLeaseDuration>%d</NewLeaseDuration>
 	</u:AddPortMapping>`
-	body := fmt.Sprintf(tpl, s.serviceURN, externalPort, protocol, internalPort, localIPAddress, description, timeout)
+	enabled := 0
+	if m.Enabled {
+		enabled = 1
+	}
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(m.RemoteHost), m.ExternalPort, m.Protocol, m.InternalPort,
+		escapeXML(m.InternalClient), enabled, escapeXML(m.Description), int(m.Lease.Seconds()))
 
-	_, err := soapRequest(s.serviceURL, s.serviceURN, "AddPortMapping", body)
+	_, err := s.soapRequest(ctx, "AddPortMapping", body)
 	if err != nil {
 		return err
 	}
 
+	if s.client != nil && s.client.VerifyMappings {
+		return s.verify(ctx, m)
+	}
+
 	return nil
 }
 
-// Delete a port mapping from the specified IGD service.
-func (s *IGDService) DeletePortMapping(protocol Protocol, externalPort int) error {
-	tpl := `<u:DeletePortMapping xmlns:u="%s">
-	<NewRemoteHost></NewRemoteHost>
+// Add the port mapping m to the IGD service with AddAnyPortMapping (IGD:2), which takes its
+// ExternalPort as a preference: when the port is taken, the router maps another one, which
+// is returned. The InternalClient defaults to the local IP address, ExpiresAt is ignored.
+func (s *IGDService) AddAny(ctx context.Context, m PortMapping) (int, error) {
+	if m.InternalClient == "" {
+		m.InternalClient = s.localIPAddress
+	}
+	if s.quirks.PermanentLeases {
+		m.Lease = 0
+	}
+	tpl := `<u:AddAnyPortMapping xmlns:u="%s">
+	<NewRemoteHost>%s</NewRemoteHost>
 	<NewExternalPort>%d</NewExternalPort>
 	<NewProtocol>%s</NewProtocol>
-	</u:DeletePortMapping>`
-	body := fmt.Sprintf(tpl, s.serviceURN, externalPort, protocol)
+	<NewInternalPort>%d</NewInternalPort>
+	<NewInternalClient>%s</NewInternalClient>
+	<NewEnabled>%d</NewEnabled>
+	<NewPortMappingDescription>%s</NewPortMappingDescription>
+	<NewLeaseDuration>%d</NewLeaseDuration>
+	</u:AddAnyPortMapping>`
+	enabled := 0
+	if m.Enabled {
+		enabled = 1
+	}
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(m.RemoteHost), m.ExternalPort, m.Protocol, m.InternalPort,
+		escapeXML(m.InternalClient), enabled, escapeXML(m.Description), int(m.Lease.Seconds()))
+
+	args, err := s.soapAction(ctx, "AddAnyPortMapping", body)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(args["NewReservedPort"])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("upnp: invalid NewReservedPort %q in AddAnyPortMapping response", args["NewReservedPort"])
+	}
+	m.ExternalPort = port
+
+	if s.client != nil && s.client.VerifyMappings {
+		return port, s.verify(ctx, m)
+	}
+	return port, nil
+}
+
+// Check that the port mapping m, just added, is in effect. Some firmwares acknowledge
+// mappings they then silently ignore, or point to another internal client or port.
+func (s *IGDService) verify(ctx context.Context, m PortMapping) error {
+	entry, err := s.getSpecificPortMappingEntry(ctx, m.RemoteHost, m.Protocol, m.ExternalPort)
+	switch {
+	case IsErrorCode(err, ErrCodeNoSuchEntry, ErrCodeNoSuchEntryInArray):
+		return fmt.Errorf("%w: %s %d not found after adding it", ErrMappingNotEffective, m.Protocol, m.ExternalPort)
+	case err != nil:
+		// Not being able to tell is no reason to fail the mapping.
+		s.logger().Warn("Could not verify port mapping", "protocol", m.Protocol, "port", m.ExternalPort, "err", err)
+		return nil
+	case entry.InternalPort != m.InternalPort || !sameHost(entry.InternalClient, m.InternalClient):
+		return fmt.Errorf("%w: %s %d points to %s:%d instead of %s:%d", ErrMappingNotEffective, m.Protocol, m.ExternalPort,
+			entry.InternalClient, entry.InternalPort, m.InternalClient, m.InternalPort)
+	}
+	return nil
+}
+
+// Whether the hosts a and b are the same, comparing IP addresses by value.
+func sameHost(a, b string) bool {
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return strings.EqualFold(a, b)
+}
+
+// A port mapping, to add to or as reported by an IGD service.
+type PortMapping struct {
+	// The remote host traffic is forwarded from, empty for any host.
+	RemoteHost     string
+	ExternalPort   int
+	Protocol       Protocol
+	InternalPort   int
+	InternalClient string
+	// Whether the router forwards traffic for the mapping. A mapping added with Enabled
+	// false is stored but inactive, so callers of Add usually set it.
+	Enabled     bool
+	Description string
+	// The lease of the mapping, zero for a permanent mapping. As reported by
+	// an IGD service, the lease remaining when the mapping was read.
+	Lease time.Duration
+	// When the lease expires, as reported by an IGD service. Zero for permanent
+	// mappings and when adding a mapping.
+	ExpiresAt time.Time
+}
+
+// Set the lease of a mapping read from an IGD service, which reports the remaining lease in seconds.
+func (m *PortMapping) setLease(seconds string) {
+	n, _ := strconv.Atoi(seconds)
+	m.Lease = time.Duration(n) * time.Second
+	if n > 0 {
+		m.ExpiresAt = time.Now().Add(m.Lease)
+	}
+}
+
+// Whether any relevant service of the InternetGatewayDevice supports GENA eventing.
+func (n *IGD) SupportsEventing() bool {
+	for _, service := range n.services {
+		if service.eventSubURL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Query the first relevant service of the specified InternetGatewayDevice for the port mapping of an external port,
+// or its preferred service with PolicyPreferredService.
+func (n *IGD) GetSpecificPortMappingEntry(ctx context.Context, protocol Protocol, externalPort int) (PortMapping, error) {
+	services, err := n.targetServices(ctx)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	if len(services) == 0 {
+		return PortMapping{}, ErrNoWANConnection
+	}
+	return services[0].GetSpecificPortMappingEntry(ctx, protocol, externalPort)
+}
 
-	_, err := soapRequest(s.serviceURL, s.serviceURN, "DeletePortMapping", body)
+// Query the IGD service for the port mapping of an external port.
+func (s *IGDService) GetSpecificPortMappingEntry(ctx context.Context, protocol Protocol, externalPort int) (PortMapping, error) {
+	return s.getSpecificPortMappingEntry(ctx, "", protocol, externalPort)
+}
 
+func (s *IGDService) getSpecificPortMappingEntry(ctx context.Context, remoteHost string, protocol Protocol, externalPort int) (PortMapping, error) {
+	tpl := `<u:GetSpecificPortMappingEntry xmlns:u="%s">
+	<NewRemoteHost>%s</NewRemoteHost>
+	<NewExternalPort>%d</NewExternalPort>
+	<NewProtocol>%s</NewProtocol>
+	</u:GetSpecificPortMappingEntry>`
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(remoteHost), externalPort, protocol)
+
+	args, err := s.soapAction(ctx, "GetSpecificPortMappingEntry", body)
+	if err != nil {
+		return PortMapping{}, err
+	}
+
+	result := PortMapping{
+		RemoteHost:     remoteHost,
+		ExternalPort:   externalPort,
+		Protocol:       protocol,
+		InternalClient: args["NewInternalClient"],
+		Enabled:        args["NewEnabled"] == "1",
+		Description:    args["NewPortMappingDescription"],
+	}
+	result.InternalPort, _ = strconv.Atoi(args["NewInternalPort"])
+	result.setLease(args["NewLeaseDuration"])
+
+	return result, nil
+}
+
+// List the port mappings of all relevant services on the specified InternetGatewayDevice.
+func (n *IGD) GetPortMappings(ctx context.Context) ([]PortMapping, error) {
+	services, err := n.targetServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []PortMapping
+	for _, service := range services {
+		mappings, err := service.GetPortMappings(ctx)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, mappings...)
+	}
+	return result, nil
+}
+
+// List the port mappings of the IGD service by walking its mapping table until the router reports the end of it.
+func (s *IGDService) GetPortMappings(ctx context.Context) ([]PortMapping, error) {
+	var result []PortMapping
+	for i := 0; ; i++ {
+		m, err := s.GetGenericPortMappingEntry(ctx, i)
+		if IsErrorCode(err, ErrCodeSpecifiedArrayIndexInvalid, ErrCodeNoSuchEntryInArray) {
+			// Routers signal the end of the table with an error
+			return result, nil
+		} else if err != nil {
+			return result, err
+		}
+		result = append(result, m)
+	}
+}
+
+// Query the IGD service for the port mapping at an index of its mapping table.
+func (s *IGDService) GetGenericPortMappingEntry(ctx context.Context, index int) (PortMapping, error) {
+	tpl := `<u:GetGenericPortMappingEntry xmlns:u="%s">
+	<NewPortMappingIndex>%d</NewPortMappingIndex>
+	</u:GetGenericPortMappingEntry>`
+	body := fmt.Sprintf(tpl, s.serviceURN, index)
+
+	args, err := s.soapAction(ctx, "GetGenericPortMappingEntry", body)
+	if err != nil {
+		return PortMapping{}, err
+	}
+
+	result := PortMapping{
+		RemoteHost:     args["NewRemoteHost"],
+		Protocol:       Protocol(strings.ToUpper(args["NewProtocol"])),
+		InternalClient: args["NewInternalClient"],
+		Enabled:        args["NewEnabled"] == "1",
+		Description:    args["NewPortMappingDescription"],
+	}
+	result.ExternalPort, _ = strconv.Atoi(args["NewExternalPort"])
+	result.InternalPort, _ = strconv.Atoi(args["NewInternalPort"])
+	result.setLease(args["NewLeaseDuration"])
+
+	return result, nil
+}
+
+// Enable or disable the port mapping of an external port on the IGD service, by adding it again
+// with the rest of its arguments and the lease it has left.
+func (s *IGDService) SetMappingEnabled(ctx context.Context, protocol Protocol, externalPort int, enabled bool) error {
+	m, err := s.GetSpecificPortMappingEntry(ctx, protocol, externalPort)
 	if err != nil {
 		return err
 	}
+	if m.Enabled == enabled {
+		return nil
+	}
+	m.Enabled = enabled
+	return s.Add(ctx, m)
+}
 
-	return nil
+// Delete the port mapping with the remote host, protocol and external port of m from the IGD service.
+func (s *IGDService) Delete(ctx context.Context, m PortMapping) error {
+	tpl := `<u:DeletePortMapping xmlns:u="%s">
+	<NewRemoteHost>%s</NewRemoteHost>
+	<NewExternalPort>%d</NewExternalPort>
+	<NewProtocol>%s</NewProtocol>
+	</u:DeletePortMapping>`
+	body := fmt.Sprintf(tpl, s.serviceURN, escapeXML(m.RemoteHost), m.ExternalPort, m.Protocol)
+
+	_, err := s.soapRequest(ctx, "DeletePortMapping", body)
+	return err
+}
+
+// Delete a port mapping from the specified IGD service.
+func (s *IGDService) DeletePortMapping(ctx context.Context, protocol Protocol, externalPort int) error {
+	return s.Delete(ctx, PortMapping{Protocol: protocol, ExternalPort: externalPort})
 }
 
 // Query the IGD service for its external IP address.
 // Returns nil if the external IP address is invalid or undefined, along with any relevant errors
-func (s *IGDService) GetExternalIPAddress() (net.IP, error) {
+func (s *IGDService) GetExternalIPAddress(ctx context.Context) (net.IP, error) {
 	tpl := `<u:GetExternalIPAddress xmlns:u="%s" />`
 
 	body := fmt.Sprintf(tpl, s.serviceURN)
 
-	response, err := soapRequest(s.serviceURL, s.serviceURN, "GetExternalIPAddress", body)
+	response, err := s.soapRequest(ctx, "GetExternalIPAddress", body)
 
 	if err != nil {
 		return nil, err
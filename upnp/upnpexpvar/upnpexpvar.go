@@ -0,0 +1,154 @@
+// Package upnpexpvar publishes the state of a upnp.Client and its Managers through expvar,
+// so services already serving /debug/vars see their gateways and port mappings without
+// wiring up metrics of their own:
+//
+//	v := upnpexpvar.Publish("upnp", nil)
+//	manager := upnp.NewManager(igd)
+//	v.AddManager(manager)
+//
+// It is a package of its own as importing expvar registers its handler on
+// http.DefaultServeMux, which package upnp leaves to its callers.
+package upnpexpvar
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+
+	"upnpctl/upnp"
+)
+
+// A Var collects the metrics of a client, see Publish. It passes them on to the
+// Metrics the client had before.
+type Var struct {
+	next upnp.Metrics
+
+	mut             sync.Mutex
+	gateways        int
+	discoveries     int64
+	soapRequests    int64
+	soapErrors      map[string]int64
+	renewals        int64
+	renewalFailures int64
+	managers        []*upnp.Manager
+}
+
+// Publish the state of the client, the DefaultClient when nil, as the expvar name, a JSON
+// object with the fields
+//
+//   - "gateways", the number of devices the last discovery found
+//   - "discoveries", "soapRequests", "renewals", the numbers of each
+//   - "soapErrors", the number of failed SOAP requests by action
+//   - "renewalFailures", the number of failed renewals
+//   - "managers", the "device" UUID, number of "mappings" and last "externalIP" of
+//     each manager added with AddManager
+//
+// It sets the client's Metrics. Like expvar.Publish, it panics when name is taken.
+func Publish(name string, c *upnp.Client) *Var {
+	if c == nil {
+		c = upnp.DefaultClient
+	}
+	v := &Var{next: c.Metrics, soapErrors: make(map[string]int64)}
+	c.Metrics = v
+	expvar.Publish(name, v)
+	return v
+}
+
+// Publish the mappings and external IP address of the manager too, until it is closed.
+func (v *Var) AddManager(m *upnp.Manager) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	v.managers = append(v.managers, m)
+}
+
+func (v *Var) Discovery(duration time.Duration, found int, err error) {
+	v.mut.Lock()
+	v.discoveries++
+	v.gateways = found
+	v.mut.Unlock()
+	if v.next != nil {
+		v.next.Discovery(duration, found, err)
+	}
+}
+
+func (v *Var) SOAPRequest(device, action string, duration time.Duration, err error) {
+	v.mut.Lock()
+	v.soapRequests++
+	if err != nil {
+		v.soapErrors[action]++
+	}
+	v.mut.Unlock()
+	if v.next != nil {
+		v.next.SOAPRequest(device, action, duration, err)
+	}
+}
+
+func (v *Var) Renewal(device string, protocol upnp.Protocol, port int, err error) {
+	v.mut.Lock()
+	v.renewals++
+	if err != nil {
+		v.renewalFailures++
+	}
+	v.mut.Unlock()
+	if v.next != nil {
+		v.next.Renewal(device, protocol, port, err)
+	}
+}
+
+type managerJSON struct {
+	Device     string `json:"device"`
+	Mappings   int    `json:"mappings"`
+	ExternalIP string `json:"externalIP,omitempty"`
+}
+
+type varJSON struct {
+	Gateways        int              `json:"gateways"`
+	Discoveries     int64            `json:"discoveries"`
+	SOAPRequests    int64            `json:"soapRequests"`
+	SOAPErrors      map[string]int64 `json:"soapErrors"`
+	Renewals        int64            `json:"renewals"`
+	RenewalFailures int64            `json:"renewalFailures"`
+	Managers        []managerJSON    `json:"managers"`
+}
+
+// The state as JSON, for expvar.
+func (v *Var) String() string {
+	v.mut.Lock()
+	j := varJSON{
+		Gateways:        v.gateways,
+		Discoveries:     v.discoveries,
+		SOAPRequests:    v.soapRequests,
+		SOAPErrors:      make(map[string]int64, len(v.soapErrors)),
+		Renewals:        v.renewals,
+		RenewalFailures: v.renewalFailures,
+		Managers:        []managerJSON{},
+	}
+	for action, n := range v.soapErrors {
+		j.SOAPErrors[action] = n
+	}
+	live := v.managers[:0]
+	for _, m := range v.managers {
+		select {
+		case <-m.Done():
+		default:
+			live = append(live, m)
+		}
+	}
+	v.managers = live
+	managers := append([]*upnp.Manager(nil), live...)
+	v.mut.Unlock()
+
+	for _, m := range managers {
+		mj := managerJSON{Device: m.IGD().UUID(), Mappings: len(m.Mappings())}
+		if ip := m.ExternalIP(); ip != nil {
+			mj.ExternalIP = ip.String()
+		}
+		j.Managers = append(j.Managers, mj)
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
@@ -0,0 +1,150 @@
+package upnptest
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"upnpctl/upnp"
+)
+
+// The fixtures directory holds a directory per router model: its device description
+// (description.xml), the responses to SOAP actions it sends (soap/<action>.xml, or
+// soap/<action>.<index>.xml for the entries of GetGenericPortMappingEntry), and what
+// package upnp is expected to make of them (expected.json).
+//
+//go:embed fixtures
+var fixturesFS embed.FS
+
+// A Fixture is a device description and SOAP responses as a popular router model sends them,
+// quirks included, with what package upnp is expected to make of them. Addresses and
+// identifiers are replaced with documentation ones.
+type Fixture struct {
+	// The name of the fixture, e.g. fritzbox-7590.
+	Name string `json:"-"`
+
+	// The device properties Client.LoadIGD is expected to report.
+	UUID         string `json:"uuid"`
+	DeviceType   string `json:"deviceType"`
+	FriendlyName string `json:"friendlyName"`
+	Manufacturer string `json:"manufacturer"`
+	ModelName    string `json:"modelName"`
+	// The port mapping services expected, in the order of the description: their
+	// service types and control URL paths.
+	Services []FixtureService `json:"services"`
+	// The external IP address and the number of port mappings the router reports.
+	ExternalIP string `json:"externalIP"`
+	Mappings   int    `json:"mappings"`
+	// How the router frames the bodies of its responses, if not as net/http does.
+	Framing Framing `json:"framing,omitempty"`
+
+	Description []byte            `json:"-"`
+	Responses   map[string][]byte `json:"-"`
+}
+
+// A port mapping service a Fixture is expected to have.
+type FixtureService struct {
+	Type       string `json:"type"`
+	ControlURL string `json:"controlURL"`
+}
+
+// All fixtures, by name.
+func Fixtures() []Fixture {
+	entries, err := fs.ReadDir(fixturesFS, "fixtures")
+	if err != nil {
+		panic("upnptest: " + err.Error())
+	}
+	var result []Fixture
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		f, err := LoadFixture(e.Name())
+		if err != nil {
+			panic("upnptest: " + err.Error())
+		}
+		result = append(result, f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// The fixture with the name.
+func LoadFixture(name string) (Fixture, error) {
+	dir := path.Join("fixtures", name)
+	f := Fixture{Name: name, Responses: make(map[string][]byte)}
+
+	expected, err := fixturesFS.ReadFile(path.Join(dir, "expected.json"))
+	if err != nil {
+		return f, fmt.Errorf("fixture %s: %w", name, err)
+	}
+	if err := json.Unmarshal(expected, &f); err != nil {
+		return f, fmt.Errorf("fixture %s: expected.json: %w", name, err)
+	}
+	if f.Description, err = fixturesFS.ReadFile(path.Join(dir, "description.xml")); err != nil {
+		return f, fmt.Errorf("fixture %s: %w", name, err)
+	}
+
+	responses, err := fs.ReadDir(fixturesFS, path.Join(dir, "soap"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return f, fmt.Errorf("fixture %s: %w", name, err)
+	}
+	for _, e := range responses {
+		data, err := fixturesFS.ReadFile(path.Join(dir, "soap", e.Name()))
+		if err != nil {
+			return f, fmt.Errorf("fixture %s: %w", name, err)
+		}
+		f.Responses[strings.TrimSuffix(e.Name(), ".xml")] = data
+	}
+	return f, nil
+}
+
+var udnPattern = regexp.MustCompile(`<UDN>\s*uuid:([^<\s]+)\s*</UDN>`)
+var urlBasePattern = regexp.MustCompile(`<URLBase>[^<]*</URLBase>`)
+
+// Start a Server serving the description of the fixture and answering SOAP requests
+// with its recorded responses. The URLBase of the description, if any, is pointed
+// at the server. Actions without a recorded response fail with Invalid Action.
+func NewFixtureServer(f Fixture) *Server {
+	s := newServer()
+	s.deviceType = f.DeviceType
+	if m := udnPattern.FindSubmatch(f.Description); m != nil {
+		s.UUID = string(m[1])
+	}
+	s.responses = f.Responses
+	s.framing = f.Framing
+	s.start()
+	// Requests may only be made once it returns.
+	s.description = urlBasePattern.ReplaceAllLiteral(f.Description, []byte("<URLBase>"+s.http.URL+"/</URLBase>"))
+	return s
+}
+
+// Answer a SOAP request with the recorded response to the action.
+func (s *Server) serveCanned(w http.ResponseWriter, action string, args map[string]string) {
+	key := action
+	if action == "GetGenericPortMappingEntry" {
+		key += "." + args["NewPortMappingIndex"]
+	}
+	resp, ok := s.responses[key]
+	if !ok {
+		code, desc := upnp.ErrCodeInvalidAction, "Invalid Action"
+		if action != key {
+			code, desc = upnp.ErrCodeSpecifiedArrayIndexInvalid, "SpecifiedArrayIndexInvalid"
+		}
+		writeFault(w, http.StatusInternalServerError, code, desc)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	if bytes.Contains(resp, []byte("Fault>")) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write(resp)
+}
@@ -0,0 +1,126 @@
+package upnptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+)
+
+// A Framing is how a Server delimits the bodies of its responses to GET and POST requests,
+// imitating the HTTP servers of routers.
+type Framing string
+
+const (
+	// A Content-Length or chunks, as net/http frames them.
+	FramingDefault Framing = ""
+	// An HTTP/1.0 response without a Content-Length, ended by closing the connection.
+	FramingHTTP10 Framing = "http/1.0"
+	// An HTTP/1.0 response sent chunked, which HTTP/1.0 does not have, ended by closing
+	// the connection.
+	FramingChunkedHTTP10 Framing = "chunked-http/1.0"
+	// An HTTP/1.1 response with neither a Content-Length nor chunks, keeping the
+	// connection open.
+	FramingUnframed Framing = "unframed"
+	// An HTTP/1.1 response with a Content-Length longer than the body, ended by closing
+	// the connection.
+	FramingLongContentLength Framing = "long-content-length"
+)
+
+// Frame the bodies of the responses as f describes, the server's Fixture's framing by
+// default.
+func (s *Server) SetFraming(f Framing) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.framing = f
+}
+
+// Serve r with the framing, writing the response to the connection of w itself.
+func (s *Server) serveFramed(w http.ResponseWriter, r *http.Request, framing Framing) {
+	rec := httptest.NewRecorder()
+	s.route(rec, r)
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	proto := "HTTP/1.0"
+	if framing == FramingUnframed || framing == FramingLongContentLength {
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(rw, "%s %d %s\r\n", proto, rec.Code, http.StatusText(rec.Code))
+	header := rec.Header()
+	header.Del("Content-Length")
+	switch framing {
+	case FramingChunkedHTTP10:
+		header.Set("Transfer-Encoding", "chunked")
+	case FramingLongContentLength:
+		header.Set("Content-Length", strconv.Itoa(rec.Body.Len()+64))
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range header[name] {
+			fmt.Fprintf(rw, "%s: %s\r\n", name, v)
+		}
+	}
+	rw.WriteString("\r\n")
+
+	body := rec.Body.Bytes()
+	if framing == FramingChunkedHTTP10 {
+		writeChunks(rw.Writer, body)
+	} else {
+		rw.Write(body)
+	}
+	rw.Flush()
+
+	if framing != FramingUnframed {
+		conn.Close()
+		return
+	}
+	// Leave the connection to the client to close, as it cannot tell where the body ends
+	// but from its content.
+	s.mut.Lock()
+	s.conns[conn] = struct{}{}
+	s.mut.Unlock()
+	go func() {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+		s.mut.Lock()
+		delete(s.conns, conn)
+		s.mut.Unlock()
+	}()
+}
+
+// Write data in chunks of at most 512 bytes, as routers with little memory do.
+func writeChunks(w *bufio.Writer, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), 512)
+		fmt.Fprintf(w, "%x\r\n", n)
+		w.Write(data[:n])
+		w.WriteString("\r\n")
+		data = data[n:]
+	}
+	w.WriteString("0\r\n\r\n")
+}
+
+// Close the connections left open for clients.
+func (s *Server) closeConns() {
+	s.mut.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mut.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,161 @@
+package upnptest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The longest subscription the server grants.
+const maxEventTimeout = 30 * time.Minute
+
+// A GENA subscription to the server's events.
+type subscriber struct {
+	callback string
+	expires  time.Time
+	seq      int
+	// Serializes the delivery of the subscriber's events.
+	queue chan string
+}
+
+// Handle SUBSCRIBE and UNSUBSCRIBE requests.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.expireSubscribers()
+
+	sid := r.Header.Get("SID")
+	switch {
+	case r.Method == "UNSUBSCRIBE":
+		sub, ok := s.subscribers[sid]
+		if !ok {
+			http.Error(w, "unknown SID", http.StatusPreconditionFailed)
+			return
+		}
+		close(sub.queue)
+		delete(s.subscribers, sid)
+
+	case sid != "":
+		sub, ok := s.subscribers[sid]
+		if !ok || r.Header.Get("CALLBACK") != "" {
+			http.Error(w, "unknown SID", http.StatusPreconditionFailed)
+			return
+		}
+		timeout := grantedTimeout(r.Header.Get("TIMEOUT"))
+		sub.expires = time.Now().Add(timeout)
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(int(timeout/time.Second)))
+
+	default:
+		callback := strings.Trim(r.Header.Get("CALLBACK"), "<>")
+		if r.Header.Get("NT") != "upnp:event" || !strings.HasPrefix(callback, "http://") {
+			http.Error(w, "invalid subscription", http.StatusPreconditionFailed)
+			return
+		}
+		sid = "uuid:" + newUUID()
+		timeout := grantedTimeout(r.Header.Get("TIMEOUT"))
+		sub := &subscriber{callback: callback, expires: time.Now().Add(timeout), queue: make(chan string, 16)}
+		s.subscribers[sid] = sub
+		go s.deliver(sid, sub)
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(int(timeout/time.Second)))
+		// The initial event, with all evented variables.
+		sub.queue <- propertySet(map[string]string{
+			"ExternalIPAddress":          ipString(s.externalIP),
+			"ConnectionStatus":           s.status,
+			"PortMappingNumberOfEntries": strconv.Itoa(len(s.mappings)),
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// The timeout granted for a TIMEOUT header.
+func grantedTimeout(header string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimPrefix(header, "Second-"))
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxEventTimeout {
+		return maxEventTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Queue an event with the changed variables for all subscribers. The server's lock is held.
+func (s *Server) notify(variables map[string]string) {
+	s.expireSubscribers()
+	body := propertySet(variables)
+	for _, sub := range s.subscribers {
+		select {
+		case sub.queue <- body:
+		default:
+		}
+	}
+}
+
+// Send the subscriber's events to its callback URL, until it unsubscribes or expires.
+func (s *Server) deliver(sid string, sub *subscriber) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for body := range sub.queue {
+		req, err := http.NewRequest("NOTIFY", sub.callback, strings.NewReader(body))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		req.Header.Set("NT", "upnp:event")
+		req.Header.Set("NTS", "upnp:propchange")
+		req.Header.Set("SID", sid)
+		req.Header.Set("SEQ", strconv.Itoa(sub.seq))
+		sub.seq++
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// Drop the expired subscriptions. The server's lock is held.
+func (s *Server) expireSubscribers() {
+	now := time.Now()
+	for sid, sub := range s.subscribers {
+		if now.After(sub.expires) {
+			close(sub.queue)
+			delete(s.subscribers, sid)
+		}
+	}
+}
+
+// The number of active GENA subscriptions.
+func (s *Server) Subscriptions() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.expireSubscribers()
+	return len(s.subscribers)
+}
+
+// Forget all GENA subscriptions, like a rebooted router, so renewals fail with 412
+// Precondition Failed.
+func (s *Server) DropSubscriptions() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for sid, sub := range s.subscribers {
+		close(sub.queue)
+		delete(s.subscribers, sid)
+	}
+}
+
+func propertySet(variables map[string]string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>` + "\n" + `<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">`)
+	for name, value := range variables {
+		fmt.Fprintf(&b, "<e:property><%s>%s</%s></e:property>", name, value, name)
+	}
+	b.WriteString("</e:propertyset>")
+	return b.String()
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
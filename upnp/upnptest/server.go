@@ -0,0 +1,397 @@
+// Package upnptest provides an in-process fake InternetGatewayDevice, for testing code using
+// package upnp without a router.
+//
+// A Server answers search requests, serves its device description and implements the port
+// mapping actions and the GENA events of a WANIPConnection service on an in-memory mapping
+// table. Clients find it
+// by searching its SSDPAddr or by loading its URL:
+//
+//	s := upnptest.NewServer()
+//	defer s.Close()
+//	c := &upnp.Client{SearchAddr: s.SSDPAddr, DiscoveryTimeout: time.Second}
+//	igds := c.Discover()
+//
+// Actions can be made to fail with InjectFault, and responses framed like those of routers
+// with SetFraming.
+package upnptest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"upnpctl/upnp"
+)
+
+// The device and service types of a Server, and of one started with NewServer2.
+const (
+	DeviceType  = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	ServiceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+	DeviceType2  = "urn:schemas-upnp-org:device:InternetGatewayDevice:2"
+	ServiceType2 = "urn:schemas-upnp-org:service:WANIPConnection:2"
+)
+
+// A Server is a fake InternetGatewayDevice:1 with a single WANIPConnection:1 service, or one
+// of version 2 (see NewServer2), listening on the loopback interface.
+type Server struct {
+	// The URL of the device description, for Client.LoadIGD.
+	URL string
+	// The UDP address the server answers search requests at, for Client.SearchAddr.
+	SSDPAddr string
+	// The UUID of the device.
+	UUID string
+
+	http        *httptest.Server
+	ssdp        net.PacketConn
+	description []byte
+	deviceType  string
+	scpd        string
+	started     time.Time
+	done        chan struct{}
+	// Whether the service implements AddAnyPortMapping, see NewServer2.
+	anyPort bool
+	// Canned responses to SOAP actions, see NewFixtureServer.
+	responses map[string][]byte
+
+	mut        sync.Mutex
+	externalIP net.IP
+	status     string
+	mappings   []upnp.PortMapping
+	faults     map[string]*Fault
+	requests   map[string]int
+	framing    Framing
+	// How long search requests wait for their response.
+	searchDelay time.Duration
+	// The connections left open after responses without framing.
+	conns map[net.Conn]struct{}
+	// The GENA subscriptions, by SID.
+	subscribers map[string]*subscriber
+}
+
+// Start a Server. It reports the external IP address 203.0.113.1 and a connected WAN
+// connection, and has no port mappings.
+func NewServer() *Server {
+	s := newServer()
+	s.UUID = newUUID()
+	s.description = []byte(fmt.Sprintf(description, s.UUID, newUUID(), newUUID()))
+	s.start()
+	return s
+}
+
+// Start a Server like NewServer, but as an InternetGatewayDevice:2 with a WANIPConnection:2
+// service, which also implements AddAnyPortMapping.
+func NewServer2() *Server {
+	s := newServer()
+	s.UUID = newUUID()
+	s.deviceType, s.scpd, s.anyPort = DeviceType2, scpd2, true
+	s.description = []byte(version2.Replace(fmt.Sprintf(description, s.UUID, newUUID(), newUUID())))
+	s.start()
+	return s
+}
+
+// Turns the description of NewServer into that of NewServer2.
+var version2 = strings.NewReplacer(
+	DeviceType, DeviceType2,
+	ServiceType, ServiceType2,
+	"device:WANDevice:1", "device:WANDevice:2",
+	"device:WANConnectionDevice:1", "device:WANConnectionDevice:2",
+)
+
+func newServer() *Server {
+	return &Server{
+		deviceType:  DeviceType,
+		scpd:        scpd,
+		started:     time.Now(),
+		done:        make(chan struct{}),
+		externalIP:  net.IPv4(203, 0, 113, 1),
+		status:      "Connected",
+		faults:      make(map[string]*Fault),
+		requests:    make(map[string]int),
+		subscribers: make(map[string]*subscriber),
+		conns:       make(map[net.Conn]struct{}),
+	}
+}
+
+// Start serving the description and answering search requests.
+func (s *Server) start() {
+	s.http = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.http.URL + descriptionPath
+
+	ssdp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		s.http.Close()
+		panic(fmt.Sprintf("upnptest: failed to listen for search requests: %v", err))
+	}
+	s.ssdp = ssdp
+	s.SSDPAddr = ssdp.LocalAddr().String()
+	go s.serveSSDP()
+}
+
+// The path the device description is served at.
+const descriptionPath = "/rootDesc.xml"
+
+// Serve the description at descriptionPath and the SCPD at any other path, and take POST
+// requests to any path as SOAP requests and (UN)SUBSCRIBE requests as GENA ones, so
+// descriptions may point to any URLs on the server. Responses to GET and POST requests
+// are framed as SetFraming set.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	framing := s.framing
+	s.mut.Unlock()
+	if framing != FramingDefault && (r.Method == "GET" || r.Method == "POST") {
+		s.serveFramed(w, r, framing)
+		return
+	}
+	s.route(w, r)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST":
+		s.serveControl(w, r)
+	case r.Method == "SUBSCRIBE" || r.Method == "UNSUBSCRIBE":
+		s.serveEvents(w, r)
+	case r.Method != "GET" && r.Method != "HEAD":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case r.URL.Path == descriptionPath:
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Header().Set("Server", "upnptest UPnP/1.1")
+		w.Write(s.description)
+	default:
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		fmt.Fprint(w, s.scpd)
+	}
+}
+
+// Shut the server down.
+func (s *Server) Close() {
+	s.DropSubscriptions()
+	s.ssdp.Close()
+	<-s.done
+	s.closeConns()
+	s.http.Close()
+}
+
+// Set the external IP address GetExternalIPAddress reports, none when nil, and send an
+// event to the subscribers.
+func (s *Server) SetExternalIP(ip net.IP) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.externalIP = ip
+	s.notify(map[string]string{"ExternalIPAddress": ipString(ip)})
+}
+
+// Set the ConnectionStatus GetStatusInfo reports, e.g. Disconnected, and send an event to
+// the subscribers.
+func (s *Server) SetStatus(status string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.status = status
+	s.notify(map[string]string{"ConnectionStatus": status})
+}
+
+// The port mappings of the server, in the order they were added. Mappings whose lease
+// has expired are gone.
+func (s *Server) Mappings() []upnp.PortMapping {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.expire()
+	result := make([]upnp.PortMapping, len(s.mappings))
+	for i, m := range s.mappings {
+		result[i] = withLease(m)
+	}
+	return result
+}
+
+// Add the port mapping m to the server directly, e.g. one added by another host.
+// Its Lease starts now, ExpiresAt is ignored.
+func (s *Server) AddMapping(m upnp.PortMapping) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.putMapping(m)
+}
+
+// The number of requests of the action the server has received, including failed ones.
+func (s *Server) Requests(action string) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.requests[action]
+}
+
+// Make requests of the action fail as f describes, replacing a fault injected before.
+// The action "*" fails all actions without a fault of their own.
+func (s *Server) InjectFault(action string, f Fault) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.faults[action] = &f
+}
+
+// Remove all injected faults.
+func (s *Server) ClearFaults() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.faults = make(map[string]*Fault)
+}
+
+// A Fault makes SOAP requests of the server fail.
+type Fault struct {
+	// The UPnP error code of the SOAP fault the response carries, e.g. upnp.ErrCodeActionFailed.
+	Code        int
+	Description string
+	// The HTTP status of the response, 500 by default. With a Code of 0, the response
+	// does not carry a SOAP fault.
+	Status int
+	// How long to wait before responding, e.g. to exercise timeouts.
+	Delay time.Duration
+	// How many requests fail before the action succeeds again, all of them when 0.
+	Times int
+}
+
+// Take the fault for a request of the action, nil when it succeeds.
+func (s *Server) takeFault(action string) *Fault {
+	f, ok := s.faults[action]
+	if !ok {
+		action = "*"
+		f = s.faults[action]
+	}
+	if f == nil {
+		return nil
+	}
+	result := *f
+	if f.Times > 0 {
+		if f.Times--; f.Times == 0 {
+			delete(s.faults, action)
+		}
+	}
+	return &result
+}
+
+// Answer the search requests sent to the server until it is closed.
+func (s *Server) serveSSDP() {
+	defer close(s.done)
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.ssdp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		st, ok := searchTarget(buf[:n])
+		usn := "uuid:" + s.UUID + "::" + s.deviceType
+		switch {
+		case !ok:
+			continue
+		case strings.EqualFold(st, "uuid:"+s.UUID):
+			// Searches by UUID are answered with it.
+			usn = st
+		case st != s.deviceType && st != "ssdp:all" && st != "upnp:rootdevice":
+			continue
+		default:
+			st = s.deviceType
+		}
+		resp := strings.Join([]string{
+			"HTTP/1.1 200 OK",
+			"Cache-Control: max-age=1800",
+			"Ext:",
+			"Location: " + s.URL,
+			"Server: upnptest UPnP/1.1",
+			"St: " + st,
+			"USN: " + usn,
+		}, "\r\n") + "\r\n\r\n"
+		s.mut.Lock()
+		delay := s.searchDelay
+		s.mut.Unlock()
+		if delay > 0 {
+			time.AfterFunc(delay, func() { s.ssdp.WriteTo([]byte(resp), addr) })
+		} else {
+			s.ssdp.WriteTo([]byte(resp), addr)
+		}
+	}
+}
+
+// Answer search requests after d, like devices waiting up to the MX of the request
+// before they answer, or slow to answer at all.
+func (s *Server) SetSearchDelay(d time.Duration) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.searchDelay = d
+}
+
+// The search target of an M-SEARCH request, false when req is none.
+func searchTarget(req []byte) (string, bool) {
+	lines := strings.Split(string(req), "\r\n")
+	if !strings.HasPrefix(lines[0], "M-SEARCH ") {
+		return "", false
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "St") {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// A random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+const description = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>upnptest router</friendlyName>
+<manufacturer>upnptest</manufacturer>
+<modelName>Fake IGD</modelName>
+<modelNumber>1</modelNumber>
+<UDN>uuid:%s</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<friendlyName>WANDevice</friendlyName>
+<manufacturer>upnptest</manufacturer>
+<modelName>Fake WANDevice</modelName>
+<UDN>uuid:%s</UDN>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANCommonIFC1</serviceId>
+<controlURL>/ctl/CmnIfCfg</controlURL>
+<eventSubURL>/evt/CmnIfCfg</eventSubURL>
+<SCPDURL>/WANCfg.xml</SCPDURL>
+</service>
+</serviceList>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<friendlyName>WANConnectionDevice</friendlyName>
+<manufacturer>upnptest</manufacturer>
+<modelName>Fake WANConnectionDevice</modelName>
+<UDN>uuid:%s</UDN>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<controlURL>/ctl/IPConn</controlURL>
+<eventSubURL>/evt/IPConn</eventSubURL>
+<SCPDURL>/WANIPCn.xml</SCPDURL>
+</service>
+</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>
+`
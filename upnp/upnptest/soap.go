@@ -0,0 +1,388 @@
+package upnptest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"upnpctl/upnp"
+)
+
+type soapEnvelope struct {
+	Body struct {
+		Action struct {
+			XMLName   xml.Name
+			Arguments []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// The service type and action of a SOAP request from its SOAPAction header,
+// e.g. "urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping".
+func soapAction(r *http.Request) (string, string) {
+	serviceType, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+	return serviceType, action
+}
+
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	serviceType, action := soapAction(r)
+	var envelope soapEnvelope
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		writeFault(w, http.StatusInternalServerError, upnp.ErrCodeInvalidArgs, "Invalid Args")
+		return
+	}
+	if action == "" {
+		action = envelope.Body.Action.XMLName.Local
+	}
+	if serviceType == "" {
+		serviceType = ServiceType
+	}
+	args := make(map[string]string)
+	for _, arg := range envelope.Body.Action.Arguments {
+		args[arg.XMLName.Local] = strings.TrimSpace(arg.Value)
+	}
+
+	s.mut.Lock()
+	s.requests[action]++
+	fault := s.takeFault(action)
+	s.mut.Unlock()
+
+	if fault != nil {
+		select {
+		case <-time.After(fault.Delay):
+		case <-r.Context().Done():
+			return
+		}
+		status := fault.Status
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		if fault.Code == 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		writeFault(w, status, fault.Code, fault.Description)
+		return
+	}
+
+	if s.responses != nil {
+		s.serveCanned(w, action, args)
+		return
+	}
+
+	s.mut.Lock()
+	out, soapErr := s.perform(action, args)
+	s.mut.Unlock()
+	if soapErr != nil {
+		writeFault(w, http.StatusInternalServerError, soapErr.Code, soapErr.Description)
+		return
+	}
+	writeResponse(w, serviceType, action, out)
+}
+
+// Perform the action with the arguments args on the mapping table, returning its output
+// arguments in order. Called with mut held.
+func (s *Server) perform(action string, args map[string]string) ([][2]string, *upnp.SOAPError) {
+	s.expire()
+	switch action {
+	case "GetExternalIPAddress":
+		ip := ""
+		if s.externalIP != nil {
+			ip = s.externalIP.String()
+		}
+		return [][2]string{{"NewExternalIPAddress", ip}}, nil
+
+	case "GetStatusInfo":
+		return [][2]string{
+			{"NewConnectionStatus", s.status},
+			{"NewLastConnectionError", "ERROR_NONE"},
+			{"NewUptime", strconv.Itoa(int(time.Since(s.started).Seconds()))},
+		}, nil
+
+	case "GetConnectionTypeInfo":
+		return [][2]string{{"NewConnectionType", "IP_Routed"}, {"NewPossibleConnectionTypes", "IP_Routed"}}, nil
+
+	case "SetConnectionType":
+		if args["NewConnectionType"] != "IP_Routed" {
+			return nil, &upnp.SOAPError{Code: upnp.ErrCodeArgumentValueInvalid, Description: "Argument Value Invalid"}
+		}
+		return nil, nil
+
+	case "GetNATRSIPStatus":
+		return [][2]string{{"NewRSIPAvailable", "0"}, {"NewNATEnabled", "1"}}, nil
+
+	case "RequestConnection", "ForceTermination":
+		s.status = "Connected"
+		if action == "ForceTermination" {
+			s.status = "Disconnected"
+		}
+		s.notify(map[string]string{"ConnectionStatus": s.status})
+		return nil, nil
+
+	case "AddPortMapping":
+		m, err := parseAddition(args)
+		if err != nil {
+			return nil, err
+		}
+		if s.taken(m) {
+			return nil, &upnp.SOAPError{Code: upnp.ErrCodeConflictInMappingEntry, Description: "ConflictInMappingEntry"}
+		}
+		s.putMapping(m)
+		return nil, nil
+
+	case "AddAnyPortMapping":
+		if !s.anyPort {
+			break
+		}
+		m, err := parseAddition(args)
+		if err != nil {
+			return nil, err
+		}
+		// Map the next free port when the one asked for is taken.
+		for tried := 0; s.taken(m); tried++ {
+			if tried > 65535 {
+				return nil, &upnp.SOAPError{Code: upnp.ErrCodeNoPortMapsAvailable, Description: "NoPortMapsAvailable"}
+			}
+			m.ExternalPort = m.ExternalPort%65535 + 1
+		}
+		s.putMapping(m)
+		return [][2]string{{"NewReservedPort", strconv.Itoa(m.ExternalPort)}}, nil
+
+	case "DeletePortMapping":
+		m, err := parseMapping(args)
+		if err != nil {
+			return nil, err
+		}
+		i := s.find(m)
+		if i < 0 {
+			return nil, &upnp.SOAPError{Code: upnp.ErrCodeNoSuchEntryInArray, Description: "NoSuchEntryInArray"}
+		}
+		s.mappings = append(s.mappings[:i], s.mappings[i+1:]...)
+		return nil, nil
+
+	case "GetSpecificPortMappingEntry":
+		m, err := parseMapping(args)
+		if err != nil {
+			return nil, err
+		}
+		i := s.find(m)
+		if i < 0 {
+			return nil, &upnp.SOAPError{Code: upnp.ErrCodeNoSuchEntryInArray, Description: "NoSuchEntryInArray"}
+		}
+		m = withLease(s.mappings[i])
+		return [][2]string{
+			{"NewInternalPort", strconv.Itoa(m.InternalPort)},
+			{"NewInternalClient", m.InternalClient},
+			{"NewEnabled", enabled(m.Enabled)},
+			{"NewPortMappingDescription", m.Description},
+			{"NewLeaseDuration", strconv.Itoa(int(m.Lease.Seconds()))},
+		}, nil
+
+	case "GetGenericPortMappingEntry":
+		i, perr := strconv.Atoi(args["NewPortMappingIndex"])
+		if perr != nil || i < 0 || i >= len(s.mappings) {
+			return nil, &upnp.SOAPError{Code: upnp.ErrCodeSpecifiedArrayIndexInvalid, Description: "SpecifiedArrayIndexInvalid"}
+		}
+		m := withLease(s.mappings[i])
+		return [][2]string{
+			{"NewRemoteHost", m.RemoteHost},
+			{"NewExternalPort", strconv.Itoa(m.ExternalPort)},
+			{"NewProtocol", string(m.Protocol)},
+			{"NewInternalPort", strconv.Itoa(m.InternalPort)},
+			{"NewInternalClient", m.InternalClient},
+			{"NewEnabled", enabled(m.Enabled)},
+			{"NewPortMappingDescription", m.Description},
+			{"NewLeaseDuration", strconv.Itoa(int(m.Lease.Seconds()))},
+		}, nil
+	}
+	return nil, &upnp.SOAPError{Code: upnp.ErrCodeInvalidAction, Description: "Invalid Action"}
+}
+
+// The remote host, external port and protocol identifying a mapping in args.
+func parseMapping(args map[string]string) (upnp.PortMapping, *upnp.SOAPError) {
+	port, err := strconv.Atoi(args["NewExternalPort"])
+	protocol := upnp.Protocol(strings.ToUpper(args["NewProtocol"]))
+	if err != nil || port < 0 || port > 65535 || (protocol != upnp.TCP && protocol != upnp.UDP) {
+		return upnp.PortMapping{}, &upnp.SOAPError{Code: upnp.ErrCodeInvalidArgs, Description: "Invalid Args"}
+	}
+	return upnp.PortMapping{RemoteHost: args["NewRemoteHost"], ExternalPort: port, Protocol: protocol}, nil
+}
+
+// The mapping AddPortMapping or AddAnyPortMapping adds with the arguments args.
+func parseAddition(args map[string]string) (upnp.PortMapping, *upnp.SOAPError) {
+	m, err := parseMapping(args)
+	if err != nil {
+		return m, err
+	}
+	internalPort, perr := strconv.Atoi(args["NewInternalPort"])
+	if perr != nil || internalPort <= 0 || internalPort > 65535 {
+		return m, &upnp.SOAPError{Code: upnp.ErrCodeInvalidArgs, Description: "Invalid Args"}
+	}
+	lease, perr := strconv.Atoi(args["NewLeaseDuration"])
+	if perr != nil || lease < 0 {
+		return m, &upnp.SOAPError{Code: upnp.ErrCodeInvalidArgs, Description: "Invalid Args"}
+	}
+	m.InternalPort = internalPort
+	m.InternalClient = args["NewInternalClient"]
+	m.Enabled = args["NewEnabled"] == "1"
+	m.Description = args["NewPortMappingDescription"]
+	m.Lease = time.Duration(lease) * time.Second
+	return m, nil
+}
+
+// Whether another client holds the remote host, external port and protocol of m. Called
+// with mut held.
+func (s *Server) taken(m upnp.PortMapping) bool {
+	i := s.find(m)
+	return i >= 0 && !strings.EqualFold(s.mappings[i].InternalClient, m.InternalClient)
+}
+
+// The index of the mapping with the remote host, external port and protocol of m, -1 when
+// there is none. Called with mut held.
+func (s *Server) find(m upnp.PortMapping) int {
+	for i, existing := range s.mappings {
+		if existing.RemoteHost == m.RemoteHost && existing.ExternalPort == m.ExternalPort && existing.Protocol == m.Protocol {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add the mapping m, replacing the one with its remote host, external port and protocol.
+// Called with mut held.
+func (s *Server) putMapping(m upnp.PortMapping) {
+	m.ExpiresAt = time.Time{}
+	if m.Lease > 0 {
+		m.ExpiresAt = time.Now().Add(m.Lease)
+	}
+	if i := s.find(m); i >= 0 {
+		s.mappings[i] = m
+		return
+	}
+	s.mappings = append(s.mappings, m)
+}
+
+// Remove the mappings whose lease has expired. Called with mut held.
+func (s *Server) expire() {
+	now := time.Now()
+	kept := s.mappings[:0]
+	for _, m := range s.mappings {
+		if m.ExpiresAt.IsZero() || m.ExpiresAt.After(now) {
+			kept = append(kept, m)
+		}
+	}
+	s.mappings = kept
+}
+
+// The mapping m with the lease it has left.
+func withLease(m upnp.PortMapping) upnp.PortMapping {
+	if !m.ExpiresAt.IsZero() {
+		m.Lease = time.Until(m.ExpiresAt).Round(time.Second)
+	}
+	return m
+}
+
+func enabled(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func writeResponse(w http.ResponseWriter, serviceType, action string, args [][2]string) {
+	var b strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&b, "<%s>", arg[0])
+		xml.EscapeText(&b, []byte(arg[1]))
+		fmt.Fprintf(&b, "</%s>", arg[0])
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body>
+</s:Envelope>
+`, action, serviceType, b.String(), action)
+}
+
+func writeFault(w http.ResponseWriter, status, code int, description string) {
+	var desc strings.Builder
+	xml.EscapeText(&desc, []byte(description))
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail>
+</s:Fault></s:Body>
+</s:Envelope>
+`, code, desc.String())
+}
+
+// The actions of the WANIPConnection service, with their arguments.
+var actions = map[string][]string{
+	"AddPortMapping":              {"in NewRemoteHost", "in NewExternalPort", "in NewProtocol", "in NewInternalPort", "in NewInternalClient", "in NewEnabled", "in NewPortMappingDescription", "in NewLeaseDuration"},
+	"DeletePortMapping":           {"in NewRemoteHost", "in NewExternalPort", "in NewProtocol"},
+	"GetExternalIPAddress":        {"out NewExternalIPAddress"},
+	"GetGenericPortMappingEntry":  {"in NewPortMappingIndex", "out NewRemoteHost", "out NewExternalPort", "out NewProtocol", "out NewInternalPort", "out NewInternalClient", "out NewEnabled", "out NewPortMappingDescription", "out NewLeaseDuration"},
+	"GetSpecificPortMappingEntry": {"in NewRemoteHost", "in NewExternalPort", "in NewProtocol", "out NewInternalPort", "out NewInternalClient", "out NewEnabled", "out NewPortMappingDescription", "out NewLeaseDuration"},
+	"GetStatusInfo":               {"out NewConnectionStatus", "out NewLastConnectionError", "out NewUptime"},
+	"GetConnectionTypeInfo":       {"out NewConnectionType", "out NewPossibleConnectionTypes"},
+	"SetConnectionType":           {"in NewConnectionType"},
+	"GetNATRSIPStatus":            {"out NewRSIPAvailable", "out NewNATEnabled"},
+	"RequestConnection":           {},
+	"ForceTermination":            {},
+}
+
+// The service descriptions (SCPDs) of the WANIPConnection:1 service and of the
+// WANIPConnection:2 one of NewServer2, which adds AddAnyPortMapping.
+var (
+	scpd  = serviceDescription(actions)
+	scpd2 = serviceDescription(withAction(actions, "AddAnyPortMapping", append(actions["AddPortMapping"], "out NewReservedPort")))
+)
+
+// A copy of actions with the action added.
+func withAction(actions map[string][]string, name string, args []string) map[string][]string {
+	result := map[string][]string{name: args}
+	for action, args := range actions {
+		result[action] = args
+	}
+	return result
+}
+
+// An SCPD listing the actions.
+func serviceDescription(actions map[string][]string) string {
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+`)
+	for _, name := range names {
+		fmt.Fprintf(&b, "<action><name>%s</name><argumentList>", name)
+		for _, arg := range actions[name] {
+			direction, argName, _ := strings.Cut(arg, " ")
+			fmt.Fprintf(&b, "<argument><name>%s</name><direction>%s</direction></argument>", argName, direction)
+		}
+		b.WriteString("</argumentList></action>\n")
+	}
+	b.WriteString("</actionList>\n</scpd>\n")
+	return b.String()
+}
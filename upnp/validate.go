@@ -0,0 +1,302 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The outcome of a check of Validate.
+type ConformanceStatus string
+
+const (
+	ConformancePass ConformanceStatus = "pass"
+	// The device deviates from the specification in a way clients cope with.
+	ConformanceWarn ConformanceStatus = "warn"
+	ConformanceFail ConformanceStatus = "fail"
+	// The check could not be made, e.g. as the one it builds on failed.
+	ConformanceSkip ConformanceStatus = "skip"
+)
+
+// A finding of Validate.
+type ConformanceCheck struct {
+	// What was checked: "description", or the service type of the SCPD or action checked,
+	// e.g. "WANIPConnection:1 AddPortMapping".
+	Subject string            `json:"subject"`
+	Status  ConformanceStatus `json:"status"`
+	Message string            `json:"message"`
+}
+
+// A ConformanceReport is what Validate found out about a device.
+type ConformanceReport struct {
+	Device     string             `json:"device"`
+	DeviceType string             `json:"deviceType"`
+	Checks     []ConformanceCheck `json:"checks"`
+}
+
+// The number of checks with the status.
+func (r *ConformanceReport) Count(status ConformanceStatus) int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Whether no check failed.
+func (r *ConformanceReport) Passed() bool {
+	return r.Count(ConformanceFail) == 0
+}
+
+func (r *ConformanceReport) add(subject string, status ConformanceStatus, format string, args ...any) {
+	r.Checks = append(r.Checks, ConformanceCheck{subject, status, fmt.Sprintf(format, args...)})
+}
+
+// The actions the port mapping services require, by service type.
+var requiredActions = map[string][]string{
+	"urn:schemas-upnp-org:service:WANIPConnection:1": {
+		"SetConnectionType", "GetConnectionTypeInfo", "RequestConnection", "ForceTermination",
+		"GetStatusInfo", "GetNATRSIPStatus", "GetGenericPortMappingEntry",
+		"GetSpecificPortMappingEntry", "AddPortMapping", "DeletePortMapping", "GetExternalIPAddress",
+	},
+	"urn:schemas-upnp-org:service:WANIPConnection:2": {
+		"SetConnectionType", "GetConnectionTypeInfo", "RequestConnection", "ForceTermination",
+		"GetStatusInfo", "GetNATRSIPStatus", "GetGenericPortMappingEntry",
+		"GetSpecificPortMappingEntry", "AddPortMapping", "AddAnyPortMapping", "DeletePortMapping",
+		"DeletePortMappingRange", "GetExternalIPAddress", "GetListOfPortMappings",
+	},
+	"urn:schemas-upnp-org:service:WANPPPConnection:1": {
+		"SetConnectionType", "GetConnectionTypeInfo", "ConfigureConnection", "RequestConnection",
+		"ForceTermination", "GetStatusInfo", "GetNATRSIPStatus", "GetGenericPortMappingEntry",
+		"GetSpecificPortMappingEntry", "AddPortMapping", "DeletePortMapping", "GetExternalIPAddress",
+	},
+}
+
+// The values of the ConnectionStatus of WANIPConnection and WANPPPConnection.
+var connectionStatuses = []string{
+	"Unconfigured", "Connecting", "Authenticating", "Connected", "PendingDisconnect",
+	"Disconnecting", "Disconnected",
+}
+
+// The lease of the port mapping Validate adds.
+const validateLease = 600
+
+// Validate checks the device against the InternetGatewayDevice:1 or :2 specification: its
+// device tree, the SCPDs of its port mapping services and how their actions behave. It
+// adds a port mapping on a random high port to each service and deletes it again. The
+// error is that of ctx, the findings are in the report.
+func Validate(ctx context.Context, igd *IGD) (*ConformanceReport, error) {
+	r := &ConformanceReport{Device: igd.uuid, DeviceType: igd.deviceType}
+	validateDeviceTree(igd, r)
+	for i := range igd.services {
+		s := &igd.services[i]
+		if err := ctx.Err(); err != nil {
+			return r, err
+		}
+		subject := strings.TrimPrefix(s.serviceURN, "urn:schemas-upnp-org:service:")
+		validateSCPD(ctx, s, subject, r)
+		validateActions(ctx, s, subject, r)
+	}
+	return r, ctx.Err()
+}
+
+// Check the device tree of the description.
+func validateDeviceTree(igd *IGD, r *ConformanceReport) {
+	const subject = "description"
+	if len(igd.rawDescription) == 0 {
+		r.add(subject, ConformanceSkip, "no description loaded")
+		return
+	}
+	var root upnpRoot
+	if err := decodeStrictly(igd.client, igd.rawDescription, &root); err != nil {
+		r.add(subject, ConformanceFail, "malformed XML: %v", err)
+		if err := igd.client.unmarshalDescription(igd.logger(), igd.rawDescription, &root); err != nil {
+			return
+		}
+	}
+	violations := 0
+	checkDescription(root, func(msg string, args ...any) error {
+		r.add(subject, ConformanceFail, "%s", describeViolation(msg, args))
+		violations++
+		return nil
+	})
+
+	if !isIGDType(igd.deviceType) {
+		r.add(subject, ConformanceFail, "%s is not an InternetGatewayDevice", igd.deviceType)
+		return
+	}
+	if len(igd.services) == 0 {
+		r.add(subject, ConformanceFail, "no WANIPConnection or WANPPPConnection service in a WANConnectionDevice")
+		violations++
+	}
+	if len(igd.interfaces) == 0 {
+		r.add(subject, ConformanceFail, "no WANCommonInterfaceConfig service in the WANDevice")
+		violations++
+	}
+	if violations == 0 {
+		r.add(subject, ConformancePass, "%s with %d port mapping services", igd.deviceType, len(igd.services))
+	}
+}
+
+// Check that the SCPD of the service is well-formed and declares the actions its type requires.
+func validateSCPD(ctx context.Context, s *IGDService, subject string, r *ConformanceReport) {
+	required, known := requiredActions[s.serviceURN]
+	data, err := s.RawSCPD(ctx)
+	if err != nil {
+		r.add(subject, ConformanceFail, "SCPD not available: %v", err)
+		return
+	}
+	if err := decodeStrictly(s.client, data, new(upnpSCPD)); err != nil {
+		r.add(subject, ConformanceFail, "malformed SCPD: %v", err)
+	}
+	actions, err := s.Actions(ctx)
+	if err != nil {
+		r.add(subject, ConformanceFail, "%v", err)
+		return
+	}
+	if !known {
+		r.add(subject, ConformanceSkip, "no required actions known for the service type")
+		return
+	}
+	declared := make(map[string]bool, len(actions))
+	for _, a := range actions {
+		declared[a] = true
+	}
+	var missing []string
+	for _, a := range required {
+		if !declared[a] {
+			missing = append(missing, a)
+		}
+	}
+	if len(missing) > 0 {
+		r.add(subject, ConformanceFail, "SCPD lacks the required actions %s", strings.Join(missing, ", "))
+	} else {
+		r.add(subject, ConformancePass, "SCPD declares all %d required actions", len(required))
+	}
+}
+
+// Check the responses of the service to its port mapping actions.
+func validateActions(ctx context.Context, s *IGDService, subject string, r *ConformanceReport) {
+	subject += " "
+
+	status, err := s.GetStatusInfo(ctx)
+	switch {
+	case err != nil:
+		r.add(subject+"GetStatusInfo", ConformanceFail, "%v", err)
+	case !slices.Contains(connectionStatuses, status.ConnectionStatus):
+		r.add(subject+"GetStatusInfo", ConformanceFail, "invalid ConnectionStatus %q", status.ConnectionStatus)
+	default:
+		r.add(subject+"GetStatusInfo", ConformancePass, "%s", status.ConnectionStatus)
+	}
+
+	ip, err := s.GetExternalIPAddress(ctx)
+	switch {
+	case err != nil:
+		r.add(subject+"GetExternalIPAddress", ConformanceFail, "%v", err)
+	case ip == nil && status.Connected():
+		r.add(subject+"GetExternalIPAddress", ConformanceWarn, "no address although connected")
+	case ip != nil && ip.To4() == nil:
+		r.add(subject+"GetExternalIPAddress", ConformanceFail, "%s is not an IPv4 address", ip)
+	default:
+		r.add(subject+"GetExternalIPAddress", ConformancePass, "%v", ip)
+	}
+
+	mappings, err := s.GetPortMappings(ctx)
+	if err != nil {
+		r.add(subject+"GetGenericPortMappingEntry", ConformanceFail, "%v", err)
+	} else {
+		// GetPortMappings stops at either error, the specification has 713 for the end.
+		_, err := s.GetGenericPortMappingEntry(ctx, len(mappings))
+		if IsErrorCode(err, ErrCodeSpecifiedArrayIndexInvalid) {
+			r.add(subject+"GetGenericPortMappingEntry", ConformancePass, "%d entries, then error 713", len(mappings))
+		} else {
+			r.add(subject+"GetGenericPortMappingEntry", ConformanceWarn, "%d entries, then %v instead of error 713", len(mappings), errorOrNil(err))
+		}
+	}
+
+	port := freePort(mappings)
+	_, err = s.GetSpecificPortMappingEntry(ctx, TCP, port)
+	if IsErrorCode(err, ErrCodeNoSuchEntryInArray) {
+		r.add(subject+"GetSpecificPortMappingEntry", ConformancePass, "error 714 for an unmapped port")
+	} else {
+		r.add(subject+"GetSpecificPortMappingEntry", ConformanceFail, "%v instead of error 714 for the unmapped port %d", errorOrNil(err), port)
+	}
+
+	internal := net.ParseIP(s.localIPAddress)
+	if internal == nil {
+		r.add(subject+"AddPortMapping", ConformanceSkip, "no local IP address")
+		r.add(subject+"DeletePortMapping", ConformanceSkip, "no mapping added")
+		return
+	}
+	if err := s.AddPortMapping(ctx, s.localIPAddress, TCP, port, port, "upnpctl validate", validateLease); err != nil {
+		status := ConformanceFail
+		if IsErrorCode(err, ErrCodeOnlyPermanentLeasesSupported) {
+			// IGD:1 allows it, IGD:2 does not.
+			status = ConformanceWarn
+		}
+		r.add(subject+"AddPortMapping", status, "%v", err)
+		r.add(subject+"DeletePortMapping", ConformanceSkip, "no mapping added")
+		return
+	}
+	m, err := s.GetSpecificPortMappingEntry(ctx, TCP, port)
+	switch {
+	case err != nil:
+		r.add(subject+"AddPortMapping", ConformanceFail, "mapping of port %d not found: %v", port, err)
+	case m.InternalPort != port || !sameHost(m.InternalClient, s.localIPAddress):
+		r.add(subject+"AddPortMapping", ConformanceFail, "mapping of port %d points to %s:%d instead of %s:%d",
+			port, m.InternalClient, m.InternalPort, internal, port)
+	case m.Lease == 0 || m.Lease > validateLease*time.Second:
+		r.add(subject+"AddPortMapping", ConformanceWarn, "requested a lease of %ds, got %s", validateLease, m.Lease)
+	default:
+		r.add(subject+"AddPortMapping", ConformancePass, "mapped port %d", port)
+	}
+
+	if err := s.DeletePortMapping(ctx, TCP, port); err != nil {
+		r.add(subject+"DeletePortMapping", ConformanceFail, "%v", err)
+		return
+	}
+	if _, err := s.GetSpecificPortMappingEntry(ctx, TCP, port); !IsErrorCode(err, ErrCodeNoSuchEntryInArray) {
+		r.add(subject+"DeletePortMapping", ConformanceFail, "port %d still mapped after deleting it (%v)", port, errorOrNil(err))
+		return
+	}
+	r.add(subject+"DeletePortMapping", ConformancePass, "deleted port %d", port)
+}
+
+// Parse the description data into v, failing on malformed XML whatever the client's ParseMode.
+func decodeStrictly(c *Client, data []byte, v any) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = c.charsetReader
+	return d.Decode(v)
+}
+
+// A random high TCP port none of the mappings uses.
+func freePort(mappings []PortMapping) int {
+	for {
+		port := 49152 + rand.Intn(16384)
+		used := false
+		for _, m := range mappings {
+			if m.Protocol == TCP && m.ExternalPort == port {
+				used = true
+			}
+		}
+		if !used {
+			return port
+		}
+	}
+}
+
+// The error, or "success" when nil.
+func errorOrNil(err error) any {
+	if err == nil {
+		return "success"
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package upnp_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"upnpctl/upnp"
+	"upnpctl/upnp/upnptest"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		server func() *upnptest.Server
+		// The subject of the check expected to fail, none for a conformant device.
+		failed string
+	}{
+		{"conformant", upnptest.NewServer, ""},
+		{"failing AddPortMapping", func() *upnptest.Server {
+			s := upnptest.NewServer()
+			s.InjectFault("AddPortMapping", upnptest.Fault{Code: upnp.ErrCodeActionFailed, Description: "Action Failed"})
+			return s
+		}, "WANIPConnection:1 AddPortMapping"},
+		// Its SCPD lacks DeletePortMappingRange and GetListOfPortMappings.
+		{"incomplete SCPD", upnptest.NewServer2, "WANIPConnection:2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server()
+			defer s.Close()
+			ctx := context.Background()
+			igd, err := (&upnp.Client{AllowPublicAddresses: true}).LoadIGD(ctx, s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := upnp.Validate(ctx, igd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var failed []string
+			for _, c := range r.Checks {
+				if c.Status == upnp.ConformanceFail {
+					failed = append(failed, c.Subject+": "+c.Message)
+				}
+			}
+			switch {
+			case tt.failed == "" && !r.Passed():
+				t.Errorf("failed the checks %q", failed)
+			case tt.failed != "" && (len(failed) != 1 || !strings.HasPrefix(failed[0], tt.failed+": ")):
+				t.Errorf("failed the checks %q, want %s to fail", failed, tt.failed)
+			}
+			if mappings := s.Mappings(); len(mappings) != 0 {
+				t.Errorf("left the port mappings %v behind", mappings)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"upnpctl/upnp" //vendored
+)
+
+var helpValidate = `
+	Usage: upnpctl [-v] validate [options]
+
+	checks the device against the InternetGatewayDevice
+	specifications and prints a conformance report: its
+	device description, the service descriptions (SCPDs)
+	of its port mapping services and how their actions
+	behave. meant for router firmware developers.
+
+	adds a port mapping on a random high port to each
+	service and removes it again.
+
+	Options:
+	  --id, the device id. required when more than one
+	  device is found.
+
+	  --json, print the report as a JSON object with the
+	  fields "device", "deviceType" and "checks", each
+	  with a "subject", "status" (pass, warn, fail, skip)
+	  and "message".
+` + helpFooter
+
+func validateCmd(args []string) {
+	f := flag.NewFlagSet(string(validate), flag.ExitOnError)
+	f.Usage = func() {
+		usage(helpValidate)
+	}
+	id := f.String("id", "", "")
+	asJSON := f.Bool("json", false, "")
+	f.Parse(args)
+
+	c := selectClient(*id)
+	report, err := upnp.Validate(context.Background(), &c.igd)
+	if err != nil {
+		fail(err, fmt.Sprintf("Validation failed (%s)", err))
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			display(err.Error())
+		}
+		fmt.Println(string(b))
+	} else {
+		fmt.Printf("Validating %s (%s)...\n", c.name, report.DeviceType)
+		for _, check := range report.Checks {
+			fmt.Printf("  [%s] %s: %s\n", strings.ToUpper(string(check.Status)), check.Subject, check.Message)
+		}
+		fmt.Printf("%d passed, %d warnings, %d failed, %d skipped\n",
+			report.Count(upnp.ConformancePass), report.Count(upnp.ConformanceWarn),
+			report.Count(upnp.ConformanceFail), report.Count(upnp.ConformanceSkip))
+	}
+	if !report.Passed() {
+		os.Exit(exitError)
+	}
+}